@@ -0,0 +1,430 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"receipt-processor/services"
+)
+
+// EnvPrefix starts the name of each setting's environment variable, e.g.
+// RECEIPT_PROCESSOR_STORAGE_PATH for storage-path
+const EnvPrefix = "RECEIPT_PROCESSOR_"
+
+// ConfigEnv names the config file when the -config flag is not given
+const ConfigEnv = EnvPrefix + "CONFIG"
+
+// Storage backends
+const (
+	StorageMemory = "memory"
+	StorageFile   = "file"
+)
+
+// Config is the server's configuration. Each setting has a flag, an
+// environment variable and a config file key named after it.
+type Config struct {
+	Listen  string
+	TLSCert string
+	TLSKey  string
+
+	Storage     string
+	StoragePath string
+
+	Rules       string
+	Catalog     string
+	Rates       string
+	TenantRules string
+	SettingsDir string
+	Tenants     []string
+
+	RetailerNames string
+
+	Workers    int
+	Queue      int
+	RateLimits string
+
+	WebhookAllowedNetworks []string
+
+	Keys             string
+	JWKS             string
+	JWTIssuer        string
+	JWTAudience      string
+	JWTTenantClaim   string
+	JWTCustomerClaim string
+	JWTOperators     []string
+	SigningKeys      string
+
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownDelay   time.Duration
+	ShutdownTimeout time.Duration
+
+	LogLevel      string
+	TraceExporter string
+	TraceFile     string
+}
+
+// Default returns the configuration used for settings given nowhere else
+func Default() Config {
+	return Config{
+		Listen:           ":8080",
+		Storage:          StorageMemory,
+		Workers:          runtime.NumCPU(),
+		Queue:            1000,
+		RetailerNames:    string(services.RetailerNameRaw),
+		JWTTenantClaim:   services.DefaultTenantClaim,
+		JWTCustomerClaim: services.DefaultCustomerClaim,
+		ReadTimeout:      30 * time.Second,
+		WriteTimeout:     time.Minute,
+		IdleTimeout:      2 * time.Minute,
+		ShutdownTimeout:  30 * time.Second,
+		LogLevel:         "info",
+		TraceExporter:    services.TraceExporterNone,
+		TraceFile:        "traces.jsonl",
+	}
+}
+
+// setting ties a name to a field of the configuration, which is a string,
+// int, duration or list of strings
+type setting struct {
+	name  string
+	usage string
+	field func(*Config) any
+}
+
+var settings = []setting{
+	{"listen", "address to listen on", func(c *Config) any { return &c.Listen }},
+	{"tls-cert", "path to a PEM certificate to serve HTTPS with; needs tls-key", func(c *Config) any { return &c.TLSCert }},
+	{"tls-key", "path to the PEM private key of tls-cert", func(c *Config) any { return &c.TLSKey }},
+	{"storage", "where receipts are kept: memory, or file to replay them at startup from the event log at storage-path and append to it", func(c *Config) any { return &c.Storage }},
+	{"storage-path", "path to the receipt event log of file storage", func(c *Config) any { return &c.StoragePath }},
+	{"rules", "path to a JSON file of custom rules", func(c *Config) any { return &c.Rules }},
+	{"catalog", "path to a JSON product catalog", func(c *Config) any { return &c.Catalog }},
+	{"rates", "path to a JSON exchange-rate table", func(c *Config) any { return &c.Rates }},
+	{"tenant-rules", "directory of JSON rule files named after the tenant they apply to", func(c *Config) any { return &c.TenantRules }},
+	{"settings-dir", "directory where each tenant's caps, retailer aliases and time zones, and webhook subscriptions are saved when changed and loaded at startup", func(c *Config) any { return &c.SettingsDir }},
+	{"tenants", "comma-separated tenant IDs to accept, besides the default tenant and those with receipts in the event log", func(c *Config) any { return &c.Tenants }},
+	{"retailer-names", "which retailer name Rule 1 counts characters in: raw, as submitted, or canonical", func(c *Config) any { return &c.RetailerNames }},
+	{"workers", "number of workers for asynchronous processing", func(c *Config) any { return &c.Workers }},
+	{"queue", "maximum number of receipts waiting for asynchronous processing", func(c *Config) any { return &c.Queue }},
+	{"rate-limits", "path to a JSON file of per-route rate limits and daily quotas", func(c *Config) any { return &c.RateLimits }},
+	{"webhook-allowed-networks", "comma-separated networks, such as 10.1.0.0/16, that webhooks may be delivered to although they are private, loopback or link-local", func(c *Config) any { return &c.WebhookAllowedNetworks }},
+	{"keys", "path to the API key file", func(c *Config) any { return &c.Keys }},
+	{"jwks", "path or URL of a JSON Web Key Set for validating bearer tokens", func(c *Config) any { return &c.JWKS }},
+	{"jwt-issuer", "required issuer of bearer tokens", func(c *Config) any { return &c.JWTIssuer }},
+	{"jwt-audience", "required audience of bearer tokens", func(c *Config) any { return &c.JWTAudience }},
+	{"jwt-tenant-claim", "bearer token claim holding the tenant", func(c *Config) any { return &c.JWTTenantClaim }},
+	{"jwt-customer-claim", "bearer token claim holding the customer ID", func(c *Config) any { return &c.JWTCustomerClaim }},
+	{"jwt-operators", "comma-separated subjects of bearer tokens that may omit the tenant claim and act for every tenant", func(c *Config) any { return &c.JWTOperators }},
+	{"signing-keys", "path to a JSON file of keys POS terminals sign submissions with", func(c *Config) any { return &c.SigningKeys }},
+	{"read-timeout", "maximum time to read a request, including its body", func(c *Config) any { return &c.ReadTimeout }},
+	{"write-timeout", "maximum time to write a response; event streams are exempt", func(c *Config) any { return &c.WriteTimeout }},
+	{"idle-timeout", "maximum time to keep an idle connection open", func(c *Config) any { return &c.IdleTimeout }},
+	{"shutdown-delay", "time to keep serving after SIGTERM while reporting not ready, for load balancers to notice", func(c *Config) any { return &c.ShutdownDelay }},
+	{"shutdown-timeout", "maximum time to drain requests and queued work when shutting down", func(c *Config) any { return &c.ShutdownTimeout }},
+	{"log-level", "minimum level of log records: debug, info, warn or error", func(c *Config) any { return &c.LogLevel }},
+	{"trace-exporter", "where to export trace spans: none, stdout, file or otlp", func(c *Config) any { return &c.TraceExporter }},
+	{"trace-file", "path of the file spans are written to with trace-exporter file", func(c *Config) any { return &c.TraceFile }},
+}
+
+// env names the setting's environment variable
+func (s setting) env() string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+// set parses value into the setting's field. Lists are comma-separated.
+func (s setting) set(c *Config, value string) error {
+	switch field := s.field(c).(type) {
+	case *string:
+		*field = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		*field = n
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration like 30s or 2m", value)
+		}
+		*field = d
+	case *[]string:
+		*field = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*field = append(*field, item)
+			}
+		}
+	}
+	return nil
+}
+
+// get returns the setting's value as it is written in a config file
+func (s setting) get(c *Config) any {
+	switch field := s.field(c).(type) {
+	case *string:
+		return *field
+	case *int:
+		return *field
+	case *time.Duration:
+		return field.String()
+	case *[]string:
+		return append([]string{}, *field...)
+	}
+	return nil
+}
+
+// Load reads the configuration from, in increasing precedence, the
+// defaults, the config file named by the -config flag or the
+// RECEIPT_PROCESSOR_CONFIG variable, environment variables and flags, then
+// validates it. It also reports whether -print-config was given, and
+// returns warnings, such as for deprecated flags, for the caller to log once
+// its logger is set up. lookupEnv is usually os.LookupEnv.
+func Load(args []string, lookupEnv func(string) (string, bool)) (Config, bool, []string, error) {
+	config := Default()
+
+	fs := flag.NewFlagSet("receipt-processor", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to a JSON config file (env "+ConfigEnv+")")
+	printConfig := fs.Bool("print-config", false, "print the configuration as a config file and exit")
+	history := fs.String("history", "", "deprecated: use -storage file -storage-path instead")
+	known := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		known[s.name] = s
+		usage := s.usage + " (env " + s.env() + ")"
+		switch value := s.field(&config).(type) {
+		case *string:
+			fs.String(s.name, *value, usage)
+		case *int:
+			fs.Int(s.name, *value, usage)
+		case *time.Duration:
+			fs.Duration(s.name, *value, usage)
+		case *[]string:
+			fs.String(s.name, strings.Join(*value, ","), usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, false, nil, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, false, nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	path := *configFile
+	if path == "" {
+		path, _ = lookupEnv(ConfigEnv)
+	}
+	if path != "" {
+		if err := config.readFile(path); err != nil {
+			return Config{}, false, nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := lookupEnv(s.env()); ok {
+			if err := s.set(&config, value); err != nil {
+				return Config{}, false, nil, fmt.Errorf("%s: %w", s.env(), err)
+			}
+		}
+	}
+
+	// Flags are applied last, as they take precedence; the flag package has
+	// already checked their values
+	fs.Visit(func(f *flag.Flag) {
+		if s, ok := known[f.Name]; ok {
+			s.set(&config, f.Value.String())
+		}
+	})
+
+	// -history predates storage and is kept so existing deployments still
+	// replay their event log
+	var warnings []string
+	if *history != "" {
+		warnings = append(warnings, "-history is deprecated, use -storage file -storage-path instead")
+		if config.StoragePath != "" && config.StoragePath != *history {
+			return Config{}, false, nil, fmt.Errorf("history %q and storage-path %q name different event logs", *history, config.StoragePath)
+		}
+		config.Storage = StorageFile
+		config.StoragePath = *history
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, false, nil, err
+	}
+	return config, *printConfig, warnings, nil
+}
+
+// readFile sets the settings in a config file: a JSON object of setting
+// names and their values, with lists as arrays of strings and durations as
+// strings like "30s"
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	known := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		known[s.name] = s
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		s, ok := known[name]
+		if !ok {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		var value string
+		switch v := values[name].(type) {
+		case string:
+			value = v
+		case json.Number:
+			value = v.String()
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				text, ok := item.(string)
+				if !ok {
+					return fmt.Errorf("%s: %s must be a list of strings", path, name)
+				}
+				items[i] = text
+			}
+			value = strings.Join(items, ",")
+		default:
+			return fmt.Errorf("%s: %s must be a string, number or list", path, name)
+		}
+		if err := s.set(c, value); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// Validate reports every setting that is invalid, or that is missing a
+// setting it needs
+func (c Config) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		invalid("listen: %q is not an address like :8080", c.Listen)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		invalid("tls-cert and tls-key must be set together")
+	}
+
+	switch c.Storage {
+	case StorageMemory:
+		if c.StoragePath != "" {
+			invalid("storage-path is only used by storage file")
+		}
+	case StorageFile:
+		if c.StoragePath == "" {
+			invalid("storage file needs storage-path")
+		}
+	default:
+		invalid("storage: %q is not memory or file", c.Storage)
+	}
+
+	for _, tenant := range c.Tenants {
+		if !services.ValidTenantID(tenant) {
+			invalid("tenants: %q: %w", tenant, services.ErrInvalidTenant)
+		}
+	}
+	switch services.RetailerNameMode(c.RetailerNames) {
+	case services.RetailerNameRaw, services.RetailerNameCanonical:
+	default:
+		invalid("retailer-names: %q is not raw or canonical", c.RetailerNames)
+	}
+	if c.Workers < 1 {
+		invalid("workers must be at least 1")
+	}
+	if c.Queue < 1 {
+		invalid("queue must be at least 1")
+	}
+	if _, err := services.ParseNetworks(c.WebhookAllowedNetworks); err != nil {
+		invalid("webhook-allowed-networks: %w", err)
+	}
+	if c.JWTTenantClaim == "" || c.JWTCustomerClaim == "" {
+		invalid("jwt-tenant-claim and jwt-customer-claim must not be empty")
+	}
+
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"read-timeout", c.ReadTimeout},
+		{"write-timeout", c.WriteTimeout},
+		{"idle-timeout", c.IdleTimeout},
+		{"shutdown-delay", c.ShutdownDelay},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value < 0 {
+			invalid("%s must not be negative", timeout.name)
+		}
+	}
+	if c.ShutdownTimeout <= 0 {
+		invalid("shutdown-timeout must be positive")
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		invalid("log-level: %q is not debug, info, warn or error", c.LogLevel)
+	}
+	switch c.TraceExporter {
+	case services.TraceExporterNone, services.TraceExporterStdout, services.TraceExporterOTLP:
+	case services.TraceExporterFile:
+		if c.TraceFile == "" {
+			invalid("trace-exporter file needs trace-file")
+		}
+	default:
+		invalid("trace-exporter: %w", services.ErrUnknownTraceExporter)
+	}
+	return errors.Join(errs...)
+}
+
+// SlogLevel returns the level set by log-level, which Validate has checked
+func (c Config) SlogLevel() slog.Level {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.LogLevel))
+	return level
+}
+
+// Write writes the configuration as a config file
+func (c Config) Write(w io.Writer) error {
+	values := make(map[string]any, len(settings))
+	for _, s := range settings {
+		values[s.name] = s.get(&c)
+	}
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
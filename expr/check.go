@@ -0,0 +1,263 @@
+package expr
+
+// Type is the static type of an expression
+type Type int
+
+const (
+	Number Type = iota
+	String
+	Bool
+	ItemType
+	ItemList
+)
+
+func (t Type) String() string {
+	switch t {
+	case Number:
+		return "number"
+	case String:
+		return "string"
+	case Bool:
+		return "bool"
+	case ItemType:
+		return "item"
+	default:
+		return "items"
+	}
+}
+
+// Receipt fields and date/time helpers available to every expression
+var variables = map[string]Type{
+	"retailer":          String,
+	"canonicalRetailer": String,
+	"purchaseDate":      String,
+	"purchaseTime":      String,
+	"total":             Number,
+	"discounts":         Number,
+	"taxes":             Number,
+	"items":             ItemList,
+	"itemCount":         Number,
+	"year":              Number,
+	"month":             Number,
+	"day":               Number,
+	"weekday":           Number,
+	"hour":              Number,
+	"minute":            Number,
+}
+
+// Fields available on the item bound inside count, sum, any and all
+var itemFields = map[string]Type{
+	"description": String,
+	"price":       Number,
+	"quantity":    Number,
+	"unitPrice":   Number,
+	"sku":         String,
+	"category":    String,
+}
+
+type signature struct {
+	params []Type
+	result Type
+}
+
+var functions = map[string]signature{
+	"len":        {[]Type{String}, Number},
+	"lower":      {[]Type{String}, String},
+	"upper":      {[]Type{String}, String},
+	"contains":   {[]Type{String, String}, Bool},
+	"startsWith": {[]Type{String, String}, Bool},
+	"floor":      {[]Type{Number}, Number},
+	"ceil":       {[]Type{Number}, Number},
+	"round":      {[]Type{Number}, Number},
+	"abs":        {[]Type{Number}, Number},
+	"min":        {[]Type{Number, Number}, Number},
+	"max":        {[]Type{Number, Number}, Number},
+}
+
+// Aggregates iterate items, evaluating their second argument once per item
+// with the current item bound to "item".
+var aggregates = map[string]struct {
+	body   Type
+	result Type
+}{
+	"count": {Bool, Number},
+	"sum":   {Number, Number},
+	"any":   {Bool, Bool},
+	"all":   {Bool, Bool},
+}
+
+type checker struct {
+	inItem bool
+}
+
+func (c *checker) check(n node) (Type, error) {
+	switch n := n.(type) {
+	case *numberLit:
+		return Number, nil
+	case *stringLit:
+		return String, nil
+	case *boolLit:
+		return Bool, nil
+
+	case *ident:
+		if n.name == "item" {
+			if !c.inItem {
+				return 0, errorf(n.pos, "item can only be used inside count, sum, any or all")
+			}
+			return ItemType, nil
+		}
+		t, ok := variables[n.name]
+		if !ok {
+			return 0, errorf(n.pos, "unknown variable %q", n.name)
+		}
+		return t, nil
+
+	case *field:
+		t, err := c.check(n.target)
+		if err != nil {
+			return 0, err
+		}
+		if t != ItemType {
+			return 0, errorf(n.pos, "%s has no field %q", t, n.name)
+		}
+		ft, ok := itemFields[n.name]
+		if !ok {
+			return 0, errorf(n.pos, "item has no field %q", n.name)
+		}
+		return ft, nil
+
+	case *call:
+		return c.checkCall(n)
+
+	case *unary:
+		t, err := c.check(n.operand)
+		if err != nil {
+			return 0, err
+		}
+		want := Number
+		if n.op == "!" {
+			want = Bool
+		}
+		if t != want {
+			return 0, errorf(n.pos, "operator %s needs %s, found %s", n.op, want, t)
+		}
+		return t, nil
+
+	case *binary:
+		return c.checkBinary(n)
+
+	case *conditional:
+		cond, err := c.check(n.cond)
+		if err != nil {
+			return 0, err
+		}
+		if cond != Bool {
+			return 0, errorf(n.cond.position(), "condition must be bool, found %s", cond)
+		}
+		then, err := c.check(n.then)
+		if err != nil {
+			return 0, err
+		}
+		if n.otherwise == nil {
+			if then != Number {
+				return 0, errorf(n.then.position(), "if without else must produce a number, found %s", then)
+			}
+			return Number, nil
+		}
+		otherwise, err := c.check(n.otherwise)
+		if err != nil {
+			return 0, err
+		}
+		if then != otherwise {
+			return 0, errorf(n.otherwise.position(), "else branch is %s but then branch is %s", otherwise, then)
+		}
+		return then, nil
+	}
+
+	return 0, errorf(n.position(), "unsupported expression")
+}
+
+func (c *checker) checkCall(n *call) (Type, error) {
+	if agg, ok := aggregates[n.name]; ok {
+		if len(n.args) != 2 {
+			return 0, errorf(n.pos, "%s takes 2 arguments, found %d", n.name, len(n.args))
+		}
+		list, err := c.check(n.args[0])
+		if err != nil {
+			return 0, err
+		}
+		if list != ItemList {
+			return 0, errorf(n.args[0].position(), "%s needs items, found %s", n.name, list)
+		}
+		if c.inItem {
+			return 0, errorf(n.pos, "%s cannot be nested inside another aggregate", n.name)
+		}
+
+		c.inItem = true
+		body, err := c.check(n.args[1])
+		c.inItem = false
+		if err != nil {
+			return 0, err
+		}
+		if body != agg.body {
+			return 0, errorf(n.args[1].position(), "%s needs a %s expression, found %s", n.name, agg.body, body)
+		}
+		return agg.result, nil
+	}
+
+	sig, ok := functions[n.name]
+	if !ok {
+		return 0, errorf(n.pos, "unknown function %q", n.name)
+	}
+	if len(n.args) != len(sig.params) {
+		return 0, errorf(n.pos, "%s takes %d arguments, found %d", n.name, len(sig.params), len(n.args))
+	}
+	for i, arg := range n.args {
+		t, err := c.check(arg)
+		if err != nil {
+			return 0, err
+		}
+		if t != sig.params[i] {
+			return 0, errorf(arg.position(), "argument %d of %s must be %s, found %s", i+1, n.name, sig.params[i], t)
+		}
+	}
+	return sig.result, nil
+}
+
+func (c *checker) checkBinary(n *binary) (Type, error) {
+	left, err := c.check(n.left)
+	if err != nil {
+		return 0, err
+	}
+	right, err := c.check(n.right)
+	if err != nil {
+		return 0, err
+	}
+	if left != right {
+		return 0, errorf(n.pos, "mismatched types %s %s %s", left, n.op, right)
+	}
+
+	switch n.op {
+	case "&&", "||":
+		if left == Bool {
+			return Bool, nil
+		}
+	case "==", "!=":
+		if left == Number || left == String || left == Bool {
+			return Bool, nil
+		}
+	case "<", "<=", ">", ">=":
+		if left == Number || left == String {
+			return Bool, nil
+		}
+	case "+":
+		if left == Number || left == String {
+			return left, nil
+		}
+	default:
+		if left == Number {
+			return Number, nil
+		}
+	}
+	return 0, errorf(n.pos, "operator %s not defined on %s", n.op, left)
+}
@@ -0,0 +1,14 @@
+// Package expr implements a small, sandboxed expression language for custom
+// point rules, e.g.
+//
+//	if total >= 50 && retailer == "Target" then 20
+//	count(items, item.price > 5) * 2
+//	if weekday == 6 || weekday == 0 then 10 else 0
+//
+// Expressions can read the receipt fields retailer, canonicalRetailer,
+// purchaseDate, purchaseTime, total, items and itemCount, the discount and
+// tax line totals discounts and taxes, and the date/time helpers year,
+// month, day, weekday (0 = Sunday), hour and minute. count, sum, any and all
+// iterate items with the current one bound to item, which has the fields
+// description, price, quantity, unitPrice, sku and category.
+package expr
@@ -0,0 +1,347 @@
+package expr
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"receipt-processor/models"
+)
+
+// DefaultMaxSteps bounds evaluation when no explicit limit is given
+const DefaultMaxSteps = 10000
+
+// Program is a parsed and type-checked expression producing a number
+type Program struct {
+	source string
+	root   node
+}
+
+// Compile parses and type-checks src. Errors carry the line and column they
+// refer to.
+func Compile(src string) (*Program, error) {
+	root, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &checker{}
+	t, err := c.check(root)
+	if err != nil {
+		return nil, err
+	}
+	if t != Number {
+		return nil, errorf(root.position(), "expression must produce a number, found %s", t)
+	}
+
+	return &Program{source: src, root: root}, nil
+}
+
+func (p *Program) String() string {
+	return p.source
+}
+
+type itemValue struct {
+	description string
+	price       float64
+	quantity    float64
+	unitPrice   float64
+	sku         string
+	category    string
+}
+
+type evaluator struct {
+	vars     map[string]interface{}
+	item     itemValue
+	steps    int
+	maxSteps int
+}
+
+// Eval runs the program against receipt, failing once more than maxSteps
+// expression nodes have been evaluated.
+func (p *Program) Eval(receipt models.Receipt, maxSteps int) (float64, error) {
+	if maxSteps <= 0 {
+		maxSteps = DefaultMaxSteps
+	}
+
+	e := &evaluator{vars: receiptVariables(receipt), maxSteps: maxSteps}
+	v, err := e.eval(p.root)
+	if err != nil {
+		return 0, err
+	}
+	return v.(float64), nil
+}
+
+func receiptVariables(receipt models.Receipt) map[string]interface{} {
+	total, _ := strconv.ParseFloat(receipt.Total, 64)
+	date, _ := time.Parse("2006-01-02", receipt.PurchaseDate)
+	clock, _ := time.Parse("15:04", receipt.PurchaseTime)
+
+	items := make([]itemValue, len(receipt.Items))
+	for i, item := range receipt.Items {
+		price, _ := strconv.ParseFloat(item.Price, 64)
+		quantity, err := strconv.ParseFloat(item.Quantity, 64)
+		if err != nil {
+			quantity = 1
+		}
+		unitPrice, err := strconv.ParseFloat(item.UnitPrice, 64)
+		if err != nil {
+			unitPrice = price / quantity
+		}
+		items[i] = itemValue{
+			description: strings.TrimSpace(item.ShortDescription),
+			price:       price,
+			quantity:    quantity,
+			unitPrice:   unitPrice,
+			sku:         item.SKU,
+			category:    item.Category,
+		}
+	}
+
+	discounts, taxes := 0.0, 0.0
+	for _, discount := range receipt.Discounts {
+		amount, _ := strconv.ParseFloat(discount.Amount, 64)
+		discounts += amount
+	}
+	for _, tax := range receipt.Taxes {
+		amount, _ := strconv.ParseFloat(tax.Amount, 64)
+		taxes += amount
+	}
+
+	return map[string]interface{}{
+		"retailer":          receipt.Retailer,
+		"canonicalRetailer": receipt.CanonicalRetailer,
+		"purchaseDate":      receipt.PurchaseDate,
+		"purchaseTime":      receipt.PurchaseTime,
+		"total":             total,
+		"discounts":         discounts,
+		"taxes":             taxes,
+		"items":             items,
+		"itemCount":         float64(len(items)),
+		"year":              float64(date.Year()),
+		"month":             float64(date.Month()),
+		"day":               float64(date.Day()),
+		"weekday":           float64(date.Weekday()),
+		"hour":              float64(clock.Hour()),
+		"minute":            float64(clock.Minute()),
+	}
+}
+
+func (e *evaluator) eval(n node) (interface{}, error) {
+	e.steps++
+	if e.steps > e.maxSteps {
+		return nil, errorf(n.position(), "evaluation exceeded %d steps", e.maxSteps)
+	}
+
+	switch n := n.(type) {
+	case *numberLit:
+		return n.value, nil
+	case *stringLit:
+		return n.value, nil
+	case *boolLit:
+		return n.value, nil
+
+	case *ident:
+		if n.name == "item" {
+			return e.item, nil
+		}
+		return e.vars[n.name], nil
+
+	case *field:
+		v, err := e.eval(n.target)
+		if err != nil {
+			return nil, err
+		}
+		item := v.(itemValue)
+		switch n.name {
+		case "description":
+			return item.description, nil
+		case "sku":
+			return item.sku, nil
+		case "category":
+			return item.category, nil
+		case "quantity":
+			return item.quantity, nil
+		case "unitPrice":
+			return item.unitPrice, nil
+		}
+		return item.price, nil
+
+	case *call:
+		return e.evalCall(n)
+
+	case *unary:
+		v, err := e.eval(n.operand)
+		if err != nil {
+			return nil, err
+		}
+		if n.op == "!" {
+			return !v.(bool), nil
+		}
+		return -v.(float64), nil
+
+	case *binary:
+		return e.evalBinary(n)
+
+	case *conditional:
+		cond, err := e.eval(n.cond)
+		if err != nil {
+			return nil, err
+		}
+		if cond.(bool) {
+			return e.eval(n.then)
+		}
+		if n.otherwise == nil {
+			return 0.0, nil
+		}
+		return e.eval(n.otherwise)
+	}
+
+	return nil, errorf(n.position(), "unsupported expression")
+}
+
+func (e *evaluator) evalCall(n *call) (interface{}, error) {
+	if _, ok := aggregates[n.name]; ok {
+		v, err := e.eval(n.args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		count, sum := 0.0, 0.0
+		for _, item := range v.([]itemValue) {
+			e.item = item
+			result, err := e.eval(n.args[1])
+			if err != nil {
+				return nil, err
+			}
+			switch r := result.(type) {
+			case bool:
+				if r {
+					count++
+				}
+			case float64:
+				sum += r
+			}
+		}
+
+		items := float64(len(v.([]itemValue)))
+		switch n.name {
+		case "count":
+			return count, nil
+		case "sum":
+			return sum, nil
+		case "any":
+			return count > 0, nil
+		default:
+			return count == items, nil
+		}
+	}
+
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		v, err := e.eval(arg)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	switch n.name {
+	case "len":
+		return float64(len([]rune(args[0].(string)))), nil
+	case "lower":
+		return strings.ToLower(args[0].(string)), nil
+	case "upper":
+		return strings.ToUpper(args[0].(string)), nil
+	case "contains":
+		return strings.Contains(args[0].(string), args[1].(string)), nil
+	case "startsWith":
+		return strings.HasPrefix(args[0].(string), args[1].(string)), nil
+	case "floor":
+		return math.Floor(args[0].(float64)), nil
+	case "ceil":
+		return math.Ceil(args[0].(float64)), nil
+	case "round":
+		return math.Round(args[0].(float64)), nil
+	case "abs":
+		return math.Abs(args[0].(float64)), nil
+	case "min":
+		return math.Min(args[0].(float64), args[1].(float64)), nil
+	case "max":
+		return math.Max(args[0].(float64), args[1].(float64)), nil
+	}
+
+	return nil, errorf(n.pos, "unknown function %q", n.name)
+}
+
+func (e *evaluator) evalBinary(n *binary) (interface{}, error) {
+	left, err := e.eval(n.left)
+	if err != nil {
+		return nil, err
+	}
+
+	// Short-circuit boolean operators
+	if n.op == "&&" && !left.(bool) {
+		return false, nil
+	}
+	if n.op == "||" && left.(bool) {
+		return true, nil
+	}
+
+	right, err := e.eval(n.right)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "&&", "||":
+		return right.(bool), nil
+	case "==":
+		return left == right, nil
+	case "!=":
+		return left != right, nil
+	}
+
+	if l, ok := left.(string); ok {
+		r := right.(string)
+		switch n.op {
+		case "+":
+			return l + r, nil
+		case "<":
+			return l < r, nil
+		case "<=":
+			return l <= r, nil
+		case ">":
+			return l > r, nil
+		default:
+			return l >= r, nil
+		}
+	}
+
+	l, r := left.(float64), right.(float64)
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/", "%":
+		if r == 0 {
+			return nil, errorf(n.pos, "division by zero")
+		}
+		if n.op == "/" {
+			return l / r, nil
+		}
+		return math.Mod(l, r), nil
+	case "<":
+		return l < r, nil
+	case "<=":
+		return l <= r, nil
+	case ">":
+		return l > r, nil
+	default:
+		return l >= r, nil
+	}
+}
@@ -0,0 +1,160 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenKeyword
+	tokenOperator
+)
+
+var keywords = map[string]bool{
+	"if":    true,
+	"then":  true,
+	"else":  true,
+	"true":  true,
+	"false": true,
+}
+
+// Two-character operators must come before their one-character prefixes
+var operators = []string{
+	"&&", "||", "==", "!=", "<=", ">=",
+	"<", ">", "+", "-", "*", "/", "%", "!", "(", ")", ",", ".",
+}
+
+// Pos is a 1-based line and column in the expression source
+type Pos struct {
+	Line   int
+	Column int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Error is a parse, type or evaluation error with the position it refers to
+type Error struct {
+	Pos Pos
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+func errorf(pos Pos, format string, args ...interface{}) *Error {
+	return &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+type token struct {
+	kind tokenKind
+	text string
+	num  float64
+	pos  Pos
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	runes := []rune(src)
+	line, col := 1, 1
+
+	advance := func(n int) {
+		for i := 0; i < n; i++ {
+			if runes[i] == '\n' {
+				line++
+				col = 1
+			} else {
+				col++
+			}
+		}
+		runes = runes[n:]
+	}
+
+	for len(runes) > 0 {
+		r := runes[0]
+		pos := Pos{Line: line, Column: col}
+
+		switch {
+		case unicode.IsSpace(r):
+			advance(1)
+
+		case unicode.IsDigit(r):
+			n := 0
+			for n < len(runes) && (unicode.IsDigit(runes[n]) || runes[n] == '.') {
+				n++
+			}
+			text := string(runes[:n])
+			num, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, errorf(pos, "invalid number %q", text)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: text, num: num, pos: pos})
+			advance(n)
+
+		case r == '"':
+			n := 1
+			for n < len(runes) && runes[n] != '"' && runes[n] != '\n' {
+				if runes[n] == '\\' {
+					n++
+				}
+				n++
+			}
+			if n >= len(runes) || runes[n] != '"' {
+				return nil, errorf(pos, "unterminated string")
+			}
+			text := string(runes[:n+1])
+			value, err := strconv.Unquote(text)
+			if err != nil {
+				return nil, errorf(pos, "invalid string %s", text)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: value, pos: pos})
+			advance(n + 1)
+
+		case unicode.IsLetter(r) || r == '_':
+			n := 0
+			for n < len(runes) && (unicode.IsLetter(runes[n]) || unicode.IsDigit(runes[n]) || runes[n] == '_') {
+				n++
+			}
+			text := string(runes[:n])
+			kind := tokenIdent
+			if keywords[text] {
+				kind = tokenKeyword
+			}
+			tokens = append(tokens, token{kind: kind, text: text, pos: pos})
+			advance(n)
+
+		default:
+			matched := ""
+			for _, op := range operators {
+				if strings.HasPrefix(string(runes[:min(len(runes), 2)]), op) {
+					matched = op
+					break
+				}
+			}
+			if matched == "" {
+				return nil, errorf(pos, "unexpected character %q", r)
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: matched, pos: pos})
+			advance(len(matched))
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: Pos{Line: line, Column: col}}), nil
+}
@@ -0,0 +1,272 @@
+package expr
+
+type node interface {
+	position() Pos
+}
+
+type numberLit struct {
+	pos   Pos
+	value float64
+}
+
+type stringLit struct {
+	pos   Pos
+	value string
+}
+
+type boolLit struct {
+	pos   Pos
+	value bool
+}
+
+type ident struct {
+	pos  Pos
+	name string
+}
+
+type field struct {
+	pos    Pos
+	target node
+	name   string
+}
+
+type call struct {
+	pos  Pos
+	name string
+	args []node
+}
+
+type unary struct {
+	pos     Pos
+	op      string
+	operand node
+}
+
+type binary struct {
+	pos   Pos
+	op    string
+	left  node
+	right node
+}
+
+type conditional struct {
+	pos       Pos
+	cond      node
+	then      node
+	otherwise node
+}
+
+func (n *numberLit) position() Pos   { return n.pos }
+func (n *stringLit) position() Pos   { return n.pos }
+func (n *boolLit) position() Pos     { return n.pos }
+func (n *ident) position() Pos       { return n.pos }
+func (n *field) position() Pos       { return n.pos }
+func (n *call) position() Pos        { return n.pos }
+func (n *unary) position() Pos       { return n.pos }
+func (n *binary) position() Pos      { return n.pos }
+func (n *conditional) position() Pos { return n.pos }
+
+// Binary operators by precedence, lowest first
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func parse(src string) (node, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	n, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, errorf(tok.pos, "unexpected %s", tok)
+	}
+	return n, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) accept(kind tokenKind, text string) bool {
+	tok := p.peek()
+	if tok.kind == kind && tok.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	if !p.accept(kind, text) {
+		tok := p.peek()
+		return errorf(tok.pos, "expected %q, found %s", text, tok)
+	}
+	return nil
+}
+
+func (p *parser) parseExpr() (node, error) {
+	tok := p.peek()
+	if !p.accept(tokenKeyword, "if") {
+		return p.parseBinary(0)
+	}
+
+	cond, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(tokenKeyword, "then"); err != nil {
+		return nil, err
+	}
+	then, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	var otherwise node
+	if p.accept(tokenKeyword, "else") {
+		if otherwise, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	return &conditional{pos: tok.pos, cond: cond, then: then, otherwise: otherwise}, nil
+}
+
+func (p *parser) parseBinary(level int) (node, error) {
+	if level == len(precedence) {
+		return p.parseUnary()
+	}
+
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.peek()
+		if tok.kind != tokenOperator || !contains(precedence[level], tok.text) {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{pos: tok.pos, op: tok.text, left: left, right: right}
+
+		// Comparisons do not chain
+		if level == 2 {
+			return left, nil
+		}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	tok := p.peek()
+	if tok.kind == tokenOperator && (tok.text == "!" || tok.text == "-") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{pos: tok.pos, op: tok.text, operand: operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (node, error) {
+	n, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept(tokenOperator, ".") {
+		tok := p.next()
+		if tok.kind != tokenIdent {
+			return nil, errorf(tok.pos, "expected field name, found %s", tok)
+		}
+		n = &field{pos: tok.pos, target: n, name: tok.text}
+	}
+	return n, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	tok := p.next()
+
+	switch tok.kind {
+	case tokenNumber:
+		return &numberLit{pos: tok.pos, value: tok.num}, nil
+	case tokenString:
+		return &stringLit{pos: tok.pos, value: tok.text}, nil
+	case tokenKeyword:
+		if tok.text == "true" || tok.text == "false" {
+			return &boolLit{pos: tok.pos, value: tok.text == "true"}, nil
+		}
+	case tokenIdent:
+		if !p.accept(tokenOperator, "(") {
+			return &ident{pos: tok.pos, name: tok.text}, nil
+		}
+
+		c := &call{pos: tok.pos, name: tok.text}
+		if p.accept(tokenOperator, ")") {
+			return c, nil
+		}
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			c.args = append(c.args, arg)
+			if p.accept(tokenOperator, ")") {
+				return c, nil
+			}
+			if err := p.expect(tokenOperator, ","); err != nil {
+				return nil, err
+			}
+		}
+	case tokenOperator:
+		if tok.text == "(" {
+			n, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(tokenOperator, ")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		}
+	}
+
+	return nil, errorf(tok.pos, "unexpected %s", tok)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"receipt-processor/models"
+	"receipt-processor/services"
+
+	"github.com/gorilla/mux"
+)
+
+type AdminHandler struct {
+	processor *services.ReceiptProcessor
+	settings  *services.SettingsFile
+}
+
+func NewAdminHandler(processor *services.ReceiptProcessor) *AdminHandler {
+	return &AdminHandler{
+		processor: processor,
+	}
+}
+
+// SetSettings saves the tenant's settings after every change. Without it,
+// changes last until the server stops.
+func (h *AdminHandler) SetSettings(settings *services.SettingsFile) {
+	h.settings = settings
+}
+
+// saveSettings saves the settings, if they are saved, and writes an error
+// response if that fails
+func saveSettings(w http.ResponseWriter, r *http.Request, settings *services.SettingsFile) bool {
+	if settings == nil {
+		return true
+	}
+	if err := settings.Save(); err != nil {
+		slog.ErrorContext(r.Context(), "failed to save settings", "error", err)
+		http.Error(w, "The change could not be saved.", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func (h *AdminHandler) ListRetailerAliases(w http.ResponseWriter, r *http.Request) {
+	aliases := h.processor.Retailers().Aliases()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aliases)
+}
+
+func (h *AdminHandler) SetRetailerAlias(w http.ResponseWriter, r *http.Request) {
+	var alias models.RetailerAlias
+
+	err := json.NewDecoder(r.Body).Decode(&alias)
+	if err != nil || !h.processor.Retailers().SetAlias(alias.Alias, alias.Canonical) {
+		http.Error(w, "The alias is invalid.", http.StatusBadRequest)
+		return
+	}
+	if !saveSettings(w, r, h.settings) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AdminHandler) DeleteRetailerAlias(w http.ResponseWriter, r *http.Request) {
+	alias := r.URL.Query().Get("alias")
+
+	if !h.processor.Retailers().RemoveAlias(alias) {
+		http.Error(w, "No alias found for that name.", http.StatusNotFound)
+		return
+	}
+	if !saveSettings(w, r, h.settings) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AdminHandler) ListRetailerTimezones(w http.ResponseWriter, r *http.Request) {
+	timezones := h.processor.Retailers().Timezones()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(timezones)
+}
+
+func (h *AdminHandler) SetRetailerTimezone(w http.ResponseWriter, r *http.Request) {
+	var timezone models.RetailerTimezone
+
+	err := json.NewDecoder(r.Body).Decode(&timezone)
+	if err != nil || h.processor.Retailers().SetTimezone(timezone.Retailer, timezone.Timezone) != nil {
+		http.Error(w, "The time zone is invalid.", http.StatusBadRequest)
+		return
+	}
+	if !saveSettings(w, r, h.settings) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AdminHandler) DeleteRetailerTimezone(w http.ResponseWriter, r *http.Request) {
+	retailer := r.URL.Query().Get("retailer")
+
+	if !h.processor.Retailers().RemoveTimezone(retailer) {
+		http.Error(w, "No time zone found for that retailer.", http.StatusNotFound)
+		return
+	}
+	if !saveSettings(w, r, h.settings) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AdminHandler) GetCaps(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.processor.Caps())
+}
+
+func (h *AdminHandler) SetCaps(w http.ResponseWriter, r *http.Request) {
+	var caps services.PointCaps
+
+	err := json.NewDecoder(r.Body).Decode(&caps)
+	if err != nil || !caps.Valid() {
+		http.Error(w, "The caps are invalid.", http.StatusBadRequest)
+		return
+	}
+
+	h.processor.SetCaps(caps)
+	if !saveSettings(w, r, h.settings) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RescoreReceipt recalculates a receipt's points with the current rules and
+// caps
+func (h *AdminHandler) RescoreReceipt(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	breakdown, err := h.processor.Rescore(requestContext(r), id)
+	if errors.Is(err, services.ErrUnknownReceipt) {
+		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "The receipt can no longer be scored.", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(breakdown)
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+// APIKeyHeader carries the secret of the caller's API key
+const APIKeyHeader = "X-API-Key"
+
+// signedRoute is the only route that accepts signed requests
+const signedRoute = "/receipts/process"
+
+// Authenticator identifies callers by an API key or, once a token validator
+// is set, a bearer token. Once a request verifier is set, POS terminals can
+// sign their submissions instead.
+type Authenticator struct {
+	keys     *services.APIKeyStore
+	tokens   *services.TokenValidator
+	verifier *services.RequestVerifier
+}
+
+// NewAuthenticator checks API keys against keys, which may be nil when only
+// bearer tokens are accepted
+func NewAuthenticator(keys *services.APIKeyStore) *Authenticator {
+	return &Authenticator{
+		keys: keys,
+	}
+}
+
+// SetTokenValidator accepts bearer tokens checked by tokens
+func (a *Authenticator) SetTokenValidator(tokens *services.TokenValidator) {
+	a.tokens = tokens
+}
+
+// SetRequestVerifier accepts receipt submissions signed with a key known to
+// verifier. Signed requests are only allowed to submit receipts.
+func (a *Authenticator) SetRequestVerifier(verifier *services.RequestVerifier) {
+	a.verifier = verifier
+}
+
+// Middleware rejects requests without valid credentials. The caller, and
+// its client as the actor for receipt history, are added to the request
+// context. Requests that are already authenticated are passed on.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := services.PrincipalFrom(r.Context()); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		principal, ok := a.authenticate(r)
+		if !ok {
+			if a.keys != nil {
+				w.Header().Add("WWW-Authenticate", "ApiKey")
+			}
+			if a.tokens != nil {
+				w.Header().Add("WWW-Authenticate", `Bearer error="invalid_token"`)
+			}
+			if a.verifier != nil && r.URL.Path == signedRoute {
+				w.Header().Add("WWW-Authenticate", "Signature")
+			}
+			http.Error(w, "Valid credentials are required.", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := services.WithPrincipal(r.Context(), principal)
+		ctx = services.WithActor(ctx, principal.Client)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Require rejects requests whose caller was not granted scope
+func (a *Authenticator) Require(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := services.PrincipalFrom(r.Context())
+		if !ok || !principal.HasScope(scope) {
+			http.Error(w, "The credentials do not allow this request.", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// operatorsOnly rejects callers limited to one tenant, for routes that
+// affect every tenant
+func operatorsOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if principal, ok := services.PrincipalFrom(r.Context()); ok && principal.Tenant != "" {
+			http.Error(w, "The credentials do not allow this request.", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func (a *Authenticator) authenticate(r *http.Request) (services.Principal, bool) {
+	if r.Header.Get(services.SignatureKeyHeader) != "" {
+		if a.verifier == nil || r.Method != http.MethodPost || r.URL.Path != signedRoute {
+			return services.Principal{}, false
+		}
+		key, err := a.verifier.Verify(r)
+		if err != nil {
+			return services.Principal{}, false
+		}
+		return services.Principal{Client: key.Client, Scopes: []string{models.ScopeSubmit}, Tenant: key.Tenant}, true
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if a.tokens == nil {
+			return services.Principal{}, false
+		}
+		principal, err := a.tokens.Validate(strings.TrimSpace(token))
+		return principal, err == nil
+	}
+
+	if a.keys == nil {
+		return services.Principal{}, false
+	}
+	key, ok := a.keys.Authenticate(r.Header.Get(APIKeyHeader))
+	if !ok {
+		return services.Principal{}, false
+	}
+	return services.Principal{Client: key.Client, Scopes: key.Scopes, Tenant: key.Tenant}, true
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec reads and writes request and response bodies in one format
+type Codec interface {
+	// MediaTypes lists the types the codec handles. The first is sent as
+	// the response Content-Type.
+	MediaTypes() []string
+	Decode(r io.Reader, v any) error
+	Encode(w io.Writer, v any) error
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) MediaTypes() []string {
+	return []string{"application/json"}
+}
+
+func (JSONCodec) Decode(r io.Reader, v any) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+func (JSONCodec) Encode(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+type XMLCodec struct{}
+
+func (XMLCodec) MediaTypes() []string {
+	return []string{"application/xml", "text/xml"}
+}
+
+func (XMLCodec) Decode(r io.Reader, v any) error {
+	return xml.NewDecoder(r).Decode(v)
+}
+
+func (XMLCodec) Encode(w io.Writer, v any) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(v)
+}
+
+// MessagePackCodec uses the models' json tags for field names, so MessagePack
+// maps have the same keys as JSON objects
+type MessagePackCodec struct{}
+
+func (MessagePackCodec) MediaTypes() []string {
+	return []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"}
+}
+
+func (MessagePackCodec) Decode(r io.Reader, v any) error {
+	decoder := msgpack.NewDecoder(r)
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
+
+func (MessagePackCodec) Encode(w io.Writer, v any) error {
+	encoder := msgpack.NewEncoder(w)
+	encoder.SetCustomStructTag("json")
+	return encoder.Encode(v)
+}
+
+// CodecRegistry picks codecs by the Content-Type and Accept headers. The
+// first codec registered is used for requests without a Content-Type.
+type CodecRegistry struct {
+	codecs []Codec
+	byType map[string]Codec
+}
+
+func NewCodecRegistry(codecs ...Codec) *CodecRegistry {
+	cr := &CodecRegistry{byType: make(map[string]Codec)}
+	for _, codec := range codecs {
+		cr.Register(codec)
+	}
+	return cr
+}
+
+// DefaultCodecs returns a registry for JSON, XML and MessagePack, with JSON
+// as the default
+func DefaultCodecs() *CodecRegistry {
+	return NewCodecRegistry(JSONCodec{}, XMLCodec{}, MessagePackCodec{})
+}
+
+func (cr *CodecRegistry) Register(codec Codec) {
+	cr.codecs = append(cr.codecs, codec)
+	for _, mediaType := range codec.MediaTypes() {
+		cr.byType[mediaType] = codec
+	}
+}
+
+// All returns the registered codecs in order
+func (cr *CodecRegistry) All() []Codec {
+	return append([]Codec(nil), cr.codecs...)
+}
+
+// Default returns the first codec registered
+func (cr *CodecRegistry) Default() Codec {
+	return cr.codecs[0]
+}
+
+// ForContentType returns the codec for a request body, or false if its
+// type is not supported
+func (cr *CodecRegistry) ForContentType(contentType string) (Codec, bool) {
+	if contentType == "" {
+		return cr.Default(), true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+	codec, ok := cr.byType[mediaType]
+	return codec, ok
+}
+
+// ForAccept returns the codec for the most preferred type in an Accept
+// header, or false if none is supported. The fallback is used when the
+// header is missing or the client accepts anything.
+func (cr *CodecRegistry) ForAccept(accept string, fallback Codec) (Codec, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return fallback, true
+	}
+
+	type acceptedType struct {
+		mediaType string
+		quality   float64
+	}
+	var accepted []acceptedType
+	for _, value := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality > 0 {
+			accepted = append(accepted, acceptedType{mediaType, quality})
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].quality > accepted[j].quality
+	})
+
+	for _, a := range accepted {
+		if a.mediaType == "*/*" {
+			return fallback, true
+		}
+		if codec, ok := cr.byType[a.mediaType]; ok {
+			return codec, true
+		}
+		if prefix, found := strings.CutSuffix(a.mediaType, "/*"); found {
+			for _, codec := range append([]Codec{fallback}, cr.codecs...) {
+				for _, mediaType := range codec.MediaTypes() {
+					if strings.HasPrefix(mediaType, prefix+"/") {
+						return codec, true
+					}
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// writeEncoded writes v with the codec's media type
+func writeEncoded(w http.ResponseWriter, codec Codec, status int, v any) {
+	w.Header().Set("Content-Type", codec.MediaTypes()[0])
+	w.WriteHeader(status)
+	codec.Encode(w, v)
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"receipt-processor/models"
+	"receipt-processor/parsers"
+)
+
+const maxImportBytes = 32 << 20
+
+// ImportReceipts processes the receipts in a CSV file. Receipts with an
+// invalid row are skipped and reported alongside the ones imported. Each
+// imported receipt counts towards the daily submission quota.
+func (h *ReceiptHandler) ImportReceipts(w http.ResponseWriter, r *http.Request) {
+	receipts, rowErrors, err := parsers.ParseCSV(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		http.Error(w, "The import file is invalid.", http.StatusBadRequest)
+		return
+	}
+
+	response := models.ImportResponse{
+		Imported: []models.ImportedReceipt{},
+		Errors:   append([]models.ImportError{}, rowErrors...),
+	}
+	var accepted []parsers.CSVReceipt
+	for _, parsed := range receipts {
+		if !h.isValidReceipt(r.Context(), parsed.Receipt) {
+			response.Errors = append(response.Errors, models.ImportError{Row: parsed.Row, Key: parsed.Key, Error: "the receipt is invalid"})
+			continue
+		}
+		if !attribute(r, &parsed.Receipt) {
+			response.Errors = append(response.Errors, models.ImportError{Row: parsed.Row, Key: parsed.Key, Error: "the receipt belongs to another customer"})
+			continue
+		}
+		accepted = append(accepted, parsed)
+	}
+
+	// Nothing is imported unless every receipt fits in the daily quota
+	if !allowSubmissions(w, r, len(accepted)) {
+		return
+	}
+	ctx := requestContext(r)
+	for _, parsed := range accepted {
+		id, err := h.processor.ProcessReceipt(ctx, parsed.Receipt)
+		if err != nil {
+			response.Errors = append(response.Errors, models.ImportError{Row: parsed.Row, Key: parsed.Key, Error: "the receipt is invalid"})
+			continue
+		}
+		response.Imported = append(response.Imported, models.ImportedReceipt{Key: parsed.Key, ID: id})
+	}
+	sort.SliceStable(response.Errors, func(i, j int) bool {
+		return response.Errors[i].Row < response.Errors[j].Row
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ExportReceipts streams every stored receipt in the CSV import layout, keyed
+// by receipt ID, followed by its points and the points from each rule.
+// Customers only export their own receipts.
+func (h *ReceiptHandler) ExportReceipts(w http.ResponseWriter, r *http.Request) {
+	if format := r.URL.Query().Get("format"); format != "" && format != "csv" {
+		http.Error(w, "Unsupported export format.", http.StatusBadRequest)
+		return
+	}
+
+	var ruleNames []string
+	for _, rule := range h.processor.Rules() {
+		ruleNames = append(ruleNames, rule.Name())
+	}
+
+	header := append([]string{}, parsers.CSVColumns...)
+	header = append(header, "points", "uncapped", "receiptCapped", "dailyCapped")
+	for _, name := range ruleNames {
+		header = append(header, "rule:"+name)
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="receipts.csv"`)
+	writer := csv.NewWriter(w)
+	writer.Write(header)
+
+	// The writer is buffered and writes to the client as it fills, so only
+	// one receipt is held at a time
+	h.processor.EachReceipt(func(id string, receipt models.Receipt, breakdown models.PointsBreakdown) bool {
+		if !ownsReceipt(r, receipt) {
+			return true
+		}
+		rulePoints := make(map[string]int64)
+		for _, rule := range breakdown.Rules {
+			rulePoints[rule.Rule] = rule.Points
+		}
+
+		summary := []string{
+			strconv.FormatInt(breakdown.Points, 10),
+			strconv.FormatInt(breakdown.Uncapped, 10),
+			strconv.FormatInt(breakdown.ReceiptCapped, 10),
+			strconv.FormatInt(breakdown.DailyCapped, 10),
+		}
+		for _, name := range ruleNames {
+			if points, ok := rulePoints[name]; ok {
+				summary = append(summary, strconv.FormatInt(points, 10))
+			} else {
+				summary = append(summary, "")
+			}
+		}
+
+		for _, record := range parsers.CSVRecords(id, receipt) {
+			if err := writer.Write(append(record, summary...)); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	writer.Flush()
+}
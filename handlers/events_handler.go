@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+const eventHeartbeat = 15 * time.Second
+
+type EventsHandler struct {
+	broker *services.EventBroker
+}
+
+func NewEventsHandler(broker *services.EventBroker) *EventsHandler {
+	return &EventsHandler{
+		broker: broker,
+	}
+}
+
+// StreamEvents sends receipt events as Server-Sent Events. Clients resume
+// after the event in the Last-Event-ID header, or the lastEventId query
+// parameter; without either only new events are sent. Slow clients are
+// disconnected and expected to reconnect and resume. Customers only receive
+// events for their own receipts.
+func (h *EventsHandler) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported.", http.StatusInternalServerError)
+		return
+	}
+	// The stream outlives the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	lastEventID := int64(-1)
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("lastEventId")
+	}
+	if value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || id < 0 {
+			http.Error(w, "The last event ID is invalid.", http.StatusBadRequest)
+			return
+		}
+		lastEventID = id
+	}
+
+	customer := callerCustomer(r)
+	visible := func(event models.ReceiptEvent) bool {
+		return customer == "" || event.CustomerID == customer
+	}
+
+	replay, subscription := h.broker.Subscribe(lastEventID)
+	defer subscription.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, event := range replay {
+		if !visible(event) {
+			continue
+		}
+		if err := writeServerSentEvent(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-subscription.Events:
+			if !ok {
+				return
+			}
+			if !visible(event) {
+				continue
+			}
+			if err := writeServerSentEvent(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeServerSentEvent(w io.Writer, event models.ReceiptEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
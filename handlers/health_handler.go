@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"receipt-processor/models"
+)
+
+// Probe paths, answered for every tenant and without credentials
+const (
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+)
+
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// HealthHandler answers liveness and readiness probes. The server is live
+// while it can answer at all, and ready once it is loaded, for as long as
+// every check passes and it is not shutting down.
+type HealthHandler struct {
+	checks   []healthCheck
+	ready    bool
+	draining bool
+	mutex    sync.RWMutex
+}
+
+// NewHealthHandler returns a handler that is not ready until SetReady is
+// called
+func NewHealthHandler() *HealthHandler {
+	return &HealthHandler{}
+}
+
+// AddCheck adds a check that must pass for the server to be ready
+func (h *HealthHandler) AddCheck(name string, check func() error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.checks = append(h.checks, healthCheck{name: name, check: check})
+}
+
+// SetReady reports that the server has finished loading
+func (h *HealthHandler) SetReady() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.ready = true
+}
+
+// Drain reports the server not ready from now on, so that no new requests
+// are sent to it while it shuts down
+func (h *HealthHandler) Drain() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.draining = true
+}
+
+func (h *HealthHandler) Liveness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, models.HealthResponse{Status: "ok"})
+}
+
+func (h *HealthHandler) Readiness(w http.ResponseWriter, r *http.Request) {
+	h.mutex.RLock()
+	ready, draining := h.ready, h.draining
+	checks := h.checks
+	h.mutex.RUnlock()
+
+	response := models.HealthResponse{Status: "ready", Checks: make(map[string]string)}
+	for _, check := range checks {
+		if err := check.check(); err != nil {
+			response.Checks[check.name] = err.Error()
+			response.Status = "failing"
+		} else {
+			response.Checks[check.name] = "ok"
+		}
+	}
+	switch {
+	case draining:
+		response.Status = "draining"
+	case !ready:
+		response.Status = "loading"
+	}
+
+	status := http.StatusOK
+	if response.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, response)
+}
+
+// Middleware answers probes ahead of next, so that they need no credentials
+// or tenant, are not rate limited, and are not logged
+func (h *HealthHandler) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			switch r.URL.Path {
+			case LivenessPath:
+				h.Liveness(w, r)
+				return
+			case ReadinessPath:
+				h.Readiness(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeHealth(w http.ResponseWriter, status int, response models.HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"receipt-processor/models"
+	"receipt-processor/services"
+
+	"github.com/gorilla/mux"
+)
+
+// UpdateReceipt replaces a receipt with a corrected one, in any registered
+// format, and returns its new points
+func (h *ReceiptHandler) UpdateReceipt(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var receipt models.Receipt
+
+	requestCodec, ok := h.codecs.ForContentType(r.Header.Get("Content-Type"))
+	if !ok {
+		http.Error(w, "Unsupported content type.", http.StatusUnsupportedMediaType)
+		return
+	}
+	responseCodec, ok := h.codecs.ForAccept(r.Header.Get("Accept"), requestCodec)
+	if !ok {
+		http.Error(w, "No acceptable response format.", http.StatusNotAcceptable)
+		return
+	}
+
+	err := decodeReceipt(r.Context(), requestCodec, r.Body, &receipt)
+	if err != nil || !h.isValidReceipt(r.Context(), receipt) {
+		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
+		return
+	}
+	if !attribute(r, &receipt) {
+		http.Error(w, "The receipt belongs to another customer.", http.StatusForbidden)
+		return
+	}
+
+	// Customers can only correct their own receipts
+	if stored, exists := h.processor.GetReceipt(id); exists && !ownsReceipt(r, stored) {
+		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+		return
+	}
+
+	breakdown, err := h.processor.UpdateReceipt(requestContext(r), id, receipt)
+	if errors.Is(err, services.ErrUnknownReceipt) {
+		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
+		return
+	}
+
+	response := models.PointsResponse{Points: breakdown.Points}
+	writeEncoded(w, responseCodec, http.StatusOK, response)
+}
+
+func (h *ReceiptHandler) DeleteReceipt(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if !h.processor.DeleteReceipt(requestContext(r), id) {
+		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetHistory returns every change made to a receipt, oldest first, including
+// after it has been deleted. Customers only see their own receipts' history.
+func (h *ReceiptHandler) GetHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	history, exists := h.processor.History(id)
+	if !exists || !ownsHistory(r, history) {
+		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// ownsHistory reports whether the caller may read a receipt's history. The
+// receipt's customer is the one in its last version, as deleted receipts
+// are no longer stored.
+func ownsHistory(r *http.Request, history []models.HistoryEvent) bool {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Receipt != nil {
+			return ownsReceipt(r, *history[i].Receipt)
+		}
+	}
+	return callerCustomer(r) == ""
+}
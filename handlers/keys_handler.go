@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"receipt-processor/models"
+	"receipt-processor/services"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultKeyOverlap is how long a rotated key keeps working by default
+const defaultKeyOverlap = 24 * time.Hour
+
+type KeysHandler struct {
+	keys *services.APIKeyStore
+}
+
+func NewKeysHandler(keys *services.APIKeyStore) *KeysHandler {
+	return &KeysHandler{
+		keys: keys,
+	}
+}
+
+func (h *KeysHandler) ListKeys(w http.ResponseWriter, r *http.Request) {
+	keys := h.keys.Keys()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// CreateKey returns the new key with its secret, which cannot be retrieved
+// again
+func (h *KeysHandler) CreateKey(w http.ResponseWriter, r *http.Request) {
+	var key models.APIKey
+
+	err := json.NewDecoder(r.Body).Decode(&key)
+	if err != nil {
+		http.Error(w, "The API key is invalid.", http.StatusBadRequest)
+		return
+	}
+
+	created, err := h.keys.Create(key.Client, key.Tenant, key.Scopes, key.ExpiresAt)
+	if errors.Is(err, services.ErrInvalidAPIKey) {
+		http.Error(w, "The API key is invalid.", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "The API key could not be saved.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// RotateKey replaces a key. The old key keeps working for ?overlap, a
+// duration such as 1h, or 24 hours by default.
+func (h *KeysHandler) RotateKey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	overlap := defaultKeyOverlap
+	if value := r.URL.Query().Get("overlap"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "The overlap is invalid.", http.StatusBadRequest)
+			return
+		}
+		overlap = parsed
+	}
+
+	created, err := h.keys.Rotate(id, overlap)
+	if errors.Is(err, services.ErrAPIKeyNotFound) {
+		http.Error(w, "No API key found for that ID.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "The API key could not be saved.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+func (h *KeysHandler) RevokeKey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	revoked, err := h.keys.Revoke(id)
+	if err != nil {
+		http.Error(w, "The API keys could not be saved.", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "No API key found for that ID.", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
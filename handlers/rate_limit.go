@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"receipt-processor/services"
+)
+
+// rateLimited refuses requests once the caller is over its limits for route,
+// or over its daily quota for a submission, with 429 Too Many Requests.
+// Callers are identified by their credentials, or else by IP address.
+func rateLimited(limiter *services.RateLimiter, route string, submission bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !writeRateDecision(w, limiter.Allow(rateLimitClient(r), route, submission)) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LimitByAddress refuses requests from an IP address over its limit with 429
+// Too Many Requests before they are authenticated, so that credentials
+// cannot be guessed at the rate of the server. Requests are not limited if
+// limiter is nil.
+func LimitByAddress(limiter *services.RateLimiter, next http.Handler) http.Handler {
+	if limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !writeRateDecision(w, limiter.AllowAddress(remoteHost(r))) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type submissionQuotaKey struct{}
+
+// submissionQuota lets the handler count the receipts a request submits
+// against the caller's daily quota with allowSubmissions, once it knows how
+// many there are
+func submissionQuota(limiter *services.RateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := rateLimitClient(r)
+		allow := func(n int) services.RateDecision {
+			return limiter.AllowSubmissions(client, n)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), submissionQuotaKey{}, allow)))
+	})
+}
+
+// allowSubmissions counts n submitted receipts against the caller's daily
+// quota. If they do not all fit it returns false, having refused the
+// request with 429 Too Many Requests.
+func allowSubmissions(w http.ResponseWriter, r *http.Request, n int) bool {
+	allow, ok := r.Context().Value(submissionQuotaKey{}).(func(int) services.RateDecision)
+	if !ok {
+		return true
+	}
+	return writeRateDecision(w, allow(n))
+}
+
+// writeRateDecision sets the rate limit headers, and refuses the request
+// with 429 Too Many Requests if it is not allowed
+func writeRateDecision(w http.ResponseWriter, decision services.RateDecision) bool {
+	if decision.Limit > 0 {
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		w.Header().Set("RateLimit-Reset", ceilSeconds(decision.Reset))
+	}
+	if !decision.Allowed {
+		w.Header().Set("Retry-After", ceilSeconds(decision.RetryAfter))
+		http.Error(w, "Too many requests.", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+func rateLimitClient(r *http.Request) string {
+	if principal, ok := services.PrincipalFrom(r.Context()); ok {
+		return "client:" + principal.Tenant + "/" + principal.Client
+	}
+	return "ip:" + remoteHost(r)
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ceilSeconds rounds up to whole seconds, and to at least one
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(d.Seconds()))))
+}
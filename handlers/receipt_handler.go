@@ -1,45 +1,230 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"regexp"
 	"time"
 
 	"receipt-processor/models"
+	"receipt-processor/parsers"
 	"receipt-processor/services"
+	"receipt-processor/utils"
 
 	"github.com/gorilla/mux"
+	attr "go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
+const (
+	maxTextReceiptBytes  = 1 << 20
+	maxEmailReceiptBytes = 10 << 20
+)
+
+// anonymousActor is recorded in receipt history for unidentified callers
+const anonymousActor = "anonymous"
+
+var errInvalidReceipt = errors.New("the receipt is invalid")
+
 type ReceiptHandler struct {
 	processor *services.ReceiptProcessor
+	codecs    *CodecRegistry
+	jobs      *services.JobQueue
 }
 
 func NewReceiptHandler(processor *services.ReceiptProcessor) *ReceiptHandler {
 	return &ReceiptHandler{
 		processor: processor,
+		codecs:    DefaultCodecs(),
 	}
 }
 
+// SetJobQueue enables asynchronous processing on the given queue
+func (h *ReceiptHandler) SetJobQueue(jobs *services.JobQueue) {
+	h.jobs = jobs
+}
+
+// ProcessReceipt reads a receipt in any registered format. The response is
+// in the format named by Accept, or the request's format if there is none.
+// With ?async=true the receipt is validated and scored on the job queue and
+// the job is returned immediately.
 func (h *ReceiptHandler) ProcessReceipt(w http.ResponseWriter, r *http.Request) {
 	var receipt models.Receipt
 
-	err := json.NewDecoder(r.Body).Decode(&receipt)
+	requestCodec, ok := h.codecs.ForContentType(r.Header.Get("Content-Type"))
+	if !ok {
+		http.Error(w, "Unsupported content type.", http.StatusUnsupportedMediaType)
+		return
+	}
+	responseCodec, ok := h.codecs.ForAccept(r.Header.Get("Accept"), requestCodec)
+	if !ok {
+		http.Error(w, "No acceptable response format.", http.StatusNotAcceptable)
+		return
+	}
+
+	err := decodeReceipt(r.Context(), requestCodec, r.Body, &receipt)
 	if err != nil {
+		h.processor.Reject(r.Context(), "malformed")
 		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
 		return
 	}
+	if !attribute(r, &receipt) {
+		http.Error(w, "The receipt belongs to another customer.", http.StatusForbidden)
+		return
+	}
+
+	if r.URL.Query().Get("async") == "true" {
+		h.processAsync(w, r, receipt, responseCodec)
+		return
+	}
 
 	// Validate receipt fields
-	if !isValidReceipt(receipt) {
+	if !h.isValidReceipt(r.Context(), receipt) {
 		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
 		return
 	}
 
-	id := h.processor.ProcessReceipt(receipt)
+	id, err := h.processor.ProcessReceipt(requestContext(r), receipt)
+	if err != nil {
+		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
+		return
+	}
 
 	response := models.ReceiptResponse{ID: id}
+	writeEncoded(w, responseCodec, http.StatusOK, response)
+}
+
+func (h *ReceiptHandler) processAsync(w http.ResponseWriter, r *http.Request, receipt models.Receipt, codec Codec) {
+	if h.jobs == nil {
+		http.Error(w, "Asynchronous processing is not available.", http.StatusServiceUnavailable)
+		return
+	}
+
+	// The job outlives the request but is still made on its caller's behalf
+	ctx := context.WithoutCancel(requestContext(r))
+	job, err := h.jobs.Submit(h.processor.Tenant(), func() (string, error) {
+		if !h.isValidReceipt(ctx, receipt) {
+			return "", errInvalidReceipt
+		}
+		id, err := h.processor.ProcessReceipt(ctx, receipt)
+		if err != nil {
+			return "", errInvalidReceipt
+		}
+		return id, nil
+	})
+	if errors.Is(err, services.ErrQueueFull) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many receipts are queued.", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Asynchronous processing is not available.", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeEncoded(w, codec, http.StatusAccepted, job)
+}
+
+// GetJob returns the status of an asynchronously processed receipt
+func (h *ReceiptHandler) GetJob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	codec, ok := h.codecs.ForAccept(r.Header.Get("Accept"), h.codecs.Default())
+	if !ok {
+		http.Error(w, "No acceptable response format.", http.StatusNotAcceptable)
+		return
+	}
+
+	if h.jobs == nil {
+		http.Error(w, "No job found for that ID.", http.StatusNotFound)
+		return
+	}
+	job, exists := h.jobs.Job(id)
+	if !exists || job.Tenant != h.processor.Tenant() {
+		http.Error(w, "No job found for that ID.", http.StatusNotFound)
+		return
+	}
+
+	writeEncoded(w, codec, http.StatusOK, job)
+}
+
+// tooLarge reports whether reading a body failed because it was over the
+// limit set with http.MaxBytesReader
+func tooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// ProcessTextReceipt accepts the plain text printed on a receipt
+func (h *ReceiptHandler) ProcessTextReceipt(w http.ResponseWriter, r *http.Request) {
+	text, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxTextReceiptBytes))
+	if tooLarge(err) {
+		http.Error(w, "The receipt is too large.", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
+		return
+	}
+
+	receipt, confidence, err := parsers.ParseText(string(text))
+	if err != nil || !h.isValidReceipt(r.Context(), receipt) {
+		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
+		return
+	}
+	if !attribute(r, &receipt) {
+		http.Error(w, "The receipt belongs to another customer.", http.StatusForbidden)
+		return
+	}
+
+	id, err := h.processor.ProcessReceipt(requestContext(r), receipt)
+	if err != nil {
+		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
+		return
+	}
+
+	response := models.ParsedReceiptResponse{ID: id, Receipt: receipt, Confidence: confidence}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ProcessEmailReceipt accepts a raw RFC 822 e-receipt message, such as an .eml
+// file forwarded from a mailbox
+func (h *ReceiptHandler) ProcessEmailReceipt(w http.ResponseWriter, r *http.Request) {
+	// The whole message is read first, as a message cut short can still parse
+	message, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEmailReceiptBytes))
+	if tooLarge(err) {
+		http.Error(w, "The receipt is too large.", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
+		return
+	}
+
+	receipt, confidence, err := parsers.ParseEmail(bytes.NewReader(message))
+	if err != nil || !h.isValidReceipt(r.Context(), receipt) {
+		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
+		return
+	}
+	if !attribute(r, &receipt) {
+		http.Error(w, "The receipt belongs to another customer.", http.StatusForbidden)
+		return
+	}
+
+	id, err := h.processor.ProcessReceipt(requestContext(r), receipt)
+	if err != nil {
+		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
+		return
+	}
+
+	response := models.ParsedReceiptResponse{ID: id, Receipt: receipt, Confidence: confidence}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
@@ -48,56 +233,238 @@ func (h *ReceiptHandler) GetPoints(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	receipt, exists := h.processor.GetReceipt(id)
-	if !exists {
+	codec, ok := h.codecs.ForAccept(r.Header.Get("Accept"), h.codecs.Default())
+	if !ok {
+		http.Error(w, "No acceptable response format.", http.StatusNotAcceptable)
+		return
+	}
+
+	breakdown, exists := h.processor.GetBreakdown(id)
+	if !exists || !h.visible(r, id) {
 		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
 		return
 	}
 
-	points := h.processor.CalculatePoints(receipt)
+	response := models.PointsResponse{Points: breakdown.Points}
+	writeEncoded(w, codec, http.StatusOK, response)
+}
+
+func (h *ReceiptHandler) GetBreakdown(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	breakdown, exists := h.processor.GetBreakdown(id)
+	if !exists || !h.visible(r, id) {
+		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+		return
+	}
 
-	response := models.PointsResponse{Points: points}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(breakdown)
 }
 
-// Helper function to validate receipt according to the requirements
-func isValidReceipt(receipt models.Receipt) bool {
+// requestContext returns the request's context, recording changes as made
+// by an anonymous caller unless the caller has already been identified
+func requestContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	if _, ok := services.ActorFrom(ctx); !ok {
+		ctx = services.WithActor(ctx, anonymousActor)
+	}
+	return ctx
+}
+
+// attribute sets the customer of a receipt submitted by a caller identified
+// as a customer. It reports false if the receipt names another customer.
+func attribute(r *http.Request, receipt *models.Receipt) bool {
+	principal, ok := services.PrincipalFrom(r.Context())
+	if !ok || principal.CustomerID == "" {
+		return true
+	}
+	if receipt.CustomerID != "" && receipt.CustomerID != principal.CustomerID {
+		return false
+	}
+	receipt.CustomerID = principal.CustomerID
+	return true
+}
+
+// callerCustomer returns the customer the caller is identified as, or ""
+// for callers that may see every customer's receipts
+func callerCustomer(r *http.Request) string {
+	principal, _ := services.PrincipalFrom(r.Context())
+	return principal.CustomerID
+}
+
+// ownsReceipt reports whether a caller identified as a customer, or any
+// other caller, may read or change a stored receipt
+func ownsReceipt(r *http.Request, receipt models.Receipt) bool {
+	customer := callerCustomer(r)
+	return customer == "" || receipt.CustomerID == customer
+}
+
+// visible reports whether a receipt is stored and the caller may read it
+func (h *ReceiptHandler) visible(r *http.Request, id string) bool {
+	receipt, exists := h.processor.GetReceipt(id)
+	return exists && ownsReceipt(r, receipt)
+}
+
+// isValidReceipt validates a receipt, recording why it was rejected if it is
+// invalid
+func (h *ReceiptHandler) isValidReceipt(ctx context.Context, receipt models.Receipt) bool {
+	ctx, span := services.Tracer().Start(ctx, "validate")
+	defer span.End()
+
+	reason := invalidReason(receipt, h.processor.ExchangeRates().Base())
+	if reason == "" && !h.processor.Convertible(receipt) {
+		reason = "exchange_rate"
+	}
+	if reason != "" {
+		span.SetAttributes(attr.String("validation.reason", reason))
+		span.SetStatus(codes.Error, "invalid receipt")
+		h.processor.Reject(ctx, reason)
+		return false
+	}
+	return true
+}
+
+// invalidReason validates a receipt according to the requirements, returning
+// why it is invalid or "" if it is valid. Receipts that name no currency are
+// in the base currency.
+func invalidReason(receipt models.Receipt, base string) string {
 	// Basic validation
 	if receipt.Retailer == "" || receipt.PurchaseDate == "" || receipt.PurchaseTime == "" || receipt.Total == "" || len(receipt.Items) == 0 {
-		return false
+		return "missing_field"
 	}
 
 	// Validate retailer
 	retailerRegex := regexp.MustCompile(`^[\w\s\-&]+$`)
 	if !retailerRegex.MatchString(receipt.Retailer) {
-		return false
+		return "retailer"
 	}
 
 	// Validate purchase date
 	_, err := time.Parse("2006-01-02", receipt.PurchaseDate)
 	if err != nil {
-		return false
+		return "purchase_date"
 	}
 
 	// Validate purchase time
 	_, err = time.Parse("15:04", receipt.PurchaseTime)
 	if err != nil {
-		return false
+		return "purchase_time"
+	}
+
+	// Validate time zone
+	if receipt.Timezone != "" && !utils.IsValidTimezone(receipt.Timezone) {
+		return "timezone"
+	}
+
+	// Validate currency; amounts use its number of decimal places
+	currency := receipt.Currency
+	if currency == "" {
+		currency = base
+	}
+	decimals, ok := utils.CurrencyDecimals(currency)
+	if !ok {
+		return "currency"
 	}
 
 	// Validate total
-	totalRegex := regexp.MustCompile(`^\d+\.\d{2}$`)
-	if !totalRegex.MatchString(receipt.Total) {
-		return false
+	if !utils.IsValidAmount(receipt.Total, decimals, false) {
+		return "total"
 	}
 
 	// Validate each item
 	for _, item := range receipt.Items {
-		if item.ShortDescription == "" || !totalRegex.MatchString(item.Price) {
+		if item.ShortDescription == "" || !utils.IsValidAmount(item.Price, decimals, true) {
+			return "item"
+		}
+		if item.Quantity != "" && !utils.IsValidQuantity(item.Quantity) {
+			return "item"
+		}
+		if item.UnitPrice != "" && !utils.IsValidAmount(item.UnitPrice, decimals, false) {
+			return "item"
+		}
+	}
+
+	// Validate discount and tax lines
+	for _, adjustments := range [][]models.Adjustment{receipt.Discounts, receipt.Taxes} {
+		for _, adjustment := range adjustments {
+			if adjustment.Description == "" || !utils.IsValidAmount(adjustment.Amount, decimals, false) {
+				return "adjustment"
+			}
+		}
+	}
+
+	if !isValidArithmetic(receipt, decimals) {
+		return "arithmetic"
+	}
+	return ""
+}
+
+// Receipts using quantities, unit prices, negative lines, discounts or taxes
+// must add up: each line's price is its quantity times its unit price, and
+// the total is the sum of the lines less discounts plus taxes. A quantity
+// needs a unit price to be checked against. Plain receipts are not checked,
+// as many clients send totals that include unitemized tax. Amounts are added
+// in minor units, and any that overflow are invalid, whether or not the
+// receipt is checked.
+func isValidArithmetic(receipt models.Receipt, decimals int) bool {
+	detailed := len(receipt.Discounts) > 0 || len(receipt.Taxes) > 0
+	var sum, magnitude int64
+	add := func(amount string, sign int64) (int64, bool) {
+		units, err := utils.ParseMinorUnits(amount, decimals)
+		if err != nil {
+			return 0, false
+		}
+		var ok bool
+		if sum, ok = utils.AddMinorUnits(sum, sign*units); !ok {
+			return 0, false
+		}
+		magnitude, ok = utils.AddMinorUnits(magnitude, max(units, -units))
+		return units, ok
+	}
+
+	for _, item := range receipt.Items {
+		price, ok := add(item.Price, 1)
+		if !ok {
+			return false
+		}
+
+		if item.Quantity == "" && item.UnitPrice == "" && price >= 0 {
+			continue
+		}
+		detailed = true
+
+		if item.UnitPrice == "" {
+			if item.Quantity != "" {
+				return false
+			}
+			continue
+		}
+		quantity := int64(1000)
+		if item.Quantity != "" {
+			quantity, _ = utils.ParseQuantity(item.Quantity)
+		}
+		unitPrice, _ := utils.ParseMinorUnits(item.UnitPrice, decimals)
+		if expected, ok := utils.LinePrice(quantity, unitPrice); !ok || expected != price {
 			return false
 		}
 	}
 
-	return true
+	for _, discount := range receipt.Discounts {
+		if _, ok := add(discount.Amount, -1); !ok {
+			return false
+		}
+	}
+	for _, tax := range receipt.Taxes {
+		if _, ok := add(tax.Amount, 1); !ok {
+			return false
+		}
+	}
+
+	total, err := utils.ParseMinorUnits(receipt.Total, decimals)
+	if err != nil {
+		return false
+	}
+	return !detailed || sum == total
 }
\ No newline at end of file
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"net/http"
+
+	"receipt-processor/models"
+	"receipt-processor/services"
+
+	"github.com/gorilla/mux"
+)
+
+// importPath takes CSV imports, which can submit many receipts at once
+const importPath = "/receipts/import"
+
+// Handlers are the handlers served by the router. Keys may be nil when API
+// keys are not in use, Limiter when requests are not rate limited, and
+// Metrics when metrics are not served. Requests are counted by wrapping the
+// router in the metrics middleware.
+type Handlers struct {
+	Receipts *ReceiptHandler
+	Admin    *AdminHandler
+	Webhooks *WebhookHandler
+	Events   *EventsHandler
+	Keys     *KeysHandler
+	Metrics  *MetricsHandler
+	Limiter  *services.RateLimiter
+}
+
+// NewRouter registers every route, each traced in its own span. With an
+// authenticator, every route needs an API key granting the scope given for
+// it here. With a limiter, each route is rate limited per caller, and the
+// POST routes needing the submit scope count towards the daily submission
+// quota, imports by the number of receipts they import.
+func NewRouter(h Handlers, auth *Authenticator) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(traceRequests)
+	router.Use(recordRoute)
+	if auth != nil {
+		router.Use(auth.Middleware)
+	}
+
+	route := func(method, path, scope string, handler http.HandlerFunc) {
+		var wrapped http.Handler = handler
+		if auth != nil {
+			wrapped = auth.Require(scope, handler)
+		}
+		if h.Limiter != nil {
+			submission := method == "POST" && scope == models.ScopeSubmit
+			if path == importPath {
+				// Each imported receipt counts, once the file is read
+				submission = false
+				wrapped = submissionQuota(h.Limiter, wrapped)
+			}
+			wrapped = rateLimited(h.Limiter, method+" "+path, submission, wrapped)
+		}
+		router.Handle(path, wrapped).Methods(method)
+	}
+
+	route("POST", "/receipts/process", models.ScopeSubmit, h.Receipts.ProcessReceipt)
+	route("POST", "/receipts/process/text", models.ScopeSubmit, h.Receipts.ProcessTextReceipt)
+	route("POST", "/receipts/process/email", models.ScopeSubmit, h.Receipts.ProcessEmailReceipt)
+	route("POST", importPath, models.ScopeSubmit, h.Receipts.ImportReceipts)
+	route("GET", "/receipts/export", models.ScopeRead, h.Receipts.ExportReceipts)
+	route("GET", "/receipts/{id}/points", models.ScopeRead, h.Receipts.GetPoints)
+	route("GET", "/receipts/{id}/breakdown", models.ScopeRead, h.Receipts.GetBreakdown)
+	route("GET", "/receipts/{id}/history", models.ScopeRead, h.Receipts.GetHistory)
+	route("PUT", "/receipts/{id}", models.ScopeSubmit, h.Receipts.UpdateReceipt)
+	route("DELETE", "/receipts/{id}", models.ScopeAdmin, h.Receipts.DeleteReceipt)
+	route("GET", "/jobs/{id}", models.ScopeRead, h.Receipts.GetJob)
+	route("GET", "/events", models.ScopeRead, h.Events.StreamEvents)
+
+	route("GET", "/admin/retailers/aliases", models.ScopeAdmin, h.Admin.ListRetailerAliases)
+	route("PUT", "/admin/retailers/aliases", models.ScopeAdmin, h.Admin.SetRetailerAlias)
+	route("DELETE", "/admin/retailers/aliases", models.ScopeAdmin, h.Admin.DeleteRetailerAlias)
+	route("GET", "/admin/retailers/timezones", models.ScopeAdmin, h.Admin.ListRetailerTimezones)
+	route("PUT", "/admin/retailers/timezones", models.ScopeAdmin, h.Admin.SetRetailerTimezone)
+	route("DELETE", "/admin/retailers/timezones", models.ScopeAdmin, h.Admin.DeleteRetailerTimezone)
+	route("GET", "/admin/caps", models.ScopeAdmin, h.Admin.GetCaps)
+	route("PUT", "/admin/caps", models.ScopeAdmin, h.Admin.SetCaps)
+	route("POST", "/admin/receipts/{id}/rescore", models.ScopeAdmin, h.Admin.RescoreReceipt)
+	route("GET", "/admin/webhooks", models.ScopeAdmin, h.Webhooks.ListWebhooks)
+	route("POST", "/admin/webhooks", models.ScopeAdmin, h.Webhooks.CreateWebhook)
+	route("GET", "/admin/webhooks/deliveries", models.ScopeAdmin, h.Webhooks.ListDeliveries)
+	route("GET", "/admin/webhooks/dead-letters", models.ScopeAdmin, h.Webhooks.ListDeadLetters)
+	route("DELETE", "/admin/webhooks/{id}", models.ScopeAdmin, h.Webhooks.DeleteWebhook)
+
+	// API keys and metrics are shared by every tenant
+	if h.Metrics != nil {
+		route("GET", "/metrics", models.ScopeMetrics, operatorsOnly(h.Metrics.GetMetrics))
+	}
+	if h.Keys != nil {
+		route("GET", "/admin/keys", models.ScopeAdmin, operatorsOnly(h.Keys.ListKeys))
+		route("POST", "/admin/keys", models.ScopeAdmin, operatorsOnly(h.Keys.CreateKey))
+		route("POST", "/admin/keys/{id}/rotate", models.ScopeAdmin, operatorsOnly(h.Keys.RotateKey))
+		route("DELETE", "/admin/keys/{id}", models.ScopeAdmin, operatorsOnly(h.Keys.RevokeKey))
+	}
+
+	return router
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"receipt-processor/services"
+)
+
+// TenantHeader names the tenant of a request made with credentials that are
+// not limited to one tenant
+const TenantHeader = services.TenantHeader
+
+// TenantRouter serves each request with the handlers of its tenant, so no
+// request can reach another tenant's receipts. The tenant is the one the
+// caller's credentials are limited to, or else the one named by the
+// X-Tenant-ID header, or else the default tenant.
+type TenantRouter struct {
+	tenants *services.TenantRegistry
+	build   func(*services.Tenant) Handlers
+	auth    *Authenticator
+	routers map[string]http.Handler
+	mutex   sync.Mutex
+}
+
+// NewTenantRouter calls build for the handlers of each tenant the first time
+// it is used. Requests are authenticated by auth if it is not nil.
+func NewTenantRouter(tenants *services.TenantRegistry, build func(*services.Tenant) Handlers, auth *Authenticator) *TenantRouter {
+	return &TenantRouter{
+		tenants: tenants,
+		build:   build,
+		auth:    auth,
+		routers: make(map[string]http.Handler),
+	}
+}
+
+func (tr *TenantRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Authenticate first, as the credentials can decide the tenant
+	if tr.auth != nil {
+		tr.auth.Middleware(http.HandlerFunc(tr.dispatch)).ServeHTTP(w, r)
+		return
+	}
+	tr.dispatch(w, r)
+}
+
+func (tr *TenantRouter) dispatch(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(TenantHeader)
+	if principal, ok := services.PrincipalFrom(r.Context()); ok && principal.Tenant != "" {
+		if id != "" && id != principal.Tenant {
+			http.Error(w, "The credentials do not allow this tenant.", http.StatusForbidden)
+			return
+		}
+		id = principal.Tenant
+	}
+	if id == "" {
+		id = services.DefaultTenant
+	}
+
+	tenant, err := tr.tenants.Tenant(id)
+	if errors.Is(err, services.ErrInvalidTenant) {
+		http.Error(w, "The tenant is invalid.", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, services.ErrUnknownTenant) {
+		http.Error(w, "No tenant found for that ID.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "The tenant could not be loaded.", http.StatusInternalServerError)
+		return
+	}
+
+	tr.router(tenant).ServeHTTP(w, r)
+}
+
+func (tr *TenantRouter) router(tenant *services.Tenant) http.Handler {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	router, exists := tr.routers[tenant.ID]
+	if !exists {
+		router = NewRouter(tr.build(tenant), tr.auth)
+		tr.routers[tenant.ID] = router
+	}
+	return router
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"receipt-processor/models"
+	"receipt-processor/services"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	attr "go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceRequests serves each request in a span named after its route,
+// continuing the caller's trace if it sent a W3C traceparent header
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route, _ := mux.CurrentRoute(r).GetPathTemplate()
+		ctx, span := services.Tracer().Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attr.String("http.request.method", r.Method),
+				attr.String("http.route", route),
+				attr.String("url.path", r.URL.Path),
+			))
+		defer span.End()
+		if id, ok := services.RequestIDFrom(ctx); ok {
+			span.SetAttributes(attr.String("request.id", id))
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(attr.Int("http.response.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// decodeReceipt reads a receipt in a span
+func decodeReceipt(ctx context.Context, codec Codec, body io.Reader, receipt *models.Receipt) error {
+	_, span := services.Tracer().Start(ctx, "decode")
+	defer span.End()
+
+	err := codec.Decode(body, receipt)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"receipt-processor/models"
+	"receipt-processor/services"
+
+	"github.com/gorilla/mux"
+)
+
+type WebhookHandler struct {
+	dispatcher *services.WebhookDispatcher
+	settings   *services.SettingsFile
+}
+
+func NewWebhookHandler(dispatcher *services.WebhookDispatcher) *WebhookHandler {
+	return &WebhookHandler{
+		dispatcher: dispatcher,
+	}
+}
+
+// SetSettings saves the tenant's settings, including its subscriptions,
+// after every change
+func (h *WebhookHandler) SetSettings(settings *services.SettingsFile) {
+	h.settings = settings
+}
+
+func (h *WebhookHandler) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	subscriptions := h.dispatcher.Subscriptions()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+func (h *WebhookHandler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var subscription models.WebhookSubscription
+
+	err := json.NewDecoder(r.Body).Decode(&subscription)
+	if err != nil {
+		http.Error(w, "The subscription is invalid.", http.StatusBadRequest)
+		return
+	}
+
+	created, err := h.dispatcher.Subscribe(subscription)
+	if err != nil {
+		http.Error(w, "The subscription is invalid.", http.StatusBadRequest)
+		return
+	}
+	if !saveSettings(w, r, h.settings) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+func (h *WebhookHandler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if !h.dispatcher.Unsubscribe(id) {
+		http.Error(w, "No subscription found for that ID.", http.StatusNotFound)
+		return
+	}
+	if !saveSettings(w, r, h.settings) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListDeliveries returns the delivery log, optionally for one subscription
+func (h *WebhookHandler) ListDeliveries(w http.ResponseWriter, r *http.Request) {
+	subscriptionID := r.URL.Query().Get("subscription")
+
+	deliveries := []models.WebhookDelivery{}
+	for _, delivery := range h.dispatcher.Deliveries() {
+		if subscriptionID == "" || delivery.SubscriptionID == subscriptionID {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+func (h *WebhookHandler) ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	deadLetters := h.dispatcher.DeadLetters()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deadLetters)
+}
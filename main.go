@@ -1,25 +1,322 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+	_ "time/tzdata"
 
+	"receipt-processor/config"
 	"receipt-processor/handlers"
+	"receipt-processor/models"
 	"receipt-processor/services"
-
-	"github.com/gorilla/mux"
 )
 
 func main() {
-	receiptProcessor := services.NewReceiptProcessor()
-	receiptHandler := handlers.NewReceiptHandler(receiptProcessor)
+	cfg, printConfig, warnings, err := config.Load(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		os.Exit(2)
+	}
+	if printConfig {
+		if err := cfg.Write(os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	logHandler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: cfg.SlogLevel()})
+	slog.SetDefault(slog.New(services.NewLogHandler(logHandler)))
+	for _, warning := range warnings {
+		slog.Warn(warning)
+	}
+
+	shutdownTracing, err := services.SetupTracing(context.Background(), cfg.TraceExporter, cfg.TraceFile)
+	if err != nil {
+		fatal("failed to set up tracing", err)
+	}
+
+	var catalog *services.Catalog
+	if cfg.Catalog != "" {
+		var err error
+		catalog, err = services.LoadCatalog(cfg.Catalog)
+		if err != nil {
+			fatal("failed to load catalog", err)
+		}
+	}
+	var rates *services.ExchangeRates
+	if cfg.Rates != "" {
+		var err error
+		rates, err = services.LoadExchangeRates(cfg.Rates)
+		if err != nil {
+			fatal("failed to load exchange rates", err)
+		}
+	}
+	var eventLog *services.FileEventLog
+	history := make(map[string][]models.HistoryEvent)
+	if cfg.Storage == config.StorageFile {
+		var err error
+		eventLog, err = services.OpenEventLog(cfg.StoragePath)
+		if err != nil {
+			fatal("failed to open event log", err)
+		}
+		events, err := eventLog.Events()
+		if err != nil {
+			fatal("failed to read event log", err)
+		}
+		// Logs written before tenants were added belong to the default tenant
+		for _, event := range events {
+			tenant := event.Tenant
+			if tenant == "" {
+				tenant = services.DefaultTenant
+			}
+			history[tenant] = append(history[tenant], event)
+		}
+		slog.Info("read event log", "events", len(events))
+	}
+
+	metrics := services.NewMetrics()
+	// Load has checked the networks
+	webhookNetworks, _ := services.ParseNetworks(cfg.WebhookAllowedNetworks)
+
+	// Each tenant gets the shared catalog, rates and rules, then its own
+	// rules, then its receipts back from the event log
+	tenants := services.NewTenantRegistry(func(tenant *services.Tenant) error {
+		processor := tenant.Processor
+		processor.SetMetrics(metrics)
+		tenant.Webhooks.SetAllowedNetworks(webhookNetworks)
+		processor.SetRetailerNameMode(services.RetailerNameMode(cfg.RetailerNames))
+		if catalog != nil {
+			processor.SetCatalog(catalog)
+		}
+		if rates != nil {
+			processor.SetExchangeRates(rates)
+		}
+		if cfg.Rules != "" {
+			rules, err := services.LoadRules(cfg.Rules)
+			if err != nil {
+				return err
+			}
+			for _, rule := range rules {
+				processor.AddRule(rule)
+			}
+		}
+		if cfg.TenantRules != "" {
+			rules, err := services.LoadRules(filepath.Join(cfg.TenantRules, tenant.ID+".json"))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			for _, rule := range rules {
+				processor.AddRule(rule)
+			}
+		}
+		// Load saved settings before replaying, so that receipts are dated
+		// in their retailers' time zones
+		if cfg.SettingsDir != "" {
+			tenant.Settings = services.NewSettingsFile(filepath.Join(cfg.SettingsDir, tenant.ID+".json"), tenant)
+			if err := tenant.Settings.Load(); err != nil {
+				return err
+			}
+		}
+		if eventLog != nil {
+			if err := processor.Replay(history[tenant.ID]); err != nil {
+				return err
+			}
+			processor.SetEventLog(eventLog)
+		}
+		return nil
+	})
+	// Tenants with receipts in the event log stay allowed, so that their
+	// receipts can still be reached
+	allowed := slices.Clone(cfg.Tenants)
+	for id := range history {
+		allowed = append(allowed, id)
+	}
+	if err := tenants.SetAllowed(allowed); err != nil {
+		fatal("invalid tenants", err)
+	}
+
+	jobs := services.NewJobQueue(cfg.Workers, cfg.Queue)
+
+	var limiter *services.RateLimiter
+	if cfg.RateLimits != "" {
+		limits, err := services.LoadRateLimits(cfg.RateLimits)
+		if err != nil {
+			fatal("failed to load rate limits", err)
+		}
+		limiter = services.NewRateLimiter(limits)
+	}
+
+	var auth *handlers.Authenticator
+	var keysHandler *handlers.KeysHandler
+	if cfg.Keys != "" {
+		keys, err := services.OpenAPIKeyStore(cfg.Keys)
+		if err != nil {
+			fatal("failed to load API keys", err)
+		}
+		if len(keys.Keys()) == 0 {
+			created, err := keys.Create("admin", "", []string{models.ScopeAdmin}, nil)
+			if err != nil {
+				fatal("failed to create admin API key", err)
+			}
+			secretPath := cfg.Keys + ".admin"
+			if err := writeAdminSecret(secretPath, created.Secret); err != nil {
+				fatal("failed to save admin API key", err)
+			}
+			slog.Warn("created admin API key", "id", created.ID, "secret_file", secretPath)
+		}
+		auth = handlers.NewAuthenticator(keys)
+		keysHandler = handlers.NewKeysHandler(keys)
+	}
+	if cfg.JWKS != "" {
+		keys, err := services.NewJWKSource(cfg.JWKS, 0)
+		if err != nil {
+			fatal("failed to load JWKS", err)
+		}
+		tokens := services.NewTokenValidator(keys)
+		tokens.SetIssuer(cfg.JWTIssuer)
+		tokens.SetAudience(cfg.JWTAudience)
+		tokens.SetClaims(cfg.JWTTenantClaim, cfg.JWTCustomerClaim)
+		tokens.SetOperators(cfg.JWTOperators)
+		if auth == nil {
+			auth = handlers.NewAuthenticator(nil)
+		}
+		auth.SetTokenValidator(tokens)
+	}
+	if cfg.SigningKeys != "" {
+		verifier, err := services.LoadSigningKeys(cfg.SigningKeys)
+		if err != nil {
+			fatal("failed to load signing keys", err)
+		}
+		if auth == nil {
+			auth = handlers.NewAuthenticator(nil)
+		}
+		auth.SetRequestVerifier(verifier)
+	}
+
+	metricsHandler := handlers.NewMetricsHandler(metrics)
+	router := handlers.NewTenantRouter(tenants, func(tenant *services.Tenant) handlers.Handlers {
+		receiptHandler := handlers.NewReceiptHandler(tenant.Processor)
+		receiptHandler.SetJobQueue(jobs)
+		adminHandler := handlers.NewAdminHandler(tenant.Processor)
+		adminHandler.SetSettings(tenant.Settings)
+		webhookHandler := handlers.NewWebhookHandler(tenant.Webhooks)
+		webhookHandler.SetSettings(tenant.Settings)
+		return handlers.Handlers{
+			Receipts: receiptHandler,
+			Admin:    adminHandler,
+			Webhooks: webhookHandler,
+			Events:   handlers.NewEventsHandler(tenant.Events),
+			Keys:     keysHandler,
+			Metrics:  metricsHandler,
+			Limiter:  limiter,
+		}
+	}, auth)
+
+	health := handlers.NewHealthHandler()
+	if eventLog != nil {
+		health.AddCheck("store", eventLog.Err)
+	}
+
+	server := &http.Server{
+		Addr:         cfg.Listen,
+		Handler:      health.Middleware(handlers.RequestLogger(metricsHandler.Middleware(handlers.LimitByAddress(limiter, router)))),
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+	server.RegisterOnShutdown(tenants.CloseEvents)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		slog.Info("server starting", "addr", server.Addr, "tls", cfg.TLSCert != "")
+		var err error
+		if cfg.TLSCert != "" {
+			err = server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("server failed to start", err)
+		}
+	}()
+
+	// Load the tenants with receipts, replaying their history and loading
+	// their rules, while answering probes. Requests for a tenant wait until
+	// it is loaded.
+	if _, err := tenants.Tenant(services.DefaultTenant); err != nil {
+		fatal("failed to load default tenant", err)
+	}
+	for id := range history {
+		if _, err := tenants.Tenant(id); err != nil {
+			fatal("failed to load tenant", err, "tenant", id)
+		}
+	}
+	health.SetReady()
+	slog.Info("server ready")
+	<-ctx.Done()
+	// A second signal stops the server at once
+	stop()
 
-	router := mux.NewRouter()
-	router.HandleFunc("/receipts/process", receiptHandler.ProcessReceipt).Methods("POST")
-	router.HandleFunc("/receipts/{id}/points", receiptHandler.GetPoints).Methods("GET")
+	// Report not ready, stop taking requests and finish those in flight,
+	// then finish the receipts already queued and flush the event log
+	slog.Info("shutting down")
+	health.Drain()
+	time.Sleep(cfg.ShutdownDelay)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("server shutdown failed", "error", err)
+	}
+	if err := jobs.Shutdown(shutdownCtx); err != nil {
+		slog.Error("queued receipts were not all processed", "error", err)
+	}
+	if err := tenants.Close(shutdownCtx); err != nil {
+		slog.Error("webhooks were not all delivered", "error", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("spans were not all exported", "error", err)
+	}
+	if eventLog != nil {
+		if err := eventLog.Close(); err != nil {
+			slog.Error("failed to close event log", "error", err)
+		}
+	}
+}
 
-	log.Println("Server starting on port 8080...")
-	if err := http.ListenAndServe(":8080", router); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+// writeAdminSecret saves the secret of the admin key created at startup to a
+// file only the server's user can read, so that it never reaches the logs
+func writeAdminSecret(path, secret string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
 	}
-}
\ No newline at end of file
+	if _, err := fmt.Fprintln(file, secret); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// fatal logs an error that stops the server and exits
+func fatal(msg string, err error, args ...any) {
+	slog.Error(msg, append(args, "error", err)...)
+	os.Exit(1)
+}
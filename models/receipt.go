@@ -1,22 +1,311 @@
 package models
 
+import (
+	"encoding/json"
+	"encoding/xml"
+	"time"
+)
+
+// Item is a receipt line. Price is the line amount; when Quantity and
+// UnitPrice are given it must equal their product. Negative prices are
+// returns or line-level coupons.
 type Item struct {
-	ShortDescription string `json:"shortDescription"`
-	Price            string `json:"price"`
+	ShortDescription string `json:"shortDescription" xml:"shortDescription"`
+	Price            string `json:"price" xml:"price"`
+	Quantity         string `json:"quantity,omitempty" xml:"quantity,omitempty"`
+	UnitPrice        string `json:"unitPrice,omitempty" xml:"unitPrice,omitempty"`
+	SKU              string `json:"sku,omitempty" xml:"sku,omitempty"`
+	Category         string `json:"category,omitempty" xml:"category,omitempty"`
+}
+
+// Adjustment is a receipt-level discount or tax line. Amounts are positive.
+type Adjustment struct {
+	Description string `json:"description" xml:"description"`
+	Amount      string `json:"amount" xml:"amount"`
 }
 
+// Receipt is exchanged as JSON, XML or MessagePack. In XML, items, discounts
+// and taxes are wrapped in <items>, <discounts> and <taxes> elements.
 type Receipt struct {
-	Retailer     string  `json:"retailer"`
-	PurchaseDate string  `json:"purchaseDate"`
-	PurchaseTime string  `json:"purchaseTime"`
-	Items        []Item  `json:"items"`
-	Total        string  `json:"total"`
+	XMLName           xml.Name     `json:"-" xml:"receipt"`
+	CustomerID        string       `json:"customerId,omitempty" xml:"customerId,omitempty"`
+	Retailer          string       `json:"retailer" xml:"retailer"`
+	CanonicalRetailer string       `json:"canonicalRetailer,omitempty" xml:"canonicalRetailer,omitempty"`
+	PurchaseDate      string       `json:"purchaseDate" xml:"purchaseDate"`
+	PurchaseTime      string       `json:"purchaseTime" xml:"purchaseTime"`
+	Timezone          string       `json:"timezone,omitempty" xml:"timezone,omitempty"`
+	Items             []Item       `json:"items" xml:"items>item"`
+	Discounts         []Adjustment `json:"discounts,omitempty" xml:"discounts>discount,omitempty"`
+	Taxes             []Adjustment `json:"taxes,omitempty" xml:"taxes>tax,omitempty"`
+	Total             string       `json:"total" xml:"total"`
+	Currency          string       `json:"currency,omitempty" xml:"currency,omitempty"`
 }
 
 type ReceiptResponse struct {
-	ID string `json:"id"`
+	XMLName xml.Name `json:"-" xml:"receiptResponse"`
+	ID      string   `json:"id" xml:"id"`
+}
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// Job is a receipt accepted for asynchronous processing. ReceiptID is set
+// when it succeeds and Errors when it fails.
+type Job struct {
+	XMLName     xml.Name   `json:"-" xml:"job"`
+	ID          string     `json:"id" xml:"id"`
+	Tenant      string     `json:"-" xml:"-"`
+	Status      JobStatus  `json:"status" xml:"status"`
+	ReceiptID   string     `json:"receiptId,omitempty" xml:"receiptId,omitempty"`
+	Errors      []string   `json:"errors,omitempty" xml:"errors>error,omitempty"`
+	SubmittedAt time.Time  `json:"submittedAt" xml:"submittedAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty" xml:"completedAt,omitempty"`
+}
+
+const (
+	EventReceiptProcessed = "receipt.processed"
+	EventPointsAdjusted   = "points.adjusted"
+)
+
+// ReceiptEvent reports a change to a stored receipt. IDs increase by one
+// with each event for a tenant. PreviousPoints is set only when points are
+// adjusted, even if they were zero.
+type ReceiptEvent struct {
+	ID             int64     `json:"id"`
+	Type           string    `json:"type"`
+	Time           time.Time `json:"time"`
+	Tenant         string    `json:"tenant,omitempty"`
+	ReceiptID      string    `json:"receiptId"`
+	CustomerID     string    `json:"customerId,omitempty"`
+	Retailer       string    `json:"retailer"`
+	Points         int64     `json:"points"`
+	PreviousPoints *int64    `json:"previousPoints,omitempty"`
+}
+
+const (
+	HistoryCreated  = "created"
+	HistoryUpdated  = "updated"
+	HistoryRescored = "rescored"
+	HistoryDeleted  = "deleted"
+)
+
+// HistoryEvent is an immutable record of a change to a receipt. Created and
+// updated events carry the whole receipt and every event but a deletion
+// carries the resulting breakdown, so replaying them in sequence rebuilds
+// the store. Diff lists the top-level fields that changed. Day is the
+// store-local purchase date the receipt's points count towards for the daily
+// cap, which depends on the retailer's time zone at the time.
+type HistoryEvent struct {
+	Sequence  int64            `json:"sequence"`
+	Tenant    string           `json:"tenant,omitempty"`
+	ReceiptID string           `json:"receiptId"`
+	Type      string           `json:"type"`
+	Actor     string           `json:"actor"`
+	Time      time.Time        `json:"time"`
+	Receipt   *Receipt         `json:"receipt,omitempty"`
+	Breakdown *PointsBreakdown `json:"breakdown,omitempty"`
+	Diff      []FieldChange    `json:"diff,omitempty"`
+	Day       string           `json:"day,omitempty"`
+}
+
+// FieldChange holds a field's JSON value before and after a change. A
+// missing value means the field was unset.
+type FieldChange struct {
+	Field string          `json:"field"`
+	Old   json.RawMessage `json:"old,omitempty"`
+	New   json.RawMessage `json:"new,omitempty"`
+}
+
+const (
+	ScopeSubmit  = "submit"
+	ScopeRead    = "read"
+	ScopeMetrics = "metrics"
+	ScopeAdmin   = "admin"
+)
+
+// APIKey identifies a client. Only a hash of the key's secret is stored, and
+// it is never returned. A key with ExpiresAt set stops working at that time,
+// and a key with a Tenant can only be used for that tenant.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Client    string     `json:"client"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Scopes    []string   `json:"scopes"`
+	Hash      string     `json:"hash,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// CreatedAPIKey is returned once when a key is created, with its secret
+type CreatedAPIKey struct {
+	APIKey
+	Secret string `json:"secret"`
+}
+
+// SigningKey is a secret shared with a POS terminal, which signs its
+// submissions with it instead of sending a credential
+type SigningKey struct {
+	ID     string `json:"id"`
+	Client string `json:"client"`
+	Tenant string `json:"tenant,omitempty"`
+	Secret string `json:"secret"`
+}
+
+// WebhookSubscription sends events of the listed types, or all events if
+// none are listed, to URL. The secret signs each payload and is never
+// returned once set.
+type WebhookSubscription struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events,omitempty"`
+	Secret string   `json:"secret,omitempty"`
+}
+
+// WebhookDelivery is one attempt to deliver an event. Retries of the same
+// delivery share its ID.
+type WebhookDelivery struct {
+	ID             string    `json:"id"`
+	SubscriptionID string    `json:"subscriptionId"`
+	EventID        int64     `json:"eventId"`
+	EventType      string    `json:"eventType"`
+	Attempt        int       `json:"attempt"`
+	StatusCode     int       `json:"statusCode,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Time           time.Time `json:"time"`
+}
+
+// DeadLetter is an event that could not be delivered after every retry
+type DeadLetter struct {
+	DeliveryID     string       `json:"deliveryId"`
+	SubscriptionID string       `json:"subscriptionId"`
+	URL            string       `json:"url"`
+	Event          ReceiptEvent `json:"event"`
+	Attempts       int          `json:"attempts"`
+	LastError      string       `json:"lastError"`
+	Time           time.Time    `json:"time"`
+}
+
+// ParsedReceiptResponse is returned when a receipt is extracted from another
+// format, with a 0-1 confidence score for each extracted field
+type ParsedReceiptResponse struct {
+	ID         string             `json:"id"`
+	Receipt    Receipt            `json:"receipt"`
+	Confidence map[string]float64 `json:"confidence"`
+}
+
+// ImportResponse reports the receipts created from a bulk import and the
+// rows that were rejected
+type ImportResponse struct {
+	Imported []ImportedReceipt `json:"imported"`
+	Errors   []ImportError     `json:"errors"`
+}
+
+// ImportedReceipt maps the receipt key used in the import file to the new
+// receipt ID
+type ImportedReceipt struct {
+	Key string `json:"key"`
+	ID  string `json:"id"`
+}
+
+// ImportError is a problem with a row of an import file. Row is the 1-based
+// line number, counting the header.
+type ImportError struct {
+	Row   int    `json:"row"`
+	Key   string `json:"key,omitempty"`
+	Error string `json:"error"`
 }
 
 type PointsResponse struct {
-	Points int64 `json:"points"`
-}
\ No newline at end of file
+	XMLName xml.Name `json:"-" xml:"pointsResponse"`
+	Points  int64    `json:"points" xml:"points"`
+}
+
+// ItemPoints is the share of a rule's points earned by a single item, before
+// caps
+type ItemPoints struct {
+	Index       int    `json:"index"`
+	Description string `json:"description"`
+	Category    string `json:"category,omitempty"`
+	Points      int64  `json:"points"`
+}
+
+type RulePoints struct {
+	Rule     string       `json:"rule"`
+	Points   int64        `json:"points"`
+	Uncapped int64        `json:"uncapped"`
+	Items    []ItemPoints `json:"items,omitempty"`
+}
+
+// Conversion records the exchange rate used to score a receipt in another
+// currency: one unit of From is worth Rate units of To.
+type Conversion struct {
+	From         string  `json:"from"`
+	To           string  `json:"to"`
+	Rate         float64 `json:"rate"`
+	Effective    string  `json:"effective"`
+	RatesVersion string  `json:"ratesVersion"`
+}
+
+// PointsBreakdown records the points each rule awarded and how much was
+// removed by the per-receipt and per-customer daily caps.
+type PointsBreakdown struct {
+	Conversion    *Conversion  `json:"conversion,omitempty"`
+	Rules         []RulePoints `json:"rules"`
+	Uncapped      int64        `json:"uncapped"`
+	ReceiptCapped int64        `json:"receiptCapped"`
+	DailyCapped   int64        `json:"dailyCapped"`
+	Points        int64        `json:"points"`
+}
+
+type RetailerAlias struct {
+	Alias     string `json:"alias"`
+	Canonical string `json:"canonical"`
+}
+
+// RuleDefinition describes a custom rule: either an expression, or points
+// for items in a category when Category is set.
+type RuleDefinition struct {
+	Name              string `json:"name"`
+	Expression        string `json:"expression,omitempty"`
+	MaxSteps          int    `json:"maxSteps,omitempty"`
+	Category          string `json:"category,omitempty"`
+	PointsPerItem     int64  `json:"pointsPerItem,omitempty"`
+	PointsPerCategory int64  `json:"pointsPerCategory,omitempty"`
+}
+
+type RetailerTimezone struct {
+	Retailer string `json:"retailer"`
+	Timezone string `json:"timezone"`
+}
+
+type CatalogProduct struct {
+	SKU         string `json:"sku,omitempty"`
+	Description string `json:"description,omitempty"`
+	Category    string `json:"category"`
+}
+
+// ExchangeRateTable is the file format for exchange rates. Each set of rates
+// applies from its effective date until the next one.
+type ExchangeRateTable struct {
+	Version string             `json:"version"`
+	Base    string             `json:"base"`
+	Rates   []EffectiveRateSet `json:"rates"`
+}
+
+type EffectiveRateSet struct {
+	Effective string             `json:"effective"`
+	Rates     map[string]float64 `json:"rates"`
+}
+
+// HealthResponse reports whether the server is live or ready and, for
+// readiness, the outcome of each check
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
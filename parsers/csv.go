@@ -0,0 +1,220 @@
+package parsers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"receipt-processor/models"
+)
+
+// CSVColumns is the spreadsheet layout for receipts: one row per item,
+// discount or tax line, with the receipt fields repeated on each row and
+// rows grouped by the receipt key. Only the first row of a receipt needs
+// the receipt fields; later rows may leave them blank.
+var CSVColumns = []string{
+	"receipt", "customerId", "retailer", "purchaseDate", "purchaseTime", "timezone", "currency", "total",
+	"type", "description", "price", "quantity", "unitPrice", "sku", "category",
+}
+
+var requiredCSVColumns = []string{"receipt", "retailer", "purchaseDate", "purchaseTime", "total", "description", "price"}
+
+// Line types in the type column. Blank means an item.
+const (
+	CSVLineItem     = "item"
+	CSVLineDiscount = "discount"
+	CSVLineTax      = "tax"
+)
+
+// CSVReceipt is a receipt read from a CSV file. Row is the line number of
+// its first row.
+type CSVReceipt struct {
+	Key     string
+	Row     int
+	Receipt models.Receipt
+}
+
+type csvGroup struct {
+	CSVReceipt
+	failed bool
+}
+
+// ParseCSV reads receipts in the CSV layout. Columns are matched by header
+// name in any order and unknown columns are ignored. Problems with
+// individual rows are returned as import errors and the receipts they
+// belong to are left out. An error is returned if the file itself cannot be
+// read, or if a malformed row's receipt key cannot be, as the receipt it
+// belongs to would otherwise be imported without it.
+func ParseCSV(r io.Reader) ([]CSVReceipt, []models.ImportError, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, errors.New("missing header row")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		for _, column := range CSVColumns {
+			if strings.EqualFold(strings.TrimSpace(name), column) {
+				columns[column] = i
+			}
+		}
+	}
+	for _, column := range requiredCSVColumns {
+		if _, ok := columns[column]; !ok {
+			return nil, nil, fmt.Errorf("missing %s column", column)
+		}
+	}
+
+	var groups []*csvGroup
+	byKey := make(map[string]*csvGroup)
+	var rowErrors []models.ImportError
+
+	group := func(key string, row int) *csvGroup {
+		g, ok := byKey[key]
+		if !ok {
+			g = &csvGroup{CSVReceipt: CSVReceipt{Key: key, Row: row}}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		return g
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, nil, fmt.Errorf("row %d: %w", parseErr.StartLine, parseErr.Err)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		row, _ := reader.FieldPos(0)
+		if len(record) != len(header) {
+			problem := fmt.Sprintf("expected %d fields, got %d", len(header), len(record))
+			var key string
+			if i := columns["receipt"]; i < len(record) {
+				key = strings.TrimSpace(record[i])
+			}
+			if key == "" {
+				return nil, nil, fmt.Errorf("row %d: %s and no receipt key", row, problem)
+			}
+			rowErrors = append(rowErrors, models.ImportError{Row: row, Key: key, Error: problem})
+			group(key, row).failed = true
+			continue
+		}
+
+		field := func(column string) string {
+			if i, ok := columns[column]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		key := field("receipt")
+		if key == "" {
+			rowErrors = append(rowErrors, models.ImportError{Row: row, Error: "missing receipt key"})
+			continue
+		}
+		g := group(key, row)
+		if err := g.add(field); err != nil {
+			rowErrors = append(rowErrors, models.ImportError{Row: row, Key: key, Error: err.Error()})
+			g.failed = true
+		}
+	}
+
+	var receipts []CSVReceipt
+	for _, group := range groups {
+		if !group.failed {
+			receipts = append(receipts, group.CSVReceipt)
+		}
+	}
+	return receipts, rowErrors, nil
+}
+
+func (g *csvGroup) add(field func(string) string) error {
+	for _, f := range []struct {
+		column string
+		value  *string
+	}{
+		{"customerId", &g.Receipt.CustomerID},
+		{"retailer", &g.Receipt.Retailer},
+		{"purchaseDate", &g.Receipt.PurchaseDate},
+		{"purchaseTime", &g.Receipt.PurchaseTime},
+		{"timezone", &g.Receipt.Timezone},
+		{"currency", &g.Receipt.Currency},
+		{"total", &g.Receipt.Total},
+	} {
+		value := field(f.column)
+		switch {
+		case value == "":
+		case *f.value == "":
+			*f.value = value
+		case *f.value != value:
+			return fmt.Errorf("%s %q differs from %q on an earlier row", f.column, value, *f.value)
+		}
+	}
+
+	description, price := field("description"), field("price")
+	if description == "" {
+		return errors.New("missing description")
+	}
+	if price == "" {
+		return errors.New("missing price")
+	}
+
+	switch lineType := strings.ToLower(field("type")); lineType {
+	case "", CSVLineItem:
+		g.Receipt.Items = append(g.Receipt.Items, models.Item{
+			ShortDescription: description,
+			Price:            price,
+			Quantity:         field("quantity"),
+			UnitPrice:        field("unitPrice"),
+			SKU:              field("sku"),
+			Category:         field("category"),
+		})
+	case CSVLineDiscount:
+		g.Receipt.Discounts = append(g.Receipt.Discounts, models.Adjustment{Description: description, Amount: price})
+	case CSVLineTax:
+		g.Receipt.Taxes = append(g.Receipt.Taxes, models.Adjustment{Description: description, Amount: price})
+	default:
+		return fmt.Errorf("unknown line type %q", lineType)
+	}
+	return nil
+}
+
+// CSVRecords returns the rows for a receipt in the CSVColumns layout:
+// items, then discounts, then taxes
+func CSVRecords(key string, receipt models.Receipt) [][]string {
+	line := func(lineType, description, price, quantity, unitPrice, sku, category string) []string {
+		return []string{
+			key, receipt.CustomerID, receipt.Retailer, receipt.PurchaseDate, receipt.PurchaseTime,
+			receipt.Timezone, receipt.Currency, receipt.Total,
+			lineType, description, price, quantity, unitPrice, sku, category,
+		}
+	}
+
+	var records [][]string
+	for _, item := range receipt.Items {
+		records = append(records, line(CSVLineItem, item.ShortDescription, item.Price, item.Quantity, item.UnitPrice, item.SKU, item.Category))
+	}
+	for _, discount := range receipt.Discounts {
+		records = append(records, line(CSVLineDiscount, discount.Description, discount.Amount, "", "", "", ""))
+	}
+	for _, tax := range receipt.Taxes {
+		records = append(records, line(CSVLineTax, tax.Description, tax.Amount, "", "", "", ""))
+	}
+	return records
+}
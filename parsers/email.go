@@ -0,0 +1,370 @@
+package parsers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"receipt-processor/models"
+)
+
+// ErrNoBody is returned when a message has no text or HTML part
+var ErrNoBody = errors.New("no text or HTML body found")
+
+// emailTemplate recognizes e-receipts from a retailer by the sender's domain.
+// Its rewrites turn the retailer's own wording into the layout ParseText
+// reads, e.g. "Order Total:" into "TOTAL"; a rewrite to "" drops the line.
+type emailTemplate struct {
+	retailer string
+	domains  []string
+	rewrites []lineRewrite
+}
+
+type lineRewrite struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+var emailTemplates = []emailTemplate{
+	{
+		retailer: "Target",
+		domains:  []string{"target.com"},
+		rewrites: []lineRewrite{
+			{regexp.MustCompile(`(?i)^order total\b:?`), "TOTAL"},
+			{regexp.MustCompile(`(?i)^estimated tax\b:?`), "TAX"},
+		},
+	},
+	{
+		retailer: "Walgreens",
+		domains:  []string{"walgreens.com"},
+	},
+	{
+		retailer: "Amazon",
+		domains:  []string{"amazon.com"},
+		rewrites: []lineRewrite{
+			{regexp.MustCompile(`(?i)^order total:`), "TOTAL"},
+			{regexp.MustCompile(`(?i)^estimated tax to be collected:`), "TAX"},
+			{regexp.MustCompile(`(?i)^promotion applied:`), "PROMO DISCOUNT"},
+			{regexp.MustCompile(`(?i)^item\(s\) subtotal:`), "SUBTOTAL"},
+			{regexp.MustCompile(`(?i)^(shipping|total before tax)\b.*`), ""},
+			{regexp.MustCompile(`\(Qty (\d+) @ \$?(\d+\.\d{2})\)`), "$1 @ $2"},
+		},
+	},
+}
+
+var (
+	htmlDropRegex  = regexp.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)\s*>`)
+	htmlLineRegex  = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|tr|li|h[1-6]|table)\s*>`)
+	htmlCellRegex  = regexp.MustCompile(`(?i)</t[dh]\s*>`)
+	htmlTagRegex   = regexp.MustCompile(`<[^>]*>`)
+	htmlSpaceRegex = regexp.MustCompile(`[ \t\r\f\v\x{a0}]+`)
+
+	// The line Gmail, Apple Mail and Outlook put before a message forwarded
+	// inline, and the original headers they copy after it
+	forwardMarkerRegex = regexp.MustCompile(`(?im)^>?[ \t]*(-+[ \t]*forwarded message[ \t]*-+|begin forwarded message:|-+[ \t]*original message[ \t]*-+)[ \t]*$`)
+	forwardHeaderRegex = regexp.MustCompile(`(?i)^(from|to|cc|date|sent|subject|reply-to):\s*(.*)$`)
+	quoteRegex         = regexp.MustCompile(`(?m)^> ?`)
+)
+
+// forwardedDateLayouts are how mail clients write the original message's
+// date when forwarding inline, besides RFC 5322 dates
+var forwardedDateLayouts = []string{
+	"Mon, Jan 2, 2006 at 3:04 PM",
+	"January 2, 2006 at 3:04:05 PM",
+	"Monday, January 2, 2006 3:04 PM",
+}
+
+// messageBody holds the parts of a message a receipt is read from
+type messageBody struct {
+	plain string
+	html  string
+	// attached is the first message/rfc822 part, as when a receipt is
+	// forwarded as an attachment
+	attached []byte
+}
+
+// ParseEmail extracts a receipt from a raw RFC 822 message. The text body is
+// preferred, falling back to the HTML body when the text has no items.
+// Messages from a known retailer are read with its template; otherwise the
+// sender's display name is taken as the retailer. The message's Date header
+// fills in a purchase date or time the body does not give.
+//
+// A receipt forwarded by a customer is read from the original message: an
+// attached message/rfc822 part, or the message quoted after a forwarding
+// line, whose copied From and Date headers are used instead.
+func ParseEmail(r io.Reader) (models.Receipt, Confidence, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return models.Receipt{}, nil, err
+	}
+
+	body, err := readBody(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return models.Receipt{}, nil, err
+	}
+	if body.attached != nil {
+		return ParseEmail(bytes.NewReader(body.attached))
+	}
+
+	header := msg.Header
+	bodies := []string{body.plain, htmlToText(body.html)}
+	forwarded := false
+	for i := range bodies {
+		if original, rest, ok := unforward(bodies[i]); ok {
+			if !forwarded {
+				header = original
+				forwarded = true
+			}
+			bodies[i] = rest
+		}
+	}
+
+	from, _ := mail.ParseAddress(header.Get("From"))
+	template := findTemplate(from)
+
+	var receipt models.Receipt
+	var confidence Confidence
+	err = ErrNoBody
+	for _, body := range bodies {
+		if strings.TrimSpace(body) == "" {
+			continue
+		}
+		receipt, confidence, err = ParseText(template.rewrite(body))
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return receipt, confidence, err
+	}
+
+	switch {
+	case template != nil:
+		receipt.Retailer = template.retailer
+		confidence["retailer"] = 0.95
+	case from != nil && from.Name != "":
+		if name := strings.Join(strings.Fields(retailerCleanRegex.ReplaceAllString(from.Name, "")), " "); name != "" {
+			receipt.Retailer = name
+			confidence["retailer"] = 0.7
+		}
+	}
+
+	if sent, zoned, err := messageDate(header, forwarded); err == nil {
+		if receipt.PurchaseDate == "" && receipt.PurchaseTime == "" && zoned {
+			receipt.Timezone = sent.Format("-07:00")
+		}
+		if receipt.PurchaseDate == "" {
+			receipt.PurchaseDate = sent.Format("2006-01-02")
+			confidence["purchaseDate"] = 0.7
+		}
+		if receipt.PurchaseTime == "" {
+			receipt.PurchaseTime = sent.Format("15:04")
+			confidence["purchaseTime"] = 0.5
+		}
+	}
+
+	return receipt, confidence, nil
+}
+
+// unforward finds a message forwarded inline in body, returning the headers
+// copied from it and its body without quoting
+func unforward(body string) (mail.Header, string, bool) {
+	marker := forwardMarkerRegex.FindStringIndex(body)
+	if marker == nil {
+		return nil, body, false
+	}
+
+	header := make(mail.Header)
+	lines := strings.Split(quoteRegex.ReplaceAllString(body[marker[1]:], ""), "\n")
+	i := 0
+	for ; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" && len(header) == 0 {
+			// Apple Mail leaves a blank line before the headers
+			continue
+		}
+		match := forwardHeaderRegex.FindStringSubmatch(line)
+		if match == nil {
+			break
+		}
+		key := textproto.CanonicalMIMEHeaderKey(match[1])
+		header[key] = append(header[key], strings.TrimSpace(match[2]))
+	}
+	return header, strings.Join(lines[i:], "\n"), true
+}
+
+// messageDate returns when a message was sent, and whether the date has a
+// time zone. Dates copied into a forwarded message may be written for people
+// and without a zone.
+func messageDate(header mail.Header, forwarded bool) (time.Time, bool, error) {
+	sent, err := header.Date()
+	if err == nil || !forwarded {
+		return sent, true, err
+	}
+	value := header.Get("Date")
+	for _, layout := range forwardedDateLayouts {
+		if sent, err := time.Parse(layout, value); err == nil {
+			return sent, false, nil
+		}
+		// Apple Mail ends the date with a zone abbreviation, which does not
+		// say which zone it is reliably, so it is dropped
+		if i := strings.LastIndex(value, " "); i > 0 {
+			if sent, err := time.Parse(layout, value[:i]); err == nil {
+				return sent, false, nil
+			}
+		}
+	}
+	return time.Time{}, false, err
+}
+
+func findTemplate(from *mail.Address) *emailTemplate {
+	if from == nil {
+		return nil
+	}
+	at := strings.LastIndex(from.Address, "@")
+	domain := strings.ToLower(from.Address[at+1:])
+
+	for i, template := range emailTemplates {
+		for _, d := range template.domains {
+			if domain == d || strings.HasSuffix(domain, "."+d) {
+				return &emailTemplates[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (t *emailTemplate) rewrite(body string) string {
+	if t == nil || len(t.rewrites) == 0 {
+		return body
+	}
+
+	var lines []string
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		for _, rw := range t.rewrites {
+			line = rw.pattern.ReplaceAllString(line, rw.replacement)
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// readBody returns the first text/plain and text/html parts of a message,
+// decoded to UTF-8, and its first attached message. Other attachments are
+// skipped.
+func readBody(contentType, encoding string, body io.Reader) (messageBody, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// RFC 2045: messages without a valid type are plain US-ASCII text
+		mediaType, params = "text/plain", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var result messageBody
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			// NextPart decodes quoted-printable parts itself
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return messageBody{}, err
+			}
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if disposition, _, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition")); disposition == "attachment" && partType != "message/rfc822" {
+				continue
+			}
+
+			p, err := readBody(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil {
+				return messageBody{}, err
+			}
+			if result.plain == "" {
+				result.plain = p.plain
+			}
+			if result.html == "" {
+				result.html = p.html
+			}
+			if result.attached == nil {
+				result.attached = p.attached
+			}
+		}
+		return result, nil
+	}
+
+	if mediaType != "text/plain" && mediaType != "text/html" && mediaType != "message/rfc822" {
+		return messageBody{}, nil
+	}
+
+	var decoded io.Reader = body
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		decoded = quotedprintable.NewReader(body)
+	case "base64":
+		decoded = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	data, err := io.ReadAll(decoded)
+	if err != nil {
+		return messageBody{}, err
+	}
+
+	switch mediaType {
+	case "message/rfc822":
+		return messageBody{attached: data}, nil
+	case "text/html":
+		return messageBody{html: decodeCharset(data, params["charset"])}, nil
+	}
+	return messageBody{plain: decodeCharset(data, params["charset"])}, nil
+}
+
+// decodeCharset converts the Latin-1 family to UTF-8; other charsets are
+// assumed to be UTF-8 compatible
+func decodeCharset(data []byte, charset string) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252", "cp1252":
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	return string(bytes.ToValidUTF8(data, []byte("�")))
+}
+
+// htmlToText renders an HTML body as lines of text: block elements and table
+// rows end lines, and table cells are separated by spaces so that amounts in
+// the last column end up at the end of the line
+func htmlToText(body string) string {
+	if body == "" {
+		return ""
+	}
+
+	body = htmlDropRegex.ReplaceAllString(body, "")
+	body = strings.NewReplacer("\r", " ", "\n", " ").Replace(body)
+	body = htmlLineRegex.ReplaceAllString(body, "\n")
+	body = htmlCellRegex.ReplaceAllString(body, "  ")
+	body = htmlTagRegex.ReplaceAllString(body, "")
+	body = html.UnescapeString(body)
+
+	var lines []string
+	for _, line := range strings.Split(body, "\n") {
+		if line = strings.TrimSpace(htmlSpaceRegex.ReplaceAllString(line, " ")); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,252 @@
+package parsers
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"receipt-processor/models"
+	"receipt-processor/utils"
+)
+
+// Confidence scores are between 0 and 1, keyed by receipt field name
+type Confidence map[string]float64
+
+// ErrNoItems is returned when no item lines could be found
+var ErrNoItems = errors.New("no item lines found")
+
+var (
+	// Amount at the end of a line, optionally with a currency symbol or a
+	// trailing tax flag such as "T" or "N"
+	trailingAmountRegex = regexp.MustCompile(`^(.*?)\s+(-?)\$?(-?\d+\.\d{2})(-?)(?:\s+[A-Z])?$`)
+	quantityRegex       = regexp.MustCompile(`^(.*?)\s+(\d+(?:\.\d{1,3})?)\s*(?:@|[xX])\s*\$?(\d+\.\d{2})(?:\s*(?:ea|EA|/ea|/lb|lb))?$`)
+	storeNumberRegex    = regexp.MustCompile(`#\s*\d+`)
+	retailerCleanRegex  = regexp.MustCompile(`[^\w\s\-&]+`)
+
+	isoDateRegex     = regexp.MustCompile(`\b(\d{4})-(\d{2})-(\d{2})\b`)
+	slashDateRegex   = regexp.MustCompile(`\b(\d{1,2})/(\d{1,2})/(\d{2}|\d{4})\b`)
+	monthDateRegex   = regexp.MustCompile(`(?i)\b(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)[a-z]*\.?\s+(\d{1,2}),?\s+(\d{4})\b`)
+	clockRegex       = regexp.MustCompile(`(?i)\b(\d{1,2}):(\d{2})(?::\d{2})?\s*([ap]\.?m\.?)?`)
+	totalLineRegex   = regexp.MustCompile(`(?i)^((grand|order)\s+)?total\b|^amount\s+due\b|^balance\s+due\b`)
+	taxLineRegex     = regexp.MustCompile(`(?i)^((sales|total)\s+)?tax\b|^vat\b|^gst\b|^hst\b`)
+	discountRegex    = regexp.MustCompile(`(?i)\b(coupon|discount|savings|promo)\b`)
+	ignoredLineRegex = regexp.MustCompile(`(?i)^(sub\s*-?\s*total|change|cash|tender|visa|mastercard|amex|debit|credit|card|balance|items?\s+sold|you\s+saved|points)\b`)
+
+	// Totals and subtotals that are not the receipt's total, e.g. "Item(s)
+	// Subtotal" or "Total before tax", are never items
+	anyTotalRegex = regexp.MustCompile(`(?i)\b(sub\s*-?\s*)?total\b`)
+)
+
+var months = map[string]time.Month{
+	"jan": time.January, "feb": time.February, "mar": time.March, "apr": time.April,
+	"may": time.May, "jun": time.June, "jul": time.July, "aug": time.August,
+	"sep": time.September, "oct": time.October, "nov": time.November, "dec": time.December,
+}
+
+// ParseText extracts a receipt from the plain text printed on it: the
+// retailer on the first line, a date/time line, item lines with the price
+// right-aligned, and a TOTAL line. Tax lines become taxes and negative
+// coupon or discount lines become discounts. Confidence reports how sure
+// the parser is of each field.
+func ParseText(text string) (models.Receipt, Confidence, error) {
+	var receipt models.Receipt
+	confidence := Confidence{
+		"retailer":     0,
+		"purchaseDate": 0,
+		"purchaseTime": 0,
+		"items":        0,
+		"total":        0,
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	totalFound := false
+	dateLine := -1
+	firstClock := ""
+	for i, line := range lines {
+		if receipt.PurchaseDate == "" {
+			if date, ok := parseDate(line); ok {
+				receipt.PurchaseDate = date
+				confidence["purchaseDate"] = 0.9
+				dateLine = i
+			}
+		}
+		if firstClock == "" {
+			firstClock, _ = parseClock(line)
+		}
+
+		match := trailingAmountRegex.FindStringSubmatch(line)
+		if match == nil || i == dateLine {
+			continue
+		}
+		label := strings.TrimSpace(match[1])
+		amount := match[3]
+		negative := match[2] == "-" || match[4] == "-" || strings.HasPrefix(amount, "-")
+		amount = strings.TrimPrefix(amount, "-")
+
+		switch {
+		case taxLineRegex.MatchString(label):
+			if !totalFound {
+				receipt.Taxes = append(receipt.Taxes, models.Adjustment{Description: label, Amount: amount})
+			}
+		case totalLineRegex.MatchString(label):
+			if !totalFound {
+				receipt.Total = amount
+				totalFound = true
+			}
+		case ignoredLineRegex.MatchString(label), anyTotalRegex.MatchString(label):
+		case negative && discountRegex.MatchString(label):
+			receipt.Discounts = append(receipt.Discounts, models.Adjustment{Description: label, Amount: amount})
+		case totalFound:
+			// Anything priced after the total is payment or change
+		default:
+			item := models.Item{ShortDescription: label, Price: amount}
+			if negative {
+				item.Price = "-" + amount
+			}
+			if qty := quantityRegex.FindStringSubmatch(label); qty != nil {
+				item.ShortDescription = strings.TrimSpace(qty[1])
+				item.Quantity = qty[2]
+				item.UnitPrice = qty[3]
+			}
+			receipt.Items = append(receipt.Items, item)
+		}
+	}
+
+	// Prefer a time printed next to the date over store hours and the like
+	if dateLine >= 0 {
+		if clock, ok := parseClock(lines[dateLine]); ok {
+			receipt.PurchaseTime = clock
+			confidence["purchaseTime"] = 0.9
+		}
+	}
+	if receipt.PurchaseTime == "" && firstClock != "" {
+		receipt.PurchaseTime = firstClock
+		confidence["purchaseTime"] = 0.6
+	}
+
+	if len(receipt.Items) == 0 {
+		return receipt, confidence, ErrNoItems
+	}
+	confidence["items"] = 0.8
+
+	receipt.Retailer, confidence["retailer"] = parseRetailer(lines)
+
+	// Cross-check the total against the lines
+	var sum int64 = 0
+	for _, item := range receipt.Items {
+		price, _ := utils.ParseMinorUnits(item.Price, 2)
+		sum += price
+	}
+	for _, discount := range receipt.Discounts {
+		amount, _ := utils.ParseMinorUnits(discount.Amount, 2)
+		sum -= amount
+	}
+	for _, tax := range receipt.Taxes {
+		amount, _ := utils.ParseMinorUnits(tax.Amount, 2)
+		sum += amount
+	}
+
+	switch total, _ := utils.ParseMinorUnits(receipt.Total, 2); {
+	case !totalFound:
+		receipt.Total = utils.FormatMinorUnits(sum, 2)
+		confidence["total"] = 0.3
+	case total == sum:
+		confidence["total"] = 0.95
+		confidence["items"] = 0.95
+	default:
+		confidence["total"] = 0.6
+		confidence["items"] = 0.5
+	}
+
+	return receipt, confidence, nil
+}
+
+// The retailer is taken from the first line that has letters and is not a
+// date or price line. Store numbers and characters the receipt validation
+// rejects are dropped.
+func parseRetailer(lines []string) (string, float64) {
+	for i, line := range lines {
+		if trailingAmountRegex.MatchString(line) || isoDateRegex.MatchString(line) ||
+			slashDateRegex.MatchString(line) || !strings.ContainsAny(strings.ToLower(line), "abcdefghijklmnopqrstuvwxyz") {
+			continue
+		}
+
+		cleaned := retailerCleanRegex.ReplaceAllString(storeNumberRegex.ReplaceAllString(line, ""), "")
+		retailer := strings.Join(strings.Fields(cleaned), " ")
+		if retailer == "" {
+			continue
+		}
+
+		confidence := 0.9
+		if i > 0 {
+			confidence = 0.6
+		}
+		if retailer != line {
+			confidence -= 0.1
+		}
+		return retailer, confidence
+	}
+	return "", 0
+}
+
+func parseDate(line string) (string, bool) {
+	var year, month, day int
+
+	if match := isoDateRegex.FindStringSubmatch(line); match != nil {
+		year, _ = strconv.Atoi(match[1])
+		month, _ = strconv.Atoi(match[2])
+		day, _ = strconv.Atoi(match[3])
+	} else if match := slashDateRegex.FindStringSubmatch(line); match != nil {
+		// US layout: month first
+		month, _ = strconv.Atoi(match[1])
+		day, _ = strconv.Atoi(match[2])
+		year, _ = strconv.Atoi(match[3])
+		if year < 100 {
+			year += 2000
+		}
+	} else if match := monthDateRegex.FindStringSubmatch(line); match != nil {
+		month = int(months[strings.ToLower(match[1])])
+		day, _ = strconv.Atoi(match[2])
+		year, _ = strconv.Atoi(match[3])
+	} else {
+		return "", false
+	}
+
+	date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if date.Year() != year || int(date.Month()) != month || date.Day() != day {
+		return "", false
+	}
+	return date.Format("2006-01-02"), true
+}
+
+func parseClock(line string) (string, bool) {
+	match := clockRegex.FindStringSubmatch(line)
+	if match == nil {
+		return "", false
+	}
+
+	hour, _ := strconv.Atoi(match[1])
+	minute, _ := strconv.Atoi(match[2])
+	meridiem := strings.ToLower(strings.ReplaceAll(match[3], ".", ""))
+	switch {
+	case meridiem != "" && (hour < 1 || hour > 12):
+		return "", false
+	case meridiem == "pm" && hour != 12:
+		hour += 12
+	case meridiem == "am" && hour == 12:
+		hour = 0
+	}
+	if hour > 23 || minute > 59 {
+		return "", false
+	}
+
+	return time.Date(0, 1, 1, hour, minute, 0, 0, time.UTC).Format("15:04"), true
+}
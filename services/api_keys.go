@@ -0,0 +1,235 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"receipt-processor/models"
+
+	"github.com/google/uuid"
+)
+
+const apiKeyPrefix = "rp_"
+
+var (
+	ErrInvalidAPIKey  = errors.New("API keys need a client, known scopes and a valid tenant if any")
+	ErrAPIKeyNotFound = errors.New("no API key found for that ID")
+)
+
+var apiKeyScopes = map[string]bool{
+	models.ScopeSubmit:  true,
+	models.ScopeRead:    true,
+	models.ScopeMetrics: true,
+	models.ScopeAdmin:   true,
+}
+
+// APIKeyStore holds API keys by the hash of their secret, saving them to a
+// file after every change if it has one
+type APIKeyStore struct {
+	path   string
+	keys   map[string]models.APIKey
+	byHash map[string]string
+	mutex  sync.RWMutex
+}
+
+func NewAPIKeyStore() *APIKeyStore {
+	return &APIKeyStore{
+		keys:   make(map[string]models.APIKey),
+		byHash: make(map[string]string),
+	}
+}
+
+// OpenAPIKeyStore loads the keys saved in a file, which is created when the
+// first key is saved if it does not exist
+func OpenAPIKeyStore(path string) (*APIKeyStore, error) {
+	store := NewAPIKeyStore()
+	store.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []models.APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.ID == "" || key.Hash == "" || !validScopes(key.Scopes) || (key.Tenant != "" && !ValidTenantID(key.Tenant)) {
+			return nil, ErrInvalidAPIKey
+		}
+		store.keys[key.ID] = key
+		store.byHash[key.Hash] = key.ID
+	}
+	return store, nil
+}
+
+// HashAPIKey returns the hash stored for an API key secret
+func HashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Authenticate returns the unexpired key with the given secret
+func (s *APIKeyStore) Authenticate(secret string) (models.APIKey, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	key, exists := s.keys[s.byHash[HashAPIKey(secret)]]
+	if !exists || (key.ExpiresAt != nil && !time.Now().Before(*key.ExpiresAt)) {
+		return models.APIKey{}, false
+	}
+	return key, true
+}
+
+// Create generates a key for a client, limited to a tenant unless tenant is
+// empty. The secret is only returned here.
+func (s *APIKeyStore) Create(client, tenant string, scopes []string, expiresAt *time.Time) (models.CreatedAPIKey, error) {
+	if client == "" || len(scopes) == 0 || !validScopes(scopes) || (tenant != "" && !ValidTenantID(tenant)) {
+		return models.CreatedAPIKey{}, ErrInvalidAPIKey
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	created, err := s.add(client, tenant, scopes, expiresAt)
+	if err != nil {
+		return models.CreatedAPIKey{}, err
+	}
+	return created, s.save()
+}
+
+// Rotate creates a replacement for a key with the same client, tenant and
+// scopes. The old key keeps working for the overlap, so clients can switch
+// over.
+func (s *APIKeyStore) Rotate(id string, overlap time.Duration) (models.CreatedAPIKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	old, exists := s.keys[id]
+	if !exists {
+		return models.CreatedAPIKey{}, ErrAPIKeyNotFound
+	}
+	created, err := s.add(old.Client, old.Tenant, old.Scopes, old.ExpiresAt)
+	if err != nil {
+		return models.CreatedAPIKey{}, err
+	}
+
+	expiresAt := time.Now().UTC().Add(overlap)
+	if old.ExpiresAt == nil || expiresAt.Before(*old.ExpiresAt) {
+		old.ExpiresAt = &expiresAt
+		s.keys[id] = old
+	}
+	return created, s.save()
+}
+
+// Revoke deletes a key immediately
+func (s *APIKeyStore) Revoke(id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key, exists := s.keys[id]
+	if !exists {
+		return false, nil
+	}
+	delete(s.keys, id)
+	delete(s.byHash, key.Hash)
+	return true, s.save()
+}
+
+// Keys returns every key, oldest first, without their hashes
+func (s *APIKeyStore) Keys() []models.APIKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	keys := s.sorted()
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+	return keys
+}
+
+// add stores a new key. Callers must hold the write lock.
+func (s *APIKeyStore) add(client, tenant string, scopes []string, expiresAt *time.Time) (models.CreatedAPIKey, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return models.CreatedAPIKey{}, err
+	}
+
+	key := models.APIKey{
+		ID:        uuid.New().String(),
+		Client:    client,
+		Tenant:    tenant,
+		Scopes:    slices.Clone(scopes),
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	created := models.CreatedAPIKey{APIKey: key, Secret: apiKeyPrefix + hex.EncodeToString(secret)}
+	key.Hash = HashAPIKey(created.Secret)
+	s.keys[key.ID] = key
+	s.byHash[key.Hash] = key.ID
+	return created, nil
+}
+
+// save writes the keys to the store's file, if it has one, replacing it
+// atomically. Callers must hold the lock.
+func (s *APIKeyStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), s.path)
+}
+
+// sorted returns the keys, oldest first. Callers must hold the lock.
+func (s *APIKeyStore) sorted() []models.APIKey {
+	keys := make([]models.APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys
+}
+
+func validScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		if !apiKeyScopes[scope] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"receipt-processor/models"
+)
+
+// PointCaps limits the points a receipt can earn. Zero values mean no cap.
+type PointCaps struct {
+	PerRule           map[string]int64 `json:"perRule,omitempty"`
+	PerReceipt        int64            `json:"perReceipt,omitempty"`
+	PerCustomerPerDay int64            `json:"perCustomerPerDay,omitempty"`
+}
+
+type dailyKey struct {
+	customerID string
+	date       string
+}
+
+// Valid reports whether no cap is negative
+func (c PointCaps) Valid() bool {
+	for _, limit := range c.PerRule {
+		if limit < 0 {
+			return false
+		}
+	}
+	return c.PerReceipt >= 0 && c.PerCustomerPerDay >= 0
+}
+
+func (c PointCaps) capRule(name string, points int64) int64 {
+	if limit := c.PerRule[name]; limit > 0 && points > limit {
+		return limit
+	}
+	return points
+}
+
+func (rp *ReceiptProcessor) Caps() PointCaps {
+	rp.mutex.RLock()
+	defer rp.mutex.RUnlock()
+
+	return rp.caps
+}
+
+// SetCaps replaces the point caps. Already processed receipts keep their
+// points until they are rescored.
+func (rp *ReceiptProcessor) SetCaps(caps PointCaps) {
+	perRule := make(map[string]int64, len(caps.PerRule))
+	for name, limit := range caps.PerRule {
+		perRule[name] = limit
+	}
+	caps.PerRule = perRule
+
+	rp.mutex.Lock()
+	rp.caps = caps
+	rp.mutex.Unlock()
+}
+
+// applyDailyCap limits the breakdown to what the customer has left for the
+// purchase date and records the points awarded. Callers must hold the write
+// lock.
+func (rp *ReceiptProcessor) applyDailyCap(receipt models.Receipt, breakdown *models.PointsBreakdown) {
+	if receipt.CustomerID == "" {
+		return
+	}
+
+	key := dailyKey{customerID: receipt.CustomerID, date: receipt.PurchaseDate}
+	if limit := rp.caps.PerCustomerPerDay; limit > 0 {
+		remaining := max(limit-rp.dailyPoints[key], 0)
+		if breakdown.Points > remaining {
+			breakdown.DailyCapped = breakdown.Points - remaining
+			breakdown.Points = remaining
+		}
+	}
+	rp.addDailyPoints(key, breakdown.Points)
+}
+
+// addDailyPoints adds points to a customer's total for a day. Days are
+// purchase dates, which may be long past, so a total is kept until no
+// stored receipt counts towards it rather than for a fixed window. Callers
+// must hold the write lock.
+func (rp *ReceiptProcessor) addDailyPoints(key dailyKey, points int64) {
+	total := rp.dailyPoints[key] + points
+	if total == 0 {
+		delete(rp.dailyPoints, key)
+		return
+	}
+	rp.dailyPoints[key] = total
+}
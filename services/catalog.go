@@ -0,0 +1,119 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"receipt-processor/models"
+)
+
+// Catalog maps product SKUs and descriptions to item categories
+type Catalog struct {
+	bySKU         map[string]string
+	byDescription map[string]string
+	mutex         sync.RWMutex
+}
+
+func NewCatalog() *Catalog {
+	return &Catalog{
+		bySKU:         make(map[string]string),
+		byDescription: make(map[string]string),
+	}
+}
+
+// LoadCatalog reads a JSON array of catalog products
+func LoadCatalog(path string) (*Catalog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var products []models.CatalogProduct
+	if err := json.Unmarshal(data, &products); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	catalog := NewCatalog()
+	for i, product := range products {
+		if !catalog.Add(product) {
+			return nil, fmt.Errorf("%s: product %d needs a category and a SKU or description", path, i+1)
+		}
+	}
+	return catalog, nil
+}
+
+func normalizeCategory(category string) string {
+	return strings.ToLower(strings.TrimSpace(category))
+}
+
+func normalizeDescription(description string) string {
+	return strings.ToLower(strings.Join(strings.Fields(description), " "))
+}
+
+// Add registers a product, returning false if it has no category or neither
+// a SKU nor a description.
+func (c *Catalog) Add(product models.CatalogProduct) bool {
+	category := normalizeCategory(product.Category)
+	sku := strings.TrimSpace(product.SKU)
+	description := normalizeDescription(product.Description)
+	if category == "" || (sku == "" && description == "") {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if sku != "" {
+		c.bySKU[sku] = category
+	}
+	if description != "" {
+		c.byDescription[description] = category
+	}
+	return true
+}
+
+// Category returns the category for an item: the one submitted with the
+// item, else the catalog entry for its SKU, else the catalog entry for its
+// description.
+func (c *Catalog) Category(item models.Item) string {
+	if category := normalizeCategory(item.Category); category != "" {
+		return category
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if category, exists := c.bySKU[strings.TrimSpace(item.SKU)]; exists {
+		return category
+	}
+	return c.byDescription[normalizeDescription(item.ShortDescription)]
+}
+
+func (rp *ReceiptProcessor) Catalog() *Catalog {
+	rp.mutex.RLock()
+	defer rp.mutex.RUnlock()
+
+	return rp.catalog
+}
+
+func (rp *ReceiptProcessor) SetCatalog(catalog *Catalog) {
+	rp.mutex.Lock()
+	rp.catalog = catalog
+	rp.mutex.Unlock()
+}
+
+// categorize returns a copy of items with each category resolved through
+// the catalog
+func (rp *ReceiptProcessor) categorize(items []models.Item) []models.Item {
+	catalog := rp.Catalog()
+
+	categorized := make([]models.Item, len(items))
+	for i, item := range items {
+		item.Category = catalog.Category(item)
+		categorized[i] = item
+	}
+	return categorized
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"sync"
+
+	"receipt-processor/models"
+)
+
+// EventBroker fans receipt events out to streaming subscribers. The most
+// recent events are kept in a ring so that reconnecting subscribers can
+// resume where they left off. Publishing never blocks: a subscriber whose
+// buffer is full is evicted and its channel closed.
+type EventBroker struct {
+	ring        []models.ReceiptEvent
+	next        int
+	count       int
+	subscribers map[*EventSubscription]struct{}
+	bufferSize  int
+	mutex       sync.Mutex
+}
+
+// EventSubscription receives events on Events until it is closed or
+// evicted, when the channel is closed
+type EventSubscription struct {
+	Events <-chan models.ReceiptEvent
+	events chan models.ReceiptEvent
+	broker *EventBroker
+}
+
+// NewEventBroker keeps the last ringSize events and buffers up to
+// bufferSize events for each subscriber
+func NewEventBroker(ringSize, bufferSize int) *EventBroker {
+	return &EventBroker{
+		ring:        make([]models.ReceiptEvent, ringSize),
+		subscribers: make(map[*EventSubscription]struct{}),
+		bufferSize:  bufferSize,
+	}
+}
+
+// Publish records an event and sends it to every subscriber. It can be
+// used as an EventListener.
+func (eb *EventBroker) Publish(event models.ReceiptEvent) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	if len(eb.ring) > 0 {
+		eb.ring[eb.next] = event
+		eb.next = (eb.next + 1) % len(eb.ring)
+		eb.count = min(eb.count+1, len(eb.ring))
+	}
+
+	for subscription := range eb.subscribers {
+		select {
+		case subscription.events <- event:
+		default:
+			eb.remove(subscription)
+		}
+	}
+}
+
+// Subscribe returns the retained events after lastEventID, oldest first,
+// and a subscription for the events that follow. A negative lastEventID
+// subscribes to new events only. If events after lastEventID have already
+// left the ring, the replay starts from the oldest retained event.
+func (eb *EventBroker) Subscribe(lastEventID int64) ([]models.ReceiptEvent, *EventSubscription) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	var replay []models.ReceiptEvent
+	if lastEventID >= 0 {
+		start := eb.next - eb.count
+		for i := 0; i < eb.count; i++ {
+			event := eb.ring[(start+i+len(eb.ring))%len(eb.ring)]
+			if event.ID > lastEventID {
+				replay = append(replay, event)
+			}
+		}
+	}
+
+	events := make(chan models.ReceiptEvent, eb.bufferSize)
+	subscription := &EventSubscription{Events: events, events: events, broker: eb}
+	eb.subscribers[subscription] = struct{}{}
+	return replay, subscription
+}
+
+// Close disconnects every subscriber, e.g. when the server shuts down
+func (eb *EventBroker) Close() {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	for subscription := range eb.subscribers {
+		eb.remove(subscription)
+	}
+}
+
+// Subscribers returns the number of connected subscribers
+func (eb *EventBroker) Subscribers() int {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	return len(eb.subscribers)
+}
+
+// Close unsubscribes. It is safe to call after eviction.
+func (es *EventSubscription) Close() {
+	es.broker.mutex.Lock()
+	defer es.broker.mutex.Unlock()
+
+	es.broker.remove(es)
+}
+
+// remove closes a subscription's channel. Callers must hold the lock.
+func (eb *EventBroker) remove(subscription *EventSubscription) {
+	if _, ok := eb.subscribers[subscription]; ok {
+		delete(eb.subscribers, subscription)
+		close(subscription.events)
+	}
+}
@@ -0,0 +1,43 @@
+package services
+
+import (
+	"time"
+
+	"receipt-processor/models"
+)
+
+var eventTypes = map[string]bool{
+	models.EventReceiptProcessed: true,
+	models.EventPointsAdjusted:   true,
+}
+
+// EventListener is called with each receipt event, in order. Listeners run
+// on the goroutine that changed the receipt, so they must not block.
+type EventListener func(models.ReceiptEvent)
+
+// AddListener registers a listener for receipt events
+func (rp *ReceiptProcessor) AddListener(listener EventListener) {
+	rp.eventMutex.Lock()
+	rp.listeners = append(rp.listeners, listener)
+	rp.eventMutex.Unlock()
+}
+
+// publish numbers an event and passes it to the listeners. Events are
+// published one at a time so listeners see them in sequence order.
+func (rp *ReceiptProcessor) publish(event models.ReceiptEvent) {
+	rp.eventMutex.Lock()
+	defer rp.eventMutex.Unlock()
+
+	rp.eventSeq++
+	event.ID = rp.eventSeq
+	event.Tenant = rp.tenant
+	event.Time = time.Now().UTC()
+	for _, listener := range rp.listeners {
+		listener(event)
+	}
+}
+
+// IsEventType reports whether the processor publishes events of this type
+func IsEventType(eventType string) bool {
+	return eventTypes[eventType]
+}
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"receipt-processor/models"
+	"receipt-processor/utils"
+)
+
+var ErrNoExchangeRate = errors.New("no exchange rate for the receipt's currency on its purchase date")
+
+// ExchangeRates converts receipt amounts to the base currency using the
+// rates in effect on the purchase date
+type ExchangeRates struct {
+	version string
+	base    string
+	sets    []models.EffectiveRateSet
+}
+
+// NewExchangeRates returns a table with no rates, which only accepts
+// receipts in the base currency
+func NewExchangeRates(base string) *ExchangeRates {
+	return &ExchangeRates{base: base}
+}
+
+func LoadExchangeRates(path string) (*ExchangeRates, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var table models.ExchangeRateTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	rates, err := newExchangeRates(table)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rates, nil
+}
+
+func newExchangeRates(table models.ExchangeRateTable) (*ExchangeRates, error) {
+	if _, ok := utils.CurrencyDecimals(table.Base); !ok || table.Base == "" {
+		return nil, fmt.Errorf("unsupported base currency %q", table.Base)
+	}
+
+	sets := append([]models.EffectiveRateSet(nil), table.Rates...)
+	for _, set := range sets {
+		if _, err := time.Parse("2006-01-02", set.Effective); err != nil {
+			return nil, fmt.Errorf("invalid effective date %q", set.Effective)
+		}
+		for currency, rate := range set.Rates {
+			if _, ok := utils.CurrencyDecimals(currency); !ok {
+				return nil, fmt.Errorf("unsupported currency %q on %s", currency, set.Effective)
+			}
+			if rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+				return nil, fmt.Errorf("invalid rate for %s on %s", currency, set.Effective)
+			}
+		}
+	}
+	sort.Slice(sets, func(i, j int) bool {
+		return sets[i].Effective < sets[j].Effective
+	})
+
+	return &ExchangeRates{version: table.Version, base: table.Base, sets: sets}, nil
+}
+
+func (er *ExchangeRates) Base() string {
+	return er.base
+}
+
+func (er *ExchangeRates) Version() string {
+	return er.version
+}
+
+// Rate returns the base-currency value of one unit of currency on date and
+// the effective date of the rate used
+func (er *ExchangeRates) Rate(currency, date string) (float64, string, bool) {
+	if currency == er.base {
+		return 1, "", true
+	}
+
+	for i := len(er.sets) - 1; i >= 0; i-- {
+		set := er.sets[i]
+		if set.Effective > date {
+			continue
+		}
+		if rate, ok := set.Rates[currency]; ok {
+			return rate, set.Effective, true
+		}
+	}
+	return 0, "", false
+}
+
+// Supports reports whether a receipt in currency on date can be converted.
+// Receipts that name no currency are in the base currency.
+func (er *ExchangeRates) Supports(currency, date string) bool {
+	if currency == "" {
+		currency = er.base
+	}
+	_, _, ok := er.Rate(currency, date)
+	return ok
+}
+
+func (rp *ReceiptProcessor) ExchangeRates() *ExchangeRates {
+	rp.mutex.RLock()
+	defer rp.mutex.RUnlock()
+
+	return rp.exchangeRates
+}
+
+func (rp *ReceiptProcessor) SetExchangeRates(rates *ExchangeRates) {
+	rp.mutex.Lock()
+	rp.exchangeRates = rates
+	rp.mutex.Unlock()
+}
+
+// Convertible reports whether a receipt's amounts can be converted to the
+// base currency on its store-local purchase date, the date it is scored with
+func (rp *ReceiptProcessor) Convertible(receipt models.Receipt) bool {
+	_, _, err := rp.convert(rp.localize(receipt))
+	return err == nil
+}
+
+// convert returns the localized receipt with every amount in the base
+// currency, and the conversion applied, or nil if none was needed. It
+// returns ErrNoExchangeRate if there is no rate for the receipt's currency
+// on its purchase date.
+func (rp *ReceiptProcessor) convert(receipt models.Receipt) (models.Receipt, *models.Conversion, error) {
+	rates := rp.ExchangeRates()
+	currency := receipt.Currency
+	if currency == "" || currency == rates.Base() {
+		return receipt, nil, nil
+	}
+
+	rate, effective, ok := rates.Rate(currency, receipt.PurchaseDate)
+	fromDecimals, known := utils.CurrencyDecimals(currency)
+	if !ok || !known {
+		return models.Receipt{}, nil, fmt.Errorf("%w: %s on %s", ErrNoExchangeRate, currency, receipt.PurchaseDate)
+	}
+	toDecimals, _ := utils.CurrencyDecimals(rates.Base())
+
+	var invalid error
+	convertAmount := func(amount string) string {
+		if amount == "" {
+			return ""
+		}
+		units, err := utils.ParseMinorUnits(amount, fromDecimals)
+		if err != nil {
+			invalid = err
+			return amount
+		}
+		converted := math.Round(float64(units) * rate * math.Pow10(toDecimals-fromDecimals))
+		return utils.FormatMinorUnits(int64(converted), toDecimals)
+	}
+
+	receipt.Total = convertAmount(receipt.Total)
+	receipt.Items = append([]models.Item(nil), receipt.Items...)
+	for i := range receipt.Items {
+		receipt.Items[i].Price = convertAmount(receipt.Items[i].Price)
+		receipt.Items[i].UnitPrice = convertAmount(receipt.Items[i].UnitPrice)
+	}
+	receipt.Discounts = append([]models.Adjustment(nil), receipt.Discounts...)
+	for i := range receipt.Discounts {
+		receipt.Discounts[i].Amount = convertAmount(receipt.Discounts[i].Amount)
+	}
+	receipt.Taxes = append([]models.Adjustment(nil), receipt.Taxes...)
+	for i := range receipt.Taxes {
+		receipt.Taxes[i].Amount = convertAmount(receipt.Taxes[i].Amount)
+	}
+	receipt.Currency = rates.Base()
+	if invalid != nil {
+		return models.Receipt{}, nil, invalid
+	}
+
+	return receipt, &models.Conversion{
+		From:         currency,
+		To:           rates.Base(),
+		Rate:         rate,
+		Effective:    effective,
+		RatesVersion: rates.Version(),
+	}, nil
+}
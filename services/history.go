@@ -0,0 +1,269 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"receipt-processor/models"
+)
+
+// SystemActor is recorded for changes made without an actor in the context
+const SystemActor = "system"
+
+type actorKey struct{}
+
+// WithActor returns a context whose changes are recorded as made by actor
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor set on the context, if any
+func ActorFrom(ctx context.Context) (string, bool) {
+	actor, ok := ctx.Value(actorKey{}).(string)
+	return actor, ok && actor != ""
+}
+
+// EventLog persists history events. Append is called in sequence order
+// while the processor is locked, so it should not block for long.
+type EventLog interface {
+	Append(event models.HistoryEvent) error
+}
+
+// FileEventLog appends history events to a file, one JSON object per line
+type FileEventLog struct {
+	path   string
+	file   *os.File
+	failed error
+	mutex  sync.Mutex
+}
+
+// OpenEventLog opens an event log file for appending, creating it if needed
+func OpenEventLog(path string) (*FileEventLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileEventLog{path: path, file: file}, nil
+}
+
+// Events reads every event in the log, oldest first
+func (l *FileEventLog) Events() ([]models.HistoryEvent, error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []models.HistoryEvent
+	decoder := json.NewDecoder(file)
+	for {
+		var event models.HistoryEvent
+		err := decoder.Decode(&event)
+		if errors.Is(err, io.EOF) {
+			return events, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %w", len(events)+1, err)
+		}
+		events = append(events, event)
+	}
+}
+
+func (l *FileEventLog) Append(event models.HistoryEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	_, err = l.file.Write(append(line, '\n'))
+	l.failed = err
+	return err
+}
+
+// Err returns the error of the last append if it failed, so that a log that
+// can no longer be written to is noticed before it is closed
+func (l *FileEventLog) Err() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.failed
+}
+
+// Close flushes the log to disk and closes it
+func (l *FileEventLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// SetEventLog writes every history event to log as well as keeping it in
+// memory
+func (rp *ReceiptProcessor) SetEventLog(eventLog EventLog) {
+	rp.mutex.Lock()
+	rp.eventLog = eventLog
+	rp.mutex.Unlock()
+}
+
+// History returns a receipt's history, oldest first. The history of a
+// deleted receipt is kept.
+func (rp *ReceiptProcessor) History(id string) ([]models.HistoryEvent, bool) {
+	rp.mutex.RLock()
+	defer rp.mutex.RUnlock()
+
+	history, exists := rp.history[id]
+	return append([]models.HistoryEvent(nil), history...), exists
+}
+
+// Replay rebuilds the stored receipts from history events, oldest first,
+// without scoring them again or publishing events. It is meant to be called
+// at startup, before any receipts are processed, and stops at the first
+// event that does not follow from the ones before it.
+func (rp *ReceiptProcessor) Replay(events []models.HistoryEvent) error {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+
+	for _, event := range events {
+		if event.Sequence <= rp.historySeq {
+			return fmt.Errorf("event %d is out of sequence", event.Sequence)
+		}
+
+		stored, exists := rp.receipts[event.ReceiptID]
+		switch event.Type {
+		case models.HistoryCreated, models.HistoryUpdated:
+			if exists != (event.Type == models.HistoryUpdated) || event.Receipt == nil || event.Breakdown == nil {
+				return fmt.Errorf("event %d cannot be applied to receipt %s", event.Sequence, event.ReceiptID)
+			}
+			if !exists {
+				rp.ids = append(rp.ids, event.ReceiptID)
+			}
+			rp.releaseDailyPoints(stored)
+			stored = storedReceipt{
+				receipt:   *event.Receipt,
+				breakdown: *event.Breakdown,
+				day:       dailyKey{customerID: event.Receipt.CustomerID, date: rp.eventDay(event)},
+			}
+		case models.HistoryRescored:
+			if !exists || event.Breakdown == nil {
+				return fmt.Errorf("event %d cannot be applied to receipt %s", event.Sequence, event.ReceiptID)
+			}
+			rp.releaseDailyPoints(stored)
+			stored.breakdown = *event.Breakdown
+			if event.Day != "" {
+				stored.day.date = event.Day
+			}
+		case models.HistoryDeleted:
+			if !exists {
+				return fmt.Errorf("event %d cannot be applied to receipt %s", event.Sequence, event.ReceiptID)
+			}
+			rp.releaseDailyPoints(stored)
+		default:
+			return fmt.Errorf("event %d has unknown type %q", event.Sequence, event.Type)
+		}
+
+		if event.Type == models.HistoryDeleted {
+			delete(rp.receipts, event.ReceiptID)
+		} else {
+			rp.receipts[event.ReceiptID] = stored
+			if stored.day.customerID != "" {
+				rp.addDailyPoints(stored.day, stored.breakdown.Points)
+			}
+		}
+		rp.history[event.ReceiptID] = append(rp.history[event.ReceiptID], event)
+		rp.historySeq = event.Sequence
+	}
+	return nil
+}
+
+// eventDay returns the day a created or updated event's points count
+// towards. Logs written before events recorded it are localized with the
+// current retailer time zones.
+func (rp *ReceiptProcessor) eventDay(event models.HistoryEvent) string {
+	if event.Day != "" {
+		return event.Day
+	}
+	return rp.localize(*event.Receipt).PurchaseDate
+}
+
+// record numbers a history event, keeps it and writes it to the event log.
+// Callers must hold the write lock.
+func (rp *ReceiptProcessor) record(ctx context.Context, event models.HistoryEvent) {
+	rp.historySeq++
+	event.Sequence = rp.historySeq
+	event.Tenant = rp.tenant
+	event.Actor = SystemActor
+	if actor, ok := ActorFrom(ctx); ok {
+		event.Actor = actor
+	}
+	event.Time = time.Now().UTC()
+	rp.history[event.ReceiptID] = append(rp.history[event.ReceiptID], event)
+
+	if rp.eventLog != nil {
+		if err := rp.eventLog.Append(event); err != nil {
+			slog.ErrorContext(ctx, "failed to append to event log", "tenant", rp.tenantLabel(),
+				"receipt_id", event.ReceiptID, "type", event.Type, "error", err)
+		}
+	}
+}
+
+// diffReceipts lists the top-level receipt fields, and the points, that
+// differ between two versions of a stored receipt
+func diffReceipts(before, after storedReceipt) []models.FieldChange {
+	changes := diffFields(before.receipt, after.receipt)
+	if before.breakdown.Points != after.breakdown.Points {
+		changes = append(changes, models.FieldChange{
+			Field: "points",
+			Old:   json.RawMessage(fmt.Sprint(before.breakdown.Points)),
+			New:   json.RawMessage(fmt.Sprint(after.breakdown.Points)),
+		})
+	}
+	return changes
+}
+
+// diffFields compares the JSON fields of two values, in field name order
+func diffFields(before, after any) []models.FieldChange {
+	var oldFields, newFields map[string]json.RawMessage
+	if data, err := json.Marshal(before); err == nil {
+		json.Unmarshal(data, &oldFields)
+	}
+	if data, err := json.Marshal(after); err == nil {
+		json.Unmarshal(data, &newFields)
+	}
+
+	fields := make(map[string]bool)
+	for field := range oldFields {
+		fields[field] = true
+	}
+	for field := range newFields {
+		fields[field] = true
+	}
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	var changes []models.FieldChange
+	for _, field := range names {
+		if !bytes.Equal(oldFields[field], newFields[field]) {
+			changes = append(changes, models.FieldChange{Field: field, Old: oldFields[field], New: newFields[field]})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"receipt-processor/models"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrQueueFull   = errors.New("job queue is full")
+	ErrQueueClosed = errors.New("job queue is shut down")
+)
+
+// JobFunc does the work of a job, returning the ID of the receipt it
+// created
+type JobFunc func() (string, error)
+
+type queuedJob struct {
+	id string
+	fn JobFunc
+}
+
+// JobQueue runs jobs on a fixed number of workers. At most capacity jobs
+// wait in the queue; more are rejected with ErrQueueFull. The most recent
+// finished jobs are kept so their status can be looked up.
+type JobQueue struct {
+	queue    chan queuedJob
+	jobs     map[string]*models.Job
+	finished []string
+	retain   int
+	closed   bool
+	workers  sync.WaitGroup
+	mutex    sync.RWMutex
+}
+
+const defaultRetainedJobs = 10000
+
+func NewJobQueue(workers, capacity int) *JobQueue {
+	jq := &JobQueue{
+		queue:  make(chan queuedJob, capacity),
+		jobs:   make(map[string]*models.Job),
+		retain: defaultRetainedJobs,
+	}
+	for i := 0; i < workers; i++ {
+		jq.workers.Add(1)
+		go jq.work()
+	}
+	return jq
+}
+
+// Submit queues fn for a tenant and returns the new job without waiting for
+// it to run
+func (jq *JobQueue) Submit(tenant string, fn JobFunc) (models.Job, error) {
+	job := &models.Job{
+		ID:          uuid.New().String(),
+		Tenant:      tenant,
+		Status:      models.JobQueued,
+		SubmittedAt: time.Now().UTC(),
+	}
+
+	jq.mutex.Lock()
+	defer jq.mutex.Unlock()
+
+	if jq.closed {
+		return models.Job{}, ErrQueueClosed
+	}
+	select {
+	case jq.queue <- queuedJob{id: job.ID, fn: fn}:
+	default:
+		return models.Job{}, ErrQueueFull
+	}
+	jq.jobs[job.ID] = job
+	return *job, nil
+}
+
+func (jq *JobQueue) Job(id string) (models.Job, bool) {
+	jq.mutex.RLock()
+	defer jq.mutex.RUnlock()
+
+	job, exists := jq.jobs[id]
+	if !exists {
+		return models.Job{}, false
+	}
+	return *job, true
+}
+
+// Shutdown stops accepting jobs and waits for the queued and running jobs
+// to finish, or for ctx to be done
+func (jq *JobQueue) Shutdown(ctx context.Context) error {
+	jq.mutex.Lock()
+	if !jq.closed {
+		jq.closed = true
+		close(jq.queue)
+	}
+	jq.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		jq.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (jq *JobQueue) work() {
+	defer jq.workers.Done()
+
+	for queued := range jq.queue {
+		jq.update(queued.id, func(job *models.Job) {
+			job.Status = models.JobRunning
+		})
+
+		receiptID, err := queued.fn()
+
+		jq.update(queued.id, func(job *models.Job) {
+			completed := time.Now().UTC()
+			job.CompletedAt = &completed
+			if err != nil {
+				job.Status = models.JobFailed
+				job.Errors = append(job.Errors, err.Error())
+				return
+			}
+			job.Status = models.JobSucceeded
+			job.ReceiptID = receiptID
+		})
+	}
+}
+
+func (jq *JobQueue) update(id string, fn func(*models.Job)) {
+	jq.mutex.Lock()
+	defer jq.mutex.Unlock()
+
+	job := jq.jobs[id]
+	fn(job)
+
+	if job.CompletedAt != nil {
+		jq.finished = append(jq.finished, id)
+		if len(jq.finished) > jq.retain {
+			delete(jq.jobs, jq.finished[0])
+			jq.finished = jq.finished[1:]
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	pointsBuckets  = []float64{10, 25, 50, 75, 100, 150, 200, 300, 500, 1000}
+)
+
+// Metrics collects the service's metrics and writes them in the Prometheus
+// text format. A nil *Metrics collects nothing, so callers need not check
+// whether metrics are enabled.
+type Metrics struct {
+	requests           *metricVec
+	requestDuration    *metricVec
+	processed          *metricVec
+	validationFailures *metricVec
+	points             *metricVec
+	ruleFires          *metricVec
+	stores             map[string]func() int
+	mutex              sync.Mutex
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: newMetricVec("receipt_processor_http_requests_total", "counter",
+			"HTTP requests by route, method and status.", nil, "route", "method", "status"),
+		requestDuration: newMetricVec("receipt_processor_http_request_duration_seconds", "histogram",
+			"HTTP request latency by route, method and status.", latencyBuckets, "route", "method", "status"),
+		processed: newMetricVec("receipt_processor_receipts_processed_total", "counter",
+			"Receipts processed by tenant.", nil, "tenant"),
+		validationFailures: newMetricVec("receipt_processor_validation_failures_total", "counter",
+			"Receipts rejected by the reason they are invalid.", nil, "reason"),
+		points: newMetricVec("receipt_processor_points_awarded", "histogram",
+			"Points awarded to processed receipts by tenant.", pointsBuckets, "tenant"),
+		ruleFires: newMetricVec("receipt_processor_rule_fires_total", "counter",
+			"Times each rule awarded points while scoring a receipt, by tenant.", nil, "tenant", "rule"),
+		stores: make(map[string]func() int),
+	}
+}
+
+// ObserveRequest counts a request and its latency
+func (m *Metrics) ObserveRequest(route, method string, status int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	labels := []string{route, method, strconv.Itoa(status)}
+	m.requests.add(1, labels)
+	m.requestDuration.observe(duration.Seconds(), labels)
+}
+
+// ReceiptProcessed counts a processed receipt and the points it was awarded
+func (m *Metrics) ReceiptProcessed(tenant string, points int64) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.processed.add(1, []string{tenant})
+	m.points.observe(float64(points), []string{tenant})
+}
+
+// RuleFired counts a rule awarding points
+func (m *Metrics) RuleFired(tenant, rule string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.ruleFires.add(1, []string{tenant, rule})
+}
+
+// ValidationFailed counts a receipt rejected for reason
+func (m *Metrics) ValidationFailed(reason string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.validationFailures.add(1, []string{reason})
+}
+
+// WatchStore reports the number of receipts a tenant holds, as returned by
+// size when the metrics are written
+func (m *Metrics) WatchStore(tenant string, size func() int) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.stores[tenant] = size
+}
+
+// Write writes every metric in the Prometheus text exposition format
+func (m *Metrics) Write(w io.Writer) error {
+	m.mutex.Lock()
+	stores := make(map[string]func() int, len(m.stores))
+	for tenant, size := range m.stores {
+		stores[tenant] = size
+	}
+	var text strings.Builder
+	for _, vec := range []*metricVec{m.requests, m.requestDuration, m.processed, m.validationFailures, m.points, m.ruleFires} {
+		vec.write(&text)
+	}
+	m.mutex.Unlock()
+
+	// Store sizes are read without holding the lock, as they take the
+	// processors' locks
+	sizes := newMetricVec("receipt_processor_receipts_stored", "gauge", "Receipts currently stored by tenant.", nil, "tenant")
+	for tenant, size := range stores {
+		sizes.add(float64(size()), []string{tenant})
+	}
+	sizes.write(&text)
+
+	_, err := io.WriteString(w, text.String())
+	return err
+}
+
+// metricVec is a counter, gauge or histogram with one series per set of
+// label values
+type metricVec struct {
+	name    string
+	kind    string
+	help    string
+	buckets []float64
+	labels  []string
+	series  map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+func newMetricVec(name, kind, help string, buckets []float64, labels ...string) *metricVec {
+	return &metricVec{
+		name:    name,
+		kind:    kind,
+		help:    help,
+		buckets: buckets,
+		labels:  labels,
+		series:  make(map[string]*metricSeries),
+	}
+}
+
+func (v *metricVec) get(labels []string) *metricSeries {
+	key := strings.Join(labels, "\xff")
+	series, exists := v.series[key]
+	if !exists {
+		series = &metricSeries{labels: labels, counts: make([]uint64, len(v.buckets))}
+		v.series[key] = series
+	}
+	return series
+}
+
+func (v *metricVec) add(value float64, labels []string) {
+	v.get(labels).value += value
+}
+
+// observe adds a value to a histogram, whose value is the sum of the values
+func (v *metricVec) observe(value float64, labels []string) {
+	series := v.get(labels)
+	series.value += value
+	series.count++
+	for i, bound := range v.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+}
+
+func (v *metricVec) write(w *strings.Builder) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := v.series[key]
+		labels := formatLabels(v.labels, series.labels)
+		if v.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, labels, formatValue(series.value))
+			continue
+		}
+		names := slices.Concat(v.labels, []string{"le"})
+		for i, bound := range v.buckets {
+			bucketLabels := formatLabels(names, slices.Concat(series.labels, []string{formatValue(bound)}))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, bucketLabels, series.counts[i])
+		}
+		bucketLabels := formatLabels(names, slices.Concat(series.labels, []string{"+Inf"}))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, bucketLabels, series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, labels, formatValue(series.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, labels, series.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
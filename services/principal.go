@@ -0,0 +1,36 @@
+package services
+
+import (
+	"context"
+	"slices"
+
+	"receipt-processor/models"
+)
+
+// Principal is the authenticated caller of a request. Tenant is only set for
+// callers bound to a tenant, and CustomerID for tokens carrying one.
+type Principal struct {
+	Client     string
+	Scopes     []string
+	Tenant     string
+	CustomerID string
+}
+
+// HasScope reports whether the caller was granted a scope. The admin scope
+// grants every scope.
+func (p Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope) || slices.Contains(p.Scopes, models.ScopeAdmin)
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context for a request made by principal
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom returns the authenticated caller of a request, if any
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
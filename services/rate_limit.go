@@ -0,0 +1,259 @@
+package services
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultMaxRateLimitClients bounds the clients tracked when no limit is set
+const DefaultMaxRateLimitClients = 10000
+
+// addressBucket names the bucket limiting every request from an IP address
+const addressBucket = "*"
+
+var ErrInvalidRateLimits = errors.New("rate limits must not be negative, and limited routes need a burst")
+
+// RateLimit allows Burst requests at once, refilled at PerMinute. A zero
+// PerMinute means no limit.
+type RateLimit struct {
+	PerMinute float64 `json:"perMinute"`
+	Burst     int     `json:"burst"`
+}
+
+// RateLimitConfig sets the limits for each route, named like
+// "POST /receipts/process", and Default for the others. PerIP limits all
+// requests from an IP address before they are authenticated, and is Default
+// if not set. DailySubmissions limits the receipts each client can submit
+// per UTC day, zero meaning no limit. At most MaxClients clients are
+// tracked; the least recently seen are forgotten first.
+type RateLimitConfig struct {
+	Default          RateLimit            `json:"default"`
+	Routes           map[string]RateLimit `json:"routes,omitempty"`
+	PerIP            *RateLimit           `json:"perIP,omitempty"`
+	DailySubmissions int                  `json:"dailySubmissions,omitempty"`
+	MaxClients       int                  `json:"maxClients,omitempty"`
+}
+
+// Valid reports whether no limit is negative and every limited route has a
+// burst
+func (c RateLimitConfig) Valid() bool {
+	valid := func(limit RateLimit) bool {
+		return limit.PerMinute >= 0 && limit.Burst >= 0 && (limit.PerMinute == 0 || limit.Burst > 0)
+	}
+	for _, limit := range c.Routes {
+		if !valid(limit) {
+			return false
+		}
+	}
+	if c.PerIP != nil && !valid(*c.PerIP) {
+		return false
+	}
+	return valid(c.Default) && c.DailySubmissions >= 0 && c.MaxClients >= 0
+}
+
+func LoadRateLimits(path string) (RateLimitConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return RateLimitConfig{}, err
+	}
+
+	var config RateLimitConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return RateLimitConfig{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if !config.Valid() {
+		return RateLimitConfig{}, fmt.Errorf("%s: %w", path, ErrInvalidRateLimits)
+	}
+	return config, nil
+}
+
+// RateDecision is the outcome of a request against a client's limits.
+// Limit is zero when the request was not limited.
+type RateDecision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type clientLimits struct {
+	client      string
+	buckets     map[string]*tokenBucket
+	day         string
+	submissions int
+}
+
+// RateLimiter keeps a token bucket per client and route, and counts each
+// client's submissions per day. State is only held in memory.
+type RateLimiter struct {
+	config  RateLimitConfig
+	clients map[string]*list.Element
+	recent  *list.List
+	mutex   sync.Mutex
+}
+
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	if config.MaxClients == 0 {
+		config.MaxClients = DefaultMaxRateLimitClients
+	}
+	return &RateLimiter{
+		config:  config,
+		clients: make(map[string]*list.Element),
+		recent:  list.New(),
+	}
+}
+
+// Clients returns the number of clients being tracked
+func (rl *RateLimiter) Clients() int {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	return len(rl.clients)
+}
+
+// Allow takes a token from the client's bucket for route and, for a
+// submission, counts it against the client's daily quota. A request that is
+// refused uses up neither.
+func (rl *RateLimiter) Allow(client, route string, submission bool) RateDecision {
+	limit, limited := rl.config.Routes[route]
+	if !limited {
+		limit = rl.config.Default
+	}
+	quota := 0
+	if submission {
+		quota = rl.config.DailySubmissions
+	}
+	return rl.allow(client, route, limit, quota)
+}
+
+// AllowAddress takes a token from the bucket shared by every request from
+// an IP address, whoever they claim to be
+func (rl *RateLimiter) AllowAddress(address string) RateDecision {
+	limit := rl.config.Default
+	if rl.config.PerIP != nil {
+		limit = *rl.config.PerIP
+	}
+	return rl.allow("ip:"+address, addressBucket, limit, 0)
+}
+
+// allow takes a token from the client's bucket for route, limited by limit,
+// and counts a submission against quota if it is not zero
+func (rl *RateLimiter) allow(client, route string, limit RateLimit, quota int) RateDecision {
+	if limit.PerMinute == 0 && quota == 0 {
+		return RateDecision{Allowed: true}
+	}
+
+	now := time.Now()
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	limits := rl.client(client)
+
+	var bucket *tokenBucket
+	var decision RateDecision
+	if limit.PerMinute > 0 {
+		perSecond := limit.PerMinute / 60
+		bucket = limits.buckets[route]
+		if bucket == nil {
+			bucket = &tokenBucket{tokens: float64(limit.Burst)}
+			limits.buckets[route] = bucket
+		} else {
+			elapsed := now.Sub(bucket.updated).Seconds()
+			bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+elapsed*perSecond)
+		}
+		bucket.updated = now
+
+		decision.Limit = limit.Burst
+		if bucket.tokens < 1 {
+			decision.RetryAfter = secondsDuration((1 - bucket.tokens) / perSecond)
+			decision.Reset = secondsDuration((float64(limit.Burst) - bucket.tokens) / perSecond)
+			return decision
+		}
+		decision.Remaining = int(bucket.tokens - 1)
+		decision.Reset = secondsDuration((float64(limit.Burst) - bucket.tokens + 1) / perSecond)
+	}
+
+	if quota > 0 {
+		submitted := rl.submit(limits, 1, now)
+		if !submitted.Allowed {
+			return submitted
+		}
+
+		// Report whichever limit is closer to being reached
+		if decision.Limit == 0 || submitted.Remaining < decision.Remaining {
+			decision = submitted
+		}
+	}
+
+	if bucket != nil {
+		bucket.tokens--
+	}
+	decision.Allowed = true
+	return decision
+}
+
+// AllowSubmissions counts n receipts submitted at once, e.g. by an import,
+// against the client's daily quota. Either all of them fit in what is left
+// of the quota and are counted, or none are.
+func (rl *RateLimiter) AllowSubmissions(client string, n int) RateDecision {
+	if rl.config.DailySubmissions == 0 {
+		return RateDecision{Allowed: true}
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	return rl.submit(rl.client(client), n, time.Now())
+}
+
+// submit counts n submissions against the client's quota for the day if
+// they fit. Callers must hold the lock.
+func (rl *RateLimiter) submit(limits *clientLimits, n int, now time.Time) RateDecision {
+	quota := rl.config.DailySubmissions
+	day := now.UTC().Format("2006-01-02")
+	if limits.day != day {
+		limits.day = day
+		limits.submissions = 0
+	}
+	untilMidnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour).Sub(now)
+	if limits.submissions+n > quota {
+		return RateDecision{Limit: quota, Remaining: quota - limits.submissions, Reset: untilMidnight, RetryAfter: untilMidnight}
+	}
+	limits.submissions += n
+	return RateDecision{Allowed: true, Limit: quota, Remaining: quota - limits.submissions, Reset: untilMidnight}
+}
+
+// client returns a client's state, forgetting the least recently seen
+// client if there are too many. Callers must hold the lock.
+func (rl *RateLimiter) client(client string) *clientLimits {
+	if element, exists := rl.clients[client]; exists {
+		rl.recent.MoveToFront(element)
+		return element.Value.(*clientLimits)
+	}
+
+	for len(rl.clients) >= rl.config.MaxClients {
+		oldest := rl.recent.Back()
+		rl.recent.Remove(oldest)
+		delete(rl.clients, oldest.Value.(*clientLimits).client)
+	}
+
+	limits := &clientLimits{client: client, buckets: make(map[string]*tokenBucket)}
+	rl.clients[client] = rl.recent.PushFront(limits)
+	return limits
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
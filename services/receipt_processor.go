@@ -1,95 +1,444 @@
 package services
 
 import (
-	"math"
-	"regexp"
-	"strconv"
-	"strings"
+	"context"
+	"errors"
+	"log/slog"
+	"reflect"
 	"sync"
 	"time"
 
 	"receipt-processor/models"
+	"receipt-processor/utils"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var ErrUnknownReceipt = errors.New("unknown receipt")
+
+type storedReceipt struct {
+	receipt   models.Receipt
+	breakdown models.PointsBreakdown
+	day       dailyKey
+}
+
 type ReceiptProcessor struct {
-	receipts map[string]models.Receipt
-	mutex    sync.RWMutex
+	tenant           string
+	receipts         map[string]storedReceipt
+	ids              []string
+	retailers        *RetailerRegistry
+	retailerNameMode RetailerNameMode
+	rules            []Rule
+	catalog          *Catalog
+	exchangeRates    *ExchangeRates
+	caps             PointCaps
+	dailyPoints      map[dailyKey]int64
+	history          map[string][]models.HistoryEvent
+	historySeq       int64
+	eventLog         EventLog
+	metrics          *Metrics
+	mutex            sync.RWMutex
+
+	listeners  []EventListener
+	eventSeq   int64
+	eventMutex sync.Mutex
 }
 
 func NewReceiptProcessor() *ReceiptProcessor {
-	return &ReceiptProcessor{
-		receipts: make(map[string]models.Receipt),
+	rp := &ReceiptProcessor{
+		receipts:         make(map[string]storedReceipt),
+		retailers:        NewRetailerRegistry(),
+		retailerNameMode: RetailerNameRaw,
+		dailyPoints:      make(map[dailyKey]int64),
+		history:          make(map[string][]models.HistoryEvent),
+		catalog:          NewCatalog(),
+		exchangeRates:    NewExchangeRates(utils.BaseCurrency),
+	}
+	rp.rules = rp.builtinRules()
+	return rp
+}
+
+// Tenant returns the tenant whose receipts the processor holds, or "" for a
+// processor created outside a TenantRegistry
+func (rp *ReceiptProcessor) Tenant() string {
+	return rp.tenant
+}
+
+// SetMetrics counts the receipts processed, their points and the rules that
+// fire in metrics, which also reports how many receipts are stored
+func (rp *ReceiptProcessor) SetMetrics(metrics *Metrics) {
+	rp.mutex.Lock()
+	rp.metrics = metrics
+	rp.mutex.Unlock()
+
+	metrics.WatchStore(rp.tenantLabel(), rp.Count)
+}
+
+// Count returns the number of receipts stored
+func (rp *ReceiptProcessor) Count() int {
+	rp.mutex.RLock()
+	defer rp.mutex.RUnlock()
+
+	return len(rp.receipts)
+}
+
+// tenantLabel names the processor's tenant in metrics and logs
+func (rp *ReceiptProcessor) tenantLabel() string {
+	if rp.tenant == "" {
+		return DefaultTenant
 	}
+	return rp.tenant
+}
+
+func (rp *ReceiptProcessor) Retailers() *RetailerRegistry {
+	return rp.retailers
+}
+
+// SetRetailerNameMode controls whether Rule 1 counts the raw retailer name
+// as submitted or its canonical form.
+func (rp *ReceiptProcessor) SetRetailerNameMode(mode RetailerNameMode) {
+	rp.mutex.Lock()
+	rp.retailerNameMode = mode
+	rp.mutex.Unlock()
 }
 
-func (rp *ReceiptProcessor) ProcessReceipt(receipt models.Receipt) string {
+// ProcessReceipt stores the receipt and scores it. Points are fixed at
+// processing time so the per-customer daily cap applies in submission order.
+// The change is recorded in the receipt's history as made by the context's
+// actor. Receipts that cannot be scored, such as those with no exchange rate
+// for their currency, are not stored.
+func (rp *ReceiptProcessor) ProcessReceipt(ctx context.Context, receipt models.Receipt) (string, error) {
+	ctx, span := Tracer().Start(ctx, "ReceiptProcessor.ProcessReceipt")
+	defer span.End()
+
 	id := uuid.New().String()
+	span.SetAttributes(attribute.String("tenant", rp.tenantLabel()), attribute.String("receipt.id", id))
+	receipt.CanonicalRetailer = rp.retailers.Canonicalize(receipt.Retailer)
+	breakdown, err := rp.score(ctx, receipt)
+	if err != nil {
+		return "", err
+	}
+	local := rp.localize(receipt)
 
+	_, storeSpan := Tracer().Start(ctx, "store")
 	rp.mutex.Lock()
-	rp.receipts[id] = receipt
+	rp.applyDailyCap(local, &breakdown)
+	rp.receipts[id] = storedReceipt{
+		receipt:   receipt,
+		breakdown: breakdown,
+		day:       dailyKey{customerID: receipt.CustomerID, date: local.PurchaseDate},
+	}
+	rp.ids = append(rp.ids, id)
+	rp.record(ctx, models.HistoryEvent{
+		ReceiptID: id,
+		Type:      models.HistoryCreated,
+		Receipt:   &receipt,
+		Breakdown: &breakdown,
+		Day:       local.PurchaseDate,
+	})
+	metrics := rp.metrics
 	rp.mutex.Unlock()
+	storeSpan.End()
+
+	metrics.ReceiptProcessed(rp.tenantLabel(), breakdown.Points)
+	slog.InfoContext(ctx, "receipt processed", "tenant", rp.tenantLabel(), "receipt_id", id, "points", breakdown.Points)
+
+	rp.publish(models.ReceiptEvent{
+		Type:       models.EventReceiptProcessed,
+		ReceiptID:  id,
+		CustomerID: receipt.CustomerID,
+		Retailer:   receipt.Retailer,
+		Points:     breakdown.Points,
+	})
 
-	return id
+	return id, nil
+}
+
+// Reject records that a receipt was not processed because it is invalid for
+// reason
+func (rp *ReceiptProcessor) Reject(ctx context.Context, reason string) {
+	rp.mutex.RLock()
+	metrics := rp.metrics
+	rp.mutex.RUnlock()
+
+	metrics.ValidationFailed(reason)
+	slog.InfoContext(ctx, "receipt rejected", "tenant", rp.tenantLabel(), "reason", reason)
 }
 
 func (rp *ReceiptProcessor) GetReceipt(id string) (models.Receipt, bool) {
 	rp.mutex.RLock()
 	defer rp.mutex.RUnlock()
 
-	receipt, exists := rp.receipts[id]
-	return receipt, exists
-}
-
-func (rp *ReceiptProcessor) CalculatePoints(receipt models.Receipt) int64 {
-    var points int64 = 0
-
-    // Rule 1: One point for every alphanumeric character in the retailer name
-    alphanumericRegex := regexp.MustCompile("[a-zA-Z0-9]")
-    points += int64(len(alphanumericRegex.FindAllString(receipt.Retailer, -1)))
-
-    // Rule 2: 50 points if the total is a round dollar amount with no cents
-    total, _ := strconv.ParseFloat(receipt.Total, 64)
-    if math.Mod(total, 1.0) == 0 {
-        points += 50
-    }
-
-    // Rule 3: 25 points if the total is a multiple of 0.25
-    if math.Mod(total*100, 25) == 0 {
-        points += 25
-    }
-
-    // Rule 4: 5 points for every two items on the receipt
-    pairs := len(receipt.Items) / 2
-    points += int64(pairs * 5)
-
-    // Rule 5: If description length is multiple of 3, multiply price by 0.2 and round up
-    for _, item := range receipt.Items {
-        trimmedDesc := strings.TrimSpace(item.ShortDescription)
-        if len(trimmedDesc) > 0 && len(trimmedDesc)%3 == 0 {
-            price, _ := strconv.ParseFloat(item.Price, 64)
-            points += int64(math.Ceil(price * 0.2))
-        }
-    }
-    
-    // Rule 6: 6 points if the day in the purchase date is odd
-    purchaseDate, _ := time.Parse("2006-01-02", receipt.PurchaseDate)
-    if purchaseDate.Day()%2 == 1 {
-        points += 6
-    }
-
-    // Rule 7: 10 points if purchase time is after 2:00pm and before 4:00pm
-    purchaseTime, _ := time.Parse("15:04", receipt.PurchaseTime)
-    hour := purchaseTime.Hour()
-    minute := purchaseTime.Minute()
-    purchaseTimeMinutes := hour*60 + minute
-    
-    // After 2:00pm means >= 14:00 (>=840 minutes)
-    // Before 4:00pm means < 16:00 (<960 minutes)
-    if purchaseTimeMinutes >= 14*60 && purchaseTimeMinutes < 16*60 {
-        points += 10
-    }
-
-    return points
-}
\ No newline at end of file
+	stored, exists := rp.receipts[id]
+	return stored.receipt, exists
+}
+
+// GetBreakdown returns the points awarded to a stored receipt
+func (rp *ReceiptProcessor) GetBreakdown(id string) (models.PointsBreakdown, bool) {
+	rp.mutex.RLock()
+	defer rp.mutex.RUnlock()
+
+	stored, exists := rp.receipts[id]
+	return stored.breakdown, exists
+}
+
+// UpdateReceipt replaces a stored receipt with a corrected one and scores it
+// again with the current rules and caps, publishing a points-adjusted event
+// if its points changed. It returns ErrUnknownReceipt if there is no such
+// receipt.
+func (rp *ReceiptProcessor) UpdateReceipt(ctx context.Context, id string, receipt models.Receipt) (models.PointsBreakdown, error) {
+	receipt.CanonicalRetailer = rp.retailers.Canonicalize(receipt.Retailer)
+	return rp.rescore(ctx, id, &receipt)
+}
+
+// Rescore recalculates a stored receipt's points with the current rules and
+// caps, publishing a points-adjusted event if they changed. The receipt's
+// earlier points are released from its customer's daily total first. A
+// receipt that can no longer be scored keeps its points.
+func (rp *ReceiptProcessor) Rescore(ctx context.Context, id string) (models.PointsBreakdown, error) {
+	return rp.rescore(ctx, id, nil)
+}
+
+// rescore scores a stored receipt, or its replacement if one is given
+func (rp *ReceiptProcessor) rescore(ctx context.Context, id string, replacement *models.Receipt) (models.PointsBreakdown, error) {
+	ctx, span := Tracer().Start(ctx, "ReceiptProcessor.Rescore")
+	defer span.End()
+	span.SetAttributes(attribute.String("tenant", rp.tenantLabel()), attribute.String("receipt.id", id))
+
+	// Scoring runs unlocked. A plain rescore keeps the stored receipt, so if
+	// the receipt is updated meanwhile the new version is scored instead.
+	var receipt models.Receipt
+	var breakdown models.PointsBreakdown
+	var local models.Receipt
+	var stored storedReceipt
+	for {
+		current, exists := rp.GetReceipt(id)
+		if !exists {
+			return models.PointsBreakdown{}, ErrUnknownReceipt
+		}
+		receipt = current
+		if replacement != nil {
+			receipt = *replacement
+		}
+		var err error
+		if breakdown, err = rp.score(ctx, receipt); err != nil {
+			return models.PointsBreakdown{}, err
+		}
+		local = rp.localize(receipt)
+
+		rp.mutex.Lock()
+		stored, exists = rp.receipts[id]
+		if !exists {
+			rp.mutex.Unlock()
+			return models.PointsBreakdown{}, ErrUnknownReceipt
+		}
+		if replacement != nil || reflect.DeepEqual(stored.receipt, current) {
+			break
+		}
+		rp.mutex.Unlock()
+	}
+	previous := stored
+	rp.releaseDailyPoints(stored)
+	rp.applyDailyCap(local, &breakdown)
+	stored.receipt = receipt
+	stored.breakdown = breakdown
+	stored.day = dailyKey{customerID: receipt.CustomerID, date: local.PurchaseDate}
+	rp.receipts[id] = stored
+
+	event := models.HistoryEvent{
+		ReceiptID: id,
+		Type:      models.HistoryRescored,
+		Breakdown: &breakdown,
+		Diff:      diffReceipts(previous, stored),
+		Day:       local.PurchaseDate,
+	}
+	if replacement != nil {
+		event.Type = models.HistoryUpdated
+		event.Receipt = &receipt
+	}
+	rp.record(ctx, event)
+	rp.mutex.Unlock()
+
+	if breakdown.Points != previous.breakdown.Points {
+		rp.publish(models.ReceiptEvent{
+			Type:           models.EventPointsAdjusted,
+			ReceiptID:      id,
+			CustomerID:     receipt.CustomerID,
+			Retailer:       receipt.Retailer,
+			Points:         breakdown.Points,
+			PreviousPoints: &previous.breakdown.Points,
+		})
+	}
+
+	return breakdown, nil
+}
+
+// DeleteReceipt removes a stored receipt, releasing its points from its
+// customer's daily total. Its history is kept.
+func (rp *ReceiptProcessor) DeleteReceipt(ctx context.Context, id string) bool {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+
+	stored, exists := rp.receipts[id]
+	if !exists {
+		return false
+	}
+	rp.releaseDailyPoints(stored)
+	delete(rp.receipts, id)
+	rp.record(ctx, models.HistoryEvent{
+		ReceiptID: id,
+		Type:      models.HistoryDeleted,
+	})
+	return true
+}
+
+// releaseDailyPoints removes a stored receipt's points from its customer's
+// daily total. Callers must hold the write lock.
+func (rp *ReceiptProcessor) releaseDailyPoints(stored storedReceipt) {
+	if stored.day.customerID != "" {
+		rp.addDailyPoints(stored.day, -stored.breakdown.Points)
+	}
+}
+
+// EachReceipt calls fn for each receipt stored when it is called and not
+// since deleted, in processing order, until fn returns false. The lock is
+// only held while fetching each receipt, so fn may be slow, e.g. writing to
+// a client.
+func (rp *ReceiptProcessor) EachReceipt(fn func(id string, receipt models.Receipt, breakdown models.PointsBreakdown) bool) {
+	rp.mutex.RLock()
+	count := len(rp.ids)
+	rp.mutex.RUnlock()
+
+	for i := 0; i < count; i++ {
+		rp.mutex.RLock()
+		id := rp.ids[i]
+		stored, exists := rp.receipts[id]
+		rp.mutex.RUnlock()
+
+		if !exists {
+			continue
+		}
+		if !fn(id, stored.receipt, stored.breakdown) {
+			return
+		}
+	}
+}
+
+// CalculatePoints returns the points for a receipt after per-rule and
+// per-receipt caps
+func (rp *ReceiptProcessor) CalculatePoints(receipt models.Receipt) (int64, error) {
+	breakdown, err := rp.CalculateBreakdown(receipt)
+	return breakdown.Points, err
+}
+
+// CalculateBreakdown scores a receipt rule by rule, applying the per-rule and
+// per-receipt caps. The per-customer daily cap depends on previously
+// processed receipts and is only applied by ProcessReceipt.
+func (rp *ReceiptProcessor) CalculateBreakdown(receipt models.Receipt) (models.PointsBreakdown, error) {
+	return rp.calculateBreakdown(context.Background(), receipt)
+}
+
+// score calculates a receipt's breakdown in a span, with an event as each
+// rule is applied
+func (rp *ReceiptProcessor) score(ctx context.Context, receipt models.Receipt) (models.PointsBreakdown, error) {
+	ctx, span := Tracer().Start(ctx, "score")
+	defer span.End()
+
+	breakdown, err := rp.calculateBreakdown(ctx, receipt)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "receipt cannot be scored")
+		return breakdown, err
+	}
+	span.SetAttributes(attribute.Int64("receipt.points", breakdown.Points))
+	return breakdown, nil
+}
+
+func (rp *ReceiptProcessor) calculateBreakdown(ctx context.Context, receipt models.Receipt) (models.PointsBreakdown, error) {
+	span := trace.SpanFromContext(ctx)
+	var breakdown models.PointsBreakdown
+	caps := rp.Caps()
+	rp.mutex.RLock()
+	metrics := rp.metrics
+	rp.mutex.RUnlock()
+
+	receipt.CanonicalRetailer = rp.retailers.Canonicalize(receipt.Retailer)
+	receipt = rp.localize(receipt)
+	receipt, conversion, err := rp.convert(receipt)
+	if err != nil {
+		return models.PointsBreakdown{}, err
+	}
+	breakdown.Conversion = conversion
+	receipt.Items = rp.categorize(receipt.Items)
+	for _, rule := range rp.Rules() {
+		points := rule.Points(receipt)
+		rulePoints := models.RulePoints{
+			Rule:     rule.Name(),
+			Points:   caps.capRule(rule.Name(), points),
+			Uncapped: points,
+		}
+
+		if itemRule, ok := rule.(ItemRule); ok {
+			for i, itemPoints := range itemRule.ItemPoints(receipt) {
+				if itemPoints == 0 {
+					continue
+				}
+				item := receipt.Items[i]
+				rulePoints.Items = append(rulePoints.Items, models.ItemPoints{
+					Index:       i,
+					Description: item.ShortDescription,
+					Category:    item.Category,
+					Points:      itemPoints,
+				})
+			}
+		}
+
+		if points != 0 {
+			metrics.RuleFired(rp.tenantLabel(), rule.Name())
+		}
+		span.AddEvent("rule", trace.WithAttributes(
+			attribute.String("rule.name", rule.Name()),
+			attribute.Int64("rule.points", rulePoints.Points),
+			attribute.Int64("rule.uncapped", points),
+		))
+		breakdown.Rules = append(breakdown.Rules, rulePoints)
+		breakdown.Uncapped += points
+		breakdown.Points += rulePoints.Points
+	}
+
+	if caps.PerReceipt > 0 && breakdown.Points > caps.PerReceipt {
+		breakdown.ReceiptCapped = breakdown.Points - caps.PerReceipt
+		breakdown.Points = caps.PerReceipt
+	}
+
+	return breakdown, nil
+}
+
+// localize rewrites the purchase date and time from the receipt's time zone
+// into the retailer's store-local zone so that date and time rules see local
+// values. Receipts without a time zone are taken to already be store-local,
+// as are all receipts for retailers without a default zone.
+func (rp *ReceiptProcessor) localize(receipt models.Receipt) models.Receipt {
+	storeLoc := rp.retailers.Timezone(receipt.Retailer)
+	if receipt.Timezone == "" || storeLoc == nil {
+		return receipt
+	}
+
+	loc, err := utils.ParseTimezone(receipt.Timezone)
+	if err != nil {
+		return receipt
+	}
+	purchased, err := time.ParseInLocation("2006-01-02 15:04", receipt.PurchaseDate+" "+receipt.PurchaseTime, loc)
+	if err != nil {
+		return receipt
+	}
+
+	local := purchased.In(storeLoc)
+	receipt.PurchaseDate = local.Format("2006-01-02")
+	receipt.PurchaseTime = local.Format("15:04")
+	receipt.Timezone = storeLoc.String()
+	return receipt
+}
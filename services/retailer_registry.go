@@ -0,0 +1,189 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"receipt-processor/models"
+	"receipt-processor/utils"
+)
+
+// RetailerNameMode selects which retailer name Rule 1 counts characters in
+type RetailerNameMode string
+
+const (
+	RetailerNameRaw       RetailerNameMode = "raw"
+	RetailerNameCanonical RetailerNameMode = "canonical"
+)
+
+// Common abbreviations expanded during normalization
+var retailerTokenAliases = map[string]string{
+	"and":  "&",
+	"co":   "company",
+	"ctr":  "center",
+	"intl": "international",
+	"mkt":  "market",
+	"mkts": "markets",
+}
+
+// NormalizeRetailerName lowercases the name, drops punctuation, collapses
+// whitespace and expands common abbreviations so that spelling variants of
+// the same retailer map to the same key.
+func NormalizeRetailerName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r == '&':
+			b.WriteString(" & ")
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		case unicode.IsSpace(r):
+			b.WriteRune(' ')
+		}
+	}
+
+	tokens := strings.Fields(b.String())
+	for i, token := range tokens {
+		if expanded, ok := retailerTokenAliases[token]; ok {
+			tokens[i] = expanded
+		}
+	}
+	return strings.Join(tokens, " ")
+}
+
+// RetailerRegistry resolves retailer names to canonical names using the
+// normalization pipeline and an admin-managed alias table, and holds each
+// retailer's default time zone.
+type RetailerRegistry struct {
+	aliases   map[string]string
+	timezones map[string]*time.Location
+	mutex     sync.RWMutex
+}
+
+func NewRetailerRegistry() *RetailerRegistry {
+	return &RetailerRegistry{
+		aliases:   make(map[string]string),
+		timezones: make(map[string]*time.Location),
+	}
+}
+
+func (rr *RetailerRegistry) Canonicalize(name string) string {
+	normalized := NormalizeRetailerName(name)
+
+	rr.mutex.RLock()
+	defer rr.mutex.RUnlock()
+
+	if canonical, exists := rr.aliases[normalized]; exists {
+		return canonical
+	}
+	return normalized
+}
+
+// SetAlias maps every spelling that normalizes like alias to canonical.
+// It returns false if either name normalizes to an empty string.
+func (rr *RetailerRegistry) SetAlias(alias, canonical string) bool {
+	key := NormalizeRetailerName(alias)
+	value := NormalizeRetailerName(canonical)
+	if key == "" || value == "" {
+		return false
+	}
+
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	if key == value {
+		delete(rr.aliases, key)
+		return true
+	}
+	rr.aliases[key] = value
+	return true
+}
+
+func (rr *RetailerRegistry) RemoveAlias(alias string) bool {
+	key := NormalizeRetailerName(alias)
+
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	if _, exists := rr.aliases[key]; !exists {
+		return false
+	}
+	delete(rr.aliases, key)
+	return true
+}
+
+// Aliases returns the alias table sorted by alias
+func (rr *RetailerRegistry) Aliases() []models.RetailerAlias {
+	rr.mutex.RLock()
+	defer rr.mutex.RUnlock()
+
+	aliases := make([]models.RetailerAlias, 0, len(rr.aliases))
+	for alias, canonical := range rr.aliases {
+		aliases = append(aliases, models.RetailerAlias{Alias: alias, Canonical: canonical})
+	}
+	sort.Slice(aliases, func(i, j int) bool {
+		return aliases[i].Alias < aliases[j].Alias
+	})
+	return aliases
+}
+
+// SetTimezone sets the store-local time zone for a retailer, keyed by its
+// canonical name.
+func (rr *RetailerRegistry) SetTimezone(retailer, timezone string) error {
+	loc, err := utils.ParseTimezone(timezone)
+	if err != nil {
+		return err
+	}
+
+	key := rr.Canonicalize(retailer)
+	if key == "" {
+		return fmt.Errorf("invalid retailer name %q", retailer)
+	}
+
+	rr.mutex.Lock()
+	rr.timezones[key] = loc
+	rr.mutex.Unlock()
+	return nil
+}
+
+func (rr *RetailerRegistry) RemoveTimezone(retailer string) bool {
+	key := rr.Canonicalize(retailer)
+
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	if _, exists := rr.timezones[key]; !exists {
+		return false
+	}
+	delete(rr.timezones, key)
+	return true
+}
+
+// Timezone returns the retailer's store-local time zone, or nil if none is set
+func (rr *RetailerRegistry) Timezone(retailer string) *time.Location {
+	key := rr.Canonicalize(retailer)
+
+	rr.mutex.RLock()
+	defer rr.mutex.RUnlock()
+
+	return rr.timezones[key]
+}
+
+// Timezones returns the retailer time zones sorted by retailer
+func (rr *RetailerRegistry) Timezones() []models.RetailerTimezone {
+	rr.mutex.RLock()
+	defer rr.mutex.RUnlock()
+
+	timezones := make([]models.RetailerTimezone, 0, len(rr.timezones))
+	for retailer, loc := range rr.timezones {
+		timezones = append(timezones, models.RetailerTimezone{Retailer: retailer, Timezone: loc.String()})
+	}
+	sort.Slice(timezones, func(i, j int) bool {
+		return timezones[i].Retailer < timezones[j].Retailer
+	})
+	return timezones
+}
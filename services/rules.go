@@ -0,0 +1,298 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"receipt-processor/expr"
+	"receipt-processor/models"
+	"receipt-processor/utils"
+)
+
+// Rule awards points for one aspect of a receipt
+type Rule interface {
+	Name() string
+	Points(receipt models.Receipt) int64
+}
+
+type ruleFunc struct {
+	name   string
+	points func(receipt models.Receipt) int64
+}
+
+func (r ruleFunc) Name() string {
+	return r.name
+}
+
+func (r ruleFunc) Points(receipt models.Receipt) int64 {
+	return r.points(receipt)
+}
+
+// ItemRule is a Rule whose points are earned by individual items, reported
+// per item in the breakdown
+type ItemRule interface {
+	Rule
+	ItemPoints(receipt models.Receipt) []int64
+}
+
+type itemRuleFunc struct {
+	name   string
+	points func(item models.Item) int64
+}
+
+func (r itemRuleFunc) Name() string {
+	return r.name
+}
+
+func (r itemRuleFunc) Points(receipt models.Receipt) int64 {
+	var points int64 = 0
+	for _, itemPoints := range r.ItemPoints(receipt) {
+		points += itemPoints
+	}
+	return points
+}
+
+func (r itemRuleFunc) ItemPoints(receipt models.Receipt) []int64 {
+	points := make([]int64, len(receipt.Items))
+	for i, item := range receipt.Items {
+		points[i] = r.points(item)
+	}
+	return points
+}
+
+var alphanumericRegex = regexp.MustCompile("[a-zA-Z0-9]")
+
+func (rp *ReceiptProcessor) builtinRules() []Rule {
+	return []Rule{
+		ruleFunc{"retailer-name", rp.retailerNamePoints},
+		ruleFunc{"round-dollar", roundDollarPoints},
+		ruleFunc{"quarter-multiple", quarterMultiplePoints},
+		ruleFunc{"item-pairs", itemPairPoints},
+		itemRuleFunc{"description-length", descriptionLengthPoints},
+		ruleFunc{"odd-day", oddDayPoints},
+		ruleFunc{"afternoon", afternoonPoints},
+	}
+}
+
+// Rules returns the built-in rules followed by any custom rules, in the
+// order they are applied.
+func (rp *ReceiptProcessor) Rules() []Rule {
+	rp.mutex.RLock()
+	defer rp.mutex.RUnlock()
+
+	return append([]Rule(nil), rp.rules...)
+}
+
+func (rp *ReceiptProcessor) AddRule(rule Rule) {
+	rp.mutex.Lock()
+	rp.rules = append(rp.rules, rule)
+	rp.mutex.Unlock()
+}
+
+// Rule 1: One point for every alphanumeric character in the retailer name
+func (rp *ReceiptProcessor) retailerNamePoints(receipt models.Receipt) int64 {
+	rp.mutex.RLock()
+	mode := rp.retailerNameMode
+	rp.mutex.RUnlock()
+
+	retailer := receipt.Retailer
+	if mode == RetailerNameCanonical {
+		retailer = receipt.CanonicalRetailer
+	}
+	return int64(len(alphanumericRegex.FindAllString(retailer, -1)))
+}
+
+// Rule 2: 50 points if the total is a round dollar amount with no cents
+func roundDollarPoints(receipt models.Receipt) int64 {
+	total, _ := strconv.ParseFloat(receipt.Total, 64)
+	if math.Mod(total, 1.0) == 0 {
+		return 50
+	}
+	return 0
+}
+
+// Rule 3: 25 points if the total is a multiple of 0.25
+func quarterMultiplePoints(receipt models.Receipt) int64 {
+	total, _ := strconv.ParseFloat(receipt.Total, 64)
+	if math.Mod(total*100, 25) == 0 {
+		return 25
+	}
+	return 0
+}
+
+// Rule 4: 5 points for every two items on the receipt. A line with an
+// integer quantity counts as that many items, a weighed line (fractional
+// quantity) as one, and negative lines as none.
+func itemPairPoints(receipt models.Receipt) int64 {
+	items := 0
+	for _, item := range receipt.Items {
+		items += itemUnits(item)
+	}
+	pairs := items / 2
+	return int64(pairs * 5)
+}
+
+func itemUnits(item models.Item) int {
+	if strings.HasPrefix(item.Price, "-") {
+		return 0
+	}
+	thousandths, err := utils.ParseQuantity(item.Quantity)
+	if err != nil || thousandths%1000 != 0 {
+		return 1
+	}
+	return int(thousandths / 1000)
+}
+
+// Rule 5: If description length is multiple of 3, multiply price by 0.2 and round up.
+// The line price is used, so multi-quantity lines earn on their full amount;
+// negative lines earn nothing.
+func descriptionLengthPoints(item models.Item) int64 {
+	trimmedDesc := strings.TrimSpace(item.ShortDescription)
+	if len(trimmedDesc) > 0 && len(trimmedDesc)%3 == 0 {
+		price, _ := strconv.ParseFloat(item.Price, 64)
+		if price <= 0 {
+			return 0
+		}
+		return int64(math.Ceil(price * 0.2))
+	}
+	return 0
+}
+
+// Rule 6: 6 points if the day in the purchase date is odd
+func oddDayPoints(receipt models.Receipt) int64 {
+	purchaseDate, _ := time.Parse("2006-01-02", receipt.PurchaseDate)
+	if purchaseDate.Day()%2 == 1 {
+		return 6
+	}
+	return 0
+}
+
+// Rule 7: 10 points if purchase time is after 2:00pm and before 4:00pm
+func afternoonPoints(receipt models.Receipt) int64 {
+	purchaseTime, _ := time.Parse("15:04", receipt.PurchaseTime)
+	purchaseTimeMinutes := purchaseTime.Hour()*60 + purchaseTime.Minute()
+
+	// After 2:00pm means >= 14:00 (>=840 minutes)
+	// Before 4:00pm means < 16:00 (<960 minutes)
+	if purchaseTimeMinutes >= 14*60 && purchaseTimeMinutes < 16*60 {
+		return 10
+	}
+	return 0
+}
+
+// ExpressionRule awards the points computed by a custom expression
+type ExpressionRule struct {
+	name     string
+	program  *expr.Program
+	maxSteps int
+}
+
+// NewExpressionRule compiles expression, reporting syntax and type errors
+// with their position. maxSteps <= 0 uses expr.DefaultMaxSteps.
+func NewExpressionRule(name, expression string, maxSteps int) (*ExpressionRule, error) {
+	program, err := expr.Compile(expression)
+	if err != nil {
+		return nil, fmt.Errorf("rule %q: %w", name, err)
+	}
+	return &ExpressionRule{name: name, program: program, maxSteps: maxSteps}, nil
+}
+
+func (r *ExpressionRule) Name() string {
+	return r.name
+}
+
+// Points rounds the expression result down to whole points. Evaluation
+// errors, such as exceeding the step limit, award no points, as do results
+// that are not numbers or too large to be points.
+func (r *ExpressionRule) Points(receipt models.Receipt) int64 {
+	value, err := r.program.Eval(receipt, r.maxSteps)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) || math.Abs(value) >= math.MaxInt64 {
+		return 0
+	}
+	return int64(math.Floor(value))
+}
+
+// CategoryRule awards points for each item in a category, plus a bonus if
+// the receipt has any item in it
+type CategoryRule struct {
+	name              string
+	category          string
+	pointsPerItem     int64
+	pointsPerCategory int64
+}
+
+func NewCategoryRule(name, category string, pointsPerItem, pointsPerCategory int64) *CategoryRule {
+	return &CategoryRule{
+		name:              name,
+		category:          normalizeCategory(category),
+		pointsPerItem:     pointsPerItem,
+		pointsPerCategory: pointsPerCategory,
+	}
+}
+
+func (r *CategoryRule) Name() string {
+	return r.name
+}
+
+func (r *CategoryRule) Points(receipt models.Receipt) int64 {
+	var points int64 = 0
+	qualifying := false
+	for _, item := range receipt.Items {
+		if normalizeCategory(item.Category) == r.category {
+			points += r.pointsPerItem
+			qualifying = true
+		}
+	}
+	if qualifying {
+		points += r.pointsPerCategory
+	}
+	return points
+}
+
+// ItemPoints reports only the per-item points; the per-category bonus is
+// not attributed to any one item.
+func (r *CategoryRule) ItemPoints(receipt models.Receipt) []int64 {
+	points := make([]int64, len(receipt.Items))
+	for i, item := range receipt.Items {
+		if normalizeCategory(item.Category) == r.category {
+			points[i] = r.pointsPerItem
+		}
+	}
+	return points
+}
+
+// LoadRules reads a JSON array of rule definitions and compiles them, failing
+// on the first invalid rule.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var definitions []models.RuleDefinition
+	if err := json.Unmarshal(data, &definitions); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	rules := make([]Rule, 0, len(definitions))
+	for _, definition := range definitions {
+		if definition.Category != "" {
+			rules = append(rules, NewCategoryRule(definition.Name, definition.Category,
+				definition.PointsPerItem, definition.PointsPerCategory))
+			continue
+		}
+
+		rule, err := NewExpressionRule(definition.Name, definition.Expression, definition.MaxSteps)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
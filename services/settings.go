@@ -0,0 +1,110 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"receipt-processor/models"
+)
+
+// TenantSettings are the settings admins change through the API: point
+// caps, retailer aliases and time zones, and webhook subscriptions with
+// their secrets
+type TenantSettings struct {
+	Caps              PointCaps                    `json:"caps"`
+	RetailerAliases   []models.RetailerAlias       `json:"retailerAliases,omitempty"`
+	RetailerTimezones []models.RetailerTimezone    `json:"retailerTimezones,omitempty"`
+	Webhooks          []models.WebhookSubscription `json:"webhooks,omitempty"`
+}
+
+// SettingsFile keeps a tenant's settings in a JSON file, so that changes
+// made through the API survive restarts. The file holds webhook secrets, so
+// only its owner can read it.
+type SettingsFile struct {
+	path   string
+	tenant *Tenant
+	mutex  sync.Mutex
+}
+
+func NewSettingsFile(path string, tenant *Tenant) *SettingsFile {
+	return &SettingsFile{
+		path:   path,
+		tenant: tenant,
+	}
+}
+
+// Load applies the saved settings to the tenant. A missing file leaves the
+// tenant unchanged.
+func (sf *SettingsFile) Load() error {
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+
+	data, err := os.ReadFile(sf.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var settings TenantSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("%s: %w", sf.path, err)
+	}
+	if !settings.Caps.Valid() {
+		return fmt.Errorf("%s: caps must not be negative", sf.path)
+	}
+
+	retailers := sf.tenant.Processor.Retailers()
+	for _, alias := range settings.RetailerAliases {
+		if !retailers.SetAlias(alias.Alias, alias.Canonical) {
+			return fmt.Errorf("%s: invalid alias %q", sf.path, alias.Alias)
+		}
+	}
+	for _, timezone := range settings.RetailerTimezones {
+		if err := retailers.SetTimezone(timezone.Retailer, timezone.Timezone); err != nil {
+			return fmt.Errorf("%s: %w", sf.path, err)
+		}
+	}
+	if err := sf.tenant.Webhooks.restoreSubscriptions(settings.Webhooks); err != nil {
+		return fmt.Errorf("%s: %w", sf.path, err)
+	}
+	sf.tenant.Processor.SetCaps(settings.Caps)
+	return nil
+}
+
+// Save writes the tenant's current settings, replacing the file only once
+// they are completely written
+func (sf *SettingsFile) Save() error {
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+
+	retailers := sf.tenant.Processor.Retailers()
+	data, err := json.MarshalIndent(TenantSettings{
+		Caps:              sf.tenant.Processor.Caps(),
+		RetailerAliases:   retailers.Aliases(),
+		RetailerTimezones: retailers.Timezones(),
+		Webhooks:          sf.tenant.Webhooks.savedSubscriptions(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(sf.path), filepath.Base(sf.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), sf.path)
+}
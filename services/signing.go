@@ -0,0 +1,214 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"receipt-processor/models"
+)
+
+// TenantHeader names the tenant of a request made with credentials that are
+// not limited to one tenant
+const TenantHeader = "X-Tenant-ID"
+
+// Headers of a signed request
+const (
+	SignatureKeyHeader       = "X-Signature-Key-ID"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	SignatureNonceHeader     = "X-Signature-Nonce"
+	SignatureHeader          = "X-Signature"
+)
+
+const (
+	// DefaultSignatureWindow is how far a signed request's timestamp may be
+	// from the server's clock
+	DefaultSignatureWindow = 5 * time.Minute
+
+	// MaxSignedBodyBytes limits the body of a signed request
+	MaxSignedBodyBytes = 1 << 20
+
+	minSigningSecretLength = 32
+	maxSignatureNonces     = 100000
+)
+
+var (
+	ErrInvalidSigningKey = errors.New("signing keys need an ID, a client, a secret of at least 32 characters and a valid tenant if any")
+	ErrInvalidSignature  = errors.New("the request signature is invalid")
+)
+
+// SignRequest signs a request with a terminal's key, setting the signature
+// headers. The body is read and replaced, so it can still be sent.
+func SignRequest(req *http.Request, keyID, secret string) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set(SignatureKeyHeader, keyID)
+	req.Header.Set(SignatureTimestampHeader, timestamp)
+	req.Header.Set(SignatureNonceHeader, hex.EncodeToString(nonce))
+	req.Header.Set(SignatureHeader, signature(secret, req, body))
+	return nil
+}
+
+// signature is the hex HMAC-SHA256 of the method, path and query, tenant
+// header, timestamp, nonce and SHA-256 digest of the body, each on its own
+// line. The tenant line is empty when no tenant is named.
+func signature(secret string, req *http.Request, body []byte) string {
+	digest := sha256.Sum256(body)
+	message := strings.Join([]string{
+		req.Method,
+		req.URL.RequestURI(),
+		req.Header.Get(TenantHeader),
+		req.Header.Get(SignatureTimestampHeader),
+		req.Header.Get(SignatureNonceHeader),
+		hex.EncodeToString(digest[:]),
+	}, "\n")
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// RequestVerifier checks signed requests against the terminals' keys. Each
+// nonce is accepted once within the window, so a captured request cannot be
+// sent again.
+type RequestVerifier struct {
+	keys   map[string]models.SigningKey
+	window time.Duration
+	nonces map[string]time.Time
+	mutex  sync.Mutex
+}
+
+func NewRequestVerifier(keys []models.SigningKey) (*RequestVerifier, error) {
+	byID := make(map[string]models.SigningKey, len(keys))
+	for _, key := range keys {
+		if key.ID == "" || key.Client == "" || len(key.Secret) < minSigningSecretLength ||
+			(key.Tenant != "" && !ValidTenantID(key.Tenant)) {
+			return nil, ErrInvalidSigningKey
+		}
+		if _, exists := byID[key.ID]; exists {
+			return nil, fmt.Errorf("%w: duplicate ID %s", ErrInvalidSigningKey, key.ID)
+		}
+		byID[key.ID] = key
+	}
+
+	return &RequestVerifier{
+		keys:   byID,
+		window: DefaultSignatureWindow,
+		nonces: make(map[string]time.Time),
+	}, nil
+}
+
+// LoadSigningKeys reads a JSON array of signing keys
+func LoadSigningKeys(path string) (*RequestVerifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []models.SigningKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	verifier, err := NewRequestVerifier(keys)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return verifier, nil
+}
+
+// SetWindow changes how far timestamps may be from the server's clock
+func (v *RequestVerifier) SetWindow(window time.Duration) {
+	v.mutex.Lock()
+	v.window = window
+	v.mutex.Unlock()
+}
+
+// Verify checks a signed request and returns the key it was signed with.
+// The body is read, up to MaxSignedBodyBytes, and replaced so that it can
+// be read again.
+func (v *RequestVerifier) Verify(req *http.Request) (models.SigningKey, error) {
+	key, exists := v.keys[req.Header.Get(SignatureKeyHeader)]
+	if !exists {
+		return models.SigningKey{}, fmt.Errorf("%w: unknown key", ErrInvalidSignature)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, MaxSignedBodyBytes+1))
+	if err != nil {
+		return models.SigningKey{}, err
+	}
+	if len(body) > MaxSignedBodyBytes {
+		return models.SigningKey{}, fmt.Errorf("%w: body too large", ErrInvalidSignature)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := signature(key.Secret, req, body)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(req.Header.Get(SignatureHeader)))) {
+		return models.SigningKey{}, fmt.Errorf("%w: bad signature", ErrInvalidSignature)
+	}
+
+	// Only signed timestamps and nonces are trusted
+	seconds, err := strconv.ParseInt(req.Header.Get(SignatureTimestampHeader), 10, 64)
+	if err != nil {
+		return models.SigningKey{}, fmt.Errorf("%w: malformed timestamp", ErrInvalidSignature)
+	}
+	nonce := req.Header.Get(SignatureNonceHeader)
+	if nonce == "" || len(nonce) > 128 {
+		return models.SigningKey{}, fmt.Errorf("%w: malformed nonce", ErrInvalidSignature)
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	now := time.Now()
+	signedAt := time.Unix(seconds, 0)
+	if signedAt.Before(now.Add(-v.window)) || signedAt.After(now.Add(v.window)) {
+		return models.SigningKey{}, fmt.Errorf("%w: timestamp outside the window", ErrInvalidSignature)
+	}
+
+	// A nonce only needs remembering until its timestamp leaves the window
+	id := key.ID + " " + nonce
+	if expires, seen := v.nonces[id]; seen && now.Before(expires) {
+		return models.SigningKey{}, fmt.Errorf("%w: replayed", ErrInvalidSignature)
+	}
+	if len(v.nonces) >= maxSignatureNonces {
+		for seen, expires := range v.nonces {
+			if !now.Before(expires) {
+				delete(v.nonces, seen)
+			}
+		}
+		if len(v.nonces) >= maxSignatureNonces {
+			return models.SigningKey{}, fmt.Errorf("%w: too many recent requests", ErrInvalidSignature)
+		}
+	}
+	v.nonces[id] = signedAt.Add(v.window)
+	return key, nil
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// DefaultTenant holds the receipts of requests that do not name a tenant
+const DefaultTenant = "default"
+
+const (
+	tenantEventRing   = 1000
+	tenantEventBuffer = 100
+)
+
+var (
+	ErrInvalidTenant = errors.New("tenant IDs are letters, digits, '.', '_' and '-'")
+	ErrUnknownTenant = errors.New("unknown tenant")
+
+	errTenantSetup = errors.New("tenant setup did not finish")
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// ValidTenantID reports whether id can name a tenant
+func ValidTenantID(id string) bool {
+	return tenantIDPattern.MatchString(id)
+}
+
+// Tenant holds one tenant's receipts, rules, event stream and webhooks,
+// none of which are shared with other tenants. Settings is nil unless the
+// tenant's settings are saved.
+type Tenant struct {
+	ID        string
+	Processor *ReceiptProcessor
+	Events    *EventBroker
+	Webhooks  *WebhookDispatcher
+	Settings  *SettingsFile
+}
+
+// TenantRegistry creates each allowed tenant the first time it is used.
+// Only allowed tenants are ever created, so callers cannot make the server
+// allocate a tenant for every ID they make up. Tenants are set up without
+// holding the registry's lock, so one tenant's setup does not hold up
+// requests for the others.
+type TenantRegistry struct {
+	tenants map[string]*Tenant
+	loading map[string]*tenantLoad
+	allowed map[string]bool
+	setup   func(*Tenant) error
+	mutex   sync.Mutex
+}
+
+// tenantLoad is a tenant being set up. Requests for it wait for done.
+type tenantLoad struct {
+	done   chan struct{}
+	tenant *Tenant
+	err    error
+}
+
+// NewTenantRegistry calls setup, if given, on each new tenant before it is
+// used, e.g. to load its rules. Only the default tenant is allowed until
+// SetAllowed is called.
+func NewTenantRegistry(setup func(*Tenant) error) *TenantRegistry {
+	return &TenantRegistry{
+		tenants: make(map[string]*Tenant),
+		loading: make(map[string]*tenantLoad),
+		allowed: map[string]bool{DefaultTenant: true},
+		setup:   setup,
+	}
+}
+
+// SetAllowed allows the given tenants as well as the default tenant
+func (tr *TenantRegistry) SetAllowed(ids []string) error {
+	allowed := map[string]bool{DefaultTenant: true}
+	for _, id := range ids {
+		if !ValidTenantID(id) {
+			return ErrInvalidTenant
+		}
+		allowed[id] = true
+	}
+
+	tr.mutex.Lock()
+	tr.allowed = allowed
+	tr.mutex.Unlock()
+	return nil
+}
+
+// Tenant returns a tenant, creating it if it is new. Tenants that are not
+// allowed return ErrUnknownTenant without anything being allocated. Callers
+// asking for a tenant that is being set up wait for it, and get its error
+// if the setup fails; the next call tries again.
+func (tr *TenantRegistry) Tenant(id string) (*Tenant, error) {
+	if !ValidTenantID(id) {
+		return nil, ErrInvalidTenant
+	}
+
+	tr.mutex.Lock()
+	if tenant, exists := tr.tenants[id]; exists {
+		tr.mutex.Unlock()
+		return tenant, nil
+	}
+	if load, exists := tr.loading[id]; exists {
+		tr.mutex.Unlock()
+		<-load.done
+		return load.tenant, load.err
+	}
+	if !tr.allowed[id] {
+		tr.mutex.Unlock()
+		return nil, ErrUnknownTenant
+	}
+	// Waiters are released even if the setup panics
+	load := &tenantLoad{done: make(chan struct{}), err: errTenantSetup}
+	tr.loading[id] = load
+	tr.mutex.Unlock()
+	defer func() {
+		tr.mutex.Lock()
+		delete(tr.loading, id)
+		if load.err == nil {
+			tr.tenants[id] = load.tenant
+		}
+		tr.mutex.Unlock()
+		close(load.done)
+	}()
+
+	load.tenant, load.err = tr.create(id)
+	return load.tenant, load.err
+}
+
+// create makes a tenant and sets it up
+func (tr *TenantRegistry) create(id string) (*Tenant, error) {
+	processor := NewReceiptProcessor()
+	processor.tenant = id
+	tenant := &Tenant{
+		ID:        id,
+		Processor: processor,
+		Events:    NewEventBroker(tenantEventRing, tenantEventBuffer),
+		Webhooks:  NewWebhookDispatcher(),
+	}
+	processor.AddListener(tenant.Events.Publish)
+	processor.AddListener(tenant.Webhooks.Notify)
+	if tr.setup != nil {
+		if err := tr.setup(tenant); err != nil {
+			tenant.Webhooks.Close(context.Background())
+			return nil, err
+		}
+	}
+	return tenant, nil
+}
+
+// Tenants returns the tenants created so far, by ID
+func (tr *TenantRegistry) Tenants() []*Tenant {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	tenants := make([]*Tenant, 0, len(tr.tenants))
+	for _, tenant := range tr.tenants {
+		tenants = append(tenants, tenant)
+	}
+	sort.Slice(tenants, func(i, j int) bool {
+		return tenants[i].ID < tenants[j].ID
+	})
+	return tenants
+}
+
+// CloseEvents disconnects every tenant's event stream subscribers
+func (tr *TenantRegistry) CloseEvents() {
+	for _, tenant := range tr.Tenants() {
+		tenant.Events.Close()
+	}
+}
+
+// Close waits for every tenant's webhooks to be delivered, or for ctx to be
+// done
+func (tr *TenantRegistry) Close(ctx context.Context) error {
+	var errs []error
+	for _, tenant := range tr.Tenants() {
+		errs = append(errs, tenant.Webhooks.Close(ctx))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,413 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTenantClaim   = "tenant_id"
+	DefaultCustomerClaim = "customer_id"
+
+	defaultJWKSRefresh = time.Hour
+	minJWKSRefresh     = 10 * time.Second
+	maxJWKSBytes       = 1 << 20
+	jwksFetchTimeout   = 10 * time.Second
+	defaultTokenLeeway = time.Minute
+)
+
+var (
+	ErrInvalidToken = errors.New("the token is invalid")
+	ErrUnknownKey   = errors.New("no key found for the token")
+)
+
+// JWKSource loads signing keys from a JSON Web Key Set in a file or at an
+// http(s) URL. Keys are cached and loaded again once they are older than
+// the refresh interval, or sooner when a token names a key that is not in
+// the cache, so that keys can be rolled over. Callers needing a load share
+// the one in progress, and after a failed load the next is put off for
+// longer each time, so an unavailable key set is not fetched for every
+// token.
+type JWKSource struct {
+	location    string
+	refresh     time.Duration
+	client      *http.Client
+	keys        map[string]crypto.PublicKey
+	loadedAt    time.Time
+	attemptedAt time.Time
+	failures    int
+	loading     chan struct{}
+	mutex       sync.Mutex
+}
+
+// NewJWKSource loads a key set, failing if it cannot be read. A zero refresh
+// interval means an hour.
+func NewJWKSource(location string, refresh time.Duration) (*JWKSource, error) {
+	if refresh <= 0 {
+		refresh = defaultJWKSRefresh
+	}
+	source := &JWKSource{
+		location: location,
+		refresh:  refresh,
+		client:   &http.Client{Timeout: jwksFetchTimeout},
+	}
+	keys, err := source.fetch()
+	if err != nil {
+		return nil, err
+	}
+	source.keys = keys
+	source.loadedAt = time.Now()
+	source.attemptedAt = source.loadedAt
+	return source, nil
+}
+
+// Key returns the key with the given ID. If the cached keys cannot be
+// reloaded they are kept.
+func (s *JWKSource) Key(kid string) (crypto.PublicKey, error) {
+	s.mutex.Lock()
+	age := time.Since(s.loadedAt)
+	_, cached := s.keys[kid]
+	due := age >= s.refresh || (!cached && age >= min(s.refresh, minJWKSRefresh))
+	loading := s.loading
+	if due && loading == nil && time.Since(s.attemptedAt) >= s.backoff() {
+		loading = s.startLoad()
+	}
+	s.mutex.Unlock()
+
+	// The key set is fetched without holding the lock
+	if due && loading != nil {
+		<-loading
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key, exists := s.keys[kid]
+	if !exists {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// backoff is how long to wait after the last attempt before loading again:
+// nothing after a success, then doubling from the shortest refresh interval
+// up to the refresh interval. Callers must hold the lock.
+func (s *JWKSource) backoff() time.Duration {
+	if s.failures == 0 {
+		return 0
+	}
+	backoff := min(s.refresh, minJWKSRefresh)
+	for i := 1; i < s.failures && backoff < s.refresh; i++ {
+		backoff *= 2
+	}
+	return min(backoff, s.refresh)
+}
+
+// startLoad loads the key set in the background, returning a channel closed
+// when it is done. Callers must hold the lock.
+func (s *JWKSource) startLoad() chan struct{} {
+	done := make(chan struct{})
+	s.loading = done
+	s.attemptedAt = time.Now()
+
+	go func() {
+		keys, err := s.fetch()
+
+		s.mutex.Lock()
+		if err != nil {
+			s.failures++
+			slog.Warn("failed to reload JWKS", "location", s.location, "failures", s.failures, "error", err)
+		} else {
+			s.keys = keys
+			s.loadedAt = time.Now()
+			s.failures = 0
+		}
+		s.loading = nil
+		s.mutex.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// fetch reads and parses the key set
+func (s *JWKSource) fetch() (map[string]crypto.PublicKey, error) {
+	data, err := s.read()
+	if err != nil {
+		return nil, fmt.Errorf("reading JWKS: %w", err)
+	}
+
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("reading JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for i, raw := range set.Keys {
+		kid, key, err := parseJWK(raw)
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key %d: %w", i+1, err)
+		}
+		if key != nil {
+			keys[kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (s *JWKSource) read() ([]byte, error) {
+	if !strings.HasPrefix(s.location, "http://") && !strings.HasPrefix(s.location, "https://") {
+		return os.ReadFile(s.location)
+	}
+
+	resp, err := s.client.Get(s.location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", s.location, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSBytes))
+}
+
+// parseJWK reads an RSA or P-256 public key. Keys of other types, or not
+// meant for signatures, are skipped and returned as nil.
+func parseJWK(raw json.RawMessage) (string, crypto.PublicKey, error) {
+	var jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return "", nil, err
+	}
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return "", nil, nil
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return "", nil, errors.New("invalid RSA key")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 {
+			return "", nil, errors.New("RSA key is too short")
+		}
+		return jwk.Kid, key, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return "", nil, nil
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return "", nil, errors.New("invalid EC key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if _, err := key.ECDH(); err != nil {
+			return "", nil, errors.New("invalid EC key")
+		}
+		return jwk.Kid, key, nil
+	}
+	return "", nil, nil
+}
+
+// TokenValidator checks RS256 and ES256 signed JWTs and maps their claims to
+// a Principal. The client is the subject and scopes come from the space
+// separated scope claim. Tokens must name a tenant unless their subject is
+// one of the operators, who may act for every tenant.
+type TokenValidator struct {
+	keys          *JWKSource
+	issuer        string
+	audience      string
+	tenantClaim   string
+	customerClaim string
+	operators     map[string]bool
+	leeway        time.Duration
+}
+
+func NewTokenValidator(keys *JWKSource) *TokenValidator {
+	return &TokenValidator{
+		keys:          keys,
+		tenantClaim:   DefaultTenantClaim,
+		customerClaim: DefaultCustomerClaim,
+		leeway:        defaultTokenLeeway,
+	}
+}
+
+// SetIssuer requires tokens to have been issued by issuer
+func (v *TokenValidator) SetIssuer(issuer string) {
+	v.issuer = issuer
+}
+
+// SetAudience requires tokens to be meant for audience
+func (v *TokenValidator) SetAudience(audience string) {
+	v.audience = audience
+}
+
+// SetClaims names the claims holding the tenant and customer ID
+func (v *TokenValidator) SetClaims(tenantClaim, customerClaim string) {
+	v.tenantClaim = tenantClaim
+	v.customerClaim = customerClaim
+}
+
+// SetOperators lists the subjects whose tokens may omit the tenant claim
+func (v *TokenValidator) SetOperators(subjects []string) {
+	v.operators = make(map[string]bool, len(subjects))
+	for _, subject := range subjects {
+		v.operators[subject] = true
+	}
+}
+
+// Validate verifies a token's signature and time limits, and its issuer and
+// audience if set, and returns its caller
+func (v *TokenValidator) Validate(token string) (Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return Principal{}, fmt.Errorf("%w: malformed header", ErrInvalidToken)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+	key, err := v.keys.Key(header.Kid)
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !verifyTokenSignature(header.Alg, key, digest[:], signature) {
+		return Principal{}, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	var claims map[string]any
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return Principal{}, fmt.Errorf("%w: malformed claims", ErrInvalidToken)
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return Principal{}, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	principal := Principal{
+		Client:     stringClaim(claims, "sub"),
+		Tenant:     stringClaim(claims, v.tenantClaim),
+		CustomerID: stringClaim(claims, v.customerClaim),
+	}
+	for _, scope := range strings.Fields(stringClaim(claims, "scope")) {
+		if apiKeyScopes[scope] {
+			principal.Scopes = append(principal.Scopes, scope)
+		}
+	}
+	if principal.Client == "" {
+		return Principal{}, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+	if principal.Tenant == "" && !v.operators[principal.Client] {
+		return Principal{}, fmt.Errorf("%w: no tenant", ErrInvalidToken)
+	}
+	return principal, nil
+}
+
+func (v *TokenValidator) checkClaims(claims map[string]any) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(v.leeway)) {
+		return errors.New("expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("not yet valid")
+	}
+	if v.issuer != "" && stringClaim(claims, "iss") != v.issuer {
+		return errors.New("wrong issuer")
+	}
+	if v.audience != "" {
+		var audiences []string
+		switch aud := claims["aud"].(type) {
+		case string:
+			audiences = []string{aud}
+		case []any:
+			for _, value := range aud {
+				if s, ok := value.(string); ok {
+					audiences = append(audiences, s)
+				}
+			}
+		}
+		if !slices.Contains(audiences, v.audience) {
+			return errors.New("wrong audience")
+		}
+	}
+	return nil
+}
+
+// verifyTokenSignature only accepts the algorithm matching the key's type,
+// so a token cannot choose a weaker check
+func verifyTokenSignature(alg string, key crypto.PublicKey, digest, signature []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+func decodeTokenPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// stringClaim returns a string claim, or a numeric one such as a customer
+// number formatted as a string
+func stringClaim(claims map[string]any, name string) string {
+	switch value := claims[name].(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return ""
+}
@@ -0,0 +1,464 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"receipt-processor/models"
+
+	"github.com/google/uuid"
+)
+
+// Headers sent with each webhook request. The signature is
+// "sha256=" followed by the hex HMAC-SHA256 of the timestamp, a ".", and
+// the body, keyed with the subscription's secret.
+const (
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+const (
+	defaultWebhookAttempts = 5
+	defaultWebhookBackoff  = time.Second
+	maxWebhookBackoff      = 5 * time.Minute
+	webhookTimeout         = 10 * time.Second
+	webhookWorkers         = 4
+	webhookQueueSize       = 1000
+	webhookLogSize         = 1000
+)
+
+var (
+	ErrInvalidSubscription = errors.New("invalid webhook subscription")
+	ErrBlockedDestination  = errors.New("webhook destination is not a public address")
+	ErrInvalidNetwork      = errors.New("networks are written like 10.1.0.0/16")
+)
+
+// internalNetworks are refused as webhook destinations unless allowed, along
+// with loopback, private, link-local (including cloud metadata endpoints),
+// multicast and unspecified addresses
+var internalNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+}
+
+type webhookDelivery struct {
+	id           string
+	subscription models.WebhookSubscription
+	event        models.ReceiptEvent
+	payload      []byte
+	attempt      int
+	lastError    string
+}
+
+// WebhookDispatcher delivers receipt events to subscribed URLs. Failed
+// deliveries are retried with exponential backoff and moved to the dead
+// letters when the attempts run out. Every attempt is logged; the log and
+// dead letters keep the most recent entries.
+type WebhookDispatcher struct {
+	subscriptions []models.WebhookSubscription
+	deliveries    []models.WebhookDelivery
+	deadLetters   []models.DeadLetter
+	allowed       []netip.Prefix
+	client        *http.Client
+	maxAttempts   int
+	backoff       time.Duration
+	queue         chan *webhookDelivery
+	pending       sync.WaitGroup
+	closed        bool
+	stop          chan struct{}
+	mutex         sync.RWMutex
+}
+
+// NewWebhookDispatcher returns a dispatcher that only delivers to public
+// addresses. Each address is checked as it is connected to, after any
+// redirect and whatever the subscription's host name resolved to.
+func NewWebhookDispatcher() *WebhookDispatcher {
+	wd := &WebhookDispatcher{
+		maxAttempts: defaultWebhookAttempts,
+		backoff:     defaultWebhookBackoff,
+		queue:       make(chan *webhookDelivery, webhookQueueSize),
+		stop:        make(chan struct{}),
+	}
+	dialer := &net.Dialer{Timeout: webhookTimeout, Control: wd.checkDestination}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Deliveries go straight to the subscriber, so the address checked is
+	// the one delivered to
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	wd.client = &http.Client{Timeout: webhookTimeout, Transport: transport}
+	for i := 0; i < webhookWorkers; i++ {
+		go wd.work()
+	}
+	return wd
+}
+
+// SetRetryPolicy sets how many times a delivery is attempted and the wait
+// before the first retry, which doubles with each further retry
+func (wd *WebhookDispatcher) SetRetryPolicy(maxAttempts int, initialBackoff time.Duration) {
+	wd.mutex.Lock()
+	wd.maxAttempts = maxAttempts
+	wd.backoff = initialBackoff
+	wd.mutex.Unlock()
+}
+
+// SetAllowedNetworks lets webhooks be delivered to addresses in networks
+// that are otherwise refused, e.g. a private network the subscribers are on
+func (wd *WebhookDispatcher) SetAllowedNetworks(networks []netip.Prefix) {
+	wd.mutex.Lock()
+	wd.allowed = append([]netip.Prefix(nil), networks...)
+	wd.mutex.Unlock()
+}
+
+// ParseNetworks parses networks in CIDR notation, such as 10.1.0.0/16
+func ParseNetworks(networks []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, len(networks))
+	for i, network := range networks {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidNetwork, network)
+		}
+		prefixes[i] = prefix.Masked()
+	}
+	return prefixes, nil
+}
+
+// checkDestination refuses connections to internal addresses that are not
+// allowed. It is called with the resolved address of each connection.
+func (wd *WebhookDispatcher) checkDestination(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	addr = addr.Unmap()
+
+	wd.mutex.RLock()
+	defer wd.mutex.RUnlock()
+
+	for _, allowed := range wd.allowed {
+		if allowed.Contains(addr) {
+			return nil
+		}
+	}
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return fmt.Errorf("%w: %s", ErrBlockedDestination, addr)
+	}
+	for _, internal := range internalNetworks {
+		if internal.Contains(addr) {
+			return fmt.Errorf("%w: %s", ErrBlockedDestination, addr)
+		}
+	}
+	return nil
+}
+
+// Subscribe adds a subscription and returns it with its new ID and without
+// its secret
+func (wd *WebhookDispatcher) Subscribe(subscription models.WebhookSubscription) (models.WebhookSubscription, error) {
+	if err := validateSubscription(subscription); err != nil {
+		return models.WebhookSubscription{}, err
+	}
+
+	subscription.ID = uuid.New().String()
+	subscription.Events = append([]string(nil), subscription.Events...)
+
+	wd.mutex.Lock()
+	wd.subscriptions = append(wd.subscriptions, subscription)
+	wd.mutex.Unlock()
+
+	subscription.Secret = ""
+	return subscription, nil
+}
+
+// restoreSubscriptions replaces the subscriptions with saved ones, keeping
+// their IDs and secrets
+func (wd *WebhookDispatcher) restoreSubscriptions(subscriptions []models.WebhookSubscription) error {
+	restored := make([]models.WebhookSubscription, len(subscriptions))
+	for i, subscription := range subscriptions {
+		if subscription.ID == "" {
+			return fmt.Errorf("%w: an ID is required", ErrInvalidSubscription)
+		}
+		if err := validateSubscription(subscription); err != nil {
+			return err
+		}
+		subscription.Events = append([]string(nil), subscription.Events...)
+		restored[i] = subscription
+	}
+
+	wd.mutex.Lock()
+	wd.subscriptions = restored
+	wd.mutex.Unlock()
+	return nil
+}
+
+func validateSubscription(subscription models.WebhookSubscription) error {
+	target, err := url.Parse(subscription.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http or https URL", ErrInvalidSubscription)
+	}
+	if subscription.Secret == "" {
+		return fmt.Errorf("%w: a secret is required", ErrInvalidSubscription)
+	}
+	for _, eventType := range subscription.Events {
+		if !IsEventType(eventType) {
+			return fmt.Errorf("%w: unknown event type %q", ErrInvalidSubscription, eventType)
+		}
+	}
+	return nil
+}
+
+func (wd *WebhookDispatcher) Unsubscribe(id string) bool {
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+
+	for i, subscription := range wd.subscriptions {
+		if subscription.ID == id {
+			wd.subscriptions = append(wd.subscriptions[:i], wd.subscriptions[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Subscriptions returns the subscriptions without their secrets
+func (wd *WebhookDispatcher) Subscriptions() []models.WebhookSubscription {
+	wd.mutex.RLock()
+	defer wd.mutex.RUnlock()
+
+	subscriptions := make([]models.WebhookSubscription, len(wd.subscriptions))
+	for i, subscription := range wd.subscriptions {
+		subscription.Secret = ""
+		subscriptions[i] = subscription
+	}
+	return subscriptions
+}
+
+// savedSubscriptions returns the subscriptions with their secrets, for
+// saving
+func (wd *WebhookDispatcher) savedSubscriptions() []models.WebhookSubscription {
+	wd.mutex.RLock()
+	defer wd.mutex.RUnlock()
+
+	return append([]models.WebhookSubscription(nil), wd.subscriptions...)
+}
+
+// Deliveries returns the logged delivery attempts, oldest first
+func (wd *WebhookDispatcher) Deliveries() []models.WebhookDelivery {
+	wd.mutex.RLock()
+	defer wd.mutex.RUnlock()
+
+	return append([]models.WebhookDelivery{}, wd.deliveries...)
+}
+
+// DeadLetters returns the events that could not be delivered, oldest first
+func (wd *WebhookDispatcher) DeadLetters() []models.DeadLetter {
+	wd.mutex.RLock()
+	defer wd.mutex.RUnlock()
+
+	return append([]models.DeadLetter{}, wd.deadLetters...)
+}
+
+// Notify queues an event for each subscription that wants it. It does not
+// wait for delivery, so it can be used as an EventListener.
+func (wd *WebhookDispatcher) Notify(event models.ReceiptEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	var deliveries []*webhookDelivery
+	wd.mutex.RLock()
+	if !wd.closed {
+		for _, subscription := range wd.subscriptions {
+			if !subscribed(subscription, event.Type) {
+				continue
+			}
+			wd.pending.Add(1)
+			deliveries = append(deliveries, &webhookDelivery{
+				id:           uuid.New().String(),
+				subscription: subscription,
+				event:        event,
+				payload:      payload,
+			})
+		}
+	}
+	wd.mutex.RUnlock()
+
+	for _, delivery := range deliveries {
+		wd.enqueue(delivery)
+	}
+}
+
+// Close stops accepting events and waits for queued deliveries and their
+// retries to finish, or for ctx to be done
+func (wd *WebhookDispatcher) Close(ctx context.Context) error {
+	wd.mutex.Lock()
+	if wd.closed {
+		wd.mutex.Unlock()
+		return nil
+	}
+	wd.closed = true
+	wd.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		wd.pending.Wait()
+		close(done)
+	}()
+	defer close(wd.stop)
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SignWebhook returns the signature header value for a payload
+func SignWebhook(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func subscribed(subscription models.WebhookSubscription, eventType string) bool {
+	if len(subscription.Events) == 0 {
+		return true
+	}
+	for _, t := range subscription.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (wd *WebhookDispatcher) enqueue(delivery *webhookDelivery) {
+	select {
+	case wd.queue <- delivery:
+	default:
+		delivery.lastError = "delivery queue is full"
+		wd.deadLetter(delivery)
+	}
+}
+
+func (wd *WebhookDispatcher) work() {
+	for {
+		select {
+		case delivery := <-wd.queue:
+			wd.attempt(delivery)
+		case <-wd.stop:
+			return
+		}
+	}
+}
+
+func (wd *WebhookDispatcher) attempt(delivery *webhookDelivery) {
+	delivery.attempt++
+	status, err := wd.send(delivery)
+
+	entry := models.WebhookDelivery{
+		ID:             delivery.id,
+		SubscriptionID: delivery.subscription.ID,
+		EventID:        delivery.event.ID,
+		EventType:      delivery.event.Type,
+		Attempt:        delivery.attempt,
+		StatusCode:     status,
+		Time:           time.Now().UTC(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		delivery.lastError = err.Error()
+	}
+
+	wd.mutex.Lock()
+	wd.deliveries = append(wd.deliveries, entry)
+	if len(wd.deliveries) > webhookLogSize {
+		wd.deliveries = wd.deliveries[len(wd.deliveries)-webhookLogSize:]
+	}
+	maxAttempts, backoff := wd.maxAttempts, wd.backoff
+	wd.mutex.Unlock()
+
+	switch {
+	case err == nil:
+		wd.pending.Done()
+	case delivery.attempt >= maxAttempts:
+		wd.deadLetter(delivery)
+	default:
+		wait := backoff << (delivery.attempt - 1)
+		if wait > maxWebhookBackoff || wait <= 0 {
+			wait = maxWebhookBackoff
+		}
+		time.AfterFunc(wait, func() {
+			wd.enqueue(delivery)
+		})
+	}
+}
+
+func (wd *WebhookDispatcher) send(delivery *webhookDelivery) (int, error) {
+	req, err := http.NewRequest("POST", delivery.subscription.URL, bytes.NewReader(delivery.payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, delivery.event.Type)
+	req.Header.Set(WebhookDeliveryHeader, delivery.id)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(delivery.subscription.Secret, timestamp, delivery.payload))
+
+	resp, err := wd.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (wd *WebhookDispatcher) deadLetter(delivery *webhookDelivery) {
+	wd.mutex.Lock()
+	wd.deadLetters = append(wd.deadLetters, models.DeadLetter{
+		DeliveryID:     delivery.id,
+		SubscriptionID: delivery.subscription.ID,
+		URL:            delivery.subscription.URL,
+		Event:          delivery.event,
+		Attempts:       delivery.attempt,
+		LastError:      delivery.lastError,
+		Time:           time.Now().UTC(),
+	})
+	if len(wd.deadLetters) > webhookLogSize {
+		wd.deadLetters = wd.deadLetters[len(wd.deadLetters)-webhookLogSize:]
+	}
+	wd.mutex.Unlock()
+
+	wd.pending.Done()
+}
@@ -0,0 +1,238 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+// protectedRoutes lists every route the server registers and the scope it
+// needs
+var protectedRoutes = []struct {
+	method string
+	path   string
+	scope  string
+}{
+	{"POST", "/receipts/process", models.ScopeSubmit},
+	{"POST", "/receipts/process/text", models.ScopeSubmit},
+	{"POST", "/receipts/process/email", models.ScopeSubmit},
+	{"POST", "/receipts/import", models.ScopeSubmit},
+	{"GET", "/receipts/export", models.ScopeRead},
+	{"GET", "/receipts/{id}/points", models.ScopeRead},
+	{"GET", "/receipts/{id}/breakdown", models.ScopeRead},
+	{"GET", "/receipts/{id}/history", models.ScopeRead},
+	{"PUT", "/receipts/{id}", models.ScopeSubmit},
+	{"DELETE", "/receipts/{id}", models.ScopeAdmin},
+	{"GET", "/jobs/{id}", models.ScopeRead},
+	{"GET", "/events", models.ScopeRead},
+	{"GET", "/admin/retailers/aliases", models.ScopeAdmin},
+	{"PUT", "/admin/retailers/aliases", models.ScopeAdmin},
+	{"DELETE", "/admin/retailers/aliases", models.ScopeAdmin},
+	{"GET", "/admin/retailers/timezones", models.ScopeAdmin},
+	{"PUT", "/admin/retailers/timezones", models.ScopeAdmin},
+	{"DELETE", "/admin/retailers/timezones", models.ScopeAdmin},
+	{"GET", "/admin/caps", models.ScopeAdmin},
+	{"PUT", "/admin/caps", models.ScopeAdmin},
+	{"POST", "/admin/receipts/{id}/rescore", models.ScopeAdmin},
+	{"GET", "/admin/webhooks", models.ScopeAdmin},
+	{"POST", "/admin/webhooks", models.ScopeAdmin},
+	{"GET", "/admin/webhooks/deliveries", models.ScopeAdmin},
+	{"GET", "/admin/webhooks/dead-letters", models.ScopeAdmin},
+	{"DELETE", "/admin/webhooks/{id}", models.ScopeAdmin},
+	{"GET", "/admin/keys", models.ScopeAdmin},
+	{"POST", "/admin/keys", models.ScopeAdmin},
+	{"POST", "/admin/keys/{id}/rotate", models.ScopeAdmin},
+	{"DELETE", "/admin/keys/{id}", models.ScopeAdmin},
+	{"GET", "/metrics", models.ScopeMetrics},
+}
+
+func newAuthRouter(keys *services.APIKeyStore) (*mux.Router, *services.ReceiptProcessor) {
+	processor := services.NewReceiptProcessor()
+	router := handlers.NewRouter(handlers.Handlers{
+		Receipts: handlers.NewReceiptHandler(processor),
+		Admin:    handlers.NewAdminHandler(processor),
+		Webhooks: handlers.NewWebhookHandler(services.NewWebhookDispatcher()),
+		Events:   handlers.NewEventsHandler(services.NewEventBroker(10, 10)),
+		Keys:     handlers.NewKeysHandler(keys),
+		Metrics:  handlers.NewMetricsHandler(services.NewMetrics()),
+	}, handlers.NewAuthenticator(keys))
+	return router, processor
+}
+
+func authRequest(router http.Handler, method, url, secret, body string) *httptest.ResponseRecorder {
+	// The context is already done so that the event stream returns at once
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, method, url, strings.NewReader(body))
+	if secret != "" {
+		req.Header.Set(handlers.APIKeyHeader, secret)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRoutesRequireScopes(t *testing.T) {
+	keys := services.NewAPIKeyStore()
+	router, _ := newAuthRouter(keys)
+
+	secrets := make(map[string]string)
+	for _, scope := range []string{models.ScopeSubmit, models.ScopeRead, models.ScopeMetrics, models.ScopeAdmin} {
+		created, err := keys.Create("client-"+scope, "", []string{scope}, nil)
+		if err != nil {
+			t.Fatalf("Creating %s key failed: %v", scope, err)
+		}
+		secrets[scope] = created.Secret
+	}
+
+	// Every registered route must be in the table
+	listed := make(map[string]bool)
+	for _, route := range protectedRoutes {
+		listed[route.method+" "+route.path] = true
+	}
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, _ := route.GetPathTemplate()
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			if !listed[method+" "+path] {
+				t.Errorf("Route %s %s is not covered", method, path)
+			}
+			delete(listed, method+" "+path)
+		}
+		return nil
+	})
+	for route := range listed {
+		t.Errorf("Route %s is not registered", route)
+	}
+
+	for _, route := range protectedRoutes {
+		url := strings.ReplaceAll(route.path, "{id}", "missing")
+
+		for _, secret := range []string{"", "rp_not-a-key"} {
+			rr := authRequest(router, route.method, url, secret, "")
+			if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s %s with key %q should return 401, got %d", route.method, url, secret, rr.Code)
+			}
+		}
+
+		for scope, secret := range secrets {
+			rr := authRequest(router, route.method, url, secret, "")
+			allowed := scope == route.scope || scope == models.ScopeAdmin
+			if allowed && (rr.Code == http.StatusUnauthorized || rr.Code == http.StatusForbidden) {
+				t.Errorf("%s %s with %s key should be allowed, got %d", route.method, url, scope, rr.Code)
+			}
+			if !allowed && rr.Code != http.StatusForbidden {
+				t.Errorf("%s %s with %s key should return 403, got %d", route.method, url, scope, rr.Code)
+			}
+		}
+	}
+}
+
+func TestAPIKeyRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	keys, err := services.OpenAPIKeyStore(path)
+	if err != nil {
+		t.Fatalf("Opening key store failed: %v", err)
+	}
+	admin, _ := keys.Create("ops", "", []string{models.ScopeAdmin}, nil)
+	router, processor := newAuthRouter(keys)
+
+	invalid := []string{
+		`{"scopes": ["read"]}`,
+		`{"client": "kiosk"}`,
+		`{"client": "kiosk", "scopes": ["everything"]}`,
+		`{`,
+	}
+	for _, body := range invalid {
+		if rr := authRequest(router, "POST", "/admin/keys", admin.Secret, body); rr.Code != http.StatusBadRequest {
+			t.Errorf("Key %s should return 400, got %d", body, rr.Code)
+		}
+	}
+
+	rr := authRequest(router, "POST", "/admin/keys", admin.Secret, `{"client": "kiosk-7", "scopes": ["submit", "read"]}`)
+	var kiosk models.CreatedAPIKey
+	json.Unmarshal(rr.Body.Bytes(), &kiosk)
+	if rr.Code != http.StatusCreated || kiosk.Secret == "" || kiosk.Hash != "" {
+		t.Fatalf("Creating key should return its secret and no hash, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	// Changes are recorded as made by the key's client
+	body, _ := json.Marshal(simpleReceipt())
+	rr = authRequest(router, "POST", "/receipts/process", kiosk.Secret, string(body))
+	var response models.ReceiptResponse
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	if history, _ := processor.History(response.ID); len(history) != 1 || history[0].Actor != "kiosk-7" {
+		t.Errorf("History should record the key's client as the actor: %+v", history)
+	}
+
+	// Both keys work during the overlap
+	rr = authRequest(router, "POST", "/admin/keys/"+kiosk.ID+"/rotate?overlap=1h", admin.Secret, "")
+	var rotated models.CreatedAPIKey
+	json.Unmarshal(rr.Body.Bytes(), &rotated)
+	if rr.Code != http.StatusCreated || rotated.ID == kiosk.ID || rotated.Client != "kiosk-7" || len(rotated.Scopes) != 2 {
+		t.Fatalf("Rotating key failed: %d %s", rr.Code, rr.Body.String())
+	}
+	for _, secret := range []string{kiosk.Secret, rotated.Secret} {
+		if rr := authRequest(router, "GET", "/receipts/"+response.ID+"/points", secret, ""); rr.Code != http.StatusOK {
+			t.Errorf("Key should work during the overlap, got %d", rr.Code)
+		}
+	}
+
+	// Rotating without overlap retires the key at once
+	rr = authRequest(router, "POST", "/admin/keys/"+rotated.ID+"/rotate?overlap=0s", admin.Secret, "")
+	var replacement models.CreatedAPIKey
+	json.Unmarshal(rr.Body.Bytes(), &replacement)
+	if rr := authRequest(router, "GET", "/receipts/"+response.ID+"/points", rotated.Secret, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Rotated key should stop working, got %d", rr.Code)
+	}
+	if rr := authRequest(router, "GET", "/receipts/"+response.ID+"/points", replacement.Secret, ""); rr.Code != http.StatusOK {
+		t.Errorf("Replacement key should work, got %d", rr.Code)
+	}
+
+	for _, url := range []string{"/admin/keys/missing/rotate", "/admin/keys/" + kiosk.ID + "/rotate?overlap=-1h", "/admin/keys/" + kiosk.ID + "/rotate?overlap=soon"} {
+		if rr := authRequest(router, "POST", url, admin.Secret, ""); rr.Code != http.StatusNotFound && rr.Code != http.StatusBadRequest {
+			t.Errorf("Rotating %s should fail, got %d", url, rr.Code)
+		}
+	}
+
+	if rr := authRequest(router, "DELETE", "/admin/keys/"+replacement.ID, admin.Secret, ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Revoking key should return 204, got %d", rr.Code)
+	}
+	if rr := authRequest(router, "GET", "/receipts/"+response.ID+"/points", replacement.Secret, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Revoked key should stop working, got %d", rr.Code)
+	}
+
+	rr = authRequest(router, "GET", "/admin/keys", admin.Secret, "")
+	var listed []models.APIKey
+	json.Unmarshal(rr.Body.Bytes(), &listed)
+	if len(listed) != 3 || listed[0].ID != admin.ID || listed[1].ExpiresAt == nil || listed[0].Hash != "" {
+		t.Errorf("Listed keys incorrect: %+v", listed)
+	}
+
+	// Keys are saved hashed and reloaded
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), admin.Secret) || !strings.Contains(string(data), services.HashAPIKey(admin.Secret)) {
+		t.Errorf("Key file should hold hashes, not secrets")
+	}
+	reloaded, err := services.OpenAPIKeyStore(path)
+	if err != nil {
+		t.Fatalf("Reloading keys failed: %v", err)
+	}
+	if key, ok := reloaded.Authenticate(kiosk.Secret); !ok || key.Client != "kiosk-7" {
+		t.Errorf("Reloaded key should authenticate, got %+v", key)
+	}
+	if _, ok := reloaded.Authenticate(replacement.Secret); ok {
+		t.Errorf("Revoked key should stay revoked after reloading")
+	}
+}
@@ -0,0 +1,196 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+func manyItemReceipt(customerID string, count int) models.Receipt {
+	items := make([]models.Item, count)
+	for i := range items {
+		items[i] = models.Item{ShortDescription: "Gum", Price: "1.00"}
+	}
+	return models.Receipt{
+		CustomerID:   customerID,
+		Retailer:     "X",
+		PurchaseDate: "2022-01-02",
+		PurchaseTime: "12:00",
+		Items:        items,
+		Total:        "5.01",
+	}
+}
+
+func findRule(breakdown models.PointsBreakdown, name string) models.RulePoints {
+	for _, rule := range breakdown.Rules {
+		if rule.Rule == name {
+			return rule
+		}
+	}
+	return models.RulePoints{}
+}
+
+func TestPerRuleCaps(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	processor.SetCaps(services.PointCaps{
+		PerRule: map[string]int64{"item-pairs": 20, "description-length": 10},
+	})
+
+	// 100 items: 250 points for item pairs and 100 points for descriptions
+	breakdown, _ := processor.CalculateBreakdown(manyItemReceipt("", 100))
+
+	pairs := findRule(breakdown, "item-pairs")
+	if pairs.Points != 20 || pairs.Uncapped != 250 {
+		t.Errorf("Item pair cap incorrect: got %d capped from %d", pairs.Points, pairs.Uncapped)
+	}
+	descriptions := findRule(breakdown, "description-length")
+	if descriptions.Points != 10 || descriptions.Uncapped != 100 {
+		t.Errorf("Description cap incorrect: got %d capped from %d", descriptions.Points, descriptions.Uncapped)
+	}
+
+	// 1 point for the retailer name in addition to the capped rules
+	if breakdown.Points != 31 || breakdown.Uncapped != 351 {
+		t.Errorf("Breakdown totals incorrect: got %d points, %d uncapped", breakdown.Points, breakdown.Uncapped)
+	}
+}
+
+func TestPerReceiptCap(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	processor.SetCaps(services.PointCaps{PerReceipt: 100})
+
+	breakdown, _ := processor.CalculateBreakdown(manyItemReceipt("", 100))
+	if breakdown.Points != 100 || breakdown.ReceiptCapped != 251 || breakdown.Uncapped != 351 {
+		t.Errorf("Per-receipt cap incorrect: got %+v", breakdown)
+	}
+
+	if points, _ := processor.CalculatePoints(manyItemReceipt("", 2)); points != 8 {
+		t.Errorf("Receipt under the cap should not be capped: got %d points, expected %d", points, 8)
+	}
+}
+
+func TestPerCustomerDailyCap(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	processor.SetCaps(services.PointCaps{PerCustomerPerDay: 50})
+
+	// Each receipt earns 1 + 10 + 4 = 15 points
+	var ids []string
+	for i := 0; i < 4; i++ {
+		id, _ := processor.ProcessReceipt(context.Background(), manyItemReceipt("alice", 4))
+		ids = append(ids, id)
+	}
+
+	expected := []struct {
+		points int64
+		capped int64
+	}{{15, 0}, {15, 0}, {15, 0}, {5, 10}}
+
+	for i, id := range ids {
+		breakdown, _ := processor.GetBreakdown(id)
+		if breakdown.Points != expected[i].points || breakdown.DailyCapped != expected[i].capped {
+			t.Errorf("Receipt %d: got %d points with %d capped, expected %d with %d capped",
+				i+1, breakdown.Points, breakdown.DailyCapped, expected[i].points, expected[i].capped)
+		}
+		if breakdown.Uncapped != 15 {
+			t.Errorf("Receipt %d: uncapped points should be kept, got %d", i+1, breakdown.Uncapped)
+		}
+	}
+
+	// Deleting receipts frees their points for the day, down to none
+	for _, id := range ids {
+		processor.DeleteReceipt(context.Background(), id)
+	}
+	replacement, _ := processor.ProcessReceipt(context.Background(), manyItemReceipt("alice", 4))
+	breakdown, _ := processor.GetBreakdown(replacement)
+	if breakdown.Points != 15 || breakdown.DailyCapped != 0 {
+		t.Errorf("Deleted receipts should not count towards the cap: got %d points with %d capped", breakdown.Points, breakdown.DailyCapped)
+	}
+
+	nextDay := manyItemReceipt("alice", 4)
+	nextDay.PurchaseDate = "2022-01-04"
+	id, _ := processor.ProcessReceipt(context.Background(), nextDay)
+	breakdown, _ = processor.GetBreakdown(id)
+	if breakdown.Points != 15 {
+		t.Errorf("Daily cap should reset on a new day: got %d points", breakdown.Points)
+	}
+
+	id, _ = processor.ProcessReceipt(context.Background(), manyItemReceipt("bob", 4))
+	breakdown, _ = processor.GetBreakdown(id)
+	if breakdown.Points != 15 {
+		t.Errorf("Daily cap should be per customer: got %d points", breakdown.Points)
+	}
+
+	id, _ = processor.ProcessReceipt(context.Background(), manyItemReceipt("", 4))
+	breakdown, _ = processor.GetBreakdown(id)
+	if breakdown.Points != 15 {
+		t.Errorf("Anonymous receipts should not be daily capped: got %d points", breakdown.Points)
+	}
+}
+
+func TestBreakdownAPI(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	receiptHandler := handlers.NewReceiptHandler(processor)
+	adminHandler := handlers.NewAdminHandler(processor)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/receipts/process", receiptHandler.ProcessReceipt).Methods("POST")
+	router.HandleFunc("/receipts/{id}/breakdown", receiptHandler.GetBreakdown).Methods("GET")
+	router.HandleFunc("/admin/caps", adminHandler.SetCaps).Methods("PUT")
+
+	req, _ := http.NewRequest("PUT", "/admin/caps", bytes.NewBufferString(`{"perRule": {"retailer-name": -1}}`))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Negative caps should return 400 Bad Request, got %d", rr.Code)
+	}
+
+	req, _ = http.NewRequest("PUT", "/admin/caps", bytes.NewBufferString(`{"perRule": {"retailer-name": 3}}`))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("Setting caps failed: got status %d, expected 204", rr.Code)
+	}
+
+	receiptJSON := `{
+		"retailer": "Walgreens",
+		"purchaseDate": "2022-01-02",
+		"purchaseTime": "08:13",
+		"total": "2.65",
+		"items": [
+			{"shortDescription": "Pepsi - 12-oz", "price": "1.25"},
+			{"shortDescription": "Dasani", "price": "1.40"}
+		]
+	}`
+	req, _ = http.NewRequest("POST", "/receipts/process", bytes.NewBufferString(receiptJSON))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var processResponse models.ReceiptResponse
+	json.Unmarshal(rr.Body.Bytes(), &processResponse)
+
+	req, _ = http.NewRequest("GET", "/receipts/"+processResponse.ID+"/breakdown", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Getting breakdown failed: got status %d, expected 200", rr.Code)
+	}
+
+	var breakdown models.PointsBreakdown
+	if err := json.Unmarshal(rr.Body.Bytes(), &breakdown); err != nil {
+		t.Fatalf("Failed to parse breakdown response: %v", err)
+	}
+	if rule := findRule(breakdown, "retailer-name"); rule.Points != 3 || rule.Uncapped != 9 {
+		t.Errorf("Retailer name rule incorrect: got %+v", rule)
+	}
+	if breakdown.Points != 9 || breakdown.Uncapped != 15 {
+		t.Errorf("Breakdown totals incorrect: got %d points, %d uncapped", breakdown.Points, breakdown.Uncapped)
+	}
+}
@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+func TestCatalogCategories(t *testing.T) {
+	catalog := services.NewCatalog()
+	catalog.Add(models.CatalogProduct{SKU: "4011", Description: "Bananas", Category: "Produce"})
+	catalog.Add(models.CatalogProduct{Description: "Great Value  Milk", Category: "store brand"})
+
+	if catalog.Add(models.CatalogProduct{Category: "produce"}) {
+		t.Errorf("Adding a product without a SKU or description should fail")
+	}
+
+	testCases := []struct {
+		item     models.Item
+		expected string
+	}{
+		{models.Item{ShortDescription: "Anything", SKU: "4011"}, "produce"},
+		{models.Item{ShortDescription: "  BANANAS "}, "produce"},
+		{models.Item{ShortDescription: "great value milk"}, "store brand"},
+		{models.Item{ShortDescription: "Bananas", Category: "Snacks"}, "snacks"},
+		{models.Item{ShortDescription: "Doritos"}, ""},
+	}
+
+	for _, tc := range testCases {
+		if category := catalog.Category(tc.item); category != tc.expected {
+			t.Errorf("Category for %+v incorrect: got %q, expected %q", tc.item, category, tc.expected)
+		}
+	}
+}
+
+func TestLoadCatalog(t *testing.T) {
+	catalog, err := services.LoadCatalog("../examples/catalog.json")
+	if err != nil {
+		t.Fatalf("Loading example catalog failed: %v", err)
+	}
+	if category := catalog.Category(models.Item{SKU: "4062"}); category != "produce" {
+		t.Errorf("Catalog SKU lookup failed: got %q", category)
+	}
+
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	os.WriteFile(path, []byte(`[{"sku": "1"}]`), 0o644)
+	if _, err := services.LoadCatalog(path); err == nil {
+		t.Errorf("Loading a product without a category should fail")
+	}
+}
+
+func TestCategoryRules(t *testing.T) {
+	catalog := services.NewCatalog()
+	catalog.Add(models.CatalogProduct{SKU: "4011", Category: "produce"})
+	catalog.Add(models.CatalogProduct{Description: "Cucumber", Category: "produce"})
+
+	processor := services.NewReceiptProcessor()
+	processor.SetCatalog(catalog)
+	processor.AddRule(services.NewCategoryRule("fresh-produce", "Produce", 2, 5))
+
+	receipt := models.Receipt{
+		Retailer:     "X",
+		PurchaseDate: "2022-01-02",
+		PurchaseTime: "12:00",
+		Items: []models.Item{
+			{ShortDescription: "Bananas", SKU: "4011", Price: "1.01"},
+			{ShortDescription: "Gum", Price: "1.01"},
+			{ShortDescription: "cucumber", Price: "1.01"},
+		},
+		Total: "3.03",
+	}
+
+	breakdown, _ := processor.CalculateBreakdown(receipt)
+	rule := findRule(breakdown, "fresh-produce")
+
+	// 2 points for each of the 2 produce items plus 5 for the category
+	if rule.Points != 9 {
+		t.Errorf("Category rule points incorrect: got %d, expected %d", rule.Points, 9)
+	}
+	if len(rule.Items) != 2 || rule.Items[0].Index != 0 || rule.Items[1].Index != 2 {
+		t.Fatalf("Category rule item breakdown incorrect: %+v", rule.Items)
+	}
+	if rule.Items[1].Category != "produce" || rule.Items[1].Points != 2 {
+		t.Errorf("Category rule item points incorrect: %+v", rule.Items[1])
+	}
+
+	description := findRule(breakdown, "description-length")
+	if len(description.Items) != 1 || description.Items[0].Description != "Gum" || description.Items[0].Points != 1 {
+		t.Errorf("Description rule item breakdown incorrect: %+v", description.Items)
+	}
+
+	if receipt.Items[0].Category != "" {
+		t.Errorf("Scoring should not modify the caller's items")
+	}
+
+	receipt.Items = receipt.Items[1:2]
+	breakdown, _ = processor.CalculateBreakdown(receipt)
+	if rule := findRule(breakdown, "fresh-produce"); rule.Points != 0 {
+		t.Errorf("Receipt without produce should earn no category points, got %d", rule.Points)
+	}
+}
+
+func TestCategoryRulesFromFile(t *testing.T) {
+	rules, err := services.LoadRules("../examples/rules.json")
+	if err != nil {
+		t.Fatalf("Loading example rules failed: %v", err)
+	}
+
+	processor := services.NewReceiptProcessor()
+	for _, rule := range rules {
+		processor.AddRule(rule)
+	}
+
+	receipt := models.Receipt{
+		Retailer:     "X",
+		PurchaseDate: "2022-01-04",
+		PurchaseTime: "12:00",
+		Items:        []models.Item{{ShortDescription: "Kale", Category: "produce", Price: "3.01"}},
+		Total:        "3.01",
+	}
+	breakdown, _ := processor.CalculateBreakdown(receipt)
+	if rule := findRule(breakdown, "fresh-produce"); rule.Points != 7 {
+		t.Errorf("Category rule from file incorrect: got %d points, expected %d", rule.Points, 7)
+	}
+}
@@ -0,0 +1,161 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	receipt := models.Receipt{
+		CustomerID:   "c-42",
+		Retailer:     "M&M Corner Market",
+		PurchaseDate: "2022-03-20",
+		PurchaseTime: "14:33",
+		Timezone:     "America/Chicago",
+		Items: []models.Item{
+			{ShortDescription: "Gatorade", Price: "4.50", Quantity: "2", UnitPrice: "2.25", SKU: "G-1", Category: "drinks"},
+			{ShortDescription: "Coupon <5% & more>", Price: "-0.50"},
+		},
+		Discounts: []models.Adjustment{{Description: "Member savings", Amount: "0.25"}},
+		Taxes:     []models.Adjustment{{Description: "Sales tax", Amount: "0.30"}},
+		Total:     "4.05",
+		Currency:  "USD",
+	}
+	want, _ := json.Marshal(receipt)
+
+	for _, codec := range handlers.DefaultCodecs().All() {
+		name := codec.MediaTypes()[0]
+		var buf bytes.Buffer
+		if err := codec.Encode(&buf, receipt); err != nil {
+			t.Fatalf("%s: encoding failed: %v", name, err)
+		}
+
+		var decoded models.Receipt
+		if err := codec.Decode(&buf, &decoded); err != nil {
+			t.Fatalf("%s: decoding failed: %v", name, err)
+		}
+		// XMLName is only set when decoding XML, and is not part of the receipt
+		decoded.XMLName = xml.Name{}
+		if got, _ := json.Marshal(decoded); string(got) != string(want) {
+			t.Errorf("%s: round trip changed the receipt:\ngot:  %s\nwant: %s", name, got, want)
+		}
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	handler := handlers.NewReceiptHandler(processor)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/receipts/process", handler.ProcessReceipt).Methods("POST")
+	router.HandleFunc("/receipts/{id}/points", handler.GetPoints).Methods("GET")
+
+	receiptXML, _ := os.ReadFile("../examples/morning-receipt.xml")
+	receiptJSON, _ := os.ReadFile("../examples/morning-receipt.json")
+	var receipt models.Receipt
+	json.Unmarshal(receiptJSON, &receipt)
+	receiptMsgpack, _ := msgpack.Marshal(map[string]any{
+		"retailer":     receipt.Retailer,
+		"purchaseDate": receipt.PurchaseDate,
+		"purchaseTime": receipt.PurchaseTime,
+		"total":        receipt.Total,
+		"items": []map[string]string{
+			{"shortDescription": receipt.Items[0].ShortDescription, "price": receipt.Items[0].Price},
+			{"shortDescription": receipt.Items[1].ShortDescription, "price": receipt.Items[1].Price},
+		},
+	})
+
+	testCases := []struct {
+		name         string
+		body         []byte
+		contentType  string
+		accept       string
+		expected     int
+		responseType string
+	}{
+		{"no content type", receiptJSON, "", "", http.StatusOK, "application/json"},
+		{"xml in, xml out", receiptXML, "application/xml; charset=utf-8", "", http.StatusOK, "application/xml"},
+		{"text/xml in, json out", receiptXML, "text/xml", "application/json", http.StatusOK, "application/json"},
+		{"msgpack in, msgpack out", receiptMsgpack, "application/msgpack", "", http.StatusOK, "application/msgpack"},
+		{"json in, msgpack preferred", receiptJSON, "application/json", "application/xml;q=0.5, application/x-msgpack", http.StatusOK, "application/msgpack"},
+		{"json in, any", receiptJSON, "application/json", "*/*", http.StatusOK, "application/json"},
+		{"json in, any application type", receiptJSON, "application/json", "text/html, application/*;q=0.9", http.StatusOK, "application/json"},
+		{"unsupported content type", receiptJSON, "text/csv", "", http.StatusUnsupportedMediaType, ""},
+		{"malformed content type", receiptJSON, "application/", "", http.StatusUnsupportedMediaType, ""},
+		{"unacceptable", receiptJSON, "application/json", "text/html, application/json;q=0", http.StatusNotAcceptable, ""},
+		{"xml labelled as json", receiptXML, "application/json", "", http.StatusBadRequest, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/receipts/process", bytes.NewBuffer(tc.body))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expected {
+				t.Fatalf("Got status %d, expected %d: %s", rr.Code, tc.expected, rr.Body.String())
+			}
+			if tc.expected != http.StatusOK {
+				return
+			}
+			if got := rr.Header().Get("Content-Type"); got != tc.responseType {
+				t.Fatalf("Got response type %q, expected %q", got, tc.responseType)
+			}
+
+			codec, _ := handlers.DefaultCodecs().ForContentType(tc.responseType)
+			var response models.ReceiptResponse
+			if err := codec.Decode(rr.Body, &response); err != nil || response.ID == "" {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+
+			// Points for the morning receipt in each format
+			for _, accept := range []string{"application/json", "text/xml", "application/vnd.msgpack"} {
+				req, _ := http.NewRequest("GET", "/receipts/"+response.ID+"/points", nil)
+				req.Header.Set("Accept", accept)
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+
+				codec, _ := handlers.DefaultCodecs().ForContentType(rr.Header().Get("Content-Type"))
+				var pointsResponse models.PointsResponse
+				if codec == nil || codec.Decode(rr.Body, &pointsResponse) != nil || pointsResponse.Points != 15 {
+					t.Errorf("Points as %s incorrect: got %d, expected %d", accept, pointsResponse.Points, 15)
+				}
+			}
+		})
+	}
+
+	req, _ := http.NewRequest("GET", "/receipts/unknown/points", nil)
+	req.Header.Set("Accept", "image/png")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotAcceptable {
+		t.Errorf("Unacceptable points format should return 406 Not Acceptable, got %d", rr.Code)
+	}
+
+	req, _ = http.NewRequest("POST", "/receipts/process", bytes.NewBuffer(receiptXML))
+	req.Header.Set("Content-Type", "text/xml")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if !strings.HasPrefix(rr.Body.String(), "<?xml") || !strings.Contains(rr.Body.String(), "<receiptResponse><id>") {
+		t.Errorf("XML response incorrect: %s", rr.Body.String())
+	}
+}
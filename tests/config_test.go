@@ -0,0 +1,168 @@
+package tests
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"receipt-processor/config"
+)
+
+func envLookup(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("Writing config file failed: %v", err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := writeConfigFile(t, `{
+		"listen": ":9000",
+		"workers": 2,
+		"queue": 50,
+		"read-timeout": "10s",
+		"tenants": ["acme", "globex"],
+		"log-level": "debug"
+	}`)
+	env := map[string]string{
+		config.ConfigEnv:              file,
+		"RECEIPT_PROCESSOR_WORKERS":   "4",
+		"RECEIPT_PROCESSOR_QUEUE":     "60",
+		"RECEIPT_PROCESSOR_LOG_LEVEL": "warn",
+	}
+	args := []string{"-queue", "70", "-storage", "file", "-storage-path", "history.jsonl"}
+
+	cfg, printConfig, _, err := config.Load(args, envLookup(env))
+	if err != nil {
+		t.Fatalf("Loading config failed: %v", err)
+	}
+	if printConfig {
+		t.Errorf("Config should only be printed with -print-config")
+	}
+
+	defaults := config.Default()
+	tests := []struct {
+		setting  string
+		got      any
+		expected any
+	}{
+		{"write-timeout (default)", cfg.WriteTimeout, defaults.WriteTimeout},
+		{"listen (file)", cfg.Listen, ":9000"},
+		{"read-timeout (file)", cfg.ReadTimeout, 10 * time.Second},
+		{"tenants (file)", cfg.Tenants, []string{"acme", "globex"}},
+		{"workers (env over file)", cfg.Workers, 4},
+		{"log-level (env over file)", cfg.LogLevel, "warn"},
+		{"queue (flag over env and file)", cfg.Queue, 70},
+		{"storage (flag over default)", cfg.Storage, config.StorageFile},
+		{"storage-path (flag)", cfg.StoragePath, "history.jsonl"},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.setting, tt.expected, tt.got)
+		}
+	}
+
+	// The -config flag takes precedence over the environment variable
+	other := writeConfigFile(t, `{"listen": "127.0.0.1:9100"}`)
+	cfg, _, _, err = config.Load([]string{"-config", other}, envLookup(env))
+	if err != nil || cfg.Listen != "127.0.0.1:9100" || cfg.Workers != 4 {
+		t.Errorf("-config should name the config file, got %+v, %v", cfg, err)
+	}
+
+	// The deprecated -history flag still selects file storage
+	cfg, _, warnings, err := config.Load([]string{"-history", "history.jsonl"}, envLookup(nil))
+	if err != nil || cfg.Storage != config.StorageFile || cfg.StoragePath != "history.jsonl" {
+		t.Errorf("-history should set file storage, got %+v, %v", cfg, err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "-history is deprecated") {
+		t.Errorf("-history should be reported as deprecated, got %q", warnings)
+	}
+
+	cfg, _, _, err = config.Load(nil, envLookup(nil))
+	if err != nil || !reflect.DeepEqual(cfg, defaults) {
+		t.Errorf("With no settings the defaults should be used, got %+v, %v", cfg, err)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		env   map[string]string
+		file  string
+		error string
+	}{
+		{"listen", []string{"-listen", "8080"}, nil, "", "listen"},
+		{"tls", []string{"-tls-cert", "cert.pem"}, nil, "", "tls-cert and tls-key"},
+		{"storage backend", []string{"-storage", "postgres"}, nil, "", "storage"},
+		{"file storage path", []string{"-storage", "file"}, nil, "", "storage-path"},
+		{"memory storage path", []string{"-storage-path", "history.jsonl"}, nil, "", "storage-path"},
+		{"history and storage path", []string{"-history", "old.jsonl", "-storage-path", "new.jsonl"}, nil, "", "different event logs"},
+		{"tenants", []string{"-tenants", "acme,not a tenant"}, nil, "", "tenants"},
+		{"retailer names", []string{"-retailer-names", "fancy"}, nil, "", "retailer-names"},
+		{"workers", []string{"-workers", "0"}, nil, "", "workers"},
+		{"negative timeout", []string{"-idle-timeout", "-1s"}, nil, "", "idle-timeout"},
+		{"shutdown timeout", []string{"-shutdown-timeout", "0s"}, nil, "", "shutdown-timeout"},
+		{"log level", nil, map[string]string{"RECEIPT_PROCESSOR_LOG_LEVEL": "loud"}, "", "log-level"},
+		{"trace exporter", []string{"-trace-exporter", "jaeger"}, nil, "", "trace-exporter"},
+		{"webhook network", []string{"-webhook-allowed-networks", "10.0.0.1"}, nil, "", "webhook-allowed-networks"},
+		{"flag value", []string{"-workers", "many"}, nil, "", "workers"},
+		{"env value", nil, map[string]string{"RECEIPT_PROCESSOR_READ_TIMEOUT": "10"}, "", "RECEIPT_PROCESSOR_READ_TIMEOUT"},
+		{"argument", []string{"serve"}, nil, "", "serve"},
+		{"unknown file setting", nil, nil, `{"port": 8080}`, "port"},
+		{"file value", nil, nil, `{"workers": "lots"}`, "workers"},
+		{"file value type", nil, nil, `{"tenants": [1, 2]}`, "tenants"},
+		{"malformed file", nil, nil, `{`, "parsing"},
+	}
+	for _, tt := range tests {
+		env := tt.env
+		if tt.file != "" {
+			env = map[string]string{config.ConfigEnv: writeConfigFile(t, tt.file)}
+		}
+		_, _, _, err := config.Load(tt.args, envLookup(env))
+		if err == nil || !strings.Contains(err.Error(), tt.error) {
+			t.Errorf("%s: expected an error about %q, got %v", tt.name, tt.error, err)
+		}
+	}
+
+	// Every problem is reported at once
+	_, _, _, err := config.Load([]string{"-workers", "0", "-queue", "0"}, envLookup(nil))
+	if err == nil || !strings.Contains(err.Error(), "workers") || !strings.Contains(err.Error(), "queue") {
+		t.Errorf("Every invalid setting should be reported, got %v", err)
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	args := []string{"-print-config", "-listen", ":9443", "-tls-cert", "cert.pem", "-tls-key", "key.pem", "-tenants", "acme", "-shutdown-delay", "5s", "-rate-limits", "limits.json"}
+	cfg, printConfig, _, err := config.Load(args, envLookup(nil))
+	if err != nil || !printConfig {
+		t.Fatalf("-print-config should be reported, got %v, %v", printConfig, err)
+	}
+
+	var printed bytes.Buffer
+	if err := cfg.Write(&printed); err != nil {
+		t.Fatalf("Writing config failed: %v", err)
+	}
+	if !strings.Contains(printed.String(), `"shutdown-delay": "5s"`) || !strings.Contains(printed.String(), `"workers": `) {
+		t.Errorf("Printed config should hold every setting:\n%s", printed.String())
+	}
+
+	// The printed config loads back unchanged
+	reloaded, _, _, err := config.Load([]string{"-config", writeConfigFile(t, printed.String())}, envLookup(nil))
+	if err != nil || !reflect.DeepEqual(reloaded, cfg) {
+		t.Errorf("Printed config should load back unchanged, got %+v, %v", reloaded, err)
+	}
+}
@@ -0,0 +1,200 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/parsers"
+	"receipt-processor/services"
+)
+
+func newCSVRouter(processor *services.ReceiptProcessor) *mux.Router {
+	handler := handlers.NewReceiptHandler(processor)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/receipts/import", handler.ImportReceipts).Methods("POST")
+	router.HandleFunc("/receipts/export", handler.ExportReceipts).Methods("GET")
+	router.HandleFunc("/receipts/{id}/points", handler.GetPoints).Methods("GET")
+	return router
+}
+
+func importCSV(t *testing.T, router *mux.Router, body []byte) (int, models.ImportResponse) {
+	req, _ := http.NewRequest("POST", "/receipts/import", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "text/csv")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var response models.ImportResponse
+	if rr.Code == http.StatusOK {
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to parse import response: %v", err)
+		}
+	}
+	return rr.Code, response
+}
+
+func TestCSVImport(t *testing.T) {
+	router := newCSVRouter(services.NewReceiptProcessor())
+
+	data, _ := os.ReadFile("../examples/receipts.csv")
+	code, response := importCSV(t, router, data)
+	if code != http.StatusOK || len(response.Imported) != 3 || len(response.Errors) != 0 {
+		t.Fatalf("Importing example receipts failed: %d %+v", code, response)
+	}
+	if response.Imported[0].Key != "target-1" {
+		t.Errorf("Imported receipts should keep file order: %+v", response.Imported)
+	}
+
+	req, _ := http.NewRequest("GET", "/receipts/"+response.Imported[0].ID+"/points", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var pointsResponse models.PointsResponse
+	json.Unmarshal(rr.Body.Bytes(), &pointsResponse)
+	if pointsResponse.Points != 28 {
+		t.Errorf("Imported Target receipt points incorrect: got %d, expected %d", pointsResponse.Points, 28)
+	}
+
+	// Rows are numbered from the header line
+	bad := strings.Join([]string{
+		"retailer,receipt,purchaseDate,purchaseTime,total,description,price,type",
+		"Target,a,2022-01-01,13:01,1.00,Pepsi,1.00,",
+		"Walmart,a,,,,Coke,1.00,",
+		"Target,b,2022-01-01,13:01,1.00,Pepsi,1.00,refund",
+		"Target,c,2022-13-01,13:01,1.00,Pepsi,1.00,",
+		"Target,,2022-01-01,13:01,1.00,Pepsi,1.00,",
+		"Target,d,2022-01-01,13:01,1.00,Pepsi",
+		"Target,e,2022-01-01,13:01,1.00,Pepsi,1.00,",
+	}, "\n")
+	code, response = importCSV(t, router, []byte(bad))
+	if code != http.StatusOK {
+		t.Fatalf("Importing with bad rows should still succeed, got %d", code)
+	}
+	if len(response.Imported) != 1 || response.Imported[0].Key != "e" {
+		t.Errorf("Only receipt e should be imported: %+v", response.Imported)
+	}
+
+	expected := []models.ImportError{
+		{Row: 3, Key: "a"},
+		{Row: 4, Key: "b"},
+		{Row: 5, Key: "c"},
+		{Row: 6},
+		{Row: 7, Key: "d"},
+	}
+	if len(response.Errors) != len(expected) {
+		t.Fatalf("Import errors incorrect: %+v", response.Errors)
+	}
+	for i, want := range expected {
+		got := response.Errors[i]
+		if got.Row != want.Row || got.Key != want.Key || got.Error == "" {
+			t.Errorf("Import error %d: got %+v, expected row %d key %q", i, got, want.Row, want.Key)
+		}
+	}
+
+	// A short row leaves its whole receipt out, not just the row
+	short := strings.Join([]string{
+		"receipt,retailer,purchaseDate,purchaseTime,total,description,price",
+		"a,Target,2022-01-01,13:01,3.00,Pepsi,1.00",
+		"a,,,,,Coke",
+		"a,,,,,Water,2.00",
+		"b,Target,2022-01-01,13:01,1.00,Pepsi,1.00",
+	}, "\n")
+	code, response = importCSV(t, router, []byte(short))
+	if code != http.StatusOK || len(response.Imported) != 1 || response.Imported[0].Key != "b" {
+		t.Errorf("Receipt a has a short row and should not be imported: %d %+v", code, response)
+	}
+	if len(response.Errors) != 1 || response.Errors[0].Row != 3 || response.Errors[0].Key != "a" {
+		t.Errorf("Short row should be reported against receipt a: %+v", response.Errors)
+	}
+
+	// Without a key, the receipt a malformed row belongs to is unknown
+	unknown := []string{
+		"receipt,retailer,purchaseDate,purchaseTime,total,description,price\na,Target,2022-01-01,13:01,1.00,Pepsi,1.00\n,Target",
+		"receipt,retailer,purchaseDate,purchaseTime,total,description,price\na,Target,2022-01-01,13:01,1.00,\"Pepsi,1.00",
+	}
+	for _, body := range unknown {
+		if code, _ := importCSV(t, router, []byte(body)); code != http.StatusBadRequest {
+			t.Errorf("Import file %q should return 400 Bad Request, got %d", body, code)
+		}
+	}
+
+	for _, body := range []string{"", "receipt,retailer\na,Target"} {
+		if code, _ := importCSV(t, router, []byte(body)); code != http.StatusBadRequest {
+			t.Errorf("Import file %q should return 400 Bad Request, got %d", body, code)
+		}
+	}
+}
+
+func TestCSVExport(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	router := newCSVRouter(processor)
+
+	data, _ := os.ReadFile("../examples/receipts.csv")
+	_, imported := importCSV(t, router, data)
+
+	req, _ := http.NewRequest("GET", "/receipts/export?format=csv", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("Export failed: got status %d, content type %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	exported := rr.Body.Bytes()
+
+	records, err := csv.NewReader(bytes.NewReader(exported)).ReadAll()
+	if err != nil {
+		t.Fatalf("Export is not valid CSV: %v", err)
+	}
+	// 5 + 1 + 5 lines plus the header
+	if len(records) != 12 {
+		t.Fatalf("Export should have 12 rows, got %d", len(records))
+	}
+
+	header := records[0]
+	column := func(name string) int {
+		for i, h := range header {
+			if h == name {
+				return i
+			}
+		}
+		t.Fatalf("Export is missing column %q", name)
+		return -1
+	}
+	first := records[1]
+	if first[column("receipt")] != imported.Imported[0].ID || first[column("points")] != "28" || first[column("rule:retailer-name")] != "6" {
+		t.Errorf("First exported row incorrect: %v", first)
+	}
+	if last := records[11]; last[column("type")] != parsers.CSVLineTax {
+		t.Errorf("Tax lines should be exported last: %v", last)
+	}
+
+	// The export can be imported again, and scores the same
+	reimported := services.NewReceiptProcessor()
+	_, response := importCSV(t, newCSVRouter(reimported), exported)
+	if len(response.Imported) != 3 || len(response.Errors) != 0 {
+		t.Fatalf("Re-importing export failed: %+v", response)
+	}
+	for i, receipt := range response.Imported {
+		original, _ := processor.GetBreakdown(imported.Imported[i].ID)
+		again, _ := reimported.GetBreakdown(receipt.ID)
+		if original.Points != again.Points {
+			t.Errorf("Re-imported receipt %d scored %d, expected %d", i, again.Points, original.Points)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", "/receipts/export?format=xlsx", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Unsupported export format should return 400 Bad Request, got %d", rr.Code)
+	}
+}
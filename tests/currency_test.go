@@ -0,0 +1,323 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/services"
+	"receipt-processor/utils"
+)
+
+func TestCurrencyAmounts(t *testing.T) {
+	testCases := []struct {
+		amount   string
+		currency string
+		valid    bool
+	}{
+		{"1.25", "USD", true},
+		{"1.25", "", true},
+		{"1250", "JPY", true},
+		{"12.50", "JPY", false},
+		{"1.250", "KWD", true},
+		{"1.25", "KWD", false},
+		{"1", "EUR", false},
+		{"1.00", "XYZ", false},
+	}
+
+	for _, tc := range testCases {
+		decimals, ok := utils.CurrencyDecimals(tc.currency)
+		valid := ok && utils.IsValidAmount(tc.amount, decimals, false)
+		if valid != tc.valid {
+			t.Errorf("Amount %q in %q: got valid=%v, expected %v", tc.amount, tc.currency, valid, tc.valid)
+		}
+	}
+
+	for _, amount := range []string{"-12.345", "0.001", "1250"} {
+		decimals := 3
+		if amount == "1250" {
+			decimals = 0
+		}
+		units, err := utils.ParseMinorUnits(amount, decimals)
+		if err != nil || utils.FormatMinorUnits(units, decimals) != amount {
+			t.Errorf("Round trip of %q failed: got %d, %v", amount, units, err)
+		}
+	}
+}
+
+func TestExchangeRates(t *testing.T) {
+	rates, err := services.LoadExchangeRates("../examples/exchange-rates.json")
+	if err != nil {
+		t.Fatalf("Loading example rates failed: %v", err)
+	}
+	if rates.Version() != "2024-06-01" || rates.Base() != "USD" {
+		t.Errorf("Rate table metadata incorrect: %q %q", rates.Version(), rates.Base())
+	}
+
+	testCases := []struct {
+		currency  string
+		date      string
+		rate      float64
+		effective string
+		ok        bool
+	}{
+		{"EUR", "2022-06-30", 1.13, "2022-01-01", true},
+		{"EUR", "2023-01-01", 1.07, "2023-01-01", true},
+		{"EUR", "2025-01-01", 1.10, "2024-01-01", true},
+		{"KWD", "2023-06-01", 0, "", false},
+		{"EUR", "2021-12-31", 0, "", false},
+		{"USD", "2000-01-01", 1, "", true},
+	}
+
+	for _, tc := range testCases {
+		rate, effective, ok := rates.Rate(tc.currency, tc.date)
+		if ok != tc.ok || rate != tc.rate || effective != tc.effective {
+			t.Errorf("Rate for %s on %s: got %v from %q (%v), expected %v from %q (%v)",
+				tc.currency, tc.date, rate, effective, ok, tc.rate, tc.effective, tc.ok)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "rates.json")
+	os.WriteFile(path, []byte(`{"base": "USD", "rates": [{"effective": "2024-01-01", "rates": {"EUR": -1}}]}`), 0o644)
+	if _, err := services.LoadExchangeRates(path); err == nil {
+		t.Errorf("Loading a negative rate should fail")
+	}
+}
+
+func TestMultiCurrencyScoring(t *testing.T) {
+	rates, _ := services.LoadExchangeRates("../examples/exchange-rates.json")
+	processor := services.NewReceiptProcessor()
+	processor.SetExchangeRates(rates)
+
+	// 10.00 EUR at 1.10 is 11.00 USD: a round dollar amount and a multiple of 0.25
+	euro := models.Receipt{
+		Retailer:     "X",
+		PurchaseDate: "2024-03-10",
+		PurchaseTime: "12:00",
+		Currency:     "EUR",
+		Items:        []models.Item{{ShortDescription: "Baguette", Price: "10.00"}},
+		Total:        "10.00",
+	}
+	breakdown, _ := processor.CalculateBreakdown(euro)
+	if findRule(breakdown, "round-dollar").Points != 50 || findRule(breakdown, "quarter-multiple").Points != 25 {
+		t.Errorf("Converted total should be a round dollar amount: %+v", breakdown.Rules)
+	}
+	if c := breakdown.Conversion; c == nil || c.From != "EUR" || c.To != "USD" || c.Rate != 1.10 || c.RatesVersion != "2024-06-01" {
+		t.Errorf("Conversion not recorded correctly: %+v", c)
+	}
+
+	// 1000 JPY at 0.0070 is 7.00 USD
+	yen := euro
+	yen.Currency = "JPY"
+	yen.Total = "1000"
+	yen.Items = []models.Item{{ShortDescription: "Onigiri", Price: "1000"}}
+	breakdown, _ = processor.CalculateBreakdown(yen)
+	if findRule(breakdown, "round-dollar").Points != 50 {
+		t.Errorf("Converted yen total should be a round dollar amount: %+v", breakdown.Rules)
+	}
+
+	usd := euro
+	usd.Currency = ""
+	if breakdown, _ := processor.CalculateBreakdown(usd); breakdown.Conversion != nil || findRule(breakdown, "round-dollar").Points != 50 {
+		t.Errorf("Base currency receipts should not be converted: %+v", breakdown)
+	}
+}
+
+func TestMultiCurrencyValidation(t *testing.T) {
+	rates, _ := services.LoadExchangeRates("../examples/exchange-rates.json")
+	processor := services.NewReceiptProcessor()
+	processor.SetExchangeRates(rates)
+	handler := handlers.NewReceiptHandler(processor)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/receipts/process", handler.ProcessReceipt).Methods("POST")
+	router.HandleFunc("/receipts/{id}/points", handler.GetPoints).Methods("GET")
+
+	testCases := []struct {
+		name     string
+		currency string
+		date     string
+		price    string
+		expected int
+	}{
+		{"euro", "EUR", "2024-03-09", "10.00", http.StatusOK},
+		{"yen", "JPY", "2024-03-09", "1000", http.StatusOK},
+		{"dinar", "KWD", "2024-03-09", "1.250", http.StatusOK},
+		{"yen with cents", "JPY", "2024-03-09", "10.00", http.StatusBadRequest},
+		{"unknown currency", "ABC", "2024-03-09", "10.00", http.StatusBadRequest},
+		{"no rate for date", "KWD", "2022-03-09", "1.250", http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			receiptJSON := `{
+				"retailer": "Carrefour",
+				"purchaseDate": "` + tc.date + `",
+				"purchaseTime": "12:00",
+				"currency": "` + tc.currency + `",
+				"total": "` + tc.price + `",
+				"items": [{"shortDescription": "Something", "price": "` + tc.price + `"}]
+			}`
+			req, _ := http.NewRequest("POST", "/receipts/process", bytes.NewBufferString(receiptJSON))
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expected {
+				t.Errorf("Got status %d, expected %d", rr.Code, tc.expected)
+			}
+		})
+	}
+
+	receiptJSON, _ := os.ReadFile("../examples/euro-receipt.json")
+	req, _ := http.NewRequest("POST", "/receipts/process", bytes.NewBuffer(receiptJSON))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var processResponse models.ReceiptResponse
+	json.Unmarshal(rr.Body.Bytes(), &processResponse)
+	req, _ = http.NewRequest("GET", "/receipts/"+processResponse.ID+"/points", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	// 9 for "Carrefour", 50 + 25 for 11.00 USD, 5 for the pair, 6 for the
+	// odd day and 10 for 14:45
+	var pointsResponse models.PointsResponse
+	json.Unmarshal(rr.Body.Bytes(), &pointsResponse)
+	if pointsResponse.Points != 105 {
+		t.Errorf("Euro example receipt points incorrect: got %d, expected %d", pointsResponse.Points, 105)
+	}
+}
+
+func TestExchangeRateDates(t *testing.T) {
+	rates, _ := services.LoadExchangeRates("../examples/exchange-rates.json")
+	processor := services.NewReceiptProcessor()
+	processor.SetExchangeRates(rates)
+	processor.Retailers().SetTimezone("Chicago Market", "America/Chicago")
+	processor.Retailers().SetTimezone("Tokyo Market", "Asia/Tokyo")
+	handler := handlers.NewReceiptHandler(processor)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/receipts/process", handler.ProcessReceipt).Methods("POST")
+
+	// KWD has rates from 2024-01-01, and receipts are checked against the
+	// store-local date they are scored with
+	testCases := []struct {
+		name     string
+		retailer string
+		date     string
+		time     string
+		expected int
+	}{
+		{"new year in UTC, before it in Chicago", "Chicago Market", "2024-01-01", "03:00", http.StatusBadRequest},
+		{"before new year in UTC, after it in Tokyo", "Tokyo Market", "2023-12-31", "20:00", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			receiptJSON := `{
+				"retailer": "` + tc.retailer + `",
+				"purchaseDate": "` + tc.date + `",
+				"purchaseTime": "` + tc.time + `",
+				"timezone": "UTC",
+				"currency": "KWD",
+				"total": "1.250",
+				"items": [{"shortDescription": "Something", "price": "1.250"}]
+			}`
+			req, _ := http.NewRequest("POST", "/receipts/process", bytes.NewBufferString(receiptJSON))
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expected {
+				t.Errorf("Got status %d, expected %d", rr.Code, tc.expected)
+			}
+		})
+	}
+
+	receipt := models.Receipt{
+		Retailer:     "X",
+		PurchaseDate: "2022-03-09",
+		PurchaseTime: "12:00",
+		Currency:     "KWD",
+		Items:        []models.Item{{ShortDescription: "Something", Price: "1.250"}},
+		Total:        "1.250",
+	}
+	if _, err := processor.CalculateBreakdown(receipt); !errors.Is(err, services.ErrNoExchangeRate) {
+		t.Errorf("Scoring a receipt with no rate should fail, got %v", err)
+	}
+	if _, err := processor.ProcessReceipt(context.Background(), receipt); !errors.Is(err, services.ErrNoExchangeRate) {
+		t.Errorf("Processing a receipt with no rate should fail, got %v", err)
+	}
+	if processor.Count() != 1 {
+		t.Errorf("Receipts with no rate should not be stored: %d stored", processor.Count())
+	}
+}
+
+func TestRateTableBaseCurrency(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	os.WriteFile(path, []byte(`{"base": "JPY", "rates": [{"effective": "2024-01-01", "rates": {"USD": 150}}]}`), 0o644)
+	rates, err := services.LoadExchangeRates(path)
+	if err != nil {
+		t.Fatalf("Loading rates failed: %v", err)
+	}
+	processor := services.NewReceiptProcessor()
+	processor.SetExchangeRates(rates)
+	handler := handlers.NewReceiptHandler(processor)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/receipts/process", handler.ProcessReceipt).Methods("POST")
+
+	// Receipts that name no currency are in the table's base currency
+	testCases := []struct {
+		name     string
+		currency string
+		price    string
+		expected int
+	}{
+		{"base currency", "", "1000", http.StatusOK},
+		{"base currency with cents", "", "10.00", http.StatusBadRequest},
+		{"dollars", "USD", "10.00", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			receiptJSON := `{
+				"retailer": "Lawson",
+				"purchaseDate": "2024-03-09",
+				"purchaseTime": "12:00",
+				"currency": "` + tc.currency + `",
+				"total": "` + tc.price + `",
+				"items": [{"shortDescription": "Something", "price": "` + tc.price + `"}]
+			}`
+			req, _ := http.NewRequest("POST", "/receipts/process", bytes.NewBufferString(receiptJSON))
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expected {
+				t.Errorf("Got status %d, expected %d", rr.Code, tc.expected)
+			}
+		})
+	}
+
+	// 10.00 USD at 150 is 1500 JPY
+	breakdown, err := processor.CalculateBreakdown(models.Receipt{
+		Retailer:     "Lawson",
+		PurchaseDate: "2024-03-09",
+		PurchaseTime: "12:00",
+		Currency:     "USD",
+		Items:        []models.Item{{ShortDescription: "Something", Price: "10.00"}},
+		Total:        "10.00",
+	})
+	if err != nil || breakdown.Conversion == nil || breakdown.Conversion.To != "JPY" {
+		t.Errorf("Dollars should be converted to yen: %+v, %v", breakdown.Conversion, err)
+	}
+}
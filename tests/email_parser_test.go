@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/parsers"
+	"receipt-processor/services"
+)
+
+// Each testdata/email/*.eml message is parsed and compared with the matching
+// .golden.json file. Run with -update to regenerate them.
+func TestEmailParserGolden(t *testing.T) {
+	runParserGolden(t, "testdata/email/*.eml", func(data []byte) (models.Receipt, parsers.Confidence, error) {
+		return parsers.ParseEmail(bytes.NewReader(data))
+	})
+}
+
+func TestEmailReceiptAPI(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	handler := handlers.NewReceiptHandler(processor)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/receipts/process/email", handler.ProcessEmailReceipt).Methods("POST")
+	router.HandleFunc("/receipts/{id}/points", handler.GetPoints).Methods("GET")
+
+	message, _ := os.ReadFile("testdata/email/target.eml")
+	req, _ := http.NewRequest("POST", "/receipts/process/email", bytes.NewBuffer(message))
+	req.Header.Set("Content-Type", "message/rfc822")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Processing email receipt failed: got status %d, expected 200", rr.Code)
+	}
+
+	var response models.ParsedReceiptResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Receipt.Retailer != "Target" || response.Confidence["retailer"] < 0.9 {
+		t.Errorf("Parsed receipt incorrect: %+v", response)
+	}
+
+	// The same receipt as README example 1
+	req, _ = http.NewRequest("GET", "/receipts/"+response.ID+"/points", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var pointsResponse models.PointsResponse
+	json.Unmarshal(rr.Body.Bytes(), &pointsResponse)
+	if pointsResponse.Points != 28 {
+		t.Errorf("Email receipt points incorrect: got %d, expected %d", pointsResponse.Points, 28)
+	}
+
+	// A message over the limit is refused rather than cut short
+	padded := append(bytes.Clone(message), bytes.Repeat([]byte("\r\n"), 5<<20)...)
+	req, _ = http.NewRequest("POST", "/receipts/process/email", bytes.NewBuffer(padded))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Oversized message should return 413 Request Entity Too Large, got %d", rr.Code)
+	}
+
+	newsletter, _ := os.ReadFile("testdata/email/newsletter.eml")
+	for name, body := range map[string][]byte{"newsletter": newsletter, "not a message": []byte("hello")} {
+		req, _ := http.NewRequest("POST", "/receipts/process/email", bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Email %s should return 400 Bad Request, got %d", name, rr.Code)
+		}
+	}
+}
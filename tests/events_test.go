@@ -0,0 +1,211 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+func TestEventBrokerReplay(t *testing.T) {
+	broker := services.NewEventBroker(3, 10)
+	for id := int64(1); id <= 5; id++ {
+		broker.Publish(models.ReceiptEvent{ID: id, Type: models.EventReceiptProcessed})
+	}
+
+	tests := []struct {
+		lastEventID int64
+		expected    []int64
+	}{
+		{-1, nil},
+		{5, nil},
+		{4, []int64{5}},
+		{2, []int64{3, 4, 5}},
+		// Events 2 and 3 have left the ring, so replay starts at the oldest
+		{1, []int64{3, 4, 5}},
+		{0, []int64{3, 4, 5}},
+	}
+	for _, tt := range tests {
+		replay, subscription := broker.Subscribe(tt.lastEventID)
+		subscription.Close()
+
+		var ids []int64
+		for _, event := range replay {
+			ids = append(ids, event.ID)
+		}
+		if len(ids) != len(tt.expected) {
+			t.Errorf("Replay after %d: expected %v, got %v", tt.lastEventID, tt.expected, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != tt.expected[i] {
+				t.Errorf("Replay after %d: expected %v, got %v", tt.lastEventID, tt.expected, ids)
+				break
+			}
+		}
+	}
+	if broker.Subscribers() != 0 {
+		t.Errorf("Closed subscriptions should be removed, %d remain", broker.Subscribers())
+	}
+}
+
+func TestEventBrokerEvictsSlowSubscriber(t *testing.T) {
+	broker := services.NewEventBroker(10, 2)
+	_, slow := broker.Subscribe(-1)
+	_, fast := broker.Subscribe(-1)
+
+	// Publish must not block on the slow subscriber, which never reads
+	var received []int64
+	for id := int64(1); id <= 5; id++ {
+		broker.Publish(models.ReceiptEvent{ID: id})
+		received = append(received, (<-fast.Events).ID)
+	}
+	if len(received) != 5 || received[4] != 5 {
+		t.Errorf("Fast subscriber should receive every event, got %v", received)
+	}
+
+	var buffered []int64
+	for event := range slow.Events {
+		buffered = append(buffered, event.ID)
+	}
+	if len(buffered) != 2 || buffered[0] != 1 || buffered[1] != 2 {
+		t.Errorf("Slow subscriber should keep its buffered events and be closed, got %v", buffered)
+	}
+	if broker.Subscribers() != 1 {
+		t.Errorf("Slow subscriber should be evicted, %d subscribers remain", broker.Subscribers())
+	}
+	slow.Close()
+
+	broker.Close()
+	if _, ok := <-fast.Events; ok {
+		t.Errorf("Close should disconnect every subscriber")
+	}
+}
+
+// sseReader reads events from a Server-Sent Events stream, skipping comments
+type sseReader struct {
+	scanner *bufio.Scanner
+}
+
+func (sr *sseReader) next(t *testing.T) (string, models.ReceiptEvent) {
+	t.Helper()
+	var id, eventType string
+	var event models.ReceiptEvent
+	for sr.scanner.Scan() {
+		line := sr.scanner.Text()
+		switch {
+		case line == "" && id != "":
+			return id, event
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				t.Fatalf("Event data is not JSON: %v", err)
+			}
+		}
+		if eventType != "" && event.Type != "" && eventType != event.Type {
+			t.Fatalf("Event field %q does not match payload type %q", eventType, event.Type)
+		}
+	}
+	t.Fatalf("Stream ended: %v", sr.scanner.Err())
+	return "", event
+}
+
+func openEventStream(t *testing.T, url, lastEventID string) *sseReader {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url+"/events", nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Opening event stream failed: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Event stream returned %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return &sseReader{scanner: bufio.NewScanner(resp.Body)}
+}
+
+func TestEventStream(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	broker := services.NewEventBroker(100, 10)
+	processor.AddListener(broker.Publish)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/events", handlers.NewEventsHandler(broker).StreamEvents).Methods("GET")
+	router.HandleFunc("/admin/receipts/{id}/rescore", handlers.NewAdminHandler(processor).RescoreReceipt).Methods("POST")
+	server := httptest.NewServer(router)
+	defer server.Close()
+	defer broker.Close()
+
+	stream := openEventStream(t, server.URL, "")
+
+	id, _ := processor.ProcessReceipt(context.Background(), simpleReceipt())
+	eventID, event := stream.next(t)
+	if eventID != "1" || event.Type != models.EventReceiptProcessed || event.ReceiptID != id || event.Points != 31 || event.PreviousPoints != nil {
+		t.Errorf("Processed event incorrect: id %s, %+v", eventID, event)
+	}
+
+	// Rescoring under a new cap publishes the adjustment
+	processor.SetCaps(services.PointCaps{PerReceipt: 20})
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/admin/receipts/"+id+"/rescore", nil)
+	router.ServeHTTP(rr, req)
+	var breakdown models.PointsBreakdown
+	json.Unmarshal(rr.Body.Bytes(), &breakdown)
+	if rr.Code != http.StatusOK || breakdown.Points != 20 {
+		t.Fatalf("Rescore should return the capped breakdown, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	eventID, event = stream.next(t)
+	if eventID != "2" || event.Type != models.EventPointsAdjusted || event.Points != 20 || event.PreviousPoints == nil || *event.PreviousPoints != 31 {
+		t.Errorf("Adjusted event incorrect: id %s, %+v", eventID, event)
+	}
+
+	// Rescoring without a change publishes nothing
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	// A reconnecting client resumes after the last event it saw
+	resumed := openEventStream(t, server.URL, "1")
+	eventID, event = resumed.next(t)
+	if eventID != "2" || event.Type != models.EventPointsAdjusted {
+		t.Errorf("Resumed stream should replay event 2, got id %s, %+v", eventID, event)
+	}
+	processor.ProcessReceipt(context.Background(), simpleReceipt())
+	if eventID, _ = resumed.next(t); eventID != "3" {
+		t.Errorf("Resumed stream should continue with event 3, got %s", eventID)
+	}
+	if eventID, _ = stream.next(t); eventID != "3" {
+		t.Errorf("Original stream should skip to event 3, got %s", eventID)
+	}
+
+	for _, lastEventID := range []string{"abc", "-2"} {
+		req, _ := http.NewRequest("GET", "/events", nil)
+		req.Header.Set("Last-Event-ID", lastEventID)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Last-Event-ID %q should return 400, got %d", lastEventID, rr.Code)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/admin/receipts/missing/rescore", nil)
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Rescoring a missing receipt should return 404, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,158 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"receipt-processor/expr"
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+var exprReceipt = models.Receipt{
+	Retailer:     "Target",
+	PurchaseDate: "2022-01-01",
+	PurchaseTime: "13:01",
+	Items: []models.Item{
+		{ShortDescription: "Mountain Dew 12PK", Price: "6.49"},
+		{ShortDescription: "Emils Cheese Pizza", Price: "12.25"},
+		{ShortDescription: "Knorr Creamy Chicken", Price: "1.26"},
+		{ShortDescription: "Doritos Nacho Cheese", Price: "3.35"},
+		{ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ", Price: "12.00"},
+	},
+	Total: "35.35",
+}
+
+func TestExpressionEvaluation(t *testing.T) {
+	testCases := []struct {
+		expression string
+		expected   float64
+	}{
+		{`if total >= 30 && retailer == "Target" then 20`, 20},
+		{`if total >= 50 && retailer == "Target" then 20`, 0},
+		{`if retailer == "Walmart" then 1 else if day == 1 then 2 else 3`, 2},
+		{`count(items, item.price > 5)`, 3},
+		{`floor(sum(items, item.price))`, 35},
+		{`if any(items, contains(lower(item.description), "pizza")) then 7`, 7},
+		{`if all(items, item.price > 1) then 4 else 0`, 4},
+		{`itemCount * 2 - 1`, 9},
+		{`weekday + month + year % 100`, 6 + 1 + 22},
+		{`if purchaseTime >= "13:00" && hour == 13 && minute == 1 then 1`, 1},
+		{`len(retailer) + -(2 * 3)`, 0},
+		{`if !(purchaseDate == "2022-01-02") then 5`, 5},
+		{`max(min(total, 10), 3) / 4`, 2.5},
+		{`count(items, item.sku == "" && item.category == "")`, 5},
+	}
+
+	for _, tc := range testCases {
+		program, err := expr.Compile(tc.expression)
+		if err != nil {
+			t.Errorf("Compiling %q failed: %v", tc.expression, err)
+			continue
+		}
+		value, err := program.Eval(exprReceipt, 0)
+		if err != nil {
+			t.Errorf("Evaluating %q failed: %v", tc.expression, err)
+			continue
+		}
+		if value != tc.expected {
+			t.Errorf("Evaluating %q: got %v, expected %v", tc.expression, value, tc.expected)
+		}
+	}
+}
+
+func TestExpressionCompileErrors(t *testing.T) {
+	testCases := []struct {
+		expression string
+		expected   string
+	}{
+		{`total >`, "1:8: unexpected end of expression"},
+		{`if total > 5 20`, `1:14: expected "then", found "20"`},
+		{"if total > 5\nthen \"big\"", "2:6: if without else must produce a number, found string"},
+		{`retailer == 5`, "1:10: mismatched types string == number"},
+		{`points + 1`, `1:1: unknown variable "points"`},
+		{`item.price`, "1:1: item can only be used inside count, sum, any or all"},
+		{`count(items, item.color == "red")`, `1:19: item has no field "color"`},
+		{`count(items, item.price)`, "1:19: count needs a bool expression, found number"},
+		{`total > 5`, "1:7: expression must produce a number, found bool"},
+		{`1 < 2 < 3`, `1:7: unexpected "<"`},
+		{`"unterminated`, "1:1: unterminated string"},
+		{`total # 2`, "1:7: unexpected character '#'"},
+		{`shout(retailer)`, `1:1: unknown function "shout"`},
+	}
+
+	for _, tc := range testCases {
+		_, err := expr.Compile(tc.expression)
+		if err == nil {
+			t.Errorf("Compiling %q should fail", tc.expression)
+			continue
+		}
+		if err.Error() != tc.expected {
+			t.Errorf("Compiling %q: got error %q, expected %q", tc.expression, err.Error(), tc.expected)
+		}
+	}
+}
+
+func TestExpressionRuntimeErrors(t *testing.T) {
+	program, err := expr.Compile(`sum(items, item.price * 2 + 1)`)
+	if err != nil {
+		t.Fatalf("Compiling failed: %v", err)
+	}
+	if _, err := program.Eval(exprReceipt, 10); err == nil || !strings.Contains(err.Error(), "exceeded 10 steps") {
+		t.Errorf("Step limit should stop evaluation, got %v", err)
+	}
+	if _, err := program.Eval(exprReceipt, 1000); err != nil {
+		t.Errorf("Evaluation within the step limit failed: %v", err)
+	}
+
+	program, _ = expr.Compile(`total / (itemCount - 5)`)
+	if _, err := program.Eval(exprReceipt, 0); err == nil || err.Error() != "1:7: division by zero" {
+		t.Errorf("Division by zero should fail with its position, got %v", err)
+	}
+}
+
+func TestExpressionRules(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.json")
+	os.WriteFile(path, []byte(`[
+		{"name": "big-target", "expression": "if total >= 30 && retailer == \"Target\" then 20"},
+		{"name": "cheap-items", "expression": "count(items, item.price < 5) * 1.5"}
+	]`), 0o644)
+
+	rules, err := services.LoadRules(path)
+	if err != nil {
+		t.Fatalf("Loading rules failed: %v", err)
+	}
+
+	processor := services.NewReceiptProcessor()
+	basePoints, _ := processor.CalculatePoints(exprReceipt)
+	for _, rule := range rules {
+		processor.AddRule(rule)
+	}
+
+	// 20 points for the Target rule, floor(2 * 1.5) for the cheap items rule
+	expectedDiff := int64(23)
+	points, _ := processor.CalculatePoints(exprReceipt)
+	if diff := points - basePoints; diff != expectedDiff {
+		t.Errorf("Custom rule points incorrect: difference was %d, expected %d", diff, expectedDiff)
+	}
+
+	// Results that overflow award no points rather than arbitrary ones
+	huge := strings.Repeat("99999999999 * ", 30) + "1"
+	for _, expression := range []string{huge, "0 - " + huge, "99999999999 * 99999999999", "(" + huge + ") - (" + huge + ")"} {
+		rule, err := services.NewExpressionRule("overflow", expression, 0)
+		if err != nil {
+			t.Fatalf("Compiling %q failed: %v", expression, err)
+		}
+		if points := rule.Points(exprReceipt); points != 0 {
+			t.Errorf("Rule %q should award no points, got %d", expression, points)
+		}
+	}
+
+	os.WriteFile(path, []byte(`[{"name": "broken", "expression": "if total then 1"}]`), 0o644)
+	if _, err := services.LoadRules(path); err == nil || !strings.Contains(err.Error(), `rule "broken": 1:4: condition must be bool`) {
+		t.Errorf("Loading an invalid rule should report its name and position, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+func probe(t *testing.T, handler http.Handler, path string) (int, models.HealthResponse) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", path, nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	var response models.HealthResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s returned %d %q: %v", path, rr.Code, rr.Body.String(), err)
+	}
+	return rr.Code, response
+}
+
+func TestHealthProbes(t *testing.T) {
+	health := handlers.NewHealthHandler()
+	var storeErr error
+	health.AddCheck("store", func() error { return storeErr })
+
+	// Probes need no API key, unlike every other route
+	router, _ := newAuthRouter(services.NewAPIKeyStore())
+	server := health.Middleware(router)
+	if rr := authRequest(server, "GET", "/receipts/missing/points", "", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Other routes should still need an API key, got %d", rr.Code)
+	}
+
+	tests := []struct {
+		name       string
+		change     func()
+		readyCode  int
+		status     string
+		storeCheck string
+	}{
+		{"loading", func() {}, http.StatusServiceUnavailable, "loading", "ok"},
+		{"ready", health.SetReady, http.StatusOK, "ready", "ok"},
+		{"failing", func() { storeErr = errors.New("disk full") }, http.StatusServiceUnavailable, "failing", "disk full"},
+		{"recovered", func() { storeErr = nil }, http.StatusOK, "ready", "ok"},
+		{"draining", health.Drain, http.StatusServiceUnavailable, "draining", "ok"},
+	}
+	for _, tt := range tests {
+		tt.change()
+		if code, response := probe(t, server, handlers.LivenessPath); code != http.StatusOK || response.Status != "ok" {
+			t.Errorf("%s: server should be live, got %d %+v", tt.name, code, response)
+		}
+		code, response := probe(t, server, handlers.ReadinessPath)
+		if code != tt.readyCode || response.Status != tt.status || response.Checks["store"] != tt.storeCheck {
+			t.Errorf("%s: expected %d %s, got %d %+v", tt.name, tt.readyCode, tt.status, code, response)
+		}
+	}
+}
+
+func TestEventLogErr(t *testing.T) {
+	eventLog, err := services.OpenEventLog(filepath.Join(t.TempDir(), "history.jsonl"))
+	if err != nil {
+		t.Fatalf("Opening event log failed: %v", err)
+	}
+	processor := services.NewReceiptProcessor()
+	processor.SetEventLog(eventLog)
+
+	processor.ProcessReceipt(context.Background(), simpleReceipt())
+	if err := eventLog.Err(); err != nil {
+		t.Fatalf("Event log should have no error, got %v", err)
+	}
+
+	// Writes after the file is closed fail, which fails readiness
+	eventLog.Close()
+	processor.ProcessReceipt(context.Background(), simpleReceipt())
+	if eventLog.Err() == nil {
+		t.Errorf("Event log should report the failed write")
+	}
+}
+
+func TestEventStreamOutlivesWriteTimeout(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	broker := services.NewEventBroker(100, 10)
+	processor.AddListener(broker.Publish)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/events", handlers.NewEventsHandler(broker).StreamEvents).Methods("GET")
+	server := httptest.NewUnstartedServer(router)
+	server.Config.WriteTimeout = 50 * time.Millisecond
+	server.Start()
+	defer server.Close()
+	defer broker.Close()
+
+	stream := openEventStream(t, server.URL, "")
+	time.Sleep(200 * time.Millisecond)
+	id, _ := processor.ProcessReceipt(context.Background(), simpleReceipt())
+	if _, event := stream.next(t); event.ReceiptID != id {
+		t.Errorf("Stream should deliver events after the write timeout, got %+v", event)
+	}
+}
@@ -0,0 +1,292 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+func TestReceiptHistory(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	receiptHandler := handlers.NewReceiptHandler(processor)
+	adminHandler := handlers.NewAdminHandler(processor)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/receipts/process", receiptHandler.ProcessReceipt).Methods("POST")
+	router.HandleFunc("/receipts/{id}/points", receiptHandler.GetPoints).Methods("GET")
+	router.HandleFunc("/receipts/{id}/history", receiptHandler.GetHistory).Methods("GET")
+	router.HandleFunc("/receipts/{id}", receiptHandler.UpdateReceipt).Methods("PUT")
+	router.HandleFunc("/receipts/{id}", receiptHandler.DeleteReceipt).Methods("DELETE")
+	router.HandleFunc("/admin/receipts/{id}/rescore", adminHandler.RescoreReceipt).Methods("POST")
+
+	request := func(method, url string, body any) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, url, bytes.NewBuffer(data))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	receipt := simpleReceipt()
+	var created models.ReceiptResponse
+	json.Unmarshal(request("POST", "/receipts/process", receipt).Body.Bytes(), &created)
+
+	// Moving the purchase into the afternoon earns 10 more points
+	receipt.PurchaseTime = "14:30"
+	rr := request("PUT", "/receipts/"+created.ID, receipt)
+	if rr.Code != http.StatusOK || rr.Body.String() != "{\"points\":41}\n" {
+		t.Fatalf("Updating receipt should return the new points, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	processor.SetCaps(services.PointCaps{PerReceipt: 25})
+	if rr := request("POST", "/admin/receipts/"+created.ID+"/rescore", nil); rr.Code != http.StatusOK {
+		t.Fatalf("Rescoring receipt failed: got %d", rr.Code)
+	}
+	if rr := request("DELETE", "/receipts/"+created.ID, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("Deleting receipt should return 204, got %d", rr.Code)
+	}
+	if rr := request("GET", "/receipts/"+created.ID+"/points", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Deleted receipt should have no points, got %d", rr.Code)
+	}
+
+	rr = request("GET", "/receipts/"+created.ID+"/history", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("History of a deleted receipt should be kept, got %d", rr.Code)
+	}
+	var history []models.HistoryEvent
+	json.Unmarshal(rr.Body.Bytes(), &history)
+
+	types := []string{models.HistoryCreated, models.HistoryUpdated, models.HistoryRescored, models.HistoryDeleted}
+	if len(history) != len(types) {
+		t.Fatalf("Expected %d history events, got %+v", len(types), history)
+	}
+	for i, event := range history {
+		if event.Type != types[i] || event.Sequence != int64(i+1) || event.ReceiptID != created.ID || event.Actor != "anonymous" || event.Time.IsZero() {
+			t.Errorf("History event %d incorrect: %+v", i, event)
+		}
+	}
+	if history[0].Receipt == nil || history[0].Receipt.PurchaseTime != "13:13" || history[0].Breakdown.Points != 31 {
+		t.Errorf("Created event should hold the original receipt and points: %+v", history[0])
+	}
+
+	expectedDiffs := [][]models.FieldChange{
+		nil,
+		{
+			{Field: "purchaseTime", Old: json.RawMessage(`"13:13"`), New: json.RawMessage(`"14:30"`)},
+			{Field: "points", Old: json.RawMessage(`31`), New: json.RawMessage(`41`)},
+		},
+		{
+			{Field: "points", Old: json.RawMessage(`41`), New: json.RawMessage(`25`)},
+		},
+		nil,
+	}
+	for i, expected := range expectedDiffs {
+		if !reflect.DeepEqual(history[i].Diff, expected) {
+			t.Errorf("History event %d: expected diff %s, got %s", i, expected, history[i].Diff)
+		}
+	}
+
+	if rr := request("GET", "/receipts/missing/history", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("History of a missing receipt should return 404, got %d", rr.Code)
+	}
+	if rr := request("PUT", "/receipts/"+created.ID, receipt); rr.Code != http.StatusNotFound {
+		t.Errorf("Updating a deleted receipt should return 404, got %d", rr.Code)
+	}
+	if rr := request("DELETE", "/receipts/"+created.ID, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Deleting a deleted receipt should return 404, got %d", rr.Code)
+	}
+
+	invalid := simpleReceipt()
+	invalid.PurchaseDate = "2022-13-01"
+	id, _ := processor.ProcessReceipt(context.Background(), simpleReceipt())
+	if rr := request("PUT", "/receipts/"+id, invalid); rr.Code != http.StatusBadRequest {
+		t.Errorf("Updating with an invalid receipt should return 400, got %d", rr.Code)
+	}
+	if history, _ := processor.History(id); len(history) != 1 || history[0].Actor != services.SystemActor {
+		t.Errorf("Changes without an actor should be recorded as the system: %+v", history)
+	}
+}
+
+func TestHistoryReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	eventLog, err := services.OpenEventLog(path)
+	if err != nil {
+		t.Fatalf("Opening event log failed: %v", err)
+	}
+
+	processor := services.NewReceiptProcessor()
+	processor.SetEventLog(eventLog)
+	processor.SetCaps(services.PointCaps{PerCustomerPerDay: 50})
+	ctx := services.WithActor(context.Background(), "alice")
+
+	first, _ := processor.ProcessReceipt(ctx, simpleReceipt())
+	second, _ := processor.ProcessReceipt(ctx, simpleReceipt())
+	corrected := simpleReceipt()
+	corrected.Retailer = "Walgreens"
+	processor.UpdateReceipt(ctx, second, corrected)
+	processor.Rescore(ctx, second)
+	processor.DeleteReceipt(ctx, first)
+	if err := eventLog.Close(); err != nil {
+		t.Fatalf("Closing event log failed: %v", err)
+	}
+
+	reopened, err := services.OpenEventLog(path)
+	if err != nil {
+		t.Fatalf("Reopening event log failed: %v", err)
+	}
+	defer reopened.Close()
+	events, err := reopened.Events()
+	if err != nil || len(events) != 5 {
+		t.Fatalf("Expected 5 logged events, got %d: %v", len(events), err)
+	}
+
+	replayed := services.NewReceiptProcessor()
+	replayed.SetCaps(services.PointCaps{PerCustomerPerDay: 50})
+	if err := replayed.Replay(events); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	if _, exists := replayed.GetReceipt(first); exists {
+		t.Errorf("Deleted receipt should not be restored")
+	}
+	receipt, _ := replayed.GetReceipt(second)
+	if receipt.Retailer != "Walgreens" {
+		t.Errorf("Updated receipt should be restored, got %+v", receipt)
+	}
+	for _, id := range []string{first, second} {
+		original, _ := processor.History(id)
+		restored, _ := replayed.History(id)
+		if len(restored) != len(original) {
+			t.Fatalf("History of %s not restored: %+v", id, restored)
+		}
+		for i := range original {
+			if restored[i].Sequence != original[i].Sequence || restored[i].Type != original[i].Type || restored[i].Actor != "alice" {
+				t.Errorf("History event of %s differs after replay: %+v", id, restored[i])
+			}
+		}
+	}
+
+	// The second receipt was capped to 19 points, and the first's 31 were
+	// released when it was deleted, leaving 31 for the day
+	original, _ := processor.GetBreakdown(second)
+	restored, _ := replayed.GetBreakdown(second)
+	if !reflect.DeepEqual(restored, original) || restored.Points != 19 {
+		t.Errorf("Breakdown differs after replay: %+v", restored)
+	}
+	nextID, _ := replayed.ProcessReceipt(ctx, simpleReceipt())
+	next, _ := replayed.GetBreakdown(nextID)
+	if next.Points != 31 {
+		t.Errorf("Daily cap should be restored by replay, next receipt got %d points", next.Points)
+	}
+	if history, _ := replayed.History(first); history[len(history)-1].Sequence != 5 {
+		t.Errorf("Sequence numbers should continue after replay")
+	}
+
+	invalidLogs := map[string][]models.HistoryEvent{
+		"out of sequence":      {events[1], events[0]},
+		"update before create": {events[2]},
+		"unknown type":         {{Sequence: 1, ReceiptID: "r", Type: "archived"}},
+	}
+	for name, events := range invalidLogs {
+		if err := services.NewReceiptProcessor().Replay(events); err == nil {
+			t.Errorf("Replaying %s should fail", name)
+		}
+	}
+}
+
+func TestReplayKeepsCapDays(t *testing.T) {
+	ctx := context.Background()
+	processor := services.NewReceiptProcessor()
+	processor.SetCaps(services.PointCaps{PerCustomerPerDay: 50})
+	if err := processor.Retailers().SetTimezone("Target", "America/Chicago"); err != nil {
+		t.Fatalf("Setting time zone failed: %v", err)
+	}
+
+	// 01:13 UTC on January 2 is the evening of January 1 in Chicago
+	receipt := simpleReceipt()
+	receipt.PurchaseTime = "01:13"
+	receipt.Timezone = "UTC"
+	id, _ := processor.ProcessReceipt(ctx, receipt)
+	first, _ := processor.GetBreakdown(id)
+	events, _ := processor.History(id)
+	if events[0].Day != "2022-01-01" {
+		t.Errorf("Created event should record the store-local day, got %q", events[0].Day)
+	}
+
+	// The day is kept even if time zones are only set after the replay
+	replayed := services.NewReceiptProcessor()
+	replayed.SetCaps(services.PointCaps{PerCustomerPerDay: 50})
+	if err := replayed.Replay(events); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	sameDay := simpleReceipt()
+	sameDay.PurchaseDate = "2022-01-01"
+	sameDayID, _ := replayed.ProcessReceipt(ctx, sameDay)
+	breakdown, _ := replayed.GetBreakdown(sameDayID)
+	if breakdown.Points != 50-first.Points {
+		t.Errorf("Replayed receipt should count towards January 1: next receipt got %d points, expected %d", breakdown.Points, 50-first.Points)
+	}
+}
+
+// gateRule holds up the first scoring after it is armed until released
+type gateRule struct {
+	armed    chan struct{}
+	entered  chan struct{}
+	released chan struct{}
+}
+
+func (g *gateRule) Name() string { return "gate" }
+
+func (g *gateRule) Points(receipt models.Receipt) int64 {
+	select {
+	case <-g.armed:
+		close(g.entered)
+		<-g.released
+	default:
+	}
+	return 0
+}
+
+func TestRescoreDuringUpdate(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	gate := &gateRule{armed: make(chan struct{}, 1), entered: make(chan struct{}), released: make(chan struct{})}
+	processor.AddRule(gate)
+	id, _ := processor.ProcessReceipt(context.Background(), simpleReceipt())
+
+	gate.armed <- struct{}{}
+	done := make(chan models.PointsBreakdown)
+	go func() {
+		breakdown, _ := processor.Rescore(context.Background(), id)
+		done <- breakdown
+	}()
+	<-gate.entered
+
+	// The update lands while the rescore is scoring the old receipt
+	updated := simpleReceipt()
+	updated.Retailer = "Walmart"
+	expected, _ := processor.UpdateReceipt(context.Background(), id, updated)
+	close(gate.released)
+	breakdown := <-done
+
+	if receipt, _ := processor.GetReceipt(id); receipt.Retailer != "Walmart" {
+		t.Errorf("Rescore should not undo the update, got retailer %q", receipt.Retailer)
+	}
+	if breakdown.Points != expected.Points {
+		t.Errorf("Rescore should score the updated receipt: expected %d points, got %d", expected.Points, breakdown.Points)
+	}
+	history, _ := processor.History(id)
+	if len(history) != 3 || history[1].Type != models.HistoryUpdated || history[2].Type != models.HistoryRescored || len(history[2].Diff) != 0 {
+		t.Errorf("Rescore after the update should change nothing: %+v", history)
+	}
+}
@@ -0,0 +1,255 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+func TestJobQueueBounds(t *testing.T) {
+	jobs := services.NewJobQueue(2, 3)
+
+	var running, maxRunning int32
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	blocking := func() (string, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		started <- struct{}{}
+		<-release
+		atomic.AddInt32(&running, -1)
+		return "receipt", nil
+	}
+
+	// Two jobs occupy the workers, three more fill the queue
+	var submitted []models.Job
+	for i := 0; i < 2; i++ {
+		job, _ := jobs.Submit(services.DefaultTenant, blocking)
+		submitted = append(submitted, job)
+	}
+	<-started
+	<-started
+	for i := 0; i < 3; i++ {
+		job, err := jobs.Submit(services.DefaultTenant, blocking)
+		if err != nil {
+			t.Fatalf("Submitting job %d failed: %v", i+3, err)
+		}
+		submitted = append(submitted, job)
+	}
+	if _, err := jobs.Submit(services.DefaultTenant, blocking); !errors.Is(err, services.ErrQueueFull) {
+		t.Errorf("Submitting to a full queue should fail with ErrQueueFull, got %v", err)
+	}
+
+	if job, _ := jobs.Job(submitted[0].ID); job.Status != models.JobRunning {
+		t.Errorf("First job should be running, got %q", job.Status)
+	}
+	if job, _ := jobs.Job(submitted[4].ID); job.Status != models.JobQueued {
+		t.Errorf("Last job should be queued, got %q", job.Status)
+	}
+
+	// A deadline while jobs are blocked is reported, and the jobs still run
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := jobs.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown with blocked jobs should time out, got %v", err)
+	}
+	if _, err := jobs.Submit(services.DefaultTenant, blocking); !errors.Is(err, services.ErrQueueClosed) {
+		t.Errorf("Submitting after shutdown should fail with ErrQueueClosed, got %v", err)
+	}
+
+	close(release)
+	if err := jobs.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Draining the queue failed: %v", err)
+	}
+	for _, submittedJob := range submitted {
+		job, _ := jobs.Job(submittedJob.ID)
+		if job.Status != models.JobSucceeded || job.ReceiptID != "receipt" || job.CompletedAt == nil {
+			t.Errorf("Job should have succeeded after draining: %+v", job)
+		}
+	}
+	if maxRunning > 2 {
+		t.Errorf("At most 2 jobs should run at once, got %d", maxRunning)
+	}
+}
+
+func TestJobQueueDrain(t *testing.T) {
+	jobs := services.NewJobQueue(3, 50)
+
+	var completed int32
+	var ids []string
+	for i := 0; i < 50; i++ {
+		job, err := jobs.Submit(services.DefaultTenant, func() (string, error) {
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&completed, 1)
+			return "", errors.New("boom")
+		})
+		if err != nil {
+			t.Fatalf("Submitting job %d failed: %v", i, err)
+		}
+		ids = append(ids, job.ID)
+	}
+
+	if err := jobs.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Draining the queue failed: %v", err)
+	}
+	if completed != 50 {
+		t.Errorf("Shutdown should run every queued job, ran %d", completed)
+	}
+	for _, id := range ids {
+		if job, _ := jobs.Job(id); job.Status != models.JobFailed || len(job.Errors) != 1 || job.Errors[0] != "boom" {
+			t.Errorf("Job should have failed with its error: %+v", job)
+		}
+	}
+}
+
+func TestAsyncProcessing(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	handler := handlers.NewReceiptHandler(processor)
+	jobs := services.NewJobQueue(4, 500)
+	handler.SetJobQueue(jobs)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/receipts/process", handler.ProcessReceipt).Methods("POST")
+	router.HandleFunc("/receipts/{id}/points", handler.GetPoints).Methods("GET")
+	router.HandleFunc("/jobs/{id}", handler.GetJob).Methods("GET")
+
+	valid, _ := os.ReadFile("../examples/simple-receipt.json")
+	invalid := []byte(`{"retailer": "Target", "purchaseDate": "2022-13-01", "purchaseTime": "13:13", "total": "1.25", "items": [{"shortDescription": "Pepsi", "price": "1.25"}]}`)
+
+	// Submit concurrently; every other receipt is invalid
+	const submissions = 200
+	locations := make([]string, submissions)
+	var wg sync.WaitGroup
+	for i := 0; i < submissions; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := valid
+			if i%2 == 1 {
+				body = invalid
+			}
+			req, _ := http.NewRequest("POST", "/receipts/process?async=true", bytes.NewBuffer(body))
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusAccepted {
+				t.Errorf("Submission %d: got status %d, expected 202", i, rr.Code)
+				return
+			}
+			var job models.Job
+			json.Unmarshal(rr.Body.Bytes(), &job)
+			if job.Status != models.JobQueued || rr.Header().Get("Location") != "/jobs/"+job.ID {
+				t.Errorf("Submission %d: job response incorrect: %+v", i, job)
+			}
+			locations[i] = rr.Header().Get("Location")
+		}(i)
+	}
+	wg.Wait()
+
+	if err := jobs.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Draining the queue failed: %v", err)
+	}
+
+	for i, location := range locations {
+		req, _ := http.NewRequest("GET", location, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		var job models.Job
+		json.Unmarshal(rr.Body.Bytes(), &job)
+		if i%2 == 1 {
+			if job.Status != models.JobFailed || len(job.Errors) == 0 || job.ReceiptID != "" {
+				t.Errorf("Invalid receipt %d should fail: %+v", i, job)
+			}
+			continue
+		}
+		if job.Status != models.JobSucceeded {
+			t.Fatalf("Valid receipt %d should succeed: %+v", i, job)
+		}
+
+		req, _ = http.NewRequest("GET", "/receipts/"+job.ReceiptID+"/points", nil)
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var pointsResponse models.PointsResponse
+		json.Unmarshal(rr.Body.Bytes(), &pointsResponse)
+		if pointsResponse.Points != 31 {
+			t.Errorf("Async receipt %d points incorrect: got %d, expected %d", i, pointsResponse.Points, 31)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		method   string
+		url      string
+		body     []byte
+		expected int
+	}{
+		{"malformed body is rejected immediately", "POST", "/receipts/process?async=true", []byte("{"), http.StatusBadRequest},
+		{"queue shut down", "POST", "/receipts/process?async=true", valid, http.StatusServiceUnavailable},
+		{"unknown job", "GET", "/jobs/unknown", nil, http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		req, _ := http.NewRequest(tc.method, tc.url, bytes.NewBuffer(tc.body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tc.expected {
+			t.Errorf("%s: got status %d, expected %d", tc.name, rr.Code, tc.expected)
+		}
+	}
+}
+
+func TestAsyncQueueFull(t *testing.T) {
+	handler := handlers.NewReceiptHandler(services.NewReceiptProcessor())
+	router := mux.NewRouter()
+	router.HandleFunc("/receipts/process", handler.ProcessReceipt).Methods("POST")
+
+	valid, _ := os.ReadFile("../examples/simple-receipt.json")
+	submit := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/receipts/process?async=true", bytes.NewBuffer(valid))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := submit(); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Async without a job queue should return 503, got %d", rr.Code)
+	}
+
+	// No workers, so the single slot stays taken
+	jobs := services.NewJobQueue(0, 1)
+	handler.SetJobQueue(jobs)
+	if rr := submit(); rr.Code != http.StatusAccepted {
+		t.Fatalf("First submission should be accepted, got %d", rr.Code)
+	}
+	rr := submit()
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Full queue should return 503 with Retry-After, got %d %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	// Synchronous processing is unaffected
+	req, _ := http.NewRequest("POST", "/receipts/process", bytes.NewBuffer(valid))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Synchronous processing should still succeed, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,205 @@
+package tests
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+func TestLineItemValidation(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	handler := handlers.NewReceiptHandler(processor)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/receipts/process", handler.ProcessReceipt).Methods("POST")
+
+	testCases := []struct {
+		name     string
+		lines    string
+		total    string
+		expected int
+	}{
+		{
+			name:     "quantity times unit price",
+			lines:    `"items": [{"shortDescription": "Gatorade", "quantity": "3", "unitPrice": "2.25", "price": "6.75"}]`,
+			total:    "6.75",
+			expected: http.StatusOK,
+		},
+		{
+			name:     "weighed item rounds to the cent",
+			lines:    `"items": [{"shortDescription": "Bananas", "quantity": "1.375", "unitPrice": "0.59", "price": "0.81"}]`,
+			total:    "0.81",
+			expected: http.StatusOK,
+		},
+		{
+			name: "discounts and taxes",
+			lines: `"items": [{"shortDescription": "Pizza", "price": "12.25"}, {"shortDescription": "Coupon", "price": "-1.00"}],
+				"discounts": [{"description": "Member savings", "amount": "0.25"}],
+				"taxes": [{"description": "Sales tax", "amount": "0.88"}]`,
+			total:    "11.88",
+			expected: http.StatusOK,
+		},
+		{
+			name:     "price does not match quantity",
+			lines:    `"items": [{"shortDescription": "Gatorade", "quantity": "3", "unitPrice": "2.25", "price": "6.00"}]`,
+			total:    "6.00",
+			expected: http.StatusBadRequest,
+		},
+		{
+			name: "total does not match lines",
+			lines: `"items": [{"shortDescription": "Pizza", "price": "12.25"}],
+				"taxes": [{"description": "Sales tax", "amount": "0.88"}]`,
+			total:    "12.25",
+			expected: http.StatusBadRequest,
+		},
+		{
+			name:     "negative quantity",
+			lines:    `"items": [{"shortDescription": "Gatorade", "quantity": "-1", "price": "2.25"}]`,
+			total:    "2.25",
+			expected: http.StatusBadRequest,
+		},
+		{
+			name:     "negative discount",
+			lines:    `"items": [{"shortDescription": "Pizza", "price": "1.00"}], "discounts": [{"description": "Oops", "amount": "-1.00"}]`,
+			total:    "2.00",
+			expected: http.StatusBadRequest,
+		},
+		{
+			name:     "largest quantity",
+			lines:    `"items": [{"shortDescription": "Screws", "quantity": "10000", "unitPrice": "0.01", "price": "100.00"}]`,
+			total:    "100.00",
+			expected: http.StatusOK,
+		},
+		{
+			name:     "quantity without unit price",
+			lines:    `"items": [{"shortDescription": "Gatorade", "quantity": "100000000", "price": "1.00"}]`,
+			total:    "1.00",
+			expected: http.StatusBadRequest,
+		},
+		{
+			name:     "quantity over the maximum",
+			lines:    `"items": [{"shortDescription": "Gatorade", "quantity": "10001", "unitPrice": "0.00", "price": "0.00"}]`,
+			total:    "0.00",
+			expected: http.StatusBadRequest,
+		},
+		{
+			name:     "quantity overflowing an integer",
+			lines:    `"items": [{"shortDescription": "Gatorade", "quantity": "99999999999999999999", "unitPrice": "0.00", "price": "0.00"}]`,
+			total:    "0.00",
+			expected: http.StatusBadRequest,
+		},
+		{
+			name:     "line price overflowing an integer",
+			lines:    `"items": [{"shortDescription": "Gatorade", "quantity": "9999", "unitPrice": "92233720368547758.07", "price": "1.00"}]`,
+			total:    "1.00",
+			expected: http.StatusBadRequest,
+		},
+		{
+			name:     "amount overflowing an integer",
+			lines:    `"items": [{"shortDescription": "Pizza", "price": "99999999999999999999.00"}]`,
+			total:    "1.00",
+			expected: http.StatusBadRequest,
+		},
+		{
+			name:     "sum overflowing an integer",
+			lines:    `"items": [{"shortDescription": "Pizza", "price": "92233720368547758.07"}, {"shortDescription": "Pizza", "price": "-92233720368547758.07"}, {"shortDescription": "Pizza", "price": "92233720368547758.07"}]`,
+			total:    "1.00",
+			expected: http.StatusBadRequest,
+		},
+		{
+			name:     "plain receipt with unitemized tax",
+			lines:    `"items": [{"shortDescription": "Pizza", "price": "12.25"}]`,
+			total:    "13.13",
+			expected: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			receiptJSON := `{
+				"retailer": "Target",
+				"purchaseDate": "2022-01-02",
+				"purchaseTime": "13:13",
+				"total": "` + tc.total + `",
+				` + tc.lines + `
+			}`
+			req, _ := http.NewRequest("POST", "/receipts/process", bytes.NewBufferString(receiptJSON))
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expected {
+				t.Errorf("Got status %d, expected %d: %s", rr.Code, tc.expected, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestLineItemRules(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+
+	receipt := models.Receipt{
+		Retailer:     "X",
+		PurchaseDate: "2022-01-02",
+		PurchaseTime: "12:00",
+		Items: []models.Item{
+			{ShortDescription: "Gatorade", Quantity: "3", UnitPrice: "2.25", Price: "6.75"},
+			{ShortDescription: "Bananas", Quantity: "1.375", UnitPrice: "0.59", Price: "0.81"},
+			{ShortDescription: "Coupon", Price: "-1.00"},
+			{ShortDescription: "Old", Price: "-5.00"},
+		},
+		Discounts: []models.Adjustment{{Description: "Member savings", Amount: "0.25"}},
+		Total:     "1.31",
+	}
+	breakdown, _ := processor.CalculateBreakdown(receipt)
+
+	// 3 Gatorade + 1 weighed Bananas = 4 items, negative lines excluded
+	if points := findRule(breakdown, "item-pairs").Points; points != 10 {
+		t.Errorf("Item pair points incorrect: got %d, expected %d", points, 10)
+	}
+
+	// "Coupon" and "Old" have lengths that are multiples of 3 but negative prices
+	descriptions := findRule(breakdown, "description-length")
+	if descriptions.Points != 0 || len(descriptions.Items) != 0 {
+		t.Errorf("Negative lines should earn no description points: %+v", descriptions)
+	}
+
+	// Quantities that are not valid count as one item
+	receipt.Items[1] = models.Item{ShortDescription: "Bananas", Quantity: "99999999999999999999", Price: "0.00"}
+	breakdown, _ = processor.CalculateBreakdown(receipt)
+	if points := findRule(breakdown, "item-pairs").Points; points != 10 {
+		t.Errorf("Invalid quantity should count as one item: got %d points, expected %d", points, 10)
+	}
+
+	receipt.Items[0].ShortDescription = "Gatorade 6PK"
+	breakdown, _ = processor.CalculateBreakdown(receipt)
+	// ceil(6.75 * 0.2) on the full line amount
+	if points := findRule(breakdown, "description-length").Points; points != 2 {
+		t.Errorf("Multi-quantity description points incorrect: got %d, expected %d", points, 2)
+	}
+}
+
+func TestLineItemExpressions(t *testing.T) {
+	rule, err := services.NewExpressionRule("bulk", `sum(items, if item.quantity >= 3 then item.unitPrice else 0) + taxes - discounts`, 0)
+	if err != nil {
+		t.Fatalf("Compiling rule failed: %v", err)
+	}
+
+	receipt := models.Receipt{
+		Items: []models.Item{
+			{ShortDescription: "Gatorade", Quantity: "4", UnitPrice: "2.50", Price: "10.00"},
+			{ShortDescription: "Pizza", Price: "12.25"},
+		},
+		Discounts: []models.Adjustment{{Description: "Savings", Amount: "1.00"}},
+		Taxes:     []models.Adjustment{{Description: "Tax", Amount: "2.00"}},
+	}
+	if points := rule.Points(receipt); points != 3 {
+		t.Errorf("Line item expression incorrect: got %d points, expected %d", points, 3)
+	}
+}
@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"receipt-processor/handlers"
+	"receipt-processor/services"
+)
+
+// logBuffer collects JSON log records
+type logBuffer struct {
+	buffer bytes.Buffer
+	mutex  sync.Mutex
+}
+
+func (lb *logBuffer) Write(data []byte) (int, error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.buffer.Write(data)
+}
+
+func (lb *logBuffer) records(message string) []map[string]any {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(lb.buffer.String()), "\n") {
+		var record map[string]any
+		if json.Unmarshal([]byte(line), &record) == nil && record["msg"] == message {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// captureLogs sends the default logger's records to a buffer for the test
+func captureLogs(t *testing.T) *logBuffer {
+	logs := &logBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(services.NewLogHandler(slog.NewJSONHandler(logs, nil))))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
+
+func TestRequestLogging(t *testing.T) {
+	logs := captureLogs(t)
+
+	processor := services.NewReceiptProcessor()
+	receiptHandler := handlers.NewReceiptHandler(processor)
+	jobs := services.NewJobQueue(1, 10)
+	receiptHandler.SetJobQueue(jobs)
+	router := handlers.RequestLogger(handlers.NewRouter(handlers.Handlers{
+		Receipts: receiptHandler,
+		Admin:    handlers.NewAdminHandler(processor),
+		Webhooks: handlers.NewWebhookHandler(services.NewWebhookDispatcher()),
+		Events:   handlers.NewEventsHandler(services.NewEventBroker(10, 10)),
+	}, nil))
+
+	request := func(url, requestID string, body any) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", url, bytes.NewBuffer(data))
+		if requestID != "" {
+			req.Header.Set(handlers.RequestIDHeader, requestID)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := request("/receipts/process", "pos-17-0001", simpleReceipt())
+	if rr.Header().Get(handlers.RequestIDHeader) != "pos-17-0001" {
+		t.Errorf("Caller's request ID should be kept, got %q", rr.Header().Get(handlers.RequestIDHeader))
+	}
+	var created struct{ ID string }
+	json.Unmarshal(rr.Body.Bytes(), &created)
+
+	processed := logs.records("receipt processed")
+	if len(processed) != 1 || processed[0]["request_id"] != "pos-17-0001" || processed[0]["receipt_id"] != created.ID || processed[0]["points"] != float64(31) {
+		t.Errorf("Processed receipt should be logged with the request ID: %v", processed)
+	}
+	access := logs.records("request")
+	if len(access) != 1 || access[0]["request_id"] != "pos-17-0001" || access[0]["status"] != float64(200) ||
+		access[0]["bytes"] != float64(rr.Body.Len()) || access[0]["path"] != "/receipts/process" || access[0]["duration_ms"] == nil {
+		t.Errorf("Request should be logged with its status, size and latency: %v", access)
+	}
+
+	invalid := simpleReceipt()
+	invalid.PurchaseTime = "25:00"
+	rr = request("/receipts/process", "not a valid\tID", invalid)
+	generated := rr.Header().Get(handlers.RequestIDHeader)
+	if generated == "" || generated == "not a valid\tID" {
+		t.Errorf("Invalid request ID should be replaced, got %q", generated)
+	}
+	rejected := logs.records("receipt rejected")
+	if len(rejected) != 1 || rejected[0]["request_id"] != generated || rejected[0]["reason"] != "purchase_time" {
+		t.Errorf("Rejected receipt should be logged with the request ID and reason: %v", rejected)
+	}
+
+	// Receipts processed later on the job queue keep the request ID
+	request("/receipts/process?async=true", "async-1", simpleReceipt())
+	jobs.Shutdown(context.Background())
+	processed = logs.records("receipt processed")
+	if len(processed) != 2 || processed[1]["request_id"] != "async-1" {
+		t.Errorf("Asynchronously processed receipt should be logged with the request ID: %v", processed)
+	}
+}
@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := services.NewMetrics()
+	processor := services.NewReceiptProcessor()
+	processor.SetMetrics(metrics)
+	receiptHandler := handlers.NewReceiptHandler(processor)
+	metricsHandler := handlers.NewMetricsHandler(metrics)
+	router := metricsHandler.Middleware(handlers.NewRouter(handlers.Handlers{
+		Receipts: receiptHandler,
+		Admin:    handlers.NewAdminHandler(processor),
+		Webhooks: handlers.NewWebhookHandler(services.NewWebhookDispatcher()),
+		Events:   handlers.NewEventsHandler(services.NewEventBroker(10, 10)),
+		Metrics:  metricsHandler,
+	}, nil))
+
+	request := func(method, url string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	valid, _ := json.Marshal(simpleReceipt())
+	invalid := simpleReceipt()
+	invalid.PurchaseDate = "2022-13-01"
+	invalidBody, _ := json.Marshal(invalid)
+
+	var created struct{ ID string }
+	json.Unmarshal(request("POST", "/receipts/process", valid).Body.Bytes(), &created)
+	request("POST", "/receipts/process", invalidBody)
+	request("POST", "/receipts/process", []byte("{"))
+	request("GET", "/receipts/"+created.ID+"/points", nil)
+	request("GET", "/receipts/missing/points", nil)
+
+	rr := request("GET", "/metrics", nil)
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("Metrics should be served in the text format, got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	body := rr.Body.String()
+
+	expected := []string{
+		`receipt_processor_http_requests_total{route="/receipts/process",method="POST",status="200"} 1`,
+		`receipt_processor_http_requests_total{route="/receipts/process",method="POST",status="400"} 2`,
+		`receipt_processor_http_requests_total{route="/receipts/{id}/points",method="GET",status="200"} 1`,
+		`receipt_processor_http_requests_total{route="/receipts/{id}/points",method="GET",status="404"} 1`,
+		`receipt_processor_http_request_duration_seconds_count{route="/receipts/process",method="POST",status="400"} 2`,
+		`receipt_processor_validation_failures_total{reason="malformed"} 1`,
+		`receipt_processor_validation_failures_total{reason="purchase_date"} 1`,
+		`receipt_processor_receipts_processed_total{tenant="default"} 1`,
+		`receipt_processor_points_awarded_bucket{tenant="default",le="25"} 0`,
+		`receipt_processor_points_awarded_bucket{tenant="default",le="50"} 1`,
+		`receipt_processor_points_awarded_bucket{tenant="default",le="+Inf"} 1`,
+		`receipt_processor_points_awarded_sum{tenant="default"} 31`,
+		`receipt_processor_rule_fires_total{tenant="default",rule="quarter-multiple"} 1`,
+		`receipt_processor_rule_fires_total{tenant="default",rule="retailer-name"} 1`,
+		`receipt_processor_receipts_stored{tenant="default"} 1`,
+		"# TYPE receipt_processor_points_awarded histogram",
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Metrics are missing %q", line)
+		}
+	}
+	if strings.Contains(body, `rule="round-dollar"`) {
+		t.Error("Rules awarding no points should not be counted")
+	}
+	if strings.Contains(body, created.ID) {
+		t.Error("Receipt IDs should not be used as labels")
+	}
+}
+
+func TestMetricsCountRefusedRequests(t *testing.T) {
+	keys := services.NewAPIKeyStore()
+	ops, _ := keys.Create("ops", "", []string{models.ScopeMetrics}, nil)
+	secret := ops.Secret
+	tenants := services.NewTenantRegistry(nil)
+	metrics := services.NewMetrics()
+	metricsHandler := handlers.NewMetricsHandler(metrics)
+	router := metricsHandler.Middleware(handlers.NewTenantRouter(tenants, func(tenant *services.Tenant) handlers.Handlers {
+		return handlers.Handlers{
+			Receipts: handlers.NewReceiptHandler(tenant.Processor),
+			Admin:    handlers.NewAdminHandler(tenant.Processor),
+			Webhooks: handlers.NewWebhookHandler(tenant.Webhooks),
+			Events:   handlers.NewEventsHandler(tenant.Events),
+			Metrics:  metricsHandler,
+		}
+	}, handlers.NewAuthenticator(keys)))
+
+	// Refused before reaching a route: no credentials, an unknown tenant, an
+	// unknown path and a made-up method
+	tenantRequest(router, "GET", "/receipts/abc/points", "", "", nil)
+	tenantRequest(router, "GET", "/receipts/abc/points", "globex", secret, nil)
+	tenantRequest(router, "GET", "/nowhere", "", secret, nil)
+	tenantRequest(router, "BREW", "/nowhere", "", secret, nil)
+
+	body := tenantRequest(router, "GET", "/metrics", "", secret, nil).Body.String()
+	expected := []string{
+		`receipt_processor_http_requests_total{route="unmatched",method="GET",status="401"} 1`,
+		`receipt_processor_http_requests_total{route="unmatched",method="GET",status="404"} 2`,
+		`receipt_processor_http_requests_total{route="unmatched",method="other",status="404"} 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Metrics are missing %q", line)
+		}
+	}
+}
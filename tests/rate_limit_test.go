@@ -0,0 +1,236 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+func newRateLimitedRouter(limiter *services.RateLimiter, keys *services.APIKeyStore) http.Handler {
+	processor := services.NewReceiptProcessor()
+	h := handlers.Handlers{
+		Receipts: handlers.NewReceiptHandler(processor),
+		Admin:    handlers.NewAdminHandler(processor),
+		Webhooks: handlers.NewWebhookHandler(services.NewWebhookDispatcher()),
+		Events:   handlers.NewEventsHandler(services.NewEventBroker(10, 10)),
+		Limiter:  limiter,
+	}
+	var auth *handlers.Authenticator
+	if keys != nil {
+		auth = handlers.NewAuthenticator(keys)
+	}
+	return handlers.NewRouter(h, auth)
+}
+
+func limitedRequest(router http.Handler, method, url, secret, remoteAddr string) *httptest.ResponseRecorder {
+	var body []byte
+	if method == "POST" {
+		body, _ = json.Marshal(simpleReceipt())
+	}
+	req, _ := http.NewRequest(method, url, bytes.NewBuffer(body))
+	req.RemoteAddr = remoteAddr
+	if secret != "" {
+		req.Header.Set(handlers.APIKeyHeader, secret)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRateLimits(t *testing.T) {
+	limiter := services.NewRateLimiter(services.RateLimitConfig{
+		Routes: map[string]services.RateLimit{
+			"POST /receipts/process": {PerMinute: 600, Burst: 3},
+		},
+	})
+	keys := services.NewAPIKeyStore()
+	router := newRateLimitedRouter(limiter, keys)
+	kiosk, _ := keys.Create("kiosk", "", []string{models.ScopeSubmit, models.ScopeRead}, nil)
+	other, _ := keys.Create("other", "", []string{models.ScopeSubmit}, nil)
+
+	for i := 0; i < 3; i++ {
+		rr := limitedRequest(router, "POST", "/receipts/process", kiosk.Secret, "10.0.0.1:1234")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Request %d within the burst should succeed, got %d", i+1, rr.Code)
+		}
+		if rr.Header().Get("RateLimit-Limit") != "3" || rr.Header().Get("RateLimit-Remaining") != strconv.Itoa(2-i) {
+			t.Errorf("Request %d has wrong headers: %v", i+1, rr.Header())
+		}
+	}
+
+	rr := limitedRequest(router, "POST", "/receipts/process", kiosk.Secret, "10.0.0.1:1234")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Request over the burst should return 429, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "1" || rr.Header().Get("RateLimit-Remaining") != "0" || rr.Header().Get("RateLimit-Reset") == "" {
+		t.Errorf("429 response has wrong headers: %v", rr.Header())
+	}
+
+	// Other clients and unlimited routes are not affected
+	if rr := limitedRequest(router, "POST", "/receipts/process", other.Secret, "10.0.0.1:1234"); rr.Code != http.StatusOK {
+		t.Errorf("Another key should not be limited, got %d", rr.Code)
+	}
+	if rr := limitedRequest(router, "GET", "/receipts/missing/points", kiosk.Secret, "10.0.0.1:1234"); rr.Code != http.StatusNotFound || rr.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("Unlimited route should not be limited, got %d", rr.Code)
+	}
+
+	// 600 a minute refills a token every 100ms
+	time.Sleep(150 * time.Millisecond)
+	if rr := limitedRequest(router, "POST", "/receipts/process", kiosk.Secret, "10.0.0.1:1234"); rr.Code != http.StatusOK {
+		t.Errorf("Request after a refill should succeed, got %d", rr.Code)
+	}
+}
+
+func TestRateLimitsByAddress(t *testing.T) {
+	limiter := services.NewRateLimiter(services.RateLimitConfig{
+		Default: services.RateLimit{PerMinute: 1, Burst: 1},
+	})
+	router := newRateLimitedRouter(limiter, nil)
+
+	if rr := limitedRequest(router, "GET", "/receipts/missing/points", "", "10.0.0.1:1234"); rr.Code != http.StatusNotFound {
+		t.Fatalf("First request should pass the limiter, got %d", rr.Code)
+	}
+	rr := limitedRequest(router, "GET", "/receipts/missing/points", "", "10.0.0.1:5678")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "60" {
+		t.Errorf("Second request from the address should return 429 with Retry-After 60, got %d %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	if rr := limitedRequest(router, "GET", "/receipts/missing/points", "", "10.0.0.2:1234"); rr.Code != http.StatusNotFound {
+		t.Errorf("Another address should not be limited, got %d", rr.Code)
+	}
+}
+
+func TestAddressLimitBeforeAuthentication(t *testing.T) {
+	limiter := services.NewRateLimiter(services.RateLimitConfig{
+		PerIP: &services.RateLimit{PerMinute: 1, Burst: 3},
+	})
+	keys := services.NewAPIKeyStore()
+	router := handlers.LimitByAddress(limiter, newRateLimitedRouter(limiter, keys))
+	kiosk, _ := keys.Create("kiosk", "", []string{models.ScopeRead}, nil)
+
+	// Guessed credentials use up the address's requests
+	for i := 0; i < 3; i++ {
+		if rr := limitedRequest(router, "GET", "/receipts/missing/points", "guess", "10.0.0.1:1234"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Request %d within the burst should be authenticated, got %d", i+1, rr.Code)
+		}
+	}
+	rr := limitedRequest(router, "GET", "/receipts/missing/points", "guess", "10.0.0.1:1234")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "60" {
+		t.Errorf("Guesses over the burst should return 429 with Retry-After 60, got %d %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	if rr := limitedRequest(router, "GET", "/receipts/missing/points", kiosk.Secret, "10.0.0.1:1234"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("The address's limit should apply whatever the credentials, got %d", rr.Code)
+	}
+	if rr := limitedRequest(router, "GET", "/receipts/missing/points", kiosk.Secret, "10.0.0.2:1234"); rr.Code != http.StatusNotFound {
+		t.Errorf("Another address should not be limited, got %d", rr.Code)
+	}
+}
+
+func TestDailySubmissionQuota(t *testing.T) {
+	limiter := services.NewRateLimiter(services.RateLimitConfig{DailySubmissions: 2})
+	router := newRateLimitedRouter(limiter, nil)
+
+	for i := 0; i < 2; i++ {
+		rr := limitedRequest(router, "POST", "/receipts/process", "", "10.0.0.1:1234")
+		if rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Remaining") != strconv.Itoa(1-i) {
+			t.Fatalf("Submission %d within the quota should succeed, got %d %v", i+1, rr.Code, rr.Header())
+		}
+	}
+
+	rr := limitedRequest(router, "POST", "/receipts/process", "", "10.0.0.1:1234")
+	retryAfter, _ := strconv.Atoi(rr.Header().Get("Retry-After"))
+	if rr.Code != http.StatusTooManyRequests || retryAfter < 1 || retryAfter > 24*60*60 {
+		t.Errorf("Submission over the quota should return 429 until midnight, got %d %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	// Reads do not count towards the quota
+	if rr := limitedRequest(router, "GET", "/receipts/missing/points", "", "10.0.0.1:1234"); rr.Code != http.StatusNotFound {
+		t.Errorf("Reads should not be limited by the quota, got %d", rr.Code)
+	}
+}
+
+func TestImportCountsTowardsQuota(t *testing.T) {
+	limiter := services.NewRateLimiter(services.RateLimitConfig{DailySubmissions: 5})
+	router := newRateLimitedRouter(limiter, nil)
+
+	importReceipts := func(keys ...string) *httptest.ResponseRecorder {
+		rows := []string{"receipt,retailer,purchaseDate,purchaseTime,total,description,price"}
+		for _, key := range keys {
+			rows = append(rows, key+",Target,2022-01-01,13:01,1.00,Pepsi,1.00")
+		}
+		req, _ := http.NewRequest("POST", "/receipts/import", strings.NewReader(strings.Join(rows, "\n")))
+		req.RemoteAddr = "10.0.0.1:1234"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := importReceipts("a", "b", "c")
+	if rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Remaining") != "2" {
+		t.Fatalf("Import within the quota should succeed and count each receipt, got %d %v", rr.Code, rr.Header())
+	}
+
+	// An import that does not fit imports nothing
+	rr = importReceipts("d", "e", "f")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("RateLimit-Remaining") != "2" || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Import over the quota should return 429, got %d %v", rr.Code, rr.Header())
+	}
+	if rr := importReceipts("d", "e"); rr.Code != http.StatusOK {
+		t.Errorf("Import using the rest of the quota should succeed, got %d", rr.Code)
+	}
+	if rr := limitedRequest(router, "POST", "/receipts/process", "", "10.0.0.1:1234"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Imported receipts should use up the quota, got %d", rr.Code)
+	}
+}
+
+func TestRateLimiterBoundsClients(t *testing.T) {
+	limiter := services.NewRateLimiter(services.RateLimitConfig{
+		Default:    services.RateLimit{PerMinute: 1, Burst: 1},
+		MaxClients: 2,
+	})
+	for _, client := range []string{"a", "b", "c", "d"} {
+		if !limiter.Allow(client, "GET /events", false).Allowed {
+			t.Errorf("First request from %s should be allowed", client)
+		}
+	}
+	if limiter.Clients() != 2 {
+		t.Errorf("Limiter should track at most 2 clients, got %d", limiter.Clients())
+	}
+	if limiter.Allow("d", "GET /events", false).Allowed {
+		t.Error("Recently seen client should still be limited")
+	}
+}
+
+func TestLoadRateLimits(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "limits.json")
+	os.WriteFile(valid, []byte(`{"default": {"perMinute": 120, "burst": 20}, "routes": {"POST /receipts/process": {"perMinute": 30, "burst": 5}}, "dailySubmissions": 1000}`), 0o600)
+	config, err := services.LoadRateLimits(valid)
+	if err != nil {
+		t.Fatalf("Loading rate limits failed: %v", err)
+	}
+	if config.Routes["POST /receipts/process"].Burst != 5 || config.DailySubmissions != 1000 {
+		t.Errorf("Rate limits loaded incorrectly: %+v", config)
+	}
+
+	invalid := filepath.Join(dir, "invalid.json")
+	os.WriteFile(invalid, []byte(`{"default": {"perMinute": 60}}`), 0o600)
+	if _, err := services.LoadRateLimits(invalid); err == nil {
+		t.Error("A limit without a burst should be rejected")
+	}
+
+	os.WriteFile(invalid, []byte(`{"perIP": {"perMinute": -1, "burst": 1}}`), 0o600)
+	if _, err := services.LoadRateLimits(invalid); err == nil {
+		t.Error("A negative per-IP limit should be rejected")
+	}
+}
@@ -29,7 +29,7 @@ func TestSimpleReceiptCalculation(t *testing.T) {
 		},
 	}
 	
-	points := processor.CalculatePoints(receipt)
+	points, _ := processor.CalculatePoints(receipt)
 	
 	// Expected points breakdown:
 	// - 6 points for "Target" (6 alphanumeric characters)
@@ -58,7 +58,7 @@ func TestMorningReceiptCalculation(t *testing.T) {
 		},
 	}
 	
-	points := processor.CalculatePoints(receipt)
+	points, _ := processor.CalculatePoints(receipt)
     
     // Expected points breakdown:
     // - 9 points for "Walgreens" (9 alphanumeric characters)
@@ -174,7 +174,7 @@ func TestReadmeExamples(t *testing.T) {
 		Total: "35.35",
 	}
 	
-	points1 := processor.CalculatePoints(receipt1)
+	points1, _ := processor.CalculatePoints(receipt1)
 	expectedPoints1 := int64(28)
 	
 	if points1 != expectedPoints1 {
@@ -195,7 +195,7 @@ func TestReadmeExamples(t *testing.T) {
 		Total: "9.00",
 	}
 	
-	points2 := processor.CalculatePoints(receipt2)
+	points2, _ := processor.CalculatePoints(receipt2)
 	expectedPoints2 := int64(109)
 	
 	if points2 != expectedPoints2 {
@@ -260,11 +260,11 @@ func TestIndividualPointRules(t *testing.T) {
 			Items:        []models.Item{{ShortDescription: "Item", Price: "1.10"}},
 			Total:        "1.10",
 		}
-		basePoints := processor.CalculatePoints(baseReceipt)
+		basePoints, _ := processor.CalculatePoints(baseReceipt)
 		
 		testReceipt := baseReceipt
 		testReceipt.Retailer = "Tar-get & Store"
-		testPoints := processor.CalculatePoints(testReceipt)
+		testPoints, _ := processor.CalculatePoints(testReceipt)
 		
 		expectedDiff := int64(10)
 		actualDiff := testPoints - basePoints
@@ -283,12 +283,12 @@ func TestIndividualPointRules(t *testing.T) {
 			Items:        []models.Item{{ShortDescription: "Item", Price: "5.01"}},
 			Total:        "5.01",
 		}
-		basePoints := processor.CalculatePoints(baseReceipt)
+		basePoints, _ := processor.CalculatePoints(baseReceipt)
 		
 		testReceipt := baseReceipt
 		testReceipt.Total = "5.00"
 		testReceipt.Items[0].Price = "5.00"
-		testPoints := processor.CalculatePoints(testReceipt)
+		testPoints, _ := processor.CalculatePoints(testReceipt)
 		
 		expectedDiff := int64(75)
 		actualDiff := testPoints - basePoints
@@ -300,7 +300,7 @@ func TestIndividualPointRules(t *testing.T) {
 		quarterReceipt := baseReceipt
 		quarterReceipt.Total = "5.25"
 		quarterReceipt.Items[0].Price = "5.25"
-		quarterPoints := processor.CalculatePoints(quarterReceipt)
+		quarterPoints, _ := processor.CalculatePoints(quarterReceipt)
 		
 		expectedRoundVsQuarterDiff := int64(50)
 		actualRoundVsQuarterDiff := testPoints - quarterPoints
@@ -319,11 +319,11 @@ func TestIndividualPointRules(t *testing.T) {
 			Items:        []models.Item{{ShortDescription: "Item", Price: "5.23"}},
 			Total:        "5.23",
 		}
-		basePoints := processor.CalculatePoints(baseReceipt)
+		basePoints, _ := processor.CalculatePoints(baseReceipt)
 		
 		testReceipt := baseReceipt
 		testReceipt.Total = "5.25"
-		testPoints := processor.CalculatePoints(testReceipt)
+		testPoints, _ := processor.CalculatePoints(testReceipt)
 		
 		expectedDiff := int64(25)
 		actualDiff := testPoints - basePoints
@@ -356,7 +356,7 @@ func TestIndividualPointRules(t *testing.T) {
 				Total:        totalStr,
 			}
 			
-			points := processor.CalculatePoints(receipt)
+			points, _ := processor.CalculatePoints(receipt)
 			constPoints := int64(1)
 
 			expectedTotalPoints := constPoints + expectedItemPairPoints
@@ -378,7 +378,7 @@ func TestIndividualPointRules(t *testing.T) {
 			},
 			Total: "5.00",
 		}
-		basePoints := processor.CalculatePoints(baseReceipt)
+		basePoints, _ := processor.CalculatePoints(baseReceipt)
 		
 		testCases := []struct {
 			description  string
@@ -398,7 +398,7 @@ func TestIndividualPointRules(t *testing.T) {
 			testReceipt.Items[0].ShortDescription = tc.description
 			testReceipt.Items[0].Price = tc.price
 			
-			testPoints := processor.CalculatePoints(testReceipt)
+			testPoints, _ := processor.CalculatePoints(testReceipt)
 			actualDiff := testPoints - basePoints
 			if actualDiff != tc.expectedDiff {
 				t.Errorf("Description '%s' with price %s points incorrect: difference was %d, expected %d", 
@@ -428,7 +428,7 @@ func TestIndividualPointRules(t *testing.T) {
 				Total:        "1.01",
 			}
 			
-			points := processor.CalculatePoints(receipt)
+			points, _ := processor.CalculatePoints(receipt)
 			basePoints := int64(1)
 			
 			expectedPoints := basePoints + tc.expected
@@ -462,7 +462,7 @@ func TestIndividualPointRules(t *testing.T) {
 				Total:        "1.01",
 			}
 			
-			points := processor.CalculatePoints(receipt)
+			points, _ := processor.CalculatePoints(receipt)
 			basePoints := int64(1)
 			
 			expectedPoints := basePoints + tc.expected
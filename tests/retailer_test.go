@@ -0,0 +1,143 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+func TestNormalizeRetailerName(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected string
+	}{
+		{"M&M Corner Market", "m & m corner market"},
+		{"M & M CORNER MKT", "m & m corner market"},
+		{"m&m corner market ", "m & m corner market"},
+		{"M and M Corner Market", "m & m corner market"},
+		{"  Trader   Joe's ", "trader joes"},
+		{"Tar-get", "target"},
+		{"---", ""},
+	}
+
+	for _, tc := range testCases {
+		if normalized := services.NormalizeRetailerName(tc.name); normalized != tc.expected {
+			t.Errorf("Normalizing %q failed: got %q, expected %q", tc.name, normalized, tc.expected)
+		}
+	}
+}
+
+func TestRetailerAliases(t *testing.T) {
+	registry := services.NewRetailerRegistry()
+
+	if !registry.SetAlias("Wal-Mart Supercenter", "Walmart") {
+		t.Fatalf("Setting a valid alias failed")
+	}
+	if registry.SetAlias("!!!", "Walmart") {
+		t.Errorf("Setting an alias that normalizes to nothing should fail")
+	}
+
+	if canonical := registry.Canonicalize("WALMART SUPERCENTER"); canonical != "walmart" {
+		t.Errorf("Alias lookup failed: got %q, expected %q", canonical, "walmart")
+	}
+	if canonical := registry.Canonicalize("Target"); canonical != "target" {
+		t.Errorf("Unaliased retailer should canonicalize to its normalized name, got %q", canonical)
+	}
+
+	if !registry.RemoveAlias("walmart supercenter") {
+		t.Errorf("Removing an existing alias failed")
+	}
+	if canonical := registry.Canonicalize("Walmart Supercenter"); canonical != "walmart supercenter" {
+		t.Errorf("Removed alias still applied: got %q", canonical)
+	}
+}
+
+func TestRetailerNameMode(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	processor.Retailers().SetAlias("M&M Corner Market", "MM")
+
+	receipt := models.Receipt{
+		Retailer:     "M&M Corner Market",
+		PurchaseDate: "2022-01-02",
+		PurchaseTime: "12:00",
+		Items:        []models.Item{{ShortDescription: "Item", Price: "1.01"}},
+		Total:        "1.01",
+	}
+
+	// 14 alphanumeric characters in the raw name
+	if points, _ := processor.CalculatePoints(receipt); points != 14 {
+		t.Errorf("Raw retailer name points failed: got %d points, expected %d", points, 14)
+	}
+
+	// 2 alphanumeric characters in the canonical name
+	processor.SetRetailerNameMode(services.RetailerNameCanonical)
+	if points, _ := processor.CalculatePoints(receipt); points != 2 {
+		t.Errorf("Canonical retailer name points failed: got %d points, expected %d", points, 2)
+	}
+}
+
+func TestProcessReceiptStoresCanonicalRetailer(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+
+	id, _ := processor.ProcessReceipt(context.Background(), models.Receipt{Retailer: "M & M CORNER MKT"})
+	receipt, _ := processor.GetReceipt(id)
+
+	if receipt.Retailer != "M & M CORNER MKT" {
+		t.Errorf("Raw retailer name was not preserved, got %q", receipt.Retailer)
+	}
+	if receipt.CanonicalRetailer != "m & m corner market" {
+		t.Errorf("Canonical retailer name incorrect: got %q", receipt.CanonicalRetailer)
+	}
+}
+
+func TestRetailerAliasAPI(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	handler := handlers.NewAdminHandler(processor)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/retailers/aliases", handler.ListRetailerAliases).Methods("GET")
+	router.HandleFunc("/admin/retailers/aliases", handler.SetRetailerAlias).Methods("PUT")
+	router.HandleFunc("/admin/retailers/aliases", handler.DeleteRetailerAlias).Methods("DELETE")
+
+	req, _ := http.NewRequest("PUT", "/admin/retailers/aliases", bytes.NewBufferString(`{"alias": "M&M Mkt", "canonical": "M&M Corner Market"}`))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("Setting alias failed: got status %d, expected 204", rr.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/admin/retailers/aliases", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var aliases []models.RetailerAlias
+	if err := json.Unmarshal(rr.Body.Bytes(), &aliases); err != nil {
+		t.Fatalf("Failed to parse alias list: %v", err)
+	}
+	if len(aliases) != 1 || aliases[0].Alias != "m & m market" || aliases[0].Canonical != "m & m corner market" {
+		t.Errorf("Alias list incorrect: %+v", aliases)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/admin/retailers/aliases?alias=M%26M+Mkt", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("Deleting alias failed: got status %d, expected 204", rr.Code)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/admin/retailers/aliases?alias=M%26M+Mkt", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Deleting missing alias should return 404, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,173 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+const terminalSecret = "0123456789abcdef0123456789abcdef"
+
+// signAt signs a request as the README describes, with a chosen timestamp
+// and nonce
+func signAt(req *http.Request, body []byte, keyID string, timestamp time.Time, nonce string) {
+	digest := sha256.Sum256(body)
+	message := req.Method + "\n" + req.URL.RequestURI() + "\n" + req.Header.Get(handlers.TenantHeader) + "\n" + strconv.FormatInt(timestamp.Unix(), 10) + "\n" + nonce + "\n" + hex.EncodeToString(digest[:])
+	mac := hmac.New(sha256.New, []byte(terminalSecret))
+	mac.Write([]byte(message))
+
+	req.Header.Set(services.SignatureKeyHeader, keyID)
+	req.Header.Set(services.SignatureTimestampHeader, strconv.FormatInt(timestamp.Unix(), 10))
+	req.Header.Set(services.SignatureNonceHeader, nonce)
+	req.Header.Set(services.SignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestSignedSubmissions(t *testing.T) {
+	verifier, err := services.NewRequestVerifier([]models.SigningKey{
+		{ID: "pos-17", Client: "store-12-lane-3", Secret: terminalSecret},
+	})
+	if err != nil {
+		t.Fatalf("Creating verifier failed: %v", err)
+	}
+	processor := services.NewReceiptProcessor()
+	auth := handlers.NewAuthenticator(nil)
+	auth.SetRequestVerifier(verifier)
+	router := handlers.NewRouter(handlers.Handlers{
+		Receipts: handlers.NewReceiptHandler(processor),
+		Admin:    handlers.NewAdminHandler(processor),
+		Webhooks: handlers.NewWebhookHandler(services.NewWebhookDispatcher()),
+		Events:   handlers.NewEventsHandler(services.NewEventBroker(10, 10)),
+	}, auth)
+
+	body, _ := json.Marshal(simpleReceipt())
+	send := func(req *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	req := httptest.NewRequest("POST", "/receipts/process", bytes.NewReader(body))
+	if err := services.SignRequest(req, "pos-17", terminalSecret); err != nil {
+		t.Fatalf("Signing request failed: %v", err)
+	}
+	headers := req.Header.Clone()
+	rr := send(req)
+	var created models.ReceiptResponse
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Signed submission should succeed, got %d %q", rr.Code, rr.Body.String())
+	}
+	history, _ := processor.History(created.ID)
+	if len(history) != 1 || history[0].Actor != "store-12-lane-3" {
+		t.Errorf("Submission should be recorded as made by the terminal: %+v", history)
+	}
+
+	replayed := httptest.NewRequest("POST", "/receipts/process", bytes.NewReader(body))
+	replayed.Header = headers
+	if rr := send(replayed); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Replayed submission should return 401, got %d", rr.Code)
+	}
+
+	now := time.Now()
+	tampered := append(bytes.Clone(body[:len(body)-1]), []byte(`,"total":"0.00"}`)...)
+	testCases := []struct {
+		name    string
+		request func() *http.Request
+	}{
+		{"tampered body", func() *http.Request {
+			req := httptest.NewRequest("POST", "/receipts/process", bytes.NewReader(tampered))
+			signAt(req, body, "pos-17", now, "n-1")
+			return req
+		}},
+		{"tampered query", func() *http.Request {
+			req := httptest.NewRequest("POST", "/receipts/process", bytes.NewReader(body))
+			signAt(req, body, "pos-17", now, "n-2")
+			req.URL.RawQuery = "async=true"
+			return req
+		}},
+		{"expired timestamp", func() *http.Request {
+			req := httptest.NewRequest("POST", "/receipts/process", bytes.NewReader(body))
+			signAt(req, body, "pos-17", now.Add(-10*time.Minute), "n-3")
+			return req
+		}},
+		{"future timestamp", func() *http.Request {
+			req := httptest.NewRequest("POST", "/receipts/process", bytes.NewReader(body))
+			signAt(req, body, "pos-17", now.Add(10*time.Minute), "n-4")
+			return req
+		}},
+		{"tampered tenant", func() *http.Request {
+			req := httptest.NewRequest("POST", "/receipts/process", bytes.NewReader(body))
+			signAt(req, body, "pos-17", now, "n-8")
+			req.Header.Set(handlers.TenantHeader, "globex")
+			return req
+		}},
+		{"unknown key", func() *http.Request {
+			req := httptest.NewRequest("POST", "/receipts/process", bytes.NewReader(body))
+			signAt(req, body, "pos-99", now, "n-5")
+			return req
+		}},
+		{"other route", func() *http.Request {
+			req := httptest.NewRequest("GET", "/receipts/"+created.ID+"/points", nil)
+			signAt(req, nil, "pos-17", now, "n-6")
+			return req
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if rr := send(tc.request()); rr.Code != http.StatusUnauthorized {
+				t.Errorf("Got status %d, expected 401", rr.Code)
+			}
+		})
+	}
+
+	// A fresh nonce within the window is accepted
+	req = httptest.NewRequest("POST", "/receipts/process?async=false", bytes.NewReader(body))
+	signAt(req, body, "pos-17", now.Add(-time.Minute), "n-7")
+	if rr := send(req); rr.Code != http.StatusOK {
+		t.Errorf("Submission signed a minute ago should succeed, got %d", rr.Code)
+	}
+
+	// The tenant header is signed along with the request
+	req = httptest.NewRequest("POST", "/receipts/process", bytes.NewReader(body))
+	req.Header.Set(handlers.TenantHeader, services.DefaultTenant)
+	if err := services.SignRequest(req, "pos-17", terminalSecret); err != nil {
+		t.Fatalf("Signing request failed: %v", err)
+	}
+	if rr := send(req); rr.Code != http.StatusOK {
+		t.Errorf("Submission signed with its tenant should succeed, got %d", rr.Code)
+	}
+}
+
+func TestLoadSigningKeys(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "keys.json")
+	os.WriteFile(valid, []byte(`[{"id": "pos-17", "client": "lane-3", "tenant": "acme", "secret": "`+terminalSecret+`"}]`), 0o600)
+	if _, err := services.LoadSigningKeys(valid); err != nil {
+		t.Errorf("Loading signing keys failed: %v", err)
+	}
+
+	for name, content := range map[string]string{
+		"short secret": `[{"id": "pos-17", "client": "lane-3", "secret": "short"}]`,
+		"no client":    `[{"id": "pos-17", "secret": "` + terminalSecret + `"}]`,
+		"duplicate":    `[{"id": "a", "client": "x", "secret": "` + terminalSecret + `"}, {"id": "a", "client": "y", "secret": "` + terminalSecret + `"}]`,
+	} {
+		path := filepath.Join(dir, "invalid.json")
+		os.WriteFile(path, []byte(content), 0o600)
+		if _, err := services.LoadSigningKeys(path); err == nil {
+			t.Errorf("Signing keys with %s should be rejected", name)
+		}
+	}
+}
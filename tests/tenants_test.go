@@ -0,0 +1,382 @@
+package tests
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+// newTenantRouter authenticates requests if given API keys or a token
+// validator
+func newTenantRouter(tenants *services.TenantRegistry, keys *services.APIKeyStore, tokens *services.TokenValidator) *handlers.TenantRouter {
+	var auth *handlers.Authenticator
+	var keysHandler *handlers.KeysHandler
+	if keys != nil || tokens != nil {
+		auth = handlers.NewAuthenticator(keys)
+	}
+	if keys != nil {
+		keysHandler = handlers.NewKeysHandler(keys)
+	}
+	if tokens != nil {
+		auth.SetTokenValidator(tokens)
+	}
+	jobs := services.NewJobQueue(1, 10)
+	return handlers.NewTenantRouter(tenants, func(tenant *services.Tenant) handlers.Handlers {
+		receiptHandler := handlers.NewReceiptHandler(tenant.Processor)
+		receiptHandler.SetJobQueue(jobs)
+		adminHandler := handlers.NewAdminHandler(tenant.Processor)
+		adminHandler.SetSettings(tenant.Settings)
+		webhookHandler := handlers.NewWebhookHandler(tenant.Webhooks)
+		webhookHandler.SetSettings(tenant.Settings)
+		return handlers.Handlers{
+			Receipts: receiptHandler,
+			Admin:    adminHandler,
+			Webhooks: webhookHandler,
+			Events:   handlers.NewEventsHandler(tenant.Events),
+			Keys:     keysHandler,
+		}
+	}, auth)
+}
+
+func tenantRequest(router http.Handler, method, url, tenant, secret string, body any) *httptest.ResponseRecorder {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	req, _ := http.NewRequest(method, url, bytes.NewBuffer(data))
+	req.Header.Set("Content-Type", "application/json")
+	if tenant != "" {
+		req.Header.Set(handlers.TenantHeader, tenant)
+	}
+	if secret != "" {
+		req.Header.Set(handlers.APIKeyHeader, secret)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestTenantIsolation(t *testing.T) {
+	tenants := services.NewTenantRegistry(nil)
+	tenants.SetAllowed([]string{"acme", "globex"})
+	router := newTenantRouter(tenants, nil, nil)
+
+	var created models.ReceiptResponse
+	rr := tenantRequest(router, "POST", "/receipts/process", "acme", "", simpleReceipt())
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if rr.Code != http.StatusOK || created.ID == "" {
+		t.Fatalf("Processing receipt for acme failed: got %d", rr.Code)
+	}
+
+	for _, path := range []string{"/points", "/breakdown", "/history"} {
+		url := "/receipts/" + created.ID + path
+		if rr := tenantRequest(router, "GET", url, "acme", "", nil); rr.Code != http.StatusOK {
+			t.Errorf("acme should read its own receipt at %s, got %d", url, rr.Code)
+		}
+		for _, tenant := range []string{"globex", ""} {
+			if rr := tenantRequest(router, "GET", url, tenant, "", nil); rr.Code != http.StatusNotFound {
+				t.Errorf("Tenant %q should not read acme's receipt at %s, got %d", tenant, url, rr.Code)
+			}
+		}
+	}
+	if rr := tenantRequest(router, "PUT", "/receipts/"+created.ID, "globex", "", simpleReceipt()); rr.Code != http.StatusNotFound {
+		t.Errorf("globex should not update acme's receipt, got %d", rr.Code)
+	}
+	if rr := tenantRequest(router, "DELETE", "/receipts/"+created.ID, "globex", "", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("globex should not delete acme's receipt, got %d", rr.Code)
+	}
+
+	// Jobs are shared by every tenant's handlers but only visible to their own
+	var job models.Job
+	rr = tenantRequest(router, "POST", "/receipts/process?async=true", "acme", "", simpleReceipt())
+	json.Unmarshal(rr.Body.Bytes(), &job)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Queueing receipt for acme failed: got %d", rr.Code)
+	}
+	if rr := tenantRequest(router, "GET", "/jobs/"+job.ID, "globex", "", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("globex should not see acme's job, got %d", rr.Code)
+	}
+	if rr := tenantRequest(router, "GET", "/jobs/"+job.ID, "acme", "", nil); rr.Code != http.StatusOK {
+		t.Errorf("acme should see its own job, got %d", rr.Code)
+	}
+
+	acme, _ := tenants.Tenant("acme")
+	history, _ := acme.Processor.History(created.ID)
+	if len(history) != 1 || history[0].Tenant != "acme" {
+		t.Errorf("History should record the tenant: %+v", history)
+	}
+	globex, _ := tenants.Tenant("globex")
+	if _, exists := globex.Processor.GetReceipt(created.ID); exists {
+		t.Error("globex's processor should not hold acme's receipt")
+	}
+}
+
+func TestTenantRules(t *testing.T) {
+	tenants := services.NewTenantRegistry(func(tenant *services.Tenant) error {
+		if tenant.ID != "acme" {
+			return nil
+		}
+		rule, err := services.NewExpressionRule("acme bonus", "100", 0)
+		if err != nil {
+			return err
+		}
+		tenant.Processor.AddRule(rule)
+		return nil
+	})
+	tenants.SetAllowed([]string{"acme", "globex"})
+	router := newTenantRouter(tenants, nil, nil)
+
+	expected := map[string]int64{"acme": 131, "globex": 31}
+	for tenant, points := range expected {
+		var created models.ReceiptResponse
+		json.Unmarshal(tenantRequest(router, "POST", "/receipts/process", tenant, "", simpleReceipt()).Body.Bytes(), &created)
+
+		var response models.PointsResponse
+		json.Unmarshal(tenantRequest(router, "GET", "/receipts/"+created.ID+"/points", tenant, "", nil).Body.Bytes(), &response)
+		if response.Points != points {
+			t.Errorf("%s points incorrect: got %d, expected %d", tenant, response.Points, points)
+		}
+	}
+}
+
+func TestTenantSetupDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	var setups atomic.Int32
+	tenants := services.NewTenantRegistry(func(tenant *services.Tenant) error {
+		if tenant.ID == "acme" {
+			setups.Add(1)
+			<-release
+		}
+		return nil
+	})
+	tenants.SetAllowed([]string{"acme", "globex"})
+
+	// Several requests for a tenant being set up share its setup
+	results := make(chan *services.Tenant, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			tenant, _ := tenants.Tenant("acme")
+			results <- tenant
+		}()
+	}
+	for setups.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := tenants.Tenant("globex")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Tenant failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Another tenant's setup should not wait for acme's")
+	}
+
+	close(release)
+	first := <-results
+	for i := 1; i < 3; i++ {
+		if tenant := <-results; tenant == nil || tenant != first {
+			t.Errorf("Requests for a tenant being set up should get the same tenant")
+		}
+	}
+	if setups.Load() != 1 {
+		t.Errorf("Tenant should be set up once, was set up %d times", setups.Load())
+	}
+}
+
+func TestTenantResolution(t *testing.T) {
+	tenants := services.NewTenantRegistry(nil)
+	if err := tenants.SetAllowed([]string{"acme", "globex"}); err != nil {
+		t.Fatalf("Setting allowed tenants failed: %v", err)
+	}
+	keys := services.NewAPIKeyStore()
+	router := newTenantRouter(tenants, keys, nil)
+
+	operator, _ := keys.Create("ops", "", []string{models.ScopeAdmin}, nil)
+	acmeKey, _ := keys.Create("acme-pos", "acme", []string{models.ScopeAdmin}, nil)
+	if _, err := keys.Create("bad", "not a tenant", []string{models.ScopeRead}, nil); err == nil {
+		t.Error("Keys should not be bound to invalid tenants")
+	}
+
+	var created models.ReceiptResponse
+	json.Unmarshal(tenantRequest(router, "POST", "/receipts/process", "", acmeKey.Secret, simpleReceipt()).Body.Bytes(), &created)
+	points := "/receipts/" + created.ID + "/points"
+
+	testCases := []struct {
+		name     string
+		method   string
+		url      string
+		tenant   string
+		secret   string
+		expected int
+	}{
+		{"bound key defaults to its tenant", "GET", points, "", acmeKey.Secret, http.StatusOK},
+		{"bound key may name its tenant", "GET", points, "acme", acmeKey.Secret, http.StatusOK},
+		{"bound key cannot name another tenant", "GET", points, "globex", acmeKey.Secret, http.StatusForbidden},
+		{"unbound key names the tenant", "GET", points, "acme", operator.Secret, http.StatusOK},
+		{"unbound key defaults to the default tenant", "GET", points, "", operator.Secret, http.StatusNotFound},
+		{"unknown tenant", "GET", points, "initech", operator.Secret, http.StatusNotFound},
+		{"invalid tenant", "GET", points, "../acme", operator.Secret, http.StatusBadRequest},
+		{"credentials are checked first", "GET", points, "initech", "", http.StatusUnauthorized},
+		{"bound key cannot manage keys", "GET", "/admin/keys", "", acmeKey.Secret, http.StatusForbidden},
+		{"unbound key manages keys", "GET", "/admin/keys", "acme", operator.Secret, http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := tenantRequest(router, tc.method, tc.url, tc.tenant, tc.secret, nil)
+			if rr.Code != tc.expected {
+				t.Errorf("Got status %d, expected %d", rr.Code, tc.expected)
+			}
+		})
+	}
+}
+
+func TestTenantsNotCreatedOnDemand(t *testing.T) {
+	created := 0
+	tenants := services.NewTenantRegistry(func(tenant *services.Tenant) error {
+		created++
+		return nil
+	})
+	router := newTenantRouter(tenants, nil, nil)
+
+	for i := range 100 {
+		tenant := fmt.Sprintf("made-up-%d", i)
+		if rr := tenantRequest(router, "GET", "/receipts/missing/points", tenant, "", nil); rr.Code != http.StatusNotFound {
+			t.Fatalf("Unlisted tenant %s should return 404, got %d", tenant, rr.Code)
+		}
+	}
+	if rr := tenantRequest(router, "POST", "/receipts/process", "", "", simpleReceipt()); rr.Code != http.StatusOK {
+		t.Errorf("Default tenant should be allowed, got %d", rr.Code)
+	}
+	if len(tenants.Tenants()) != 1 || created != 1 {
+		t.Errorf("Only the default tenant should be created, got %d tenants and %d setups", len(tenants.Tenants()), created)
+	}
+}
+
+func TestTenantTokenClaim(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(path, jwksJSON(t, map[string]crypto.Signer{"ec-1": key}), 0o600)
+	jwks, err := services.NewJWKSource(path, 0)
+	if err != nil {
+		t.Fatalf("Loading JWKS failed: %v", err)
+	}
+	tenants := services.NewTenantRegistry(nil)
+	tenants.SetAllowed([]string{"acme", "globex"})
+	router := newTenantRouter(tenants, nil, services.NewTokenValidator(jwks))
+
+	request := func(method, url, tenant string, body any) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, url, bytes.NewBuffer(data))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+signToken(t, "ES256", "ec-1", key, tokenClaims(map[string]any{"customer_id": nil})))
+		if tenant != "" {
+			req.Header.Set(handlers.TenantHeader, tenant)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	var created models.ReceiptResponse
+	rr := request("POST", "/receipts/process", "", simpleReceipt())
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Processing receipt with a token failed: got %d", rr.Code)
+	}
+
+	acme, _ := tenants.Tenant("acme")
+	if _, exists := acme.Processor.GetReceipt(created.ID); !exists {
+		t.Error("Receipt should be stored for the token's tenant")
+	}
+	if rr := request("GET", "/receipts/"+created.ID+"/points", "globex", nil); rr.Code != http.StatusForbidden {
+		t.Errorf("Token for acme should not name another tenant, got %d", rr.Code)
+	}
+}
+
+func TestTenantSettingsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	newRegistry := func() *services.TenantRegistry {
+		tenants := services.NewTenantRegistry(func(tenant *services.Tenant) error {
+			tenant.Settings = services.NewSettingsFile(filepath.Join(dir, tenant.ID+".json"), tenant)
+			return tenant.Settings.Load()
+		})
+		tenants.SetAllowed([]string{"acme"})
+		return tenants
+	}
+
+	router := newTenantRouter(newRegistry(), nil, nil)
+	changes := []struct {
+		method, url string
+		body        any
+	}{
+		{"PUT", "/admin/caps", services.PointCaps{PerReceipt: 100}},
+		{"PUT", "/admin/retailers/aliases", models.RetailerAlias{Alias: "Tgt", Canonical: "Target"}},
+		{"PUT", "/admin/retailers/timezones", models.RetailerTimezone{Retailer: "Target", Timezone: "America/Chicago"}},
+		{"POST", "/admin/webhooks", models.WebhookSubscription{URL: "https://example.com/hook", Secret: "s3cret"}},
+	}
+	for _, change := range changes {
+		if rr := tenantRequest(router, change.method, change.url, "acme", "", change.body); rr.Code >= 300 {
+			t.Fatalf("%s %s failed: %d %s", change.method, change.url, rr.Code, rr.Body.String())
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "acme.json"))
+	if err != nil {
+		t.Fatalf("Settings not saved: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Settings file is readable by others: %v", info.Mode().Perm())
+	}
+
+	// A new registry loads what the first one saved
+	tenant, err := newRegistry().Tenant("acme")
+	if err != nil {
+		t.Fatalf("Tenant failed: %v", err)
+	}
+	if caps := tenant.Processor.Caps(); caps.PerReceipt != 100 {
+		t.Errorf("Caps not restored: %+v", caps)
+	}
+	retailers := tenant.Processor.Retailers()
+	if got := retailers.Canonicalize("TGT"); got != "target" {
+		t.Errorf("Alias not restored: got %q", got)
+	}
+	if loc := retailers.Timezone("Tgt"); loc == nil || loc.String() != "America/Chicago" {
+		t.Errorf("Time zone not restored: %v", loc)
+	}
+	subscriptions := tenant.Webhooks.Subscriptions()
+	if len(subscriptions) != 1 || subscriptions[0].URL != "https://example.com/hook" || subscriptions[0].ID == "" {
+		t.Errorf("Webhook not restored: %+v", subscriptions)
+	}
+
+	// Removing a setting is saved too
+	router = newTenantRouter(newRegistry(), nil, nil)
+	if rr := tenantRequest(router, "DELETE", "/admin/webhooks/"+subscriptions[0].ID, "acme", "", nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("Delete failed: %d", rr.Code)
+	}
+	tenant, _ = newRegistry().Tenant("acme")
+	if subscriptions := tenant.Webhooks.Subscriptions(); len(subscriptions) != 0 {
+		t.Errorf("Deleted webhook restored: %+v", subscriptions)
+	}
+}
@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/parsers"
+	"receipt-processor/services"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+type textGolden struct {
+	Receipt    models.Receipt     `json:"receipt"`
+	Confidence parsers.Confidence `json:"confidence"`
+	Error      string             `json:"error,omitempty"`
+}
+
+// Each testdata/text/*.txt receipt is parsed and compared with the
+// matching .golden.json file. Run with -update to regenerate them.
+func TestTextParserGolden(t *testing.T) {
+	runParserGolden(t, "testdata/text/*.txt", func(data []byte) (models.Receipt, parsers.Confidence, error) {
+		return parsers.ParseText(string(data))
+	})
+}
+
+func runParserGolden(t *testing.T, pattern string, parse func([]byte) (models.Receipt, parsers.Confidence, error)) {
+	inputs, _ := filepath.Glob(pattern)
+	if len(inputs) == 0 {
+		t.Fatalf("No inputs match %s", pattern)
+	}
+
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), filepath.Ext(input))
+		t.Run(name, func(t *testing.T) {
+			data, _ := os.ReadFile(input)
+			receipt, confidence, err := parse(data)
+
+			got := textGolden{Receipt: receipt, Confidence: confidence}
+			if err != nil {
+				got.Error = err.Error()
+			}
+			gotJSON, _ := json.MarshalIndent(got, "", "  ")
+
+			goldenPath := strings.TrimSuffix(input, filepath.Ext(input)) + ".golden.json"
+			if *update {
+				os.WriteFile(goldenPath, append(gotJSON, '\n'), 0o644)
+			}
+
+			wantJSON, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("Missing golden file, run with -update: %v", err)
+			}
+			if string(bytes.TrimSpace(wantJSON)) != string(gotJSON) {
+				t.Errorf("Parsed receipt does not match %s:\ngot:\n%s\nwant:\n%s", goldenPath, gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestTextReceiptAPI(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	handler := handlers.NewReceiptHandler(processor)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/receipts/process/text", handler.ProcessTextReceipt).Methods("POST")
+	router.HandleFunc("/receipts/{id}/points", handler.GetPoints).Methods("GET")
+
+	text, _ := os.ReadFile("testdata/text/target.txt")
+	req, _ := http.NewRequest("POST", "/receipts/process/text", bytes.NewBuffer(text))
+	req.Header.Set("Content-Type", "text/plain")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Processing text receipt failed: got status %d, expected 200", rr.Code)
+	}
+
+	var response models.ParsedReceiptResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Receipt.Retailer != "TARGET" || response.Confidence["total"] < 0.9 {
+		t.Errorf("Parsed receipt incorrect: %+v", response)
+	}
+
+	// The same receipt as README example 1
+	req, _ = http.NewRequest("GET", "/receipts/"+response.ID+"/points", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var pointsResponse models.PointsResponse
+	json.Unmarshal(rr.Body.Bytes(), &pointsResponse)
+	if pointsResponse.Points != 28 {
+		t.Errorf("Text receipt points incorrect: got %d, expected %d", pointsResponse.Points, 28)
+	}
+
+	// A receipt over the limit is refused rather than cut short
+	padded := append(bytes.Clone(text), bytes.Repeat([]byte("\n"), 1<<20)...)
+	req, _ = http.NewRequest("POST", "/receipts/process/text", bytes.NewBuffer(padded))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Oversized receipt should return 413 Request Entity Too Large, got %d", rr.Code)
+	}
+
+	for _, name := range []string{"no-items.txt"} {
+		text, _ := os.ReadFile(filepath.Join("testdata/text", name))
+		req, _ := http.NewRequest("POST", "/receipts/process/text", bytes.NewBuffer(text))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Unparseable receipt %s should return 400 Bad Request, got %d", name, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/services"
+	"receipt-processor/utils"
+)
+
+func TestParseTimezone(t *testing.T) {
+	testCases := []struct {
+		name   string
+		valid  bool
+		offset int
+	}{
+		{"UTC", true, 0},
+		{"Z", true, 0},
+		{"+05:30", true, 5*3600 + 30*60},
+		{"-0800", true, -8 * 3600},
+		{"America/New_York", true, -5 * 3600},
+		{"+15:00", false, 0},
+		{"+05:60", false, 0},
+		{"Local", false, 0},
+		{"Mars/Olympus_Mons", false, 0},
+	}
+
+	for _, tc := range testCases {
+		loc, err := utils.ParseTimezone(tc.name)
+		if (err == nil) != tc.valid {
+			t.Errorf("Parsing time zone %q: got error %v, expected valid=%v", tc.name, err, tc.valid)
+			continue
+		}
+		if !tc.valid {
+			continue
+		}
+		// Offsets are checked in January, outside daylight saving time
+		_, offset := utcDate(2022, 1, 15).In(loc).Zone()
+		if offset != tc.offset {
+			t.Errorf("Time zone %q offset incorrect: got %d, expected %d", tc.name, offset, tc.offset)
+		}
+	}
+}
+
+func TestTimezoneAwareRules(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	if err := processor.Retailers().SetTimezone("Corner Shop", "America/New_York"); err != nil {
+		t.Fatalf("Setting retailer time zone failed: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		retailer string
+		date     string
+		time     string
+		timezone string
+		expected int64
+	}{
+		// No time zone on the receipt: values are already store-local
+		{"naive local time", "Corner Shop", "2022-03-14", "14:30", "", 10},
+		// 18:30 UTC is 14:30 EDT after the March DST change, but would be
+		// 13:30 with the standard-time offset
+		{"UTC after spring forward", "Corner Shop", "2022-03-14", "18:30", "UTC", 10},
+		// 18:30 UTC is 13:30 EST after the November DST change
+		{"UTC after fall back", "Corner Shop", "2022-11-08", "18:30", "UTC", 0},
+		// 06:30 UTC on the spring-forward day is 01:30 EST, before the change
+		{"UTC before DST starts", "Corner Shop", "2022-03-13", "06:30", "Z", 6},
+		// 03:00 UTC on Jan 2 is 22:00 EST on Jan 1, an odd day
+		{"UTC crossing midnight", "Corner Shop", "2022-01-02", "03:00", "UTC", 6},
+		// 04:30 +09:00 on Jan 3 is 14:30 EST on Jan 2
+		{"fixed offset", "Corner Shop", "2022-01-03", "04:30", "+09:00", 10},
+		// Same zone as the store: unchanged
+		{"store zone", "CORNER SHOP", "2022-07-01", "15:00", "America/New_York", 16},
+		// No default zone for the retailer: scored as sent
+		{"retailer without zone", "Elsewhere", "2022-01-02", "03:00", "UTC", 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			receipt := models.Receipt{
+				Retailer:     tc.retailer,
+				PurchaseDate: tc.date,
+				PurchaseTime: tc.time,
+				Timezone:     tc.timezone,
+				Items:        []models.Item{{ShortDescription: "Item", Price: "1.01"}},
+				Total:        "1.01",
+			}
+
+			breakdown, _ := processor.CalculateBreakdown(receipt)
+			dateTimePoints := findRule(breakdown, "odd-day").Points + findRule(breakdown, "afternoon").Points
+			if dateTimePoints != tc.expected {
+				t.Errorf("Date and time points incorrect: got %d, expected %d", dateTimePoints, tc.expected)
+			}
+		})
+	}
+}
+
+func TestDailyCapUsesStoreLocalDate(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	processor.Retailers().SetTimezone("X", "America/Los_Angeles")
+	processor.SetCaps(services.PointCaps{PerCustomerPerDay: 20})
+
+	// 15 points each; 06:00 UTC on Jan 3 is 22:00 PST on Jan 2, the same
+	// store-local day as the first receipt
+	first := manyItemReceipt("alice", 4)
+	second := manyItemReceipt("alice", 4)
+	second.PurchaseDate = "2022-01-03"
+	second.PurchaseTime = "06:00"
+	second.Timezone = "UTC"
+
+	processor.ProcessReceipt(context.Background(), first)
+	id, _ := processor.ProcessReceipt(context.Background(), second)
+	breakdown, _ := processor.GetBreakdown(id)
+	if breakdown.Points != 5 {
+		t.Errorf("Daily cap should use the store-local date: got %d points, expected %d", breakdown.Points, 5)
+	}
+
+	id, _ = processor.ProcessReceipt(context.Background(), second)
+	receipt, _ := processor.GetReceipt(id)
+	if receipt.PurchaseDate != "2022-01-03" || receipt.Timezone != "UTC" {
+		t.Errorf("Stored receipt should keep the submitted values, got %s %s", receipt.PurchaseDate, receipt.Timezone)
+	}
+}
+
+func TestTimezoneValidation(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	handler := handlers.NewReceiptHandler(processor)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/receipts/process", handler.ProcessReceipt).Methods("POST")
+
+	testCases := []struct {
+		timezone string
+		expected int
+	}{
+		{"America/Chicago", http.StatusOK},
+		{"-05:00", http.StatusOK},
+		{"Nowhere/Special", http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		receiptJSON := `{
+			"retailer": "Target",
+			"purchaseDate": "2022-01-02",
+			"purchaseTime": "13:13",
+			"timezone": "` + tc.timezone + `",
+			"total": "1.25",
+			"items": [{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}]
+		}`
+		req, _ := http.NewRequest("POST", "/receipts/process", bytes.NewBufferString(receiptJSON))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != tc.expected {
+			t.Errorf("Time zone %q: got status %d, expected %d", tc.timezone, rr.Code, tc.expected)
+		}
+	}
+}
+
+func utcDate(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 12, 0, 0, 0, time.UTC)
+}
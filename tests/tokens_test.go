@@ -0,0 +1,431 @@
+package tests
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+var b64 = base64.RawURLEncoding
+
+func publicJWK(t *testing.T, kid string, key crypto.Signer) map[string]string {
+	switch public := key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": b64.EncodeToString(public.N.Bytes()), "e": b64.EncodeToString(big.NewInt(int64(public.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64.EncodeToString(public.X.FillBytes(make([]byte, 32))), "y": b64.EncodeToString(public.Y.FillBytes(make([]byte, 32)))}
+	}
+	t.Fatalf("Unsupported key type %T", key)
+	return nil
+}
+
+func jwksJSON(t *testing.T, keys map[string]crypto.Signer) []byte {
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for kid, key := range keys {
+		set.Keys = append(set.Keys, publicJWK(t, kid, key))
+	}
+	data, _ := json.Marshal(set)
+	return data
+}
+
+// signToken signs claims with the key, naming the algorithm in the header
+func signToken(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatalf("Signing token failed: %v", err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + b64.EncodeToString(signature)
+}
+
+func tokenClaims(overrides map[string]any) map[string]any {
+	claims := map[string]any{
+		"sub":         "mobile-app",
+		"iss":         "https://gateway.example",
+		"aud":         []string{"receipts", "other"},
+		"exp":         time.Now().Add(time.Hour).Unix(),
+		"scope":       "submit read",
+		"tenant_id":   "acme",
+		"customer_id": "cust-42",
+	}
+	for name, value := range overrides {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
+func TestBearerTokens(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(path, jwksJSON(t, map[string]crypto.Signer{"rsa-1": rsaKey, "ec-1": ecKey}), 0o600)
+	keys, err := services.NewJWKSource(path, 0)
+	if err != nil {
+		t.Fatalf("Loading JWKS failed: %v", err)
+	}
+	validator := services.NewTokenValidator(keys)
+	validator.SetIssuer("https://gateway.example")
+	validator.SetAudience("receipts")
+
+	processor := services.NewReceiptProcessor()
+	auth := handlers.NewAuthenticator(nil)
+	auth.SetTokenValidator(validator)
+	router := handlers.NewRouter(handlers.Handlers{
+		Receipts: handlers.NewReceiptHandler(processor),
+		Admin:    handlers.NewAdminHandler(processor),
+		Webhooks: handlers.NewWebhookHandler(services.NewWebhookDispatcher()),
+		Events:   handlers.NewEventsHandler(services.NewEventBroker(10, 10)),
+	}, auth)
+
+	submit := func(token string, receipt models.Receipt) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(receipt)
+		req := httptest.NewRequest("POST", "/receipts/process", strings.NewReader(string(body)))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for alg, key := range map[string]crypto.Signer{"RS256": rsaKey, "ES256": ecKey} {
+		kid := map[string]string{"RS256": "rsa-1", "ES256": "ec-1"}[alg]
+		receipt := simpleReceipt()
+		receipt.CustomerID = ""
+		rr := submit(signToken(t, alg, kid, key, tokenClaims(nil)), receipt)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s token should be accepted, got %d %s", alg, rr.Code, rr.Body.String())
+		}
+
+		// The receipt is attributed to the token's customer
+		var response models.ReceiptResponse
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		stored, _ := processor.GetReceipt(response.ID)
+		history, _ := processor.History(response.ID)
+		if stored.CustomerID != "cust-42" || history[0].Actor != "mobile-app" {
+			t.Errorf("%s receipt should belong to the token's customer and subject: %+v, %+v", alg, stored, history[0])
+		}
+	}
+
+	rejected := map[string]string{
+		"expired":          signToken(t, "RS256", "rsa-1", rsaKey, tokenClaims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()})),
+		"no expiry":        signToken(t, "RS256", "rsa-1", rsaKey, tokenClaims(map[string]any{"exp": nil})),
+		"not yet valid":    signToken(t, "RS256", "rsa-1", rsaKey, tokenClaims(map[string]any{"nbf": time.Now().Add(time.Hour).Unix()})),
+		"wrong issuer":     signToken(t, "RS256", "rsa-1", rsaKey, tokenClaims(map[string]any{"iss": "https://evil.example"})),
+		"wrong audience":   signToken(t, "RS256", "rsa-1", rsaKey, tokenClaims(map[string]any{"aud": "billing"})),
+		"no subject":       signToken(t, "RS256", "rsa-1", rsaKey, tokenClaims(map[string]any{"sub": nil})),
+		"no tenant":        signToken(t, "RS256", "rsa-1", rsaKey, tokenClaims(map[string]any{"tenant_id": nil})),
+		"unknown key":      signToken(t, "ES256", "ec-2", otherKey, tokenClaims(nil)),
+		"wrong signer":     signToken(t, "ES256", "ec-1", otherKey, tokenClaims(nil)),
+		"algorithm switch": signToken(t, "ES256", "rsa-1", ecKey, tokenClaims(nil)),
+		"malformed":        "not.a-token",
+	}
+	valid := signToken(t, "RS256", "rsa-1", rsaKey, tokenClaims(nil))
+	parts := strings.Split(valid, ".")
+	forged, _ := json.Marshal(tokenClaims(map[string]any{"customer_id": "cust-1", "scope": "admin"}))
+	rejected["tampered"] = parts[0] + "." + b64.EncodeToString(forged) + "." + parts[2]
+	rejected["unsigned"] = b64.EncodeToString([]byte(`{"alg":"none","kid":"rsa-1"}`)) + "." + parts[1] + "."
+
+	for name, token := range rejected {
+		rr := submit(token, simpleReceipt())
+		if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("Token %s should return 401, got %d", name, rr.Code)
+		}
+	}
+
+	// API keys are not accepted without a key store
+	req := httptest.NewRequest("GET", "/receipts/missing/points", nil)
+	req.Header.Set(handlers.APIKeyHeader, "rp_anything")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("API key should return 401 without a key store, got %d", rr.Code)
+	}
+
+	readOnly := signToken(t, "RS256", "rsa-1", rsaKey, tokenClaims(map[string]any{"scope": "read"}))
+	if rr := submit(readOnly, simpleReceipt()); rr.Code != http.StatusForbidden {
+		t.Errorf("Token without the submit scope should return 403, got %d", rr.Code)
+	}
+
+	receipt := simpleReceipt()
+	receipt.CustomerID = "cust-7"
+	if rr := submit(valid, receipt); rr.Code != http.StatusForbidden {
+		t.Errorf("Receipt for another customer should return 403, got %d", rr.Code)
+	}
+
+	// Customers cannot correct each other's receipts
+	other, _ := processor.ProcessReceipt(context.Background(), receipt)
+	correction := simpleReceipt()
+	correction.CustomerID = ""
+	body, _ := json.Marshal(correction)
+	req = httptest.NewRequest("PUT", "/receipts/"+other, strings.NewReader(string(body)))
+	req.Header.Set("Authorization", "Bearer "+valid)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Correcting another customer's receipt should return 404, got %d", rr.Code)
+	}
+
+	principal, err := validator.Validate(valid)
+	if err != nil || principal.Tenant != "acme" || principal.CustomerID != "cust-42" || len(principal.Scopes) != 2 {
+		t.Errorf("Claims mapped incorrectly: %+v, %v", principal, err)
+	}
+	// Only listed operators may act for every tenant
+	operator := signToken(t, "RS256", "rsa-1", rsaKey, tokenClaims(map[string]any{"sub": "ops-console", "tenant_id": nil}))
+	if _, err := validator.Validate(operator); err == nil {
+		t.Error("Token without a tenant should be rejected unless its subject is an operator")
+	}
+	validator.SetOperators([]string{"ops-console"})
+	if principal, err := validator.Validate(operator); err != nil || principal.Tenant != "" {
+		t.Errorf("Operator token should be accepted for every tenant: %+v, %v", principal, err)
+	}
+
+	validator.SetClaims("org", "member")
+	principal, _ = validator.Validate(signToken(t, "RS256", "rsa-1", rsaKey, tokenClaims(map[string]any{"org": "globex", "member": 1234567})))
+	if principal.Tenant != "globex" || principal.CustomerID != "1234567" {
+		t.Errorf("Configured claims mapped incorrectly: %+v", principal)
+	}
+}
+
+func TestCustomerTokensReadOwnReceipts(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(path, jwksJSON(t, map[string]crypto.Signer{"ec-1": key}), 0o600)
+	jwks, err := services.NewJWKSource(path, 0)
+	if err != nil {
+		t.Fatalf("Loading JWKS failed: %v", err)
+	}
+
+	processor := services.NewReceiptProcessor()
+	broker := services.NewEventBroker(10, 10)
+	processor.AddListener(broker.Publish)
+	defer broker.Close()
+	auth := handlers.NewAuthenticator(nil)
+	auth.SetTokenValidator(services.NewTokenValidator(jwks))
+	router := handlers.NewRouter(handlers.Handlers{
+		Receipts: handlers.NewReceiptHandler(processor),
+		Admin:    handlers.NewAdminHandler(processor),
+		Webhooks: handlers.NewWebhookHandler(services.NewWebhookDispatcher()),
+		Events:   handlers.NewEventsHandler(broker),
+	}, auth)
+
+	ids := make(map[string]string)
+	for _, customer := range []string{"cust-42", "cust-7"} {
+		receipt := simpleReceipt()
+		receipt.CustomerID = customer
+		ids[customer], _ = processor.ProcessReceipt(context.Background(), receipt)
+	}
+	token := signToken(t, "ES256", "ec-1", key, tokenClaims(nil))
+	read := func(url string) *httptest.ResponseRecorder {
+		// The context is already done so that the event stream returns at once
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest("GET", url, nil).WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for _, path := range []string{"/points", "/breakdown", "/history"} {
+		if rr := read("/receipts/" + ids["cust-42"] + path); rr.Code != http.StatusOK {
+			t.Errorf("Customer should read their own receipt at %s, got %d", path, rr.Code)
+		}
+		if rr := read("/receipts/" + ids["cust-7"] + path); rr.Code != http.StatusNotFound {
+			t.Errorf("Customer should not read another customer's receipt at %s, got %d", path, rr.Code)
+		}
+	}
+
+	// A deleted receipt's history stays with its customer
+	processor.DeleteReceipt(context.Background(), ids["cust-7"])
+	if rr := read("/receipts/" + ids["cust-7"] + "/history"); rr.Code != http.StatusNotFound {
+		t.Errorf("Customer should not read another customer's deleted receipt history, got %d", rr.Code)
+	}
+
+	for _, url := range []string{"/receipts/export", "/events?lastEventId=0"} {
+		body := read(url).Body.String()
+		if !strings.Contains(body, ids["cust-42"]) || strings.Contains(body, ids["cust-7"]) {
+			t.Errorf("%s should only include the customer's own receipts:\n%s", url, body)
+		}
+	}
+}
+
+func TestJWKSRollover(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	var mutex sync.Mutex
+	jwks := jwksJSON(t, map[string]crypto.Signer{"old": oldKey})
+	status := http.StatusOK
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		fetches++
+		w.WriteHeader(status)
+		w.Write(jwks)
+	}))
+	defer server.Close()
+	serve := func(keys map[string]crypto.Signer, code int) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		jwks = jwksJSON(t, keys)
+		status = code
+	}
+	fetchCount := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return fetches
+	}
+
+	const refresh = 200 * time.Millisecond
+	keys, err := services.NewJWKSource(server.URL, refresh)
+	if err != nil {
+		t.Fatalf("Loading JWKS failed: %v", err)
+	}
+	validator := services.NewTokenValidator(keys)
+
+	oldToken := signToken(t, "ES256", "old", oldKey, tokenClaims(nil))
+	newToken := signToken(t, "ES256", "new", newKey, tokenClaims(nil))
+	if _, err := validator.Validate(oldToken); err != nil {
+		t.Fatalf("Token should be valid: %v", err)
+	}
+
+	// Unknown keys do not cause a fetch on every request
+	serve(map[string]crypto.Signer{"old": oldKey, "new": newKey}, http.StatusOK)
+	for range 5 {
+		validator.Validate(newToken)
+	}
+	if fetchCount() > 2 {
+		t.Errorf("Unknown keys should not refetch the JWKS every time, got %d fetches", fetchCount())
+	}
+
+	time.Sleep(refresh)
+	if _, err := validator.Validate(newToken); err != nil {
+		t.Errorf("Token signed with the new key should be valid after refresh: %v", err)
+	}
+	if _, err := validator.Validate(oldToken); err != nil {
+		t.Errorf("Both keys should be valid during the rollover: %v", err)
+	}
+
+	// Keys are kept when the JWKS cannot be fetched
+	serve(nil, http.StatusInternalServerError)
+	time.Sleep(refresh)
+	if _, err := validator.Validate(newToken); err != nil {
+		t.Errorf("Cached keys should be kept when the JWKS is unavailable: %v", err)
+	}
+
+	// Once the old key is retired its tokens are rejected
+	serve(map[string]crypto.Signer{"new": newKey}, http.StatusOK)
+	time.Sleep(refresh)
+	if _, err := validator.Validate(oldToken); err == nil {
+		t.Errorf("Token signed with a retired key should be rejected")
+	}
+
+	serve(nil, http.StatusNotFound)
+	if _, err := services.NewJWKSource(server.URL, 0); err == nil {
+		t.Errorf("Loading an unavailable JWKS should fail")
+	}
+}
+
+func TestJWKSUnavailable(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := jwksJSON(t, map[string]crypto.Signer{"ec-1": key})
+
+	var mutex sync.Mutex
+	status := http.StatusOK
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		fetches++
+		code := status
+		mutex.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(code)
+		w.Write(jwks)
+	}))
+	defer server.Close()
+	fetchCount := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return fetches
+	}
+
+	const refresh = 300 * time.Millisecond
+	keys, err := services.NewJWKSource(server.URL, refresh)
+	if err != nil {
+		t.Fatalf("Loading JWKS failed: %v", err)
+	}
+	validator := services.NewTokenValidator(keys)
+	token := signToken(t, "ES256", "ec-1", key, tokenClaims(nil))
+
+	mutex.Lock()
+	status = http.StatusServiceUnavailable
+	mutex.Unlock()
+	time.Sleep(refresh)
+
+	// Requests due a reload share one fetch
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := validator.Validate(token); err != nil {
+				t.Errorf("Cached key should be used when the JWKS is unavailable: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if fetchCount() != 2 {
+		t.Errorf("Concurrent requests should share one fetch, got %d fetches", fetchCount()-1)
+	}
+
+	// Failed fetches are retried after a delay, not on every request
+	for range 10 {
+		validator.Validate(token)
+	}
+	if fetchCount() != 2 {
+		t.Errorf("A failed fetch should not be retried at once, got %d fetches", fetchCount()-1)
+	}
+	time.Sleep(350 * time.Millisecond)
+	validator.Validate(token)
+	if fetchCount() != 3 {
+		t.Errorf("Fetch should be retried after the backoff, got %d fetches", fetchCount()-1)
+	}
+}
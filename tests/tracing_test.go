@@ -0,0 +1,166 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+
+	"receipt-processor/handlers"
+	"receipt-processor/services"
+)
+
+type exportedAttribute struct {
+	Key   string
+	Value struct{ Value any }
+}
+
+// exportedSpan is a span as written by the file exporter
+type exportedSpan struct {
+	Name        string
+	SpanContext struct{ TraceID, SpanID string }
+	Parent      struct{ TraceID, SpanID string }
+	Attributes  []exportedAttribute
+	Events      []struct {
+		Name       string
+		Attributes []exportedAttribute
+	}
+	Status struct{ Code string }
+}
+
+func (s exportedSpan) attribute(key string) any {
+	for _, attribute := range s.Attributes {
+		if attribute.Key == key {
+			return attribute.Value.Value
+		}
+	}
+	return nil
+}
+
+func readSpans(t *testing.T, path string) []exportedSpan {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Reading trace file failed: %v", err)
+	}
+	var spans []exportedSpan
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var span exportedSpan
+		if err := decoder.Decode(&span); errors.Is(err, io.EOF) {
+			return spans
+		} else if err != nil {
+			t.Fatalf("Trace file is malformed: %v", err)
+		}
+		spans = append(spans, span)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	shutdown, err := services.SetupTracing(context.Background(), services.TraceExporterFile, path)
+	if err != nil {
+		t.Fatalf("Setting up tracing failed: %v", err)
+	}
+
+	processor := services.NewReceiptProcessor()
+	router := handlers.NewRouter(handlers.Handlers{
+		Receipts: handlers.NewReceiptHandler(processor),
+		Admin:    handlers.NewAdminHandler(processor),
+		Webhooks: handlers.NewWebhookHandler(services.NewWebhookDispatcher()),
+		Events:   handlers.NewEventsHandler(services.NewEventBroker(10, 10)),
+	}, nil)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentID = "00f067aa0ba902b7"
+	body, _ := json.Marshal(simpleReceipt())
+	req, _ := http.NewRequest("POST", "/receipts/process", bytes.NewBuffer(body))
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	invalid := simpleReceipt()
+	invalid.PurchaseTime = "25:00"
+	body, _ = json.Marshal(invalid)
+	req, _ = http.NewRequest("POST", "/receipts/process", bytes.NewBuffer(body))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("Flushing spans failed: %v", err)
+	}
+
+	byName := make(map[string][]exportedSpan)
+	for _, span := range readSpans(t, path) {
+		byName[span.Name] = append(byName[span.Name], span)
+	}
+	for name, count := range map[string]int{"POST /receipts/process": 2, "decode": 2, "validate": 2, "ReceiptProcessor.ProcessReceipt": 1, "score": 1, "store": 1} {
+		if len(byName[name]) != count {
+			t.Fatalf("Expected %d %q spans, got %d", count, name, len(byName[name]))
+		}
+	}
+
+	server := byName["POST /receipts/process"][0]
+	if server.SpanContext.TraceID != traceID || server.Parent.SpanID != parentID {
+		t.Errorf("Request span should continue the caller's trace: %+v", server)
+	}
+	if server.attribute("http.route") != "/receipts/process" || server.attribute("http.response.status_code") != float64(200) {
+		t.Errorf("Request span has wrong attributes: %+v", server.Attributes)
+	}
+
+	process := byName["ReceiptProcessor.ProcessReceipt"][0]
+	childOf := map[string]exportedSpan{
+		"decode":                          server,
+		"ReceiptProcessor.ProcessReceipt": server,
+		"score":                           process,
+		"store":                           process,
+	}
+	for name, parent := range childOf {
+		span := byName[name][0]
+		if span.SpanContext.TraceID != traceID || span.Parent.SpanID != parent.SpanContext.SpanID {
+			t.Errorf("%q span should be a child of %q", name, parent.Name)
+		}
+	}
+
+	score := byName["score"][0]
+	fired := make(map[string]float64)
+	for _, event := range score.Events {
+		var rule string
+		var points float64
+		for _, attribute := range event.Attributes {
+			switch attribute.Key {
+			case "rule.name":
+				rule, _ = attribute.Value.Value.(string)
+			case "rule.points":
+				points, _ = attribute.Value.Value.(float64)
+			}
+		}
+		fired[rule] = points
+	}
+	if len(score.Events) != len(processor.Rules()) || fired["retailer-name"] != 6 || fired["quarter-multiple"] != 25 {
+		t.Errorf("Score span should have an event for each rule: %+v", score.Events)
+	}
+	if score.attribute("receipt.points") != float64(31) {
+		t.Errorf("Score span should record the points: %+v", score.Attributes)
+	}
+
+	var rejected exportedSpan
+	for _, span := range byName["validate"] {
+		if span.SpanContext.TraceID != traceID {
+			rejected = span
+		}
+	}
+	if rejected.attribute("validation.reason") != "purchase_time" || rejected.Status.Code != "Error" {
+		t.Errorf("Failed validation should be recorded on its span: %+v", rejected)
+	}
+}
@@ -0,0 +1,247 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"receipt-processor/handlers"
+	"receipt-processor/models"
+	"receipt-processor/services"
+)
+
+// webhookReceiver records the events it is sent, answering with the given
+// status codes in turn and 200 once they run out
+type webhookReceiver struct {
+	server   *httptest.Server
+	secret   string
+	statuses []int
+	events   []models.ReceiptEvent
+	mutex    sync.Mutex
+	t        *testing.T
+}
+
+func newWebhookReceiver(t *testing.T, secret string, statuses ...int) *webhookReceiver {
+	wr := &webhookReceiver{secret: secret, statuses: statuses, t: t}
+	wr.server = httptest.NewServer(http.HandlerFunc(wr.handle))
+	t.Cleanup(wr.server.Close)
+	return wr
+}
+
+func (wr *webhookReceiver) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	timestamp := r.Header.Get(services.WebhookTimestampHeader)
+	if r.Header.Get(services.WebhookSignatureHeader) != services.SignWebhook(wr.secret, timestamp, body) {
+		wr.t.Errorf("Webhook signature does not verify: %q", r.Header.Get(services.WebhookSignatureHeader))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	wr.mutex.Lock()
+	defer wr.mutex.Unlock()
+	if len(wr.statuses) > 0 {
+		status := wr.statuses[0]
+		wr.statuses = wr.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+
+	var event models.ReceiptEvent
+	json.Unmarshal(body, &event)
+	if r.Header.Get(services.WebhookEventHeader) != event.Type {
+		wr.t.Errorf("Event header %q does not match payload type %q", r.Header.Get(services.WebhookEventHeader), event.Type)
+	}
+	wr.events = append(wr.events, event)
+}
+
+func (wr *webhookReceiver) received() []models.ReceiptEvent {
+	wr.mutex.Lock()
+	defer wr.mutex.Unlock()
+	return append([]models.ReceiptEvent(nil), wr.events...)
+}
+
+func simpleReceipt() models.Receipt {
+	return models.Receipt{
+		CustomerID:   "c-1",
+		Retailer:     "Target",
+		PurchaseDate: "2022-01-02",
+		PurchaseTime: "13:13",
+		Total:        "1.25",
+		Items:        []models.Item{{ShortDescription: "Pepsi - 12-oz", Price: "1.25"}},
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	processor := services.NewReceiptProcessor()
+	dispatcher := services.NewWebhookDispatcher()
+	dispatcher.SetRetryPolicy(4, time.Millisecond)
+	dispatcher.SetAllowedNetworks([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	processor.AddListener(dispatcher.Notify)
+
+	healthy := newWebhookReceiver(t, "s3cret")
+	flaky := newWebhookReceiver(t, "other", http.StatusInternalServerError, http.StatusBadGateway)
+	broken := newWebhookReceiver(t, "broken", 500, 500, 500, 500, 500)
+
+	subscriptions := make(map[string]models.WebhookSubscription)
+	for name, receiver := range map[string]*webhookReceiver{"healthy": healthy, "flaky": flaky, "broken": broken} {
+		subscription, err := dispatcher.Subscribe(models.WebhookSubscription{
+			URL:    receiver.server.URL,
+			Events: []string{models.EventReceiptProcessed},
+			Secret: receiver.secret,
+		})
+		if err != nil {
+			t.Fatalf("Subscribing %s failed: %v", name, err)
+		}
+		subscriptions[name] = subscription
+	}
+
+	id, _ := processor.ProcessReceipt(context.Background(), simpleReceipt())
+	if err := dispatcher.Close(context.Background()); err != nil {
+		t.Fatalf("Waiting for deliveries failed: %v", err)
+	}
+
+	for name, receiver := range map[string]*webhookReceiver{"healthy": healthy, "flaky": flaky} {
+		events := receiver.received()
+		if len(events) != 1 {
+			t.Fatalf("%s receiver should get one event, got %d", name, len(events))
+		}
+		if e := events[0]; e.Type != models.EventReceiptProcessed || e.ReceiptID != id || e.Points != 31 || e.CustomerID != "c-1" || e.ID != 1 {
+			t.Errorf("%s receiver got the wrong event: %+v", name, e)
+		}
+	}
+
+	// The flaky receiver succeeded on the third attempt of one delivery
+	var attempts []models.WebhookDelivery
+	for _, delivery := range dispatcher.Deliveries() {
+		if delivery.SubscriptionID == subscriptions["flaky"].ID {
+			attempts = append(attempts, delivery)
+		}
+	}
+	if len(attempts) != 3 || attempts[0].ID != attempts[2].ID || attempts[0].StatusCode != 500 || attempts[2].StatusCode != 200 || attempts[2].Attempt != 3 {
+		t.Errorf("Flaky deliveries logged incorrectly: %+v", attempts)
+	}
+	if !attempts[2].Time.After(attempts[0].Time) {
+		t.Errorf("Retries should be spaced out: %+v", attempts)
+	}
+
+	deadLetters := dispatcher.DeadLetters()
+	if len(deadLetters) != 1 {
+		t.Fatalf("Broken receiver should leave one dead letter, got %+v", deadLetters)
+	}
+	if d := deadLetters[0]; d.SubscriptionID != subscriptions["broken"].ID || d.Attempts != 4 || d.Event.ReceiptID != id || d.LastError == "" {
+		t.Errorf("Dead letter incorrect: %+v", d)
+	}
+
+	// Nothing is sent once the dispatcher is closed
+	processor.ProcessReceipt(context.Background(), simpleReceipt())
+	if len(healthy.received()) != 1 {
+		t.Errorf("Events after Close should not be delivered")
+	}
+}
+
+func TestWebhookSubscriptions(t *testing.T) {
+	dispatcher := services.NewWebhookDispatcher()
+	handler := handlers.NewWebhookHandler(dispatcher)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/webhooks", handler.ListWebhooks).Methods("GET")
+	router.HandleFunc("/admin/webhooks", handler.CreateWebhook).Methods("POST")
+	router.HandleFunc("/admin/webhooks/deliveries", handler.ListDeliveries).Methods("GET")
+	router.HandleFunc("/admin/webhooks/dead-letters", handler.ListDeadLetters).Methods("GET")
+	router.HandleFunc("/admin/webhooks/{id}", handler.DeleteWebhook).Methods("DELETE")
+
+	request := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	invalid := []string{
+		`{"url": "ftp://crm.example/hook", "secret": "s"}`,
+		`{"url": "/hook", "secret": "s"}`,
+		`{"url": "https://crm.example/hook"}`,
+		`{"url": "https://crm.example/hook", "secret": "s", "events": ["receipt.deleted.forever"]}`,
+		`{`,
+	}
+	for _, body := range invalid {
+		if rr := request("POST", "/admin/webhooks", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("Subscription %s should return 400, got %d", body, rr.Code)
+		}
+	}
+
+	rr := request("POST", "/admin/webhooks", `{"url": "https://crm.example/hook", "secret": "s3cret"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Creating subscription failed: got %d", rr.Code)
+	}
+	var created models.WebhookSubscription
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if created.ID == "" || created.Secret != "" {
+		t.Errorf("Created subscription should have an ID and no secret: %+v", created)
+	}
+
+	rr = request("GET", "/admin/webhooks", "")
+	var listed []models.WebhookSubscription
+	json.Unmarshal(rr.Body.Bytes(), &listed)
+	if len(listed) != 1 || listed[0].ID != created.ID || listed[0].Secret != "" {
+		t.Errorf("Listed subscriptions incorrect: %+v", listed)
+	}
+
+	for _, url := range []string{"/admin/webhooks/deliveries", "/admin/webhooks/deliveries?subscription=" + created.ID, "/admin/webhooks/dead-letters"} {
+		if rr := request("GET", url, ""); rr.Code != http.StatusOK || rr.Body.String() != "[]\n" {
+			t.Errorf("%s should be an empty list, got %d %q", url, rr.Code, rr.Body.String())
+		}
+	}
+
+	if rr := request("DELETE", "/admin/webhooks/"+created.ID, ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Deleting subscription should return 204, got %d", rr.Code)
+	}
+	if rr := request("DELETE", "/admin/webhooks/"+created.ID, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Deleting missing subscription should return 404, got %d", rr.Code)
+	}
+}
+
+func TestWebhooksRefuseInternalAddresses(t *testing.T) {
+	dispatcher := services.NewWebhookDispatcher()
+	dispatcher.SetRetryPolicy(1, time.Millisecond)
+	receiver := newWebhookReceiver(t, "s3cret")
+
+	// The receiver listens on loopback, as would a metadata endpoint or an
+	// internal service reached by a name resolving to a private address
+	subscription, err := dispatcher.Subscribe(models.WebhookSubscription{URL: receiver.server.URL, Secret: "s3cret"})
+	if err != nil {
+		t.Fatalf("Subscribing failed: %v", err)
+	}
+	dispatcher.Notify(models.ReceiptEvent{Type: models.EventReceiptProcessed, ReceiptID: "r-1"})
+	if err := dispatcher.Close(context.Background()); err != nil {
+		t.Fatalf("Waiting for deliveries failed: %v", err)
+	}
+
+	if len(receiver.received()) != 0 {
+		t.Errorf("Webhooks should not be delivered to loopback addresses")
+	}
+	deadLetters := dispatcher.DeadLetters()
+	if len(deadLetters) != 1 || deadLetters[0].SubscriptionID != subscription.ID || !strings.Contains(deadLetters[0].LastError, services.ErrBlockedDestination.Error()) {
+		t.Errorf("Refused delivery should be dead lettered with the reason: %+v", deadLetters)
+	}
+
+	for _, networks := range [][]string{{"10.0.0.0/8", "fd00::/8"}, {}} {
+		if _, err := services.ParseNetworks(networks); err != nil {
+			t.Errorf("Networks %v should parse: %v", networks, err)
+		}
+	}
+	if _, err := services.ParseNetworks([]string{"10.0.0.1"}); !errors.Is(err, services.ErrInvalidNetwork) {
+		t.Errorf("An address without a prefix length should be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// BaseCurrency is the base currency until an exchange-rate table is loaded,
+// which names its own
+const BaseCurrency = "USD"
+
+// Decimal places of the ISO 4217 minor unit for supported currencies
+var currencyDecimals = map[string]int{
+	"AUD": 2,
+	"BHD": 3,
+	"CAD": 2,
+	"CHF": 2,
+	"CZK": 2,
+	"DKK": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"HUF": 2,
+	"ISK": 0,
+	"JOD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"MXN": 2,
+	"NOK": 2,
+	"NZD": 2,
+	"OMR": 3,
+	"PLN": 2,
+	"SEK": 2,
+	"TND": 3,
+	"USD": 2,
+}
+
+var quantityRegex = regexp.MustCompile(`^\d+(\.\d{1,3})?$`)
+
+// MaxQuantity is the largest quantity of a line
+const MaxQuantity = 10000
+
+// CurrencyDecimals returns the number of decimal places used by an ISO 4217
+// currency code, treating "" as the base currency
+func CurrencyDecimals(currency string) (int, bool) {
+	if currency == "" {
+		currency = BaseCurrency
+	}
+	decimals, ok := currencyDecimals[currency]
+	return decimals, ok
+}
+
+func amountRegex(decimals int, allowNegative bool) *regexp.Regexp {
+	pattern := `\d+`
+	if decimals > 0 {
+		pattern += fmt.Sprintf(`\.\d{%d}`, decimals)
+	}
+	if allowNegative {
+		pattern = `-?` + pattern
+	}
+	return regexp.MustCompile(`^` + pattern + `$`)
+}
+
+// IsValidAmount checks that amount has exactly the given number of decimal
+// places, such as "1.25" for two or "1250" for none
+func IsValidAmount(amount string, decimals int, allowNegative bool) bool {
+	return amountRegex(decimals, allowNegative).MatchString(amount)
+}
+
+// IsValidQuantity accepts positive quantities up to MaxQuantity with up to
+// three decimal places, such as "2" or "1.375"
+func IsValidQuantity(quantity string) bool {
+	_, err := ParseQuantity(quantity)
+	return err == nil
+}
+
+// ParseQuantity converts a valid quantity such as "1.375" to thousandths
+// (1375)
+func ParseQuantity(quantity string) (int64, error) {
+	if !quantityRegex.MatchString(quantity) {
+		return 0, fmt.Errorf("invalid quantity %q", quantity)
+	}
+	whole, fraction, _ := strings.Cut(quantity, ".")
+	units, err := strconv.ParseInt(whole+(fraction + "000")[:3], 10, 64)
+	if err != nil || units <= 0 || units > MaxQuantity*1000 {
+		return 0, fmt.Errorf("invalid quantity %q", quantity)
+	}
+	return units, nil
+}
+
+// LinePrice multiplies a unit price in minor units by a quantity in
+// thousandths, rounding to the nearest minor unit. It reports false if the
+// result overflows.
+func LinePrice(thousandths, unitPrice int64) (int64, bool) {
+	if unitPrice < 0 || thousandths < 0 || (thousandths > 0 && unitPrice > (math.MaxInt64-500)/thousandths) {
+		return 0, false
+	}
+	return (thousandths*unitPrice + 500) / 1000, true
+}
+
+// AddMinorUnits adds two amounts in minor units, reporting false if the sum
+// overflows
+func AddMinorUnits(a, b int64) (int64, bool) {
+	sum := a + b
+	if (b > 0 && sum < a) || (b < 0 && sum > a) {
+		return 0, false
+	}
+	return sum, true
+}
+
+// ParseMinorUnits converts an amount such as "-12.05" to minor units (-1205)
+func ParseMinorUnits(amount string, decimals int) (int64, error) {
+	if !IsValidAmount(amount, decimals, true) {
+		return 0, fmt.Errorf("invalid amount %q", amount)
+	}
+	negative := strings.HasPrefix(amount, "-")
+	units, err := strconv.ParseInt(strings.Replace(strings.TrimPrefix(amount, "-"), ".", "", 1), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if negative {
+		units = -units
+	}
+	return units, nil
+}
+
+// FormatMinorUnits is the inverse of ParseMinorUnits
+func FormatMinorUnits(units int64, decimals int) string {
+	sign := ""
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+	if decimals == 0 {
+		return sign + strconv.FormatInt(units, 10)
+	}
+
+	scale := int64(math.Pow10(decimals))
+	return fmt.Sprintf("%s%d.%0*d", sign, units/scale, decimals, units%scale)
+}
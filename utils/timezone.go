@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var utcOffsetRegex = regexp.MustCompile(`^([+-])(\d{2}):?(\d{2})$`)
+
+// ParseTimezone accepts an IANA zone name such as "America/New_York", "UTC",
+// "Z", or a fixed UTC offset such as "+05:30" or "-0800".
+func ParseTimezone(name string) (*time.Location, error) {
+	switch name {
+	case "UTC", "Z":
+		return time.UTC, nil
+	case "", "Local":
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+
+	if match := utcOffsetRegex.FindStringSubmatch(name); match != nil {
+		hours, _ := strconv.Atoi(match[2])
+		minutes, _ := strconv.Atoi(match[3])
+		if hours > 14 || minutes > 59 {
+			return nil, fmt.Errorf("invalid UTC offset %q", name)
+		}
+		offset := hours*3600 + minutes*60
+		if match[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(name, offset), nil
+	}
+
+	return time.LoadLocation(name)
+}
+
+func IsValidTimezone(name string) bool {
+	_, err := ParseTimezone(name)
+	return err == nil
+}